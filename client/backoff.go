@@ -0,0 +1,155 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/alfrunes/mqttie/mqtt"
+	log "github.com/sirupsen/logrus"
+)
+
+// Backoff computes the delays between reconnect attempts (see
+// Client.ReconnectWithBackoff).
+type Backoff interface {
+	// Next returns the delay before the next attempt after the given
+	// number of consecutive failed attempts (starting at 1).
+	Next(attempt int) time.Duration
+	// Reset is called once the client has reconnected successfully.
+	Reset()
+}
+
+// ConstantBackoff waits the same delay between all attempts.
+type ConstantBackoff struct {
+	Delay time.Duration
+}
+
+// Next implements Backoff.
+func (b ConstantBackoff) Next(attempt int) time.Duration {
+	return b.Delay
+}
+
+// Reset implements Backoff.
+func (b ConstantBackoff) Reset() {}
+
+// ExponentialBackoff doubles the delay for every failed attempt, starting at
+// Initial and bounded by Max. The failed attempts are counted from the last
+// Reset rather than taken from the attempt argument, such that the delay
+// keeps growing across ReconnectWithBackoff calls giving up until the client
+// reconnects successfully. An ExponentialBackoff must not be shared between
+// clients.
+type ExponentialBackoff struct {
+	// Initial is the delay after the first failed attempt.
+	Initial time.Duration
+	// Max bounds the delay (0: unbounded).
+	Max time.Duration
+	// Jitter randomizes the delay by up to the fraction (between 0 and
+	// 1) of the delay in either direction, such that clients that lost
+	// the connection at the same time do not reconnect in lockstep.
+	Jitter float64
+
+	// failures is the number of delays returned since the last Reset.
+	failures int
+}
+
+// Next implements Backoff.
+func (b *ExponentialBackoff) Next(attempt int) time.Duration {
+	b.failures++
+	delay := b.Initial
+	for i := 1; i < b.failures; i++ {
+		if b.Max > 0 && delay >= b.Max || delay<<1 < delay {
+			// Bounded or overflowing.
+			break
+		}
+		delay <<= 1
+	}
+	if b.Max > 0 && delay > b.Max {
+		delay = b.Max
+	}
+	if b.Jitter > 0 {
+		delay += time.Duration(
+			b.Jitter * (2*rand.Float64() - 1) * float64(delay),
+		)
+	}
+	return delay
+}
+
+// Reset implements Backoff.
+func (b *ExponentialBackoff) Reset() {
+	b.failures = 0
+}
+
+// DefaultReconnectBackoff returns the backoff used by ReconnectWithBackoff
+// unless set by ClientOptions.SetReconnectBackoff.
+func DefaultReconnectBackoff() Backoff {
+	return &ExponentialBackoff{
+		Initial: time.Second,
+		Max:     time.Minute,
+		Jitter:  0.2,
+	}
+}
+
+// permanentConnectErrors are the errors ReconnectWithBackoff does not retry:
+// the server keeps refusing the client until its configuration changes.
+var permanentConnectErrors = []error{
+	mqtt.ErrConnectBadVersion,
+	mqtt.ErrConnectIDNotAllowed,
+	mqtt.ErrConnectCredentials,
+	mqtt.ErrConnectUnauthorized,
+	mqtt.ErrConnectBanned,
+	mqtt.ErrConnectBadAuthMethod,
+	ErrNoFallbackDial,
+}
+
+// isPermanentConnectError returns whether retrying the connect is futile.
+func isPermanentConnectError(err error) bool {
+	for _, permanent := range permanentConnectErrors {
+		if errors.Is(err, permanent) {
+			return true
+		}
+	}
+	return false
+}
+
+// ReconnectWithBackoff re-establishes the session using Reconnect with
+// connections established by dial, retrying with delays given by the
+// reconnect backoff until the reconnect succeeds. The backoff is reset on
+// success. The retries stop with the context's error once ctx, or the
+// context of a client created by NewClientContext, is done. Connect errors
+// the server keeps returning until the client's configuration changes, such
+// as mqtt.ErrConnectCredentials and mqtt.ErrConnectUnauthorized, are returned
+// without retrying. ReconnectWithBackoff must not be called concurrently
+// with other client methods.
+func (c *Client) ReconnectWithBackoff(
+	ctx context.Context,
+	dial func() (net.Conn, error),
+	options ...*ConnectOptions,
+) error {
+	for attempt := 1; ; attempt++ {
+		conn, err := dial()
+		if err == nil {
+			err = c.Reconnect(conn, options...)
+			if err == nil {
+				c.reconnectBackoff.Reset()
+				return nil
+			} else if isPermanentConnectError(err) {
+				return err
+			}
+		}
+		delay := c.reconnectBackoff.Next(attempt)
+		log.Warnf("Reconnect attempt %d failed: %s; retrying in %s",
+			attempt, err, delay)
+		timer := c.clock.NewTimer(delay)
+		select {
+		case <-timer.C():
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-c.ctx.Done():
+			timer.Stop()
+			return c.ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/alfrunes/mqttie/mqtt"
+	"github.com/alfrunes/mqttie/packets"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExponentialBackoff(t *testing.T) {
+	backoff := &ExponentialBackoff{
+		Initial: time.Second,
+		Max:     10 * time.Second,
+	}
+	var delays []time.Duration
+	for attempt := 1; attempt <= 6; attempt++ {
+		delays = append(delays, backoff.Next(attempt))
+	}
+	assert.Equal(t, []time.Duration{
+		time.Second, 2 * time.Second, 4 * time.Second,
+		8 * time.Second, 10 * time.Second, 10 * time.Second,
+	}, delays)
+
+	// The delay restarts at Initial after a reset.
+	backoff.Reset()
+	assert.Equal(t, time.Second, backoff.Next(1))
+	assert.Equal(t, 2*time.Second, backoff.Next(2))
+
+	// Unbounded, the delay saturates instead of overflowing.
+	backoff.Max = 0
+	for i := 0; i < 100; i++ {
+		backoff.Next(i)
+	}
+	assert.True(t, backoff.Next(100) > 0)
+
+	backoff.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		backoff.Reset()
+		backoff.Next(1)
+		backoff.Next(2)
+		delay := backoff.Next(3)
+		assert.True(t, delay >= 2*time.Second && delay <= 6*time.Second,
+			delay)
+	}
+
+	assert.Equal(t, time.Second, ConstantBackoff{time.Second}.Next(10))
+}
+
+// recordingBackoff records the attempts and resets.
+type recordingBackoff struct {
+	attempts []int
+	resets   int
+}
+
+func (b *recordingBackoff) Next(attempt int) time.Duration {
+	b.attempts = append(b.attempts, attempt)
+	return time.Millisecond
+}
+
+func (b *recordingBackoff) Reset() {
+	b.resets++
+}
+
+func TestReconnectWithBackoff(t *testing.T) {
+	handler := func(b *PipeBroker, p packets.Packet) {
+		if _, ok := p.(*packets.Connect); ok {
+			b.Send(&packets.ConnAck{Version: mqtt.MQTTv311})
+		}
+	}
+	broker, conn := NewPipeBroker(mqtt.MQTTv311, handler)
+	backoff := &recordingBackoff{}
+	opts := NewClientOptions()
+	opts.SetReconnectBackoff(backoff)
+	client := NewClient(conn, opts)
+	broker.Close()
+	<-client.Done()
+
+	// dial fails the given number of times before connecting.
+	dial := func(failures int) func() (net.Conn, error) {
+		return func() (net.Conn, error) {
+			if failures > 0 {
+				failures--
+				return nil, fmt.Errorf("connection refused")
+			}
+			broker, conn = NewPipeBroker(mqtt.MQTTv311, handler)
+			return conn, nil
+		}
+	}
+	err := client.ReconnectWithBackoff(context.Background(), dial(2))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, []int{1, 2}, backoff.attempts)
+	assert.Equal(t, 1, backoff.resets)
+	broker.Close()
+	<-client.Done()
+
+	// The attempts restart after a successful reconnect.
+	backoff.attempts = nil
+	err = client.ReconnectWithBackoff(context.Background(), dial(1))
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1}, backoff.attempts)
+	assert.Equal(t, 2, backoff.resets)
+	broker.Close()
+	<-client.Done()
+
+	// The retries stop once the context is done.
+	backoff.attempts = nil
+	ctx, cancel := context.WithCancel(context.Background())
+	err = client.ReconnectWithBackoff(ctx, func() (net.Conn, error) {
+		if len(backoff.attempts) == 2 {
+			cancel()
+		}
+		return nil, fmt.Errorf("connection refused")
+	})
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, []int{1, 2, 3}, backoff.attempts)
+	assert.Equal(t, 2, backoff.resets)
+
+	// Refused credentials are not retried.
+	backoff.attempts = nil
+	err = client.ReconnectWithBackoff(context.Background(),
+		func() (net.Conn, error) {
+			broker, conn = NewPipeBroker(mqtt.MQTTv311, func(
+				b *PipeBroker, p packets.Packet,
+			) {
+				if _, ok := p.(*packets.Connect); ok {
+					b.Send(&packets.ConnAck{
+						Version:    mqtt.MQTTv311,
+						ReturnCode: packets.ConnAckBadCredentials,
+					})
+				}
+			})
+			return conn, nil
+		})
+	assert.Equal(t, mqtt.ErrConnectCredentials, err)
+	assert.Empty(t, backoff.attempts)
+	broker.Close()
+}
+
+func TestReconnectWithExponentialBackoff(t *testing.T) {
+	handler := func(b *PipeBroker, p packets.Packet) {
+		if _, ok := p.(*packets.Connect); ok {
+			b.Send(&packets.ConnAck{Version: mqtt.MQTTv311})
+		}
+	}
+	broker, conn := NewPipeBroker(mqtt.MQTTv311, handler)
+	backoff := &ExponentialBackoff{Initial: time.Millisecond}
+	opts := NewClientOptions()
+	opts.SetReconnectBackoff(backoff)
+	client := NewClient(conn, opts)
+	broker.Close()
+	<-client.Done()
+
+	// The delay keeps growing across calls giving up...
+	ctx, cancel := context.WithCancel(context.Background())
+	var dials int
+	err := client.ReconnectWithBackoff(ctx, func() (net.Conn, error) {
+		if dials++; dials == 2 {
+			cancel()
+		}
+		return nil, fmt.Errorf("connection refused")
+	})
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, 2, backoff.failures)
+	dials = 0
+	err = client.ReconnectWithBackoff(context.Background(),
+		func() (net.Conn, error) {
+			if dials++; dials == 1 {
+				return nil, fmt.Errorf("connection refused")
+			}
+			broker, conn = NewPipeBroker(mqtt.MQTTv311, handler)
+			return conn, nil
+		})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer broker.Close()
+	// ...and restarts at the initial delay after a successful connect.
+	assert.Equal(t, time.Millisecond, backoff.Next(1))
+}
@@ -1,15 +1,20 @@
 package client
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/binary"
 	"fmt"
 	"net"
+	"sort"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/alfrunes/mqttie/mqtt"
 	"github.com/alfrunes/mqttie/packets"
 	"github.com/satori/go.uuid"
+	log "github.com/sirupsen/logrus"
 )
 
 var (
@@ -20,28 +25,251 @@ var (
 	// internal receive routine sends an unexpected packet to the main
 	// routine.
 	ErrInternalConflict = fmt.Errorf("received unexpected packet")
+	// ErrRequiresMQTTv5 is returned by operations only supported by
+	// protocol version 5.0.
+	ErrRequiresMQTTv5 = fmt.Errorf("operation requires MQTT 5.0")
+	// ErrNoPacketIDs is returned if all packet identifiers are in use by
+	// in-flight packets.
+	ErrNoPacketIDs = fmt.Errorf("no packet identifiers available")
+	// ErrPacketIDInUse is returned if the packet identifier allocator
+	// returns zero or an identifier in use by an in-flight packet.
+	ErrPacketIDInUse = fmt.Errorf("allocated packet identifier in use")
+	// ErrSubscribeCancelled is the result of a subscribe request
+	// abandoned by CancelSubscribe.
+	ErrSubscribeCancelled = fmt.Errorf("subscribe request cancelled")
+	// ErrSubscriptionRefused is returned by Open if the server does not
+	// grant the subscription.
+	ErrSubscriptionRefused = fmt.Errorf("subscription refused by server")
+	// ErrPingTimeout is the error reported when the server does not
+	// respond to a keep-alive ping in time; the connection is considered
+	// dead and closed.
+	ErrPingTimeout = fmt.Errorf("no ping response from server")
+	// ErrNotSubscribed is returned by Resubscribe if the client is not
+	// subscribed to the topic filter.
+	ErrNotSubscribed = fmt.Errorf("not subscribed to topic filter")
+	// ErrServerClosed is the error reported when the server closes the
+	// connection without sending a Disconnect packet.
+	ErrServerClosed = fmt.Errorf("connection closed by server")
+	// ErrKeepAliveRange is returned by ConnectOptions.SetKeepAliveStrict
+	// if the keep alive is negative or exceeds 18:12:15 (hr:min:sec).
+	ErrKeepAliveRange = fmt.Errorf("keep alive out of range")
+	// ErrWildcardSubUnavailable is returned by Subscribe if a topic
+	// filter contains wildcards but the server does not support wildcard
+	// subscriptions (MQTTv5).
+	ErrWildcardSubUnavailable = fmt.Errorf(
+		"wildcard subscriptions not supported by server",
+	)
+	// ErrSharedSubUnavailable is returned by Subscribe if a topic filter
+	// is a shared subscription but the server does not support shared
+	// subscriptions (MQTTv5).
+	ErrSharedSubUnavailable = fmt.Errorf(
+		"shared subscriptions not supported by server",
+	)
+	// ErrNilHandler is returned by SubscribeMap if the handler is nil.
+	ErrNilHandler = fmt.Errorf("message handler is nil")
+	// ErrNoFallbackDial is returned by Connect if the server refuses the
+	// protocol version and version fallbacks are configured without a
+	// function dialing the connections to retry on (see
+	// ClientOptions.VersionFallbackDial).
+	ErrNoFallbackDial = fmt.Errorf(
+		"protocol version refused: version fallback requires a dial " +
+			"function",
+	)
+	// ErrSessionLost is returned by the publishes awaiting an
+	// acknowledgement when the client reconnects and the server has
+	// discarded the session; the publish may or may not have been
+	// delivered.
+	ErrSessionLost = fmt.Errorf("session lost")
 )
 
+// DisconnectError is the error reported when the server terminates the
+// connection by sending a Disconnect packet (MQTTv5).
+type DisconnectError struct {
+	// ReasonCode is the disconnect reason code sent by the server.
+	ReasonCode uint8
+	// ReasonString is the (optional) human readable reason.
+	ReasonString string
+}
+
+func (err *DisconnectError) Error() string {
+	if err.ReasonString != "" {
+		return fmt.Sprintf(
+			"disconnected by server: %s (reason code 0x%02X)",
+			err.ReasonString, err.ReasonCode,
+		)
+	}
+	return fmt.Sprintf(
+		"disconnected by server (reason code 0x%02X)", err.ReasonCode,
+	)
+}
+
+// PublishError is the error returned when the server rejects a publish by
+// acknowledging it with an error reason code (MQTTv5). It wraps
+// mqtt.ErrPublishRejected.
+type PublishError struct {
+	// ReasonCode is the PUBACK or PUBREC reason code sent by the server.
+	ReasonCode uint8
+	// ReasonString is the (optional) human readable reason.
+	ReasonString string
+}
+
+func (err *PublishError) Error() string {
+	if err.ReasonString != "" {
+		return fmt.Sprintf(
+			"%s: %s (reason code 0x%02X)", mqtt.ErrPublishRejected,
+			err.ReasonString, err.ReasonCode,
+		)
+	}
+	return fmt.Sprintf(
+		"%s (reason code 0x%02X)", mqtt.ErrPublishRejected,
+		err.ReasonCode,
+	)
+}
+
+// Unwrap returns mqtt.ErrPublishRejected.
+func (err *PublishError) Unwrap() error {
+	return mqtt.ErrPublishRejected
+}
+
+// TopicFilterError is returned by Subscribe if topic filters are invalid
+// (see mqtt.ValidateTopicFilter). It wraps mqtt.ErrInvalidTopicFilter.
+type TopicFilterError struct {
+	// Filters are the invalid topic filters.
+	Filters []string
+}
+
+func (err *TopicFilterError) Error() string {
+	return fmt.Sprintf("%s: %q", mqtt.ErrInvalidTopicFilter,
+		strings.Join(err.Filters, `", "`))
+}
+
+// Unwrap returns mqtt.ErrInvalidTopicFilter.
+func (err *TopicFilterError) Unwrap() error {
+	return mqtt.ErrInvalidTopicFilter
+}
+
 // Client is the package representation of an MQTT client. The struct holds all
 // internal client state and session data to provide a functional high-level
 // API to the MQTT protocol.
+//
+// Packets are written in the order the calls are made from a single
+// goroutine: Publish, Subscribe, SubscribeAsync, Unsubscribe, Ping and
+// Disconnect queue their packet for writing before returning, so a publish
+// issued after a subscribe call returns is never written ahead of the
+// SUBSCRIBE packet. The order of packets sent concurrently from different
+// goroutines is unspecified.
 type Client struct {
 	// ClientID is the identity communicated with the server on connect.
 	ClientID string
 	version  mqtt.Version
 
-	pendingPackets  *packetMap
+	pendingPackets *packetMap
+	// inboundQoS2 holds the PUBRECs of the inbound QoS2 flows awaiting
+	// release, apart from the outbound state since both sides allocate
+	// packet identifiers independently.
+	inboundQoS2     *packetMap
 	packetIDCounter uint32
+	// packetIDAllocator replaces packetIDCounter if set.
+	packetIDAllocator func() (uint16, error)
+	// maxPacketSize is the maximum size of inbound packets
+	// (0: unlimited).
+	maxPacketSize uint32
+	// maxTopicLength and maxTopicLevels limit the inbound topics
+	// (0: unlimited).
+	maxTopicLength int
+	maxTopicLevels int
+	// ackTimeout is the duration to wait for acknowledgements of
+	// control requests (0: wait indefinitely).
+	ackTimeout time.Duration
+	// controlSlots bounds the number of in-flight subscribe and
+	// unsubscribe requests (nil: unbounded).
+	controlSlots chan struct{}
+	// versionFallback are the protocol versions to retry the connect
+	// handshake with if the server refuses the version.
+	versionFallback []mqtt.Version
+	// fallbackDial opens the connections for the fallback handshakes
+	// (nil: retry on the same connection).
+	fallbackDial func() (net.Conn, error)
+	// maxTopicsPerSubscribe is the maximum number of topic filters per
+	// subscribe packet (0: unlimited).
+	maxTopicsPerSubscribe int
+	// skipInvalidFilters makes Subscribe skip invalid topic filters
+	// instead of failing.
+	skipInvalidFilters bool
 
 	expiresAt time.Time
+	// session holds the parameters negotiated on connect.
+	session mqtt.SessionInfo
+	// clock is the time source for keep-alive and timeouts.
+	clock Clock
+	// payloadEncoder and payloadDecoder transform the payloads of sent
+	// and received messages (nil: unchanged).
+	payloadEncoder func([]mqtt.UserProperty, []byte) ([]byte, error)
+	payloadDecoder func([]mqtt.UserProperty, []byte) ([]byte, error)
+	// reconnectBackoff computes the delays of ReconnectWithBackoff.
+	reconnectBackoff Backoff
+	// ctx bounds the lifetime of the connections (see NewClientContext).
+	ctx context.Context
+	// pingTimedOut is set (atomically) when keepAlive closes the
+	// connection because the server did not respond to a ping.
+	pingTimedOut uint32
 
 	io *packets.PacketIO
+	// timeout is the send and receive timeout of the connection.
+	timeout time.Duration
+	// readBufferSize and writeBufferSize are the sizes of the
+	// connection read and write buffers (0: unbuffered).
+	readBufferSize  int
+	writeBufferSize int
 
 	// errChan is an internal error channel detecting asynchronous fatal
 	// errors.
 	errChan chan error
+	// done is closed when the receive routine terminates, err holds the
+	// cause (if any).
+	done chan struct{}
+	err  error
 	// subs that maps topic names to chan []byte for subscriptions
-	subs subMap
+	subs *subscriptionMap
+	// subRequests holds the in-flight subscribe requests.
+	subRequests *subscribeRequestMap
+	// registered holds the subscriptions restored on every connect.
+	registered *registrationMap
+	// quota bounds the in-flight publishes to the server's Receive
+	// Maximum.
+	quota *sendQuota
+	// flowControlBlocked is called when a publish blocks on quota.
+	flowControlBlocked func()
+	// stats holds message counters reported by Stats.
+	stats *clientStats
+	// responses maps response topics of outstanding requests to the
+	// channel awaiting the response.
+	responses *responseMap
+	// topicAliases maps inbound topic aliases to topic names (MQTTv5).
+	// The map is only accessed by the receive routine.
+	topicAliases map[uint16]string
+	// qos2Validator decides whether incoming QoS2 messages are accepted
+	// (MQTTv5; nil: all accepted).
+	qos2Validator func(mqtt.Message) uint8
+	// retained holds the last retained message per topic if the retained
+	// cache is enabled (nil otherwise).
+	retained *retainedMap
+	// deadLetters receives the messages that could not be delivered
+	// (nil: discarded).
+	deadLetters chan<- mqtt.Message
+	// copyPayloads makes the client deliver copies of the received
+	// payloads to subscribers.
+	copyPayloads bool
+	// closeOnUnsubscribe makes the client close subscriber channels on
+	// unsubscribe.
+	closeOnUnsubscribe bool
+	// workers holds the per-subscription delivery workers if ordered
+	// delivery is enabled (nil otherwise). The map is only accessed by
+	// the receive routine.
+	workers map[*subscription]*deliveryWorker
+	// paused withholds the messages from the subscribers while the
+	// client is paused.
+	paused *pauseGate
 
 	// pingResp is used to pass PingResp responses to the
 	// caller goroutine.
@@ -59,19 +287,51 @@ type Client struct {
 // complete ownership of the connection and any reads or writes to the
 // connection will lead to the client throwing an error.
 func NewClient(connection net.Conn, options ...*ClientOptions) (client *Client) {
+	return newClient(context.Background(), connection, options...)
+}
+
+// NewClientContext initializes a new client like NewClient, bound to the
+// lifetime of ctx: cancelling the context closes the connection, such that
+// the receive routine stops and the channel returned by Done is closed; Err
+// then returns the context's error. The binding applies to the connections
+// passed to Reconnect as well.
+func NewClientContext(
+	ctx context.Context,
+	connection net.Conn,
+	options ...*ClientOptions,
+) *Client {
+	return newClient(ctx, connection, options...)
+}
+
+func newClient(
+	ctx context.Context,
+	connection net.Conn,
+	options ...*ClientOptions,
+) (client *Client) {
 	var r [2]byte
-	var timeout time.Duration
+	var store Store = NewMemoryStore()
 	id := uuid.NewV4()
 	client = &Client{
 		ClientID: id.String(),
 		version:  mqtt.MQTTv311,
+		clock:    realClock{},
+		ctx:      ctx,
+
+		reconnectBackoff: DefaultReconnectBackoff(),
 
-		pendingPackets: newPacketMap(),
-		ackChan:        newPacketChanMap(),
-		errChan:        make(chan error, 1),
-		pingResp:       make(chan *packets.PingResp, 1),
-		connAck:        make(chan *packets.ConnAck, 1),
-		subs:           make(subMap),
+		ackChan:      newPacketChanMap(),
+		subRequests:  newSubscribeRequestMap(),
+		registered:   newRegistrationMap(),
+		stats:        new(clientStats),
+		quota:        newSendQuota(),
+		errChan:      make(chan error, 1),
+		done:         make(chan struct{}),
+		pingResp:     make(chan *packets.PingResp, 1),
+		connAck:      make(chan *packets.ConnAck, 1),
+		subs:         newSubscriptionMap(),
+		responses:    newResponseMap(),
+		paused:       newPauseGate(pauseQueueSize),
+		topicAliases: make(map[uint16]string),
 	}
 	for _, opt := range options {
 		if opt == nil {
@@ -84,23 +344,217 @@ func NewClient(connection net.Conn, options ...*ClientOptions) (client *Client)
 			client.ClientID = *opt.ClientID
 		}
 		if opt.Timeout != nil {
-			timeout = *opt.Timeout
+			client.timeout = *opt.Timeout
+		}
+		if opt.MaxInboundPacketSize != nil {
+			client.maxPacketSize = *opt.MaxInboundPacketSize
+		}
+		if opt.MaxInboundTopicLength != nil {
+			client.maxTopicLength = *opt.MaxInboundTopicLength
+		}
+		if opt.MaxInboundTopicLevels != nil {
+			client.maxTopicLevels = *opt.MaxInboundTopicLevels
+		}
+		if opt.AckTimeout != nil {
+			client.ackTimeout = *opt.AckTimeout
+		}
+		if opt.MaxInflightControl != nil {
+			if *opt.MaxInflightControl > 0 {
+				client.controlSlots = make(
+					chan struct{}, *opt.MaxInflightControl,
+				)
+			} else {
+				client.controlSlots = nil
+			}
+		}
+		if opt.VersionFallback != nil {
+			client.versionFallback = opt.VersionFallback
+		}
+		if opt.VersionFallbackDial != nil {
+			client.fallbackDial = opt.VersionFallbackDial
+		}
+		if opt.MaxTopicsPerSubscribe != nil {
+			client.maxTopicsPerSubscribe = *opt.MaxTopicsPerSubscribe
+		}
+		if opt.SkipInvalidFilters != nil {
+			client.skipInvalidFilters = *opt.SkipInvalidFilters
+		}
+		if opt.IncomingQoS2Validator != nil {
+			client.qos2Validator = opt.IncomingQoS2Validator
+		}
+		if opt.RetainedCache != nil {
+			if *opt.RetainedCache {
+				client.retained = newRetainedMap()
+			} else {
+				client.retained = nil
+			}
+		}
+		if opt.DeadLetterChannel != nil {
+			client.deadLetters = opt.DeadLetterChannel
+		}
+		if opt.PacketIDAllocator != nil {
+			client.packetIDAllocator = opt.PacketIDAllocator
+		}
+		if opt.CopyPayloads != nil {
+			client.copyPayloads = *opt.CopyPayloads
+		}
+		if opt.ReadBufferSize != nil {
+			client.readBufferSize = *opt.ReadBufferSize
+		}
+		if opt.WriteBufferSize != nil {
+			client.writeBufferSize = *opt.WriteBufferSize
+		}
+		if opt.Clock != nil {
+			client.clock = opt.Clock
+		}
+		if opt.CloseOnUnsubscribe != nil {
+			client.closeOnUnsubscribe = *opt.CloseOnUnsubscribe
+		}
+		if opt.Store != nil {
+			store = opt.Store
+		}
+		if opt.PayloadEncoder != nil {
+			client.payloadEncoder = opt.PayloadEncoder
+		}
+		if opt.PayloadDecoder != nil {
+			client.payloadDecoder = opt.PayloadDecoder
+		}
+		if opt.ReconnectBackoff != nil {
+			client.reconnectBackoff = opt.ReconnectBackoff
+		}
+		if opt.FlowControlBlockedHandler != nil {
+			client.flowControlBlocked = opt.FlowControlBlockedHandler
+		}
+		if opt.OrderedDelivery != nil {
+			if *opt.OrderedDelivery {
+				client.workers = make(
+					map[*subscription]*deliveryWorker,
+				)
+			} else {
+				client.workers = nil
+			}
 		}
 	}
-	client.io = packets.NewPacketIO(connection, client.version, timeout)
+	client.pendingPackets = newPacketMap(store)
+	client.inboundQoS2 = newPacketMap(NewMemoryStore())
+	// Until connected, the server is assumed to support all features.
+	client.session = newSessionInfo(&packets.ConnAck{}, 0)
+	client.io = packets.NewPacketIO(
+		connection, client.version, client.timeout,
+	)
+	client.io.SetMaxPacketSize(client.maxPacketSize)
+	client.io.SetMaxTopicLength(client.maxTopicLength)
+	client.io.SetMaxTopicLevels(client.maxTopicLevels)
+	client.io.SetReadBufferSize(client.readBufferSize)
+	client.io.SetWriteBufferSize(client.writeBufferSize)
 	if _, err := rand.Read(r[:]); err == nil {
 		initID := binary.LittleEndian.Uint16(r[:])
 		client.packetIDCounter = uint32(initID)
 	}
 	go client.recvRoutine()
+	if ctx.Done() != nil {
+		go client.watchContext(client.io, client.done)
+	}
 	return client
 }
 
-// Connect establishes connection to the mqtt broker.
+// Done returns a channel that is closed when the client stops receiving
+// packets from the connection, i.e. the connection is closed or lost.
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns the error that caused the channel returned by Done to close,
+// or nil if Done is not yet closed. If the server disconnected the client,
+// the error is of type *DisconnectError; if the server closed the connection
+// without a Disconnect packet, Err returns ErrServerClosed; if the server
+// does not respond to a keep-alive ping, Err returns ErrPingTimeout; if the
+// context of a client created by NewClientContext is cancelled, Err returns
+// the context's error. Otherwise, the error is the cause of the connection
+// failure, or mqtt.ErrConnectionClosed if the client closed the connection.
+func (c *Client) Err() error {
+	select {
+	case <-c.done:
+		return c.err
+	default:
+		return nil
+	}
+}
+
+// SessionInfo returns the session parameters negotiated by the last
+// successful Connect or Reconnect. It must not be called concurrently with
+// either.
+func (c *Client) SessionInfo() mqtt.SessionInfo {
+	return c.session
+}
+
+// Connect establishes connection to the mqtt broker. If the server resumes
+// an existing session, packets loaded with LoadPendingPackets are
+// retransmitted, otherwise they are discarded. On success, the
+// subscriptions added with Register are subscribed to.
 func (c *Client) Connect(options ...*ConnectOptions) error {
+	err := c.connect(options...)
+	if err != nil {
+		return err
+	}
+	err = c.retransmit()
+	if err != nil {
+		return err
+	}
+	return c.subscribeRegistered()
+}
+
+// PendingPackets returns a copy of the packets awaiting acknowledgement
+// indexed by packet identifier. Together with LoadPendingPackets it allows
+// persisting the session state across process restarts.
+func (c *Client) PendingPackets() map[uint16]packets.Packet {
+	return c.pendingPackets.All()
+}
+
+// LoadPendingPackets restores packets previously returned by PendingPackets.
+// It must be called before Connect; the packets are retransmitted if the
+// server reports that the session is present and discarded otherwise.
+func (c *Client) LoadPendingPackets(pending map[uint16]packets.Packet) {
+	for id, packet := range pending {
+		c.pendingPackets.Set(id, packet)
+	}
+}
+
+// connect performs the connect handshake, retrying with the fallback
+// versions while the server refuses the protocol version. Each retry uses a
+// new connection from the fallback dial function.
+func (c *Client) connect(options ...*ConnectOptions) error {
+	err := c.handshake(options...)
+	if err == mqtt.ErrConnectBadVersion &&
+		len(c.versionFallback) > 0 && c.fallbackDial == nil {
+		// The server closes the connection after refusing the
+		// version; there is no connection to retry on.
+		return ErrNoFallbackDial
+	}
+	for _, version := range c.versionFallback {
+		if err != mqtt.ErrConnectBadVersion {
+			break
+		}
+		log.Warnf("Server refused protocol version %d, "+
+			"retrying with version %d", c.version, version)
+		c.version = version
+		var conn net.Conn
+		conn, err = c.fallbackDial()
+		if err != nil {
+			return err
+		}
+		c.setConnection(conn)
+		err = c.handshake(options...)
+	}
+	return err
+}
+
+// handshake sends the connect packet and awaits the acknowledgement.
+func (c *Client) handshake(options ...*ConnectOptions) error {
 	conn := &packets.Connect{
-		Version:  c.version,
-		ClientID: c.ClientID,
+		Version:       c.version,
+		ClientID:      c.ClientID,
+		MaxPacketSize: c.maxPacketSize,
 	}
 	for _, opt := range options {
 		if opt == nil {
@@ -118,43 +572,231 @@ func (c *Client) Connect(options ...*ConnectOptions) error {
 		if opt.Password != nil {
 			conn.Password = *opt.Password
 		}
+		if opt.TopicAliasMax != nil {
+			conn.TopicAliasMax = *opt.TopicAliasMax
+		}
+		if opt.SessionExpiryInterval != nil {
+			conn.SessionExpiryInterval = *opt.SessionExpiryInterval
+		}
+		if opt.RequestResponseInfo != nil {
+			conn.RequestResponseInfo = *opt.RequestResponseInfo
+		}
+		if opt.WillTopic != nil {
+			conn.WillTopic = *opt.WillTopic
+		}
+		if opt.WillMessage != nil {
+			conn.WillMessage = opt.WillMessage
+		}
+		if opt.WillRetain != nil {
+			conn.WillRetain = *opt.WillRetain
+		}
+	}
+	if conn.WillTopic.QoS > mqtt.QoS2 {
+		return mqtt.ErrIllegalQoS
 	}
 
 	if conn.KeepAlive > 0 {
-		c.expiresAt = time.Now().
+		c.expiresAt = c.clock.Now().
 			Add(time.Second * time.Duration(conn.KeepAlive))
 	}
 	err := c.io.Send(conn)
 	if err != nil {
 		return err
 	}
+	var connAck *packets.ConnAck
 	select {
-	case connAck := <-c.connAck:
-		switch connAck.ReturnCode {
-		case packets.ConnAckAccepted:
-			return nil
-		case packets.ConnAckBadVersion:
-			return mqtt.ErrConnectBadVersion
-		case packets.ConnAckIDNotAllowed:
-			return mqtt.ErrConnectIDNotAllowed
-		case packets.ConnAckServerUnavail:
-			return mqtt.ErrConnectUnavailable
-		case packets.ConnAckBadCredentials:
-			return mqtt.ErrConnectCredentials
-		case packets.ConnAckUnauthorized:
-			return mqtt.ErrConnectUnauthorized
-		default:
-			return ErrIllegalResponse
-		}
+	case connAck = <-c.connAck:
 	case err := <-c.errChan:
 		return err
 	}
+	err = connAckError(c.version, connAck.ReturnCode)
+	if err != nil {
+		return err
+	}
+	if !connAck.SessionPresent {
+		// The server has no session state; the unacknowledged
+		// packets of the previous session will never be completed.
+		for packetID := range c.pendingPackets.All() {
+			c.publishAcked(packetID, sessionLost{}, 0)
+		}
+		c.pendingPackets.Clear()
+		c.inboundQoS2.Clear()
+	}
+	if c.version >= mqtt.MQTTv5 && connAck.AssignedClientID != "" {
+		c.ClientID = connAck.AssignedClientID
+	}
+	// Packets exceeding the server's maximum packet size are rejected
+	// locally (MQTTv5).
+	c.io.SetMaxSendPacketSize(connAck.MaxPacketSize)
+	// Unacknowledged publishes are retransmitted and count against the
+	// Receive Maximum of the new connection (MQTTv5).
+	c.quota.Reset(int(connAck.ReceiveMax), c.outboundInflight())
+	keepAlive := conn.KeepAlive
+	if connAck.ServerKeepAlive != nil {
+		keepAlive = *connAck.ServerKeepAlive
+	}
+	c.session = newSessionInfo(connAck, keepAlive)
+	if keepAlive > 0 {
+		go c.keepAlive(
+			c.io, time.Duration(keepAlive)*time.Second/2, c.done,
+		)
+	}
+	return nil
+}
+
+// newSessionInfo returns the session parameters in effect given the
+// server's acknowledgement and the negotiated keep alive. Absent MQTTv5
+// properties take their default values.
+func newSessionInfo(connAck *packets.ConnAck, keepAlive uint16) mqtt.SessionInfo {
+	info := mqtt.SessionInfo{
+		SessionPresent:       connAck.SessionPresent,
+		KeepAlive:            keepAlive,
+		ReceiveMax:           connAck.ReceiveMax,
+		MaxPacketSize:        connAck.MaxPacketSize,
+		TopicAliasMax:        connAck.TopicAliasMax,
+		MaxQoS:               mqtt.QoS2,
+		RetainAvailable:      !connAck.RetainUnavailable,
+		WildcardSubAvailable: !connAck.WildcardSubUnavailable,
+		SubIDAvailable:       !connAck.SubIDUnavailable,
+		SharedSubAvailable:   !connAck.SharedSubUnavailable,
+		ResponseInfo:         connAck.ResponseInfo,
+	}
+	if info.ReceiveMax == 0 {
+		info.ReceiveMax = ^uint16(0)
+	}
+	if connAck.MaxQoS != nil {
+		info.MaxQoS = *connAck.MaxQoS
+	}
+	return info
+}
+
+func connAckError(version mqtt.Version, code uint8) error {
+	if version >= mqtt.MQTTv5 && code == packets.ConnAckBadVersion {
+		// Response from a server not supporting MQTTv5.
+		return mqtt.ErrConnectBadVersion
+	} else if version >= mqtt.MQTTv5 {
+		return mqtt.ConnAckReason(code).Err()
+	}
+	switch code {
+	case packets.ConnAckAccepted:
+		return nil
+	case packets.ConnAckBadVersion:
+		return mqtt.ErrConnectBadVersion
+	case packets.ConnAckIDNotAllowed:
+		return mqtt.ErrConnectIDNotAllowed
+	case packets.ConnAckServerUnavail:
+		return mqtt.ErrConnectUnavailable
+	case packets.ConnAckBadCredentials:
+		return mqtt.ErrConnectCredentials
+	case packets.ConnAckUnauthorized:
+		return mqtt.ErrConnectUnauthorized
+	default:
+		return ErrIllegalResponse
+	}
+}
+
+// Reconnect re-establishes the session with the server over a new connection,
+// e.g. after the previous connection was lost. The previous connection is
+// closed if it is still open. On success, unacknowledged publishes are
+// retransmitted with the duplicate flag set if the server resumed the session
+// and discarded otherwise, and subscriptions are restored
+// except those marked Transient, which are removed as if unsubscribed.
+// Reconnect must not be called concurrently with other client methods.
+func (c *Client) Reconnect(
+	connection net.Conn,
+	options ...*ConnectOptions,
+) error {
+	c.setConnection(connection)
+	err := c.connect(options...)
+	if err != nil {
+		return err
+	}
+	err = c.retransmit()
+	if err != nil {
+		return err
+	}
+	err = c.resubscribe()
+	if err != nil {
+		return err
+	}
+	return c.subscribeRegistered()
+}
+
+// setConnection terminates the receive routine of the current connection
+// and starts receiving on the new connection.
+func (c *Client) setConnection(connection net.Conn) {
+	c.io.Close()
+	for terminated := false; !terminated; {
+		select {
+		case <-c.done:
+			terminated = true
+		case <-c.errChan:
+		}
+	}
+	select {
+	case <-c.errChan:
+	default:
+	}
+	// Discard a ping response of the previous connection, which would
+	// otherwise answer the first ping on the new one.
+	select {
+	case <-c.pingResp:
+	default:
+	}
+
+	c.stats.previous = c.stats.previous.Add(c.io.Stats())
+	c.io = packets.NewPacketIO(connection, c.version, c.timeout)
+	c.io.SetMaxPacketSize(c.maxPacketSize)
+	c.io.SetMaxTopicLength(c.maxTopicLength)
+	c.io.SetMaxTopicLevels(c.maxTopicLevels)
+	c.io.SetReadBufferSize(c.readBufferSize)
+	c.io.SetWriteBufferSize(c.writeBufferSize)
+	c.done = make(chan struct{})
+	c.err = nil
+	atomic.StoreUint32(&c.pingTimedOut, 0)
+	// Topic aliases and delivery workers are scoped to the connection.
+	c.topicAliases = make(map[uint16]string)
+	if c.workers != nil {
+		c.workers = make(map[*subscription]*deliveryWorker)
+	}
+	go c.recvRoutine()
+	if c.ctx.Done() != nil {
+		go c.watchContext(c.io, c.done)
+	}
 }
 
 // Disconnect sends a disconnect packet to the server and closes the connection.
-func (c *Client) Disconnect() (err error) {
+func (c *Client) Disconnect(options ...*DisconnectOptions) error {
+	return c.disconnect(packets.DisconnectNormal, options)
+}
+
+// DisconnectWithWill disconnects like Disconnect, but with the reason code
+// "Disconnect with Will Message" (0x04), such that the server publishes the
+// will message as if the connection was lost. DisconnectWithWill requires
+// protocol version MQTTv5.
+func (c *Client) DisconnectWithWill(options ...*DisconnectOptions) error {
+	if c.version < mqtt.MQTTv5 {
+		return ErrRequiresMQTTv5
+	}
+	return c.disconnect(packets.DisconnectWithWill, options)
+}
+
+func (c *Client) disconnect(
+	reasonCode uint8, options []*DisconnectOptions,
+) (err error) {
 	dc := &packets.Disconnect{
-		Version: c.version,
+		Version:    c.version,
+		ReasonCode: reasonCode,
+	}
+	for _, opt := range options {
+		if opt == nil {
+			continue
+		}
+		if opt.SessionExpiryInterval != nil &&
+			c.version >= mqtt.MQTTv5 {
+			expiry := *opt.SessionExpiryInterval
+			dc.SessionExpiryInterval = &expiry
+		}
 	}
 	defer func() {
 		errClose := c.io.Close()
@@ -178,23 +820,38 @@ func (c *Client) Ping() error {
 	select {
 	case <-c.pingResp:
 	case err := <-c.errChan:
-		select {
-		case c.errChan <- err:
-		default:
-		}
+		c.reportError(err)
 		return err
 	}
 	return nil
 }
 
-// Publish publishes a new packet to the specified topic.
-func (c *Client) Publish(
+// Pause stops delivering received messages to the subscribers without
+// disconnecting, e.g. to let a slow consumer catch up. The client keeps
+// receiving and acknowledging messages, holding up to 1024 of them in memory
+// until Resume is called; further messages are dropped (see
+// Stats.MessagesDropped). Responses to outstanding requests are still
+// delivered.
+func (c *Client) Pause() {
+	c.paused.Pause()
+}
+
+// Resume delivers the messages received while paused, in the order
+// received, and resumes the delivery. Resume waits for the subscribers to
+// take the held messages, so the subscriber channels must be drained
+// concurrently; the messages arriving meanwhile are acknowledged and
+// delivered after the held ones before Resume returns.
+func (c *Client) Resume() {
+	c.paused.Resume(c.dispatchWait)
+}
+
+// newPublish returns the publish packet for the topic and payload with the
+// options and the payload encoder applied.
+func (c *Client) newPublish(
 	topic mqtt.Topic,
 	payload []byte,
 	options ...*PublishOptions,
-) error {
-	// Reserve packet identifier
-	packetID := c.aquirePacketID()
+) (*packets.Publish, error) {
 	pub := &packets.Publish{
 		Version: c.version,
 
@@ -206,19 +863,118 @@ func (c *Client) Publish(
 		if opts == nil {
 			continue
 		}
-		if *opts.Retain {
+		if opts.Retain != nil {
 			pub.Retain = *opts.Retain
 		}
+		if opts.QoS != nil {
+			pub.QoS = *opts.QoS
+		}
+		if opts.ResponseTopic != nil {
+			pub.ResponseTopic = *opts.ResponseTopic
+		}
+		if opts.CorrelationData != nil {
+			pub.CorrelationData = opts.CorrelationData
+		}
+		if opts.UserProperties != nil {
+			pub.UserProperties = opts.UserProperties
+		}
+	}
+	if c.payloadEncoder != nil {
+		var err error
+		pub.Payload, err = c.payloadEncoder(
+			pub.UserProperties, pub.Payload,
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return pub, nil
+}
+
+// DefaultBufferSize is the default size of the read and write buffers of
+// connections established by Dial and DialSRV.
+const DefaultBufferSize = 4096
+
+// tryPublishWait is how long TryPublish waits for the connection to accept
+// the packet.
+const tryPublishWait = time.Millisecond
+
+// TryPublish publishes a QoS0 message like Publish, but drops the message
+// instead of blocking under backpressure: sent is false, without an error,
+// if another packet is being sent or the connection does not accept the
+// packet right away. If the connection accepts only part of the packet, the
+// connection is closed and the error returned. A QoS other than QoS0
+// results in mqtt.ErrIllegalQoS.
+func (c *Client) TryPublish(
+	topic mqtt.Topic,
+	payload []byte,
+	options ...*PublishOptions,
+) (sent bool, err error) {
+	pub, err := c.newPublish(topic, payload, options...)
+	if err != nil {
+		return false, err
+	} else if pub.QoS != mqtt.QoS0 {
+		return false, mqtt.ErrIllegalQoS
 	}
+	return c.io.TrySend(pub, tryPublishWait)
+}
 
-	switch topic.QoS {
+// Publish publishes a new packet to the specified topic with the QoS of the
+// topic, unless overridden by the options. For QoS2, Publish blocks until the
+// server completes the flow with a PUBCOMP.
+func (c *Client) Publish(
+	topic mqtt.Topic,
+	payload []byte,
+	options ...*PublishOptions,
+) error {
+	pub, err := c.newPublish(topic, payload, options...)
+	if err != nil {
+		return err
+	}
+	return c.publish(pub, false)
+}
+
+// PublishAndWait publishes like Publish, but for QoS1 also blocks until the
+// server acknowledges the message with a PUBACK. If the server rejects the
+// message with an error reason code in the PUBACK or PUBREC (MQTTv5), the
+// returned error is a *PublishError wrapping mqtt.ErrPublishRejected. If the
+// client reconnects meanwhile and the server has discarded the session, the
+// returned error is ErrSessionLost.
+func (c *Client) PublishAndWait(
+	topic mqtt.Topic,
+	payload []byte,
+	options ...*PublishOptions,
+) error {
+	pub, err := c.newPublish(topic, payload, options...)
+	if err != nil {
+		return err
+	}
+	return c.publish(pub, true)
+}
+
+// publish sends the publish packet. The exactly-once flow is always awaited;
+// the acknowledgement of QoS1 publishes only if waitAck is set.
+func (c *Client) publish(pub *packets.Publish, waitAck bool) error {
+	wait := pub.QoS == mqtt.QoS2 || (waitAck && pub.QoS == mqtt.QoS1)
+	var packetID uint16
+	switch pub.QoS {
 	case mqtt.QoS0:
 		// Nothing to do here.
-	case mqtt.QoS2:
-		c.ackChan.New(packetID)
-		defer c.ackChan.Del(packetID)
-		fallthrough
-	case mqtt.QoS1:
+	case mqtt.QoS1, mqtt.QoS2:
+		if !c.acquireSendQuota() {
+			return mqtt.ErrConnectionClosed
+		}
+		// Reserve packet identifier
+		var err error
+		packetID, err = c.aquirePacketID()
+		if err != nil {
+			c.quota.Release()
+			return err
+		}
+		if wait {
+			c.ackChan.New(packetID)
+			defer c.ackChan.Del(packetID)
+		}
 		pub.PacketIdentifier = packetID
 		c.pendingPackets.Add(packetID, pub)
 	default:
@@ -226,23 +982,424 @@ func (c *Client) Publish(
 	}
 
 	err := c.io.Send(pub)
-	if err == nil && topic.QoS == mqtt.QoS2 {
+	if err == mqtt.ErrPacketTooLarge && packetID > 0 {
+		// The packet is never sent, release the packet identifier.
+		c.pendingPackets.Del(packetID)
+		c.quota.Release()
+	}
+	if err == nil && wait {
+		// Wait for the acknowledgement or, for QoS2, the
+		// exactly-once flow to complete.
 		ackChan, _ := c.ackChan.Get(packetID)
-		<-ackChan
+		select {
+		case ack := <-ackChan:
+			return publishAckError(ack)
+		case err := <-c.errChan:
+			c.reportError(err)
+			return err
+		}
 	}
 	return err
 }
 
+// publishAckError returns the *PublishError corresponding to the reason
+// code of the acknowledgement, or nil if the publish succeeded.
+func publishAckError(ack packets.Packet) error {
+	switch ack := ack.(type) {
+	case *packets.PubAck:
+		if ack.ReasonCode >= packets.PubAckUnspecifiedError {
+			return &PublishError{
+				ReasonCode:   ack.ReasonCode,
+				ReasonString: ack.ReasonString,
+			}
+		}
+	case *packets.PubRec:
+		if ack.ReasonCode >= packets.PubRecUnspecifiedError {
+			return &PublishError{ReasonCode: ack.ReasonCode}
+		}
+	case *packets.PubComp:
+		if ack.ReasonCode != packets.PubCompSuccess {
+			return &PublishError{ReasonCode: ack.ReasonCode}
+		}
+	case sessionLost:
+		return ErrSessionLost
+	}
+	return nil
+}
+
 // Subscribe sends a subscribe request with the given topics. On success
 // the list of status codes corresponding to the provided topics are returned.
+// If the number of topics exceeds the MaxTopicsPerSubscribe client option,
+// the request is split into multiple subscribe packets. The topic filters
+// are validated before sending: if any filter is invalid, nothing is sent
+// and a *TopicFilterError listing the invalid filters is returned, unless
+// the SkipInvalidFilters client option is set, in which case the invalid
+// filters are left out and their status code is 0x80 (failure).
 func (c *Client) Subscribe(topics ...mqtt.Subscription) ([]uint8, error) {
-	var statusCodes []uint8
+	return c.subscribeAll(topics, channelSubscription)
+}
+
+// channelSubscription returns a subscription delivering to the channel of
+// the topic.
+func channelSubscription(topic mqtt.Subscription) *subscription {
+	sub := newSubscription(topic.QoS, topic.Messages)
+	sub.transient = topic.Transient
+	return sub
+}
+
+// subscribeAll subscribes to the topics like Subscribe, creating the
+// subscriptions using newSub.
+func (c *Client) subscribeAll(
+	topics []mqtt.Subscription,
+	newSub func(mqtt.Subscription) *subscription,
+) ([]uint8, error) {
 	if len(topics) == 0 {
 		return nil, nil
 	}
+	var invalid []int
+	for i, topic := range topics {
+		if mqtt.ValidateTopicFilter(topic.Name) != nil {
+			invalid = append(invalid, i)
+		}
+	}
+	if len(invalid) > 0 {
+		return c.subscribeValid(topics, invalid, newSub)
+	}
+	// Send the batches before awaiting the acknowledgements.
+	var err error
+	results := make([]<-chan SubscribeResult, 0, 1)
+	for _, batch := range c.subscribeBatches(len(topics)) {
+		batchTopics := topics[batch[0]:batch[1]]
+		subTopics := make([]mqtt.Topic, len(batchTopics))
+		subs := make([]*subscription, len(batchTopics))
+		for i, topic := range batchTopics {
+			subTopics[i] = topic.Topic
+			subs[i] = newSub(topic)
+		}
+		var result <-chan SubscribeResult
+		_, result, err = c.subscribeAsync(subTopics, subs)
+		if err != nil {
+			break
+		}
+		results = append(results, result)
+	}
+	codes := make([]uint8, 0, len(topics))
+	for _, result := range results {
+		res := <-result
+		if res.Err != nil && err == nil {
+			err = res.Err
+		}
+		codes = append(codes, res.ReturnCodes...)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
 
+// subscribeValid handles a Subscribe call with the invalid topics at the
+// given indices.
+func (c *Client) subscribeValid(
+	topics []mqtt.Subscription, invalid []int,
+	newSub func(mqtt.Subscription) *subscription,
+) ([]uint8, error) {
+	if !c.skipInvalidFilters {
+		err := &TopicFilterError{Filters: make([]string, len(invalid))}
+		for i, j := range invalid {
+			err.Filters[i] = topics[j].Name
+		}
+		return nil, err
+	}
+	codes := make([]uint8, len(topics))
+	for _, i := range invalid {
+		codes[i] = packets.SubAckFailure
+	}
+	// Indices of the valid topics.
+	var indices []int
+	var valid []mqtt.Subscription
+	for i, topic := range topics {
+		if codes[i] != packets.SubAckFailure {
+			indices = append(indices, i)
+			valid = append(valid, topic)
+		}
+	}
+	validCodes, err := c.subscribeAll(valid, newSub)
+	if err != nil {
+		return nil, err
+	}
+	for i, code := range validCodes {
+		if i < len(indices) {
+			codes[indices[i]] = code
+		}
+	}
+	return codes, nil
+}
+
+// subscribeBatches splits n topics into [start, end) index ranges of at most
+// the maximum number of topics per subscribe packet.
+func (c *Client) subscribeBatches(n int) [][2]int {
+	size := n
+	if c.maxTopicsPerSubscribe > 0 && c.maxTopicsPerSubscribe < n {
+		size = c.maxTopicsPerSubscribe
+	}
+	batches := make([][2]int, 0, (n+size-1)/size)
+	for start := 0; start < n; start += size {
+		end := start + size
+		if end > n {
+			end = n
+		}
+		batches = append(batches, [2]int{start, end})
+	}
+	return batches
+}
+
+// SubscribeResult is the outcome of an asynchronous subscribe request.
+type SubscribeResult struct {
+	// ReturnCodes are the status codes corresponding to the requested
+	// topics.
+	ReturnCodes []uint8
+	// Err is the error causing the request to fail (if any).
+	Err error
+}
+
+// SubscribeAsync sends a subscribe request with the given topics without
+// waiting for the acknowledgement. The packet identifier of the request is
+// returned along with a channel receiving the result once the request
+// completes. The request can be abandoned using CancelSubscribe. Invalid
+// topic filters fail the request with a *TopicFilterError without sending.
+func (c *Client) SubscribeAsync(
+	topics ...mqtt.Subscription,
+) (uint16, <-chan SubscribeResult, error) {
+	if len(topics) == 0 {
+		result := make(chan SubscribeResult, 1)
+		result <- SubscribeResult{}
+		return 0, result, nil
+	}
+	subTopics := make([]mqtt.Topic, len(topics))
+	subs := make([]*subscription, len(topics))
+	for i, topic := range topics {
+		subTopics[i] = topic.Topic
+		subs[i] = channelSubscription(topic)
+	}
+	return c.subscribeAsync(subTopics, subs)
+}
+
+// subscribeAsync registers the subscriptions for the topics and sends the
+// subscribe request (see SubscribeAsync).
+func (c *Client) subscribeAsync(
+	subTopics []mqtt.Topic, subs []*subscription,
+) (uint16, <-chan SubscribeResult, error) {
+	// Refuse invalid filters and features the server does not support
+	// locally; the server would otherwise disconnect the client.
+	if err := c.validateSubscribe(subTopics); err != nil {
+		return 0, nil, err
+	}
+	result := make(chan SubscribeResult, 1)
+	release := c.acquireControlSlot()
 	// Reserve packet id
-	packetID := c.aquirePacketID()
+	packetID, err := c.aquirePacketID()
+	if err != nil {
+		release()
+		return 0, nil, err
+	}
+	req := &subscribeRequest{
+		names:  make([]string, len(subTopics)),
+		subs:   subs,
+		cancel: make(chan struct{}),
+	}
+	for i, topic := range subTopics {
+		// Reserve receive channels
+		req.names[i] = topic.Name
+		c.subs.Add(topic.Name, subs[i])
+	}
+	// Setup ack channel
+	c.ackChan.New(packetID)
+	c.subRequests.Add(packetID, req)
+	err = c.io.Send(&packets.Subscribe{
+		Version:          c.version,
+		PacketIdentifier: packetID,
+		Topics:           subTopics,
+	})
+	if err != nil {
+		c.subRequests.Pop(packetID)
+		c.ackChan.Del(packetID)
+		release()
+		for _, name := range req.names {
+			c.subs.Del(name)
+		}
+		return 0, nil, err
+	}
+	go func() {
+		res := c.awaitSubscribe(packetID, req)
+		c.ackChan.Del(packetID)
+		release()
+		result <- res
+	}()
+	return packetID, result, nil
+}
+
+// CancelSubscribe abandons the in-flight subscribe request with the given
+// packet identifier, releasing the packet identifier and removing the
+// subscriptions reserved by the request. The pending result receives
+// ErrSubscribeCancelled. The return value is false if the request is not
+// in-flight.
+func (c *Client) CancelSubscribe(packetID uint16) bool {
+	req, ok := c.subRequests.Pop(packetID)
+	if !ok {
+		return false
+	}
+	for _, name := range req.names {
+		if sub := c.subs.Del(name); sub != nil {
+			sub.Close(c.closeOnUnsubscribe)
+		}
+	}
+	close(req.cancel)
+	return true
+}
+
+// Register adds the subscriptions to the set of subscriptions the client
+// subscribes to on every successful Connect and Reconnect, such that the
+// subscriptions are restored without the application subscribing after each
+// connect. Register does not subscribe if the client is already connected;
+// the subscriptions take effect on the next connect. A subscription replaces
+// a registered subscription with the same topic filter.
+func (c *Client) Register(topics ...mqtt.Subscription) {
+	for _, topic := range topics {
+		c.registered.Add(topic)
+	}
+}
+
+// Unregister removes the topic filters from the set of registered
+// subscriptions. Active subscriptions are left intact; use Unsubscribe to
+// stop receiving messages.
+func (c *Client) Unregister(topicNames ...string) {
+	for _, name := range topicNames {
+		c.registered.Del(name)
+	}
+}
+
+// SubscribeMap subscribes to the topic filters in the map with the mapped
+// QoS in a single subscribe request (see Subscribe), calling the shared
+// handler with the incoming messages on all filters. The status codes are
+// returned indexed by topic filter. The handler is called from the receive
+// routine, or from the delivery workers if ordered delivery is enabled; it
+// must not block or wait for responses from the server.
+func (c *Client) SubscribeMap(
+	filters map[string]mqtt.QoS,
+	handler func(mqtt.Message),
+) (map[string]mqtt.SubAckCode, error) {
+	if handler == nil {
+		return nil, ErrNilHandler
+	}
+	topics := make([]mqtt.Subscription, 0, len(filters))
+	for name, qos := range filters {
+		topics = append(topics, mqtt.Subscription{
+			Topic: mqtt.Topic{Name: name, QoS: qos},
+		})
+	}
+	// Send the filters in a deterministic order.
+	sort.Slice(topics, func(i, j int) bool {
+		return topics[i].Name < topics[j].Name
+	})
+	codes, err := c.subscribeAll(topics, func(
+		topic mqtt.Subscription,
+	) *subscription {
+		sub := newSubscription(topic.QoS, nil)
+		sub.handler = handler
+		return sub
+	})
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string]mqtt.SubAckCode, len(topics))
+	for i, code := range codes {
+		ret[topics[i].Name] = mqtt.SubAckCode(code)
+	}
+	return ret, nil
+}
+
+// LastRetained returns the last retained message received on the topic, if
+// the retained cache is enabled (see ClientOptions.SetRetainedCache). The
+// return value is false if no retained message is known for the topic. The
+// payload must not be modified.
+func (c *Client) LastRetained(topic string) (mqtt.Message, bool) {
+	if c.retained == nil {
+		return mqtt.Message{}, false
+	}
+	return c.retained.Get(topic)
+}
+
+// Resubscribe changes the QoS of an existing subscription by subscribing to
+// the same topic filter with the new QoS, which replaces the subscription on
+// the server without interrupting the message flow. The returned status
+// code is stored as the granted QoS unless the server refuses the request
+// (status code 0x80), in which case the subscription is left unchanged.
+// The filter is validated like the filters passed to Subscribe.
+// ErrNotSubscribed is returned if the client is not subscribed to the
+// filter.
+func (c *Client) Resubscribe(
+	filter string, qos mqtt.QoS,
+) ([]mqtt.SubAckCode, error) {
+	if qos > mqtt.QoS2 {
+		return nil, mqtt.ErrIllegalQoS
+	}
+	topics := []mqtt.Topic{{Name: filter, QoS: qos}}
+	if err := c.validateSubscribe(topics); err != nil {
+		return nil, err
+	}
+	sub, ok := c.subs.All()[filter]
+	if !ok {
+		return nil, ErrNotSubscribed
+	}
+	codes, err := c.subscribe(topics)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]mqtt.SubAckCode, len(codes))
+	for i, code := range codes {
+		ret[i] = mqtt.SubAckCode(code)
+	}
+	if len(ret) > 0 && ret[0].Granted() {
+		c.subs.SetQoS(sub, ret[0].QoS())
+	}
+	return ret, nil
+}
+
+// Subscriptions returns the topic filters the client is currently subscribed
+// to along with the QoS granted by the server, sorted by topic name.
+func (c *Client) Subscriptions() []mqtt.Topic {
+	topics := c.subs.Topics()
+	sort.Slice(topics, func(i, j int) bool {
+		return topics[i].Name < topics[j].Name
+	})
+	return topics
+}
+
+// subscribe sends subscribe packets with the given topics, split by the
+// maximum number of topics per packet, and blocks until the corresponding
+// SubAcks are received.
+func (c *Client) subscribe(topics []mqtt.Topic) ([]uint8, error) {
+	codes := make([]uint8, 0, len(topics))
+	for _, batch := range c.subscribeBatches(len(topics)) {
+		batchCodes, err := c.subscribePacket(topics[batch[0]:batch[1]])
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, batchCodes...)
+	}
+	return codes, nil
+}
+
+// subscribePacket sends a single subscribe packet with the given topics and
+// blocks until the corresponding SubAck is received.
+func (c *Client) subscribePacket(topics []mqtt.Topic) ([]uint8, error) {
+	release := c.acquireControlSlot()
+	defer release()
+	// Reserve packet id
+	packetID, err := c.aquirePacketID()
+	if err != nil {
+		return nil, err
+	}
 	// Setup ack channel
 	c.ackChan.New(packetID)
 	defer c.ackChan.Del(packetID)
@@ -250,14 +1407,9 @@ func (c *Client) Subscribe(topics ...mqtt.Subscription) ([]uint8, error) {
 	sub := &packets.Subscribe{
 		Version:          c.version,
 		PacketIdentifier: packetID,
+		Topics:           topics,
 	}
-	sub.Topics = make([]mqtt.Topic, len(topics))
-	for i, topic := range topics {
-		// Reserve receive channels
-		c.subs.Add(topic.Name, topic.Messages)
-		sub.Topics[i] = topic.Topic
-	}
-	err := c.io.Send(sub)
+	err = c.io.Send(sub)
 	if err != nil {
 		return nil, err
 	}
@@ -265,32 +1417,38 @@ func (c *Client) Subscribe(topics ...mqtt.Subscription) ([]uint8, error) {
 	select {
 	case ack := <-ackChan:
 		if subAck, ok := ack.(*packets.SubAck); ok {
-			statusCodes = subAck.ReturnCodes
-			// Remove subscribe channels with bad status code.
-			for i, status := range statusCodes {
-				if status > 2 {
-					c.subs.Del(topics[i].Name)
-				}
+			err = checkReturnCodes(len(topics), subAck.ReturnCodes)
+			if err != nil {
+				return nil, err
 			}
-		} else {
-			return nil, ErrInternalConflict
+			return subAck.ReturnCodes, nil
 		}
+		return nil, ErrInternalConflict
 
 	case err := <-c.errChan:
 		// Push error back in channel buffer and abort
-		c.errChan <- err
+		c.reportError(err)
 		return nil, err
 	}
-	return statusCodes, nil
 }
 
 // Unsubscribe sends an unsubscribe packet to the topic names. The
-// client will no longer receive packets on the given topics.
+// client will no longer receive packets on the given topics; once
+// Unsubscribe returns successfully, no further messages are sent on the
+// subscriber channels, and the channels are closed if CloseOnUnsubscribe
+// is set. The subscriptions stay active until the server acknowledges the
+// request, such that messages the server sends before processing the
+// request are delivered rather than dropped.
 func (c *Client) Unsubscribe(topicNames ...string) error {
 	if len(topicNames) == 0 {
 		return nil
 	}
-	packetID := c.aquirePacketID()
+	release := c.acquireControlSlot()
+	defer release()
+	packetID, err := c.aquirePacketID()
+	if err != nil {
+		return err
+	}
 	p := &packets.Unsubscribe{
 		Version: c.version,
 
@@ -298,11 +1456,99 @@ func (c *Client) Unsubscribe(topicNames ...string) error {
 		PacketIdentifier: packetID,
 	}
 	c.ackChan.New(packetID)
-	err := c.io.Send(p)
-	if err == nil {
-		ackChan, _ := c.ackChan.Get(packetID)
-		<-ackChan
+	// Releases the packet id on return, a late UnsubAck is discarded.
+	defer c.ackChan.Del(packetID)
+	err = c.io.Send(p)
+	if err != nil {
+		return err
+	}
+	var timeout <-chan time.Time
+	if c.ackTimeout > 0 {
+		timer := c.clock.NewTimer(c.ackTimeout)
+		defer timer.Stop()
+		timeout = timer.C()
+	}
+	ackChan, _ := c.ackChan.Get(packetID)
+	select {
+	case <-ackChan:
+		// Once the subscriptions are closed, no further messages
+		// are passed to the subscriber channels.
+		for _, topic := range topicNames {
+			if sub := c.subs.Del(topic); sub != nil {
+				sub.Close(c.closeOnUnsubscribe)
+			}
+		}
+		return nil
+
+	case <-timeout:
+		return mqtt.ErrUnsubscribeTimeout
+
+	case err := <-c.errChan:
+		// Push error back in channel buffer and abort
+		c.reportError(err)
+		return err
+	}
+}
+
+// Request publishes a request message on topic with a generated response
+// topic and correlation data, and blocks until the first correlated response
+// is received or the timeout expires. The payload of the response is
+// returned. The response topic is prefixed by the response information of the
+// server if requested on connect (see ConnectOptions.SetRequestResponseInfo)
+// and by "<client ID>/response" otherwise. Request requires protocol version
+// MQTTv5.
+func (c *Client) Request(
+	topic mqtt.Topic,
+	payload []byte,
+	timeout time.Duration,
+) ([]byte, error) {
+	if c.version < mqtt.MQTTv5 {
+		return nil, ErrRequiresMQTTv5
+	}
+	correlationData := uuid.NewV4().Bytes()
+	responseBase := c.session.ResponseInfo
+	if responseBase == "" {
+		responseBase = c.ClientID + "/response"
+	}
+	responseTopic := fmt.Sprintf(
+		"%s/%s", responseBase, uuid.NewV4().String(),
+	)
+	responses := c.responses.New(responseTopic, correlationData)
+	defer c.responses.Del(responseTopic)
+
+	statusCodes, err := c.subscribe([]mqtt.Topic{{
+		Name: responseTopic,
+		QoS:  topic.QoS,
+	}})
+	if err != nil {
+		return nil, err
+	} else if len(statusCodes) != 1 || statusCodes[0] > 2 {
+		return nil, fmt.Errorf(
+			"request: subscribe to response topic rejected",
+		)
+	}
+	defer c.Unsubscribe(responseTopic)
+
+	pubOpts := NewPublishOptions()
+	pubOpts.SetResponseTopic(responseTopic)
+	pubOpts.SetCorrelationData(correlationData)
+	err = c.Publish(topic, payload, pubOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	timer := c.clock.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case rsp := <-responses:
+		return rsp.Payload, nil
+
+	case <-timer.C():
+		return nil, mqtt.ErrRequestTimeout
+
+	case err := <-c.errChan:
+		// Push error back in channel buffer and abort
+		c.reportError(err)
+		return nil, err
 	}
-	c.ackChan.Del(packetID)
-	return err
 }
@@ -1,168 +1,729 @@
 package client
 
 import (
+	"fmt"
 	log "github.com/sirupsen/logrus"
 	"io"
 	"reflect"
+	"sort"
+	"strings"
 	"sync/atomic"
+	"time"
 
 	"github.com/alfrunes/mqttie/mqtt"
 	"github.com/alfrunes/mqttie/packets"
 )
 
-func (c *Client) aquirePacketID() uint16 {
+func (c *Client) aquirePacketID() (uint16, error) {
+	if c.packetIDAllocator != nil {
+		return c.allocatePacketID()
+	}
 	// Thread safe method to acquire unique packet ID.
-	for i := 0; i < int(^uint16(0)); i++ {
+	for i := 0; i <= int(^uint16(0)); i++ {
 		newVal := atomic.AddUint32(&c.packetIDCounter, 1)
 		ret := uint16(newVal)
-		if _, ok := c.pendingPackets.Get(ret); ok {
+		if ret == 0 {
+			// Zero is not a valid packet identifier.
+			continue
+		} else if _, ok := c.pendingPackets.Get(ret); ok {
 			continue
 		} else if _, ok := c.ackChan.Get(ret); ok {
 			continue
 		} else {
-			return ret
+			return ret, nil
 		}
 	}
-	panic("ran out of packet ids")
+	return 0, ErrNoPacketIDs
 }
 
-func (c *Client) recvRoutine() {
-	for {
-		packet, err := c.io.Recv()
-		if err == io.EOF {
-			return
-		} else if err != nil {
-			log.Error(err)
-			c.errChan <- err
-			return
+// allocatePacketID returns a packet identifier from the user supplied
+// allocator, refusing identifiers that are invalid or in use.
+func (c *Client) allocatePacketID() (uint16, error) {
+	id, err := c.packetIDAllocator()
+	if err != nil {
+		return 0, err
+	} else if id == 0 {
+		return 0, ErrPacketIDInUse
+	} else if _, ok := c.pendingPackets.Get(id); ok {
+		return 0, ErrPacketIDInUse
+	} else if _, ok := c.ackChan.Get(id); ok {
+		return 0, ErrPacketIDInUse
+	}
+	return id, nil
+}
+
+// acquireControlSlot blocks until the number of in-flight subscribe and
+// unsubscribe requests is below the configured bound. The returned function
+// releases the slot.
+func (c *Client) acquireControlSlot() func() {
+	if c.controlSlots == nil {
+		return func() {}
+	}
+	c.controlSlots <- struct{}{}
+	return func() { <-c.controlSlots }
+}
+
+// acquireSendQuota reserves a slot for a QoS1 or QoS2 publish within the
+// server's Receive Maximum, notifying the flow control handler if the
+// publish blocks. The return value is false if the connection terminates
+// while blocking.
+func (c *Client) acquireSendQuota() bool {
+	var blocked bool
+	ok := c.quota.Acquire(c.done, func() {
+		blocked = true
+		atomic.AddInt64(&c.stats.blocked, 1)
+		if c.flowControlBlocked != nil {
+			c.flowControlBlocked()
 		}
-		switch packet := packet.(type) {
-		case *packets.PingResp:
-			// Bypass to response channel.
-			c.pingResp <- packet
-		case *packets.ConnAck:
-			c.connAck <- packet
-		case *packets.SubAck, *packets.UnsubAck:
-			// Use generic reflection of the (dereferenced) value
-			pVal := reflect.ValueOf(packet).Elem()
-			// Extract packet ID.
-			id := pVal.FieldByName("PacketIdentifier")
-			packetID := id.Interface().(uint16)
-			// Verify that the channel is present
-			if c, ok := c.ackChan.Get(packetID); ok {
-				// Non-blocking send on channel
-				//  - May receive multiple copies.
-				select {
-				case c <- packet:
-				default:
-				}
-			} else {
-				log.Errorf("Package lost: %s; packet id: %d",
-					pVal.Type().Name(), packetID,
-				)
+	})
+	if blocked {
+		atomic.AddInt64(&c.stats.blocked, -1)
+	}
+	return ok
+}
+
+// validateSubscribe verifies the topic filters before subscribing: invalid
+// filters are reported in a *TopicFilterError, otherwise the filters are
+// checked against the features available on the server (see
+// checkSubscribe).
+func (c *Client) validateSubscribe(topics []mqtt.Topic) error {
+	var filterErr *TopicFilterError
+	for _, topic := range topics {
+		if mqtt.ValidateTopicFilter(topic.Name) != nil {
+			if filterErr == nil {
+				filterErr = &TopicFilterError{}
 			}
+			filterErr.Filters = append(filterErr.Filters, topic.Name)
+		}
+	}
+	if filterErr != nil {
+		return filterErr
+	}
+	return c.checkSubscribe(topics)
+}
 
+// checkSubscribe verifies that the topic filters only use subscription
+// features available on the server.
+func (c *Client) checkSubscribe(topics []mqtt.Topic) error {
+	for _, topic := range topics {
+		if !c.session.SharedSubAvailable &&
+			strings.HasPrefix(topic.Name, "$share/") {
+			return ErrSharedSubUnavailable
+		}
+		if !c.session.WildcardSubAvailable &&
+			strings.ContainsAny(topic.Name, "+#") {
+			return ErrWildcardSubUnavailable
+		}
+	}
+	return nil
+}
+
+// outboundInflight returns the number of outbound QoS1 and QoS2 publishes
+// awaiting acknowledgement.
+func (c *Client) outboundInflight() int {
+	var n int
+	for _, packet := range c.pendingPackets.All() {
+		switch packet.(type) {
+		case *packets.Publish, *packets.PubRel:
+			n++
+		}
+	}
+	return n
+}
+
+// retransmit resends the unacknowledged outbound publish and publish release
+// packets after reconnecting. Retransmitted publishes keep their flags and
+// have the duplicate flag set.
+func (c *Client) retransmit() error {
+	pending := c.pendingPackets.All()
+	ids := make([]int, 0, len(pending))
+	for id := range pending {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		var packet packets.Packet
+		switch p := pending[uint16(id)].(type) {
 		case *packets.Publish:
-			subChan := c.subs.Get(packet.Topic.Name)
-			if subChan != nil {
-				select {
-				case subChan <- packet.Payload:
-
-				default:
-					log.Errorf("Subscriber channel %s is "+
-						"full, discarding payload",
-						packet.Topic.Name)
-				}
+			dup := *p
+			dup.Duplicate = true
+			c.pendingPackets.Set(uint16(id), &dup)
+			packet = &dup
+		case *packets.PubRel:
+			packet = p
+		default:
+			// Inbound QoS2 state stored by earlier releases is
+			// resumed by the server.
+			continue
+		}
+		if err := c.io.Send(packet); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// awaitSubscribe waits for the acknowledgement of the subscribe request,
+// updating the granted QoS of the reserved subscriptions. Subscriptions that
+// are not granted by the server are removed.
+func (c *Client) awaitSubscribe(
+	packetID uint16, req *subscribeRequest,
+) SubscribeResult {
+	ackChan, _ := c.ackChan.Get(packetID)
+	select {
+	case ack := <-ackChan:
+		if _, ok := c.subRequests.Pop(packetID); !ok {
+			// Cancelled while receiving the acknowledgement.
+			return SubscribeResult{Err: ErrSubscribeCancelled}
+		}
+		subAck, ok := ack.(*packets.SubAck)
+		if !ok {
+			for _, name := range req.names {
+				c.subs.Del(name)
+			}
+			return SubscribeResult{Err: ErrInternalConflict}
+		}
+		if err := checkReturnCodes(
+			len(req.names), subAck.ReturnCodes,
+		); err != nil {
+			for _, name := range req.names {
+				c.subs.Del(name)
+			}
+			return SubscribeResult{Err: err}
+		}
+		// Remove subscribe channels with bad status code and update
+		// the granted QoS of the rest.
+		for i, status := range subAck.ReturnCodes {
+			if status > 2 {
+				c.subs.Del(req.names[i])
 			} else {
-				log.Warnf("Internal error: no subscriber "+
-					"chan for topic %s", packet.Topic.Name)
+				c.subs.SetQoS(req.subs[i], mqtt.QoS(status))
 			}
-			switch packet.QoS {
-			case mqtt.QoS0:
-				// We're done here
-
-			case mqtt.QoS1:
-				// Send puback and delete packet from pending.
-				pubAck := &packets.PubAck{
-					Version: c.version,
-					PacketIdentifier: packet.
-						PacketIdentifier,
-				}
-				err := c.io.Send(pubAck)
-				if err != nil {
-					log.Error(err)
-					c.errChan <- err
-				}
-				c.pendingPackets.Del(packet.PacketIdentifier)
+		}
+		return SubscribeResult{ReturnCodes: subAck.ReturnCodes}
+
+	case <-req.cancel:
+		return SubscribeResult{Err: ErrSubscribeCancelled}
 
-			case mqtt.QoS2:
-				// Send PubRec and update pending packet.
-				packetID := packet.PacketIdentifier
-				pubRec := &packets.PubRec{
-					Version:          c.version,
-					PacketIdentifier: packetID,
-				}
-				err := c.io.Send(pubRec)
-				if err != nil {
-					log.Error(err)
-					c.errChan <- err
-					return
-				}
-				c.pendingPackets.Set(
-					packet.PacketIdentifier,
-					pubRec)
+	case err := <-c.errChan:
+		// Push error back in channel buffer and abort
+		c.reportError(err)
+		if _, ok := c.subRequests.Pop(packetID); ok {
+			for _, name := range req.names {
+				c.subs.Del(name)
 			}
+		}
+		return SubscribeResult{Err: err}
+	}
+}
 
-		case *packets.PubAck:
-			// Delete pending packet; publish completed
-			c.pendingPackets.Del(packet.PacketIdentifier)
+// checkReturnCodes returns an error wrapping ErrIllegalResponse unless the
+// SubAck holds a return code for each of the n requested topics.
+func checkReturnCodes(n int, codes []uint8) error {
+	if len(codes) != n {
+		return fmt.Errorf(
+			"%w: %d return codes for %d topics",
+			ErrIllegalResponse, len(codes), n,
+		)
+	}
+	return nil
+}
 
-		case *packets.PubComp:
-			// Delete pending packet; publish completed
-			c.pendingPackets.Del(packet.PacketIdentifier)
+// resubscribe restores the persistent subscriptions after reconnecting and
+// removes the transient ones.
+func (c *Client) resubscribe() error {
+	var topics []mqtt.Topic
+	var subs []*subscription
+	for name, sub := range c.subs.All() {
+		if sub.transient {
+			c.subs.Del(name)
+			sub.Close(c.closeOnUnsubscribe)
+			continue
+		}
+		topics = append(topics, mqtt.Topic{Name: name, QoS: sub.qos})
+		subs = append(subs, sub)
+	}
+	if len(topics) == 0 {
+		return nil
+	}
+	statusCodes, err := c.subscribe(topics)
+	if err != nil {
+		return err
+	}
+	for i, status := range statusCodes {
+		if i >= len(topics) {
+			break
+		} else if status > 2 {
+			c.subs.Del(topics[i].Name)
+			subs[i].Close(c.closeOnUnsubscribe)
+		} else {
+			c.subs.SetQoS(subs[i], mqtt.QoS(status))
+		}
+	}
+	return nil
+}
 
-		case *packets.PubRel:
-			// Discard cached packet and send publish complete
-			c.pendingPackets.Del(packet.PacketIdentifier)
-			pubComp := &packets.PubComp{
-				Version:          c.version,
-				PacketIdentifier: packet.PacketIdentifier,
+// subscribeRegistered subscribes to the registered subscriptions that are
+// not already active. Filters refused by the server are retried on the next
+// connect.
+func (c *Client) subscribeRegistered() error {
+	active := c.subs.All()
+	var topics []mqtt.Subscription
+	for _, sub := range c.registered.All() {
+		if _, ok := active[sub.Name]; !ok {
+			topics = append(topics, sub)
+		}
+	}
+	statusCodes, err := c.Subscribe(topics...)
+	if err != nil {
+		return err
+	}
+	for i, status := range statusCodes {
+		if i < len(topics) && status > 2 {
+			log.Warnf("Registered subscription %s refused "+
+				"by server (0x%02X)", topics[i].Name, status)
+		}
+	}
+	return nil
+}
+
+// resolveTopicAlias updates the inbound topic alias mapping, or if the topic
+// name is empty, resolves the topic name from the alias.
+func (c *Client) resolveTopicAlias(pub *packets.Publish) {
+	if pub.Topic.Name != "" {
+		c.topicAliases[pub.TopicAlias] = pub.Topic.Name
+	} else if name, ok := c.topicAliases[pub.TopicAlias]; ok {
+		pub.Topic.Name = name
+	} else {
+		log.Errorf("Received publish with unknown topic alias %d",
+			pub.TopicAlias)
+	}
+}
+
+// deliver decodes the payload and passes the publish packet to the
+// outstanding request or the subscriber channel matching the topic. If
+// copyPayloads is set, subscribers receive a copy of the payload such that
+// the packet buffer may be reused.
+func (c *Client) deliver(packet *packets.Publish) {
+	atomic.AddUint64(&c.stats.received, 1)
+	if c.payloadDecoder != nil {
+		payload, err := c.payloadDecoder(
+			packet.UserProperties, packet.Payload,
+		)
+		if err != nil {
+			atomic.AddUint64(&c.stats.dropped, 1)
+			log.Errorf("Failed to decode payload on %s, "+
+				"discarding message: %s", packet.Topic.Name, err)
+			return
+		}
+		packet.Payload = payload
+	}
+	if c.responses.Deliver(packet) {
+		// Response to an outstanding request.
+		return
+	}
+	msg := mqtt.Message{
+		Topic:   packet.Topic.Name,
+		Retain:  packet.Retain,
+		Payload: packet.Payload,
+	}
+	if packet.Retain && c.retained != nil {
+		c.retained.Set(msg)
+	}
+	if c.copyPayloads {
+		msg.Payload = make([]byte, len(packet.Payload))
+		copy(msg.Payload, packet.Payload)
+	}
+	if !c.paused.Deliver(msg, c.dispatch) {
+		atomic.AddUint64(&c.stats.dropped, 1)
+		log.Errorf("Pause queue is full, discarding payload on %s",
+			msg.Topic)
+		c.deadLetter(msg)
+	}
+}
+
+// dispatch passes the message to the subscriber channel matching the topic.
+func (c *Client) dispatch(msg mqtt.Message) {
+	sub := c.subs.Get(msg.Topic)
+	if sub == nil {
+		log.Warnf("Internal error: no subscriber "+
+			"chan for topic %s", msg.Topic)
+		c.deadLetter(msg)
+		return
+	}
+	if c.workers != nil {
+		c.deliverOrdered(sub, msg)
+		return
+	}
+	if !sub.TrySend(msg) {
+		atomic.AddUint64(&c.stats.dropped, 1)
+		log.Errorf("Subscriber channel %s is full or closed, "+
+			"discarding payload", msg.Topic)
+		c.deadLetter(msg)
+	}
+}
+
+// dispatchWait passes the message to the subscriber matching the topic like
+// dispatch, but waits for the subscriber to make room instead of dropping
+// the message.
+func (c *Client) dispatchWait(msg mqtt.Message) {
+	sub := c.subs.Get(msg.Topic)
+	if sub == nil {
+		log.Warnf("Internal error: no subscriber "+
+			"chan for topic %s", msg.Topic)
+		c.deadLetter(msg)
+		return
+	}
+	var ok bool
+	if c.workers != nil {
+		ok = c.worker(sub).PushWait(msg, c.done)
+	} else {
+		ok = sub.Send(msg, c.done)
+	}
+	if !ok {
+		atomic.AddUint64(&c.stats.dropped, 1)
+		log.Errorf("Subscriber channel %s is closed, "+
+			"discarding payload", msg.Topic)
+		c.deadLetter(msg)
+	}
+}
+
+// rejectPublish responds to an incoming QoS2 publish with a PUBREC carrying
+// the error reason code, discarding the message.
+func (c *Client) rejectPublish(packet *packets.Publish, code uint8) error {
+	err := c.io.Send(&packets.PubRec{
+		Version:          c.version,
+		PacketIdentifier: packet.PacketIdentifier,
+		ReasonCode:       code,
+	})
+	if err != nil {
+		log.Error(err)
+		c.reportError(err)
+	}
+	return err
+}
+
+// sessionLost is passed to the publishers waiting for an acknowledgement
+// that will never arrive since the server discarded the session.
+type sessionLost struct {
+	packets.Packet
+}
+
+// publishAcked passes the acknowledgement to the publisher waiting for it,
+// if any. Rejections without a waiting publisher are logged.
+func (c *Client) publishAcked(
+	packetID uint16, ack packets.Packet, reasonCode uint8,
+) {
+	if ackChan, ok := c.ackChan.Get(packetID); ok {
+		select {
+		case ackChan <- ack:
+		default:
+		}
+	} else if reasonCode >= packets.PubAckUnspecifiedError {
+		log.Errorf("Publish rejected by server: %s; packet id: %d",
+			publishAckError(ack), packetID)
+	}
+}
+
+// deadLetter passes a message that could not be delivered to the dead
+// letter channel, if configured, without blocking.
+func (c *Client) deadLetter(msg mqtt.Message) {
+	if c.deadLetters == nil {
+		return
+	}
+	select {
+	case c.deadLetters <- msg:
+	default:
+		log.Errorf("Dead letter channel is full, "+
+			"discarding message on %s", msg.Topic)
+	}
+}
+
+// deliverOrdered queues the message on the subscription's delivery worker,
+// starting the worker if it does not exist. The message is discarded if the
+// worker's queue is full.
+func (c *Client) deliverOrdered(sub *subscription, msg mqtt.Message) {
+	if !c.worker(sub).Push(msg) {
+		atomic.AddUint64(&c.stats.dropped, 1)
+		log.Errorf("Delivery queue of %s is full, discarding payload",
+			msg.Topic)
+		c.deadLetter(msg)
+	}
+}
+
+// worker returns the delivery worker of the subscription, starting one if
+// needed.
+func (c *Client) worker(sub *subscription) *deliveryWorker {
+	w, ok := c.workers[sub]
+	if !ok {
+		// Reap the workers of removed subscriptions.
+		for s, w := range c.workers {
+			if w.Stopped() {
+				delete(c.workers, s)
+			}
+		}
+		w = newDeliveryWorker(sub, c.done, c.deadLetter)
+		c.workers[sub] = w
+	}
+	return w
+}
+
+// keepAlive sends a ping request on conn every interval until done is
+// closed. If the server does not respond within the interval, the connection
+// is considered dead (e.g. half-open) and closed.
+func (c *Client) keepAlive(
+	conn *packets.PacketIO, interval time.Duration, done <-chan struct{},
+) {
+	for {
+		select {
+		case <-c.clock.After(interval):
+		case <-done:
+			return
+		}
+		err := conn.Send(&packets.PingReq{Version: c.version})
+		if err != nil {
+			c.reportError(err)
+			return
+		}
+		timeout := c.clock.NewTimer(interval)
+		select {
+		case <-c.pingResp:
+			timeout.Stop()
+		case <-timeout.C():
+			log.Error(ErrPingTimeout)
+			atomic.StoreUint32(&c.pingTimedOut, 1)
+			c.reportError(ErrPingTimeout)
+			conn.Close()
+			return
+		case <-done:
+			timeout.Stop()
+			return
+		}
+	}
+}
+
+// reportError passes err to the caller blocking on errChan without blocking.
+// If an error is already pending, the first error is kept and err is
+// discarded.
+func (c *Client) reportError(err error) {
+	select {
+	case c.errChan <- err:
+	default:
+	}
+}
+
+func (c *Client) recvRoutine() {
+	c.err = c.recvLoop()
+	if err := c.ctx.Err(); err != nil {
+		// The connection was closed by watchContext.
+		c.err = err
+	} else if atomic.LoadUint32(&c.pingTimedOut) != 0 {
+		c.err = ErrPingTimeout
+	}
+	close(c.done)
+}
+
+// watchContext closes the connection when the client's context is done,
+// returning once the receive routine of the connection terminates.
+func (c *Client) watchContext(
+	conn *packets.PacketIO, done <-chan struct{},
+) {
+	select {
+	case <-c.ctx.Done():
+		conn.Close()
+	case <-done:
+	}
+}
+
+func (c *Client) recvLoop() error {
+	var batch []packets.Packet
+	for {
+		var err error
+		batch, err = c.io.RecvBatch(batch[:0])
+		for _, packet := range batch {
+			if err := c.handlePacket(packet); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			// Release callers waiting for a response.
+			c.reportError(ErrServerClosed)
+			return ErrServerClosed
+		} else if err != nil {
+			log.Error(err)
+			c.reportError(err)
+			return err
+		}
+	}
+}
+
+// handlePacket processes a packet received from the server. A non-nil error
+// terminates the receive routine.
+func (c *Client) handlePacket(packet packets.Packet) error {
+	switch packet := packet.(type) {
+	case *packets.PingResp:
+		// Bypass to response channel; PINGRESPs nobody waits for are
+		// dropped rather than stalling the receive routine.
+		select {
+		case c.pingResp <- packet:
+		default:
+			log.Warn("Discarding unsolicited PINGRESP")
+		}
+	case *packets.ConnAck:
+		c.connAck <- packet
+	case *packets.SubAck, *packets.UnsubAck:
+		// Use generic reflection of the (dereferenced) value
+		pVal := reflect.ValueOf(packet).Elem()
+		// Extract packet ID.
+		id := pVal.FieldByName("PacketIdentifier")
+		packetID := id.Interface().(uint16)
+		// Verify that the channel is present
+		if c, ok := c.ackChan.Get(packetID); ok {
+			// Non-blocking send on channel
+			//  - May receive multiple copies.
+			select {
+			case c <- packet:
+			default:
 			}
-			err := c.io.Send(pubComp)
+		} else {
+			log.Errorf("Package lost: %s; packet id: %d",
+				pVal.Type().Name(), packetID,
+			)
+		}
+
+	case *packets.Publish:
+		if packet.TopicAlias > 0 {
+			c.resolveTopicAlias(packet)
+		}
+		var pubRecCode uint8
+		if packet.QoS == mqtt.QoS2 && c.version >= mqtt.MQTTv5 &&
+			c.qos2Validator != nil {
+			pubRecCode = c.qos2Validator(mqtt.Message{
+				Topic:   packet.Topic.Name,
+				Retain:  packet.Retain,
+				Payload: packet.Payload,
+			})
+			if pubRecCode >= packets.PubRecUnspecifiedError {
+				// The message is rejected and the flow ends
+				// with the PUBREC.
+				return c.rejectPublish(packet, pubRecCode)
+			}
+		}
+		c.deliver(packet)
+		switch packet.QoS {
+		case mqtt.QoS0:
+			// We're done here
+
+		case mqtt.QoS1:
+			// Send puback; no state is kept for the inbound flow.
+			pubAck := &packets.PubAck{
+				Version: c.version,
+				PacketIdentifier: packet.
+					PacketIdentifier,
+			}
+			err := c.io.Send(pubAck)
 			if err != nil {
 				log.Error(err)
-				c.errChan <- err
-				return
+				c.reportError(err)
 			}
 
-		case *packets.PubRec:
-			// Update pending packets and send PubRel
-			if ackChan, ok := c.ackChan.
-				Get(packet.PacketIdentifier); ok {
-				select {
-				case ackChan <- packet:
-				default:
-					log.Warn("Packet discarded: PUBREC")
-				}
-			} else {
-				log.Error("[internal] ACK chan not present")
-			}
-			pubRel := &packets.PubRel{
+		case mqtt.QoS2:
+			// Send PubRec and keep the inbound state until the
+			// release.
+			packetID := packet.PacketIdentifier
+			pubRec := &packets.PubRec{
 				Version:          c.version,
-				PacketIdentifier: packet.PacketIdentifier,
+				PacketIdentifier: packetID,
+				ReasonCode:       pubRecCode,
 			}
-			c.pendingPackets.Set(packet.PacketIdentifier, pubRel)
-			err := c.io.Send(pubRel)
+			err := c.io.Send(pubRec)
 			if err != nil {
 				log.Error(err)
-				c.errChan <- err
-				return
+				c.reportError(err)
+				return err
 			}
+			c.inboundQoS2.Set(packetID, pubRec)
+		}
 
-		default:
-			log.Error(ErrIllegalResponse)
-			c.errChan <- ErrIllegalResponse
-			return
+	case *packets.PubAck:
+		// Delete pending packet; publish completed
+		if _, ok := c.pendingPackets.Get(packet.PacketIdentifier); ok {
+			c.pendingPackets.Del(packet.PacketIdentifier)
+			c.quota.Release()
+		}
+		c.publishAcked(packet.PacketIdentifier, packet, packet.ReasonCode)
+
+	case *packets.PubComp:
+		// Delete pending packet; publish completed
+		if _, ok := c.pendingPackets.Get(packet.PacketIdentifier); ok {
+			c.pendingPackets.Del(packet.PacketIdentifier)
+			c.quota.Release()
+		}
+		if ackChan, ok := c.ackChan.
+			Get(packet.PacketIdentifier); ok {
+			select {
+			case ackChan <- packet:
+			default:
+				log.Warn("Packet discarded: PUBCOMP")
+			}
+		}
+
+	case *packets.PubRel:
+		// Discard the inbound state and send publish complete
+		c.inboundQoS2.Del(packet.PacketIdentifier)
+		pubComp := &packets.PubComp{
+			Version:          c.version,
+			PacketIdentifier: packet.PacketIdentifier,
+		}
+		err := c.io.Send(pubComp)
+		if err != nil {
+			log.Error(err)
+			c.reportError(err)
+			return err
 		}
+
+	case *packets.PubRec:
+		if packet.ReasonCode >= packets.PubRecUnspecifiedError {
+			// The server rejected the message; the flow ends
+			// without a PubRel.
+			if _, ok := c.pendingPackets.
+				Get(packet.PacketIdentifier); ok {
+				c.pendingPackets.Del(packet.PacketIdentifier)
+				c.quota.Release()
+			}
+			c.publishAcked(
+				packet.PacketIdentifier, packet, packet.ReasonCode,
+			)
+			break
+		}
+		// Update pending packets and send PubRel
+		pubRel := &packets.PubRel{
+			Version:          c.version,
+			PacketIdentifier: packet.PacketIdentifier,
+		}
+		c.pendingPackets.Set(packet.PacketIdentifier, pubRel)
+		err := c.io.Send(pubRel)
+		if err != nil {
+			log.Error(err)
+			c.reportError(err)
+			return err
+		}
+
+	case *packets.Disconnect:
+		// Server-initiated disconnect (MQTTv5)
+		err := &DisconnectError{
+			ReasonCode:   packet.ReasonCode,
+			ReasonString: packet.ReasonString,
+		}
+		log.Error(err)
+		c.reportError(err)
+		c.io.Close()
+		return err
+
+	default:
+		log.Error(ErrIllegalResponse)
+		c.reportError(ErrIllegalResponse)
+		return ErrIllegalResponse
 	}
+	return nil
 }
@@ -1,6 +1,15 @@
 package client
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
 	"testing"
 	"time"
 
@@ -78,7 +87,7 @@ func TestConnect(t *testing.T) {
 			connectErr: mqtt.ErrConnectBadVersion,
 			response: &packets.ConnAck{
 				ReturnCode: packets.ConnAckBadVersion,
-				Version:    mqtt.Version(250),
+				Version:    mqtt.MQTTv311,
 			},
 		},
 		{
@@ -195,6 +204,423 @@ func TestConnect(t *testing.T) {
 	}
 }
 
+func TestConnectWill(t *testing.T) {
+	connects := make(chan *packets.Connect, 1)
+	broker, conn := NewPipeBroker(mqtt.MQTTv311, func(
+		b *PipeBroker, p packets.Packet,
+	) {
+		if connect, ok := p.(*packets.Connect); ok {
+			connects <- connect
+			b.Send(&packets.ConnAck{Version: mqtt.MQTTv311})
+		}
+	})
+	defer broker.Close()
+	client := NewClient(conn)
+
+	connectOpts := NewConnectOptions()
+	connectOpts.SetWillTopic(mqtt.Topic{Name: "foo", QoS: 3}, false)
+	err := client.Connect(connectOpts)
+	assert.EqualError(t, err, mqtt.ErrIllegalQoS.Error())
+	select {
+	case <-connects:
+		t.Error("illegal connect sent to server")
+	default:
+	}
+
+	connectOpts.SetWillTopic(mqtt.Topic{Name: "foo", QoS: mqtt.QoS1}, true)
+	connectOpts.SetWillMessage([]byte("bar"))
+	err = client.Connect(connectOpts)
+	if assert.NoError(t, err) {
+		connect := <-connects
+		assert.Equal(t,
+			mqtt.Topic{Name: "foo", QoS: mqtt.QoS1}, connect.WillTopic)
+		assert.Equal(t, []byte("bar"), connect.WillMessage)
+		assert.True(t, connect.WillRetain)
+	}
+}
+
+func TestConnectV5(t *testing.T) {
+	testCases := []struct {
+		Name string
+
+		reasonCode uint8
+		connectErr error
+	}{{
+		Name:       "Success",
+		reasonCode: uint8(mqtt.ConnAckSuccess),
+	}, {
+		Name:       "Quota exceeded",
+		reasonCode: uint8(mqtt.ConnAckQuotaExceeded),
+		connectErr: mqtt.ErrQuotaExceeded,
+	}, {
+		Name:       "Bad credentials",
+		reasonCode: uint8(mqtt.ConnAckBadCredentials),
+		connectErr: mqtt.ErrConnectCredentials,
+	}, {
+		Name:       "Unknown reason code",
+		reasonCode: 0xF0,
+		connectErr: fmt.Errorf("connection refused: reason code 0xF0"),
+	}}
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			broker, conn := NewPipeBroker(mqtt.MQTTv5, func(
+				b *PipeBroker, p packets.Packet,
+			) {
+				if _, ok := p.(*packets.Connect); ok {
+					b.Send(&packets.ConnAck{
+						Version:    mqtt.MQTTv5,
+						ReturnCode: testCase.reasonCode,
+					})
+				}
+			})
+			defer broker.Close()
+			clientOpts := NewClientOptions()
+			clientOpts.SetVersion(mqtt.MQTTv5)
+			client := NewClient(conn, clientOpts)
+			err := client.Connect()
+			if testCase.connectErr == nil {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, testCase.connectErr.Error())
+			}
+		})
+	}
+}
+
+func TestSessionInfo(t *testing.T) {
+	maxQoS := mqtt.QoS1
+	serverKeepAlive := uint16(30)
+	broker, conn := NewPipeBroker(mqtt.MQTTv5, func(
+		b *PipeBroker, p packets.Packet,
+	) {
+		if _, ok := p.(*packets.Connect); ok {
+			b.Send(&packets.ConnAck{
+				Version:                mqtt.MQTTv5,
+				SessionPresent:         true,
+				ReceiveMax:             10,
+				MaxPacketSize:          1024,
+				TopicAliasMax:          5,
+				MaxQoS:                 &maxQoS,
+				RetainUnavailable:      true,
+				WildcardSubUnavailable: true,
+				ServerKeepAlive:        &serverKeepAlive,
+			})
+		}
+	})
+	defer broker.Close()
+	clientOpts := NewClientOptions()
+	clientOpts.SetVersion(mqtt.MQTTv5)
+	client := NewClient(conn, clientOpts)
+	connOpts := NewConnectOptions()
+	connOpts.SetKeepAlive(time.Minute)
+	err := client.Connect(connOpts)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, mqtt.SessionInfo{
+		SessionPresent:       true,
+		KeepAlive:            30,
+		ReceiveMax:           10,
+		MaxPacketSize:        1024,
+		TopicAliasMax:        5,
+		MaxQoS:               mqtt.QoS1,
+		RetainAvailable:      false,
+		WildcardSubAvailable: false,
+		SubIDAvailable:       true,
+		SharedSubAvailable:   true,
+	}, client.SessionInfo())
+}
+
+func TestSubscribeUnavailable(t *testing.T) {
+	subs := make(chan *packets.Subscribe, 1)
+	broker, conn := NewPipeBroker(mqtt.MQTTv5, func(
+		b *PipeBroker, p packets.Packet,
+	) {
+		switch p := p.(type) {
+		case *packets.Connect:
+			b.Send(&packets.ConnAck{
+				Version:                mqtt.MQTTv5,
+				WildcardSubUnavailable: true,
+				SharedSubUnavailable:   true,
+			})
+		case *packets.Subscribe:
+			subs <- p
+			b.Send(&packets.SubAck{
+				Version:          mqtt.MQTTv5,
+				PacketIdentifier: p.PacketIdentifier,
+				ReturnCodes:      []uint8{0},
+			})
+		}
+	})
+	defer broker.Close()
+	clientOpts := NewClientOptions()
+	clientOpts.SetVersion(mqtt.MQTTv5)
+	client := NewClient(conn, clientOpts)
+	err := client.Connect()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	messages := make(chan []byte, 1)
+	_, err = client.Subscribe(mqtt.Subscription{
+		Topic:    mqtt.Topic{Name: "foo/+"},
+		Messages: messages,
+	})
+	assert.EqualError(t, err, ErrWildcardSubUnavailable.Error())
+	_, err = client.Subscribe(mqtt.Subscription{
+		Topic:    mqtt.Topic{Name: "$share/group/foo"},
+		Messages: messages,
+	})
+	assert.EqualError(t, err, ErrSharedSubUnavailable.Error())
+	select {
+	case <-subs:
+		t.Error("refused subscription sent to server")
+	default:
+	}
+	assert.Empty(t, client.Subscriptions())
+
+	codes, err := client.Subscribe(mqtt.Subscription{
+		Topic:    mqtt.Topic{Name: "foo/bar"},
+		Messages: messages,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []uint8{0}, codes)
+}
+
+func TestMaxTopicsPerSubscribe(t *testing.T) {
+	subs := make(chan *packets.Subscribe, 10)
+	broker, conn := NewPipeBroker(mqtt.MQTTv311, func(
+		b *PipeBroker, p packets.Packet,
+	) {
+		if sub, ok := p.(*packets.Subscribe); ok {
+			subs <- sub
+			codes := make([]uint8, len(sub.Topics))
+			for i, topic := range sub.Topics {
+				codes[i] = uint8(topic.QoS)
+			}
+			b.Send(&packets.SubAck{
+				Version:          mqtt.MQTTv311,
+				PacketIdentifier: sub.PacketIdentifier,
+				ReturnCodes:      codes,
+			})
+		}
+	})
+	defer broker.Close()
+	opts := NewClientOptions()
+	opts.SetMaxTopicsPerSubscribe(4)
+	client := NewClient(conn, opts)
+
+	filters := make(map[string]mqtt.QoS)
+	expected := make(map[string]mqtt.SubAckCode)
+	for i := 0; i < 10; i++ {
+		qos := mqtt.QoS(i % 3)
+		filters[fmt.Sprintf("foo/%d", i)] = qos
+		expected[fmt.Sprintf("foo/%d", i)] = mqtt.SubAckCode(qos)
+	}
+	codes, err := client.SubscribeMap(filters, func(mqtt.Message) {})
+	assert.NoError(t, err)
+	assert.Equal(t, expected, codes)
+	assert.Len(t, client.Subscriptions(), 10)
+
+	ids := make(map[uint16]bool)
+	var sizes []int
+	for len(subs) > 0 {
+		sub := <-subs
+		ids[sub.PacketIdentifier] = true
+		sizes = append(sizes, len(sub.Topics))
+	}
+	assert.ElementsMatch(t, []int{4, 4, 2}, sizes)
+	assert.Len(t, ids, 3)
+}
+
+func TestSubscribeReturnCodeCount(t *testing.T) {
+	broker, conn := NewPipeBroker(mqtt.MQTTv311, func(
+		b *PipeBroker, p packets.Packet,
+	) {
+		if p, ok := p.(*packets.Subscribe); ok {
+			// One return code for two topics.
+			b.Send(&packets.SubAck{
+				Version:          mqtt.MQTTv311,
+				PacketIdentifier: p.PacketIdentifier,
+				ReturnCodes:      []uint8{0},
+			})
+		}
+	})
+	defer broker.Close()
+	client := NewClient(conn)
+	_, err := client.Subscribe(
+		mqtt.Subscription{
+			Topic:    mqtt.Topic{Name: "foo"},
+			Messages: make(chan []byte, 1),
+		},
+		mqtt.Subscription{
+			Topic:    mqtt.Topic{Name: "bar"},
+			Messages: make(chan []byte, 1),
+		},
+	)
+	assert.True(t, errors.Is(err, ErrIllegalResponse), err)
+	assert.Empty(t, client.Subscriptions())
+
+	// Internal subscriptions (e.g. resubscribing) validate the count too.
+	_, err = client.subscribe([]mqtt.Topic{{Name: "foo"}, {Name: "bar"}})
+	assert.True(t, errors.Is(err, ErrIllegalResponse), err)
+}
+
+func TestSubscribeReturnCodeCountV5(t *testing.T) {
+	broker, conn := NewPipeBroker(mqtt.MQTTv5, func(
+		b *PipeBroker, p packets.Packet,
+	) {
+		if p, ok := p.(*packets.Subscribe); ok {
+			// A v5 SUBACK as sent by a broker: the property block
+			// precedes the return codes.
+			b.Conn.Write([]byte{
+				0x90, 5,
+				byte(p.PacketIdentifier >> 8),
+				byte(p.PacketIdentifier),
+				0, 1, 0,
+			})
+		}
+	})
+	defer broker.Close()
+	clientOpts := NewClientOptions()
+	clientOpts.SetVersion(mqtt.MQTTv5)
+	client := NewClient(conn, clientOpts)
+	codes, err := client.Subscribe(
+		mqtt.Subscription{
+			Topic:    mqtt.Topic{Name: "foo", QoS: mqtt.QoS1},
+			Messages: make(chan []byte, 1),
+		},
+		mqtt.Subscription{
+			Topic:    mqtt.Topic{Name: "bar"},
+			Messages: make(chan []byte, 1),
+		},
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint8{1, 0}, codes)
+	assert.Len(t, client.Subscriptions(), 2)
+}
+
+func TestSubscribeInvalidFilters(t *testing.T) {
+	subs := make(chan *packets.Subscribe, 1)
+	broker, conn := NewPipeBroker(mqtt.MQTTv311, func(
+		b *PipeBroker, p packets.Packet,
+	) {
+		if sub, ok := p.(*packets.Subscribe); ok {
+			subs <- sub
+			codes := make([]uint8, len(sub.Topics))
+			for i, topic := range sub.Topics {
+				codes[i] = uint8(topic.QoS)
+			}
+			b.Send(&packets.SubAck{
+				Version:          mqtt.MQTTv311,
+				PacketIdentifier: sub.PacketIdentifier,
+				ReturnCodes:      codes,
+			})
+		}
+	})
+	defer broker.Close()
+	client := NewClient(conn)
+
+	msgs := make(chan []byte)
+	topics := []mqtt.Subscription{
+		{Topic: mqtt.Topic{Name: "foo/+", QoS: mqtt.QoS1}},
+		{Topic: mqtt.Topic{Name: "foo/#/bar"}},
+		{Topic: mqtt.Topic{Name: "bar/#", QoS: mqtt.QoS2}},
+		{Topic: mqtt.Topic{Name: "baz+"}},
+	}
+	for i := range topics {
+		topics[i].Messages = msgs
+	}
+	_, err := client.Subscribe(topics...)
+	assert.True(t, errors.Is(err, mqtt.ErrInvalidTopicFilter))
+	assert.Equal(t, &TopicFilterError{
+		Filters: []string{"foo/#/bar", "baz+"},
+	}, err)
+	assert.Empty(t, subs)
+	assert.Empty(t, client.Subscriptions())
+
+	client.skipInvalidFilters = true
+	codes, err := client.Subscribe(topics...)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint8{1, packets.SubAckFailure, 2,
+		packets.SubAckFailure}, codes)
+	if assert.Len(t, subs, 1) {
+		assert.Equal(t, []mqtt.Topic{
+			{Name: "foo/+", QoS: mqtt.QoS1},
+			{Name: "bar/#", QoS: mqtt.QoS2},
+		}, (<-subs).Topics)
+	}
+}
+
+func TestVersionFallback(t *testing.T) {
+	connects := make(chan *packets.Connect, 2)
+	// The broker closes the connection after refusing the version, as
+	// required by the specification.
+	handler := func(b *PipeBroker, p packets.Packet) {
+		switch p := p.(type) {
+		case *packets.Connect:
+			connects <- p
+			if p.Version != mqtt.MQTTv311 {
+				b.Send(&packets.ConnAck{
+					Version:    mqtt.MQTTv311,
+					ReturnCode: packets.ConnAckBadVersion,
+				})
+				b.Close()
+				return
+			}
+			b.Send(&packets.ConnAck{Version: mqtt.MQTTv311})
+		case *packets.PingReq:
+			b.Send(&packets.PingResp{Version: mqtt.MQTTv311})
+		}
+	}
+	broker, conn := NewPipeBroker(mqtt.MQTTv311, handler)
+	defer broker.Close()
+	var dials int
+	dial := func() (net.Conn, error) {
+		dials++
+		var conn net.Conn
+		broker, conn = NewPipeBroker(mqtt.MQTTv311, handler)
+		return conn, nil
+	}
+	clientOpts := NewClientOptions()
+	clientOpts.SetVersion(mqtt.MQTTv5)
+	clientOpts.SetVersionFallback([]mqtt.Version{mqtt.MQTTv311})
+	clientOpts.SetVersionFallbackDial(dial)
+	client := NewClient(conn, clientOpts)
+	err := client.Connect()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, mqtt.MQTTv5, (<-connects).Version)
+	assert.Equal(t, mqtt.MQTTv311, (<-connects).Version)
+	assert.Equal(t, 1, dials)
+	assert.Equal(t, mqtt.MQTTv311, client.version)
+	assert.NoError(t, client.Ping())
+	broker.Close()
+
+	// Without fallback the refusal is returned.
+	broker, conn = NewPipeBroker(mqtt.MQTTv311, handler)
+	defer broker.Close()
+	clientOpts = NewClientOptions()
+	clientOpts.SetVersion(mqtt.MQTTv5)
+	client = NewClient(conn, clientOpts)
+	err = client.Connect()
+	assert.EqualError(t, err, mqtt.ErrConnectBadVersion.Error())
+	<-connects
+
+	// Fallback versions without a dial function are not retried on the
+	// closed connection.
+	broker, conn = NewPipeBroker(mqtt.MQTTv311, handler)
+	defer broker.Close()
+	clientOpts = NewClientOptions()
+	clientOpts.SetVersion(mqtt.MQTTv5)
+	clientOpts.SetVersionFallback([]mqtt.Version{mqtt.MQTTv311})
+	client = NewClient(conn, clientOpts)
+	err = client.Connect()
+	assert.EqualError(t, err, ErrNoFallbackDial.Error())
+	assert.Equal(t, mqtt.MQTTv5, (<-connects).Version)
+	assert.Len(t, connects, 0)
+}
+
 func TestDisconnect(t *testing.T) {
 	testCases := []struct {
 		Name string
@@ -234,6 +660,77 @@ func TestDisconnect(t *testing.T) {
 	}
 }
 
+func TestSessionExpiry(t *testing.T) {
+	received := make(chan packets.Packet, 2)
+	broker, conn := NewPipeBroker(mqtt.MQTTv5, func(
+		b *PipeBroker, p packets.Packet,
+	) {
+		received <- p
+		if _, ok := p.(*packets.Connect); ok {
+			b.Send(&packets.ConnAck{Version: mqtt.MQTTv5})
+		}
+	})
+	defer broker.Close()
+	clientOpts := NewClientOptions()
+	clientOpts.SetVersion(mqtt.MQTTv5)
+	client := NewClient(conn, clientOpts)
+
+	connectOpts := NewConnectOptions()
+	connectOpts.SetSessionExpiryInterval(time.Hour)
+	err := client.Connect(connectOpts)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	if connect, ok := (<-received).(*packets.Connect); assert.True(t, ok) {
+		assert.Equal(t, uint32(3600), connect.SessionExpiryInterval)
+	}
+
+	disconnectOpts := NewDisconnectOptions()
+	disconnectOpts.SetSessionExpiryInterval(0)
+	err = client.Disconnect(disconnectOpts)
+	assert.NoError(t, err)
+	<-broker.Done
+	dc, ok := (<-received).(*packets.Disconnect)
+	if assert.True(t, ok) && assert.NotNil(t, dc.SessionExpiryInterval) {
+		assert.Zero(t, *dc.SessionExpiryInterval)
+	}
+}
+
+func TestDisconnectWithWill(t *testing.T) {
+	received := make(chan packets.Packet, 2)
+	broker, conn := NewPipeBroker(mqtt.MQTTv5, func(
+		b *PipeBroker, p packets.Packet,
+	) {
+		received <- p
+		if _, ok := p.(*packets.Connect); ok {
+			b.Send(&packets.ConnAck{Version: mqtt.MQTTv5})
+		}
+	})
+	defer broker.Close()
+	clientOpts := NewClientOptions()
+	clientOpts.SetVersion(mqtt.MQTTv5)
+	client := NewClient(conn, clientOpts)
+	connectOpts := NewConnectOptions()
+	connectOpts.SetWillTopic(mqtt.Topic{Name: "foo/will"}, false)
+	connectOpts.SetWillMessage([]byte("bye"))
+	err := client.Connect(connectOpts)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	<-received
+
+	err = client.DisconnectWithWill()
+	assert.NoError(t, err)
+	<-broker.Done
+	if dc, ok := (<-received).(*packets.Disconnect); assert.True(t, ok) {
+		assert.Equal(t, packets.DisconnectWithWill, dc.ReasonCode)
+	}
+
+	// The reason code requires MQTTv5.
+	client = NewClient(NewFakeConn(1))
+	assert.Equal(t, ErrRequiresMQTTv5, client.DisconnectWithWill())
+}
+
 func TestPing(t *testing.T) {
 	testCases := []struct {
 		Name string
@@ -404,6 +901,13 @@ func TestPublish(t *testing.T) {
 				}
 				b, _ := pubRec.MarshalBinary()
 				conn.ReadChan <- b
+				pubComp := &packets.PubComp{
+					Version: testCase.Version,
+					PacketIdentifier: uint16(
+						client.packetIDCounter + 1),
+				}
+				b, _ = pubComp.MarshalBinary()
+				conn.ReadChan <- b
 
 				if testCase.ReadErr != nil {
 					conn.On("Read", mock.Anything).
@@ -411,7 +915,7 @@ func TestPublish(t *testing.T) {
 				} else {
 					conn.On("Read", mock.Anything).
 						Return(0, nil).
-						Times(6)
+						Times(9)
 				}
 				if testCase.WriteErr != nil {
 					conn.On("Write", mock.Anything).
@@ -588,9 +1092,9 @@ func TestSubscribe(t *testing.T) {
 					t.FailNow()
 				}
 				conn.ReadChan <- b
-				if c := client.subs.Get(
+				if sub := client.subs.Get(
 					pub.Topic.Name,
-				); c != nil && cap(c) > 0 {
+				); sub != nil && cap(sub.c) > 0 {
 					<-subChan
 				}
 				if pub.QoS > mqtt.QoS0 {
@@ -624,3 +1128,2392 @@ func TestSubscribe(t *testing.T) {
 		})
 	}
 }
+
+func TestSubscribePublishOrder(t *testing.T) {
+	received := make(chan string, 16)
+	broker, conn := NewPipeBroker(mqtt.MQTTv311, func(
+		b *PipeBroker, p packets.Packet,
+	) {
+		switch p := p.(type) {
+		case *packets.Subscribe:
+			received <- "SUBSCRIBE " + p.Topics[0].Name
+			b.Send(&packets.SubAck{
+				Version:          mqtt.MQTTv311,
+				PacketIdentifier: p.PacketIdentifier,
+				ReturnCodes:      []uint8{0},
+			})
+		case *packets.Publish:
+			received <- "PUBLISH " + p.Topic.Name
+		}
+	})
+	defer broker.Close()
+	client := NewClient(conn)
+
+	msgs := make(chan []byte, 1)
+	var expected []string
+	for _, name := range []string{"foo", "bar", "baz"} {
+		_, err := client.Subscribe(mqtt.Subscription{
+			Topic:    mqtt.Topic{Name: name},
+			Messages: msgs,
+		})
+		assert.NoError(t, err)
+		err = client.Publish(mqtt.Topic{Name: name}, []byte("first"))
+		assert.NoError(t, err)
+		// The asynchronous request is written before returning.
+		_, result, err := client.SubscribeAsync(mqtt.Subscription{
+			Topic:    mqtt.Topic{Name: name + "/async"},
+			Messages: msgs,
+		})
+		assert.NoError(t, err)
+		err = client.Publish(mqtt.Topic{Name: name}, []byte("second"))
+		assert.NoError(t, err)
+		assert.NoError(t, (<-result).Err)
+		expected = append(expected,
+			"SUBSCRIBE "+name,
+			"PUBLISH "+name,
+			"SUBSCRIBE "+name+"/async",
+			"PUBLISH "+name,
+		)
+	}
+	for i, exp := range expected {
+		select {
+		case pkt := <-received:
+			assert.Equal(t, exp, pkt, "packet %d", i)
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for packet %d", i)
+		}
+	}
+}
+
+func TestResubscribe(t *testing.T) {
+	subs := make(chan *packets.Subscribe, 2)
+	broker, conn := NewPipeBroker(mqtt.MQTTv311, func(
+		b *PipeBroker, p packets.Packet,
+	) {
+		if sub, ok := p.(*packets.Subscribe); ok {
+			subs <- sub
+			b.Send(&packets.SubAck{
+				Version:          mqtt.MQTTv311,
+				PacketIdentifier: sub.PacketIdentifier,
+				ReturnCodes:      []uint8{uint8(sub.Topics[0].QoS)},
+			})
+		}
+	})
+	defer broker.Close()
+	client := NewClient(conn)
+
+	_, err := client.Resubscribe("foo/bar", mqtt.QoS2)
+	assert.EqualError(t, err, ErrNotSubscribed.Error())
+
+	_, err = client.Subscribe(mqtt.Subscription{
+		Topic:    mqtt.Topic{Name: "foo/bar", QoS: mqtt.QoS1},
+		Messages: make(chan []byte),
+	})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	<-subs
+	codes, err := client.Resubscribe("foo/bar", mqtt.QoS2)
+	assert.NoError(t, err)
+	assert.Equal(t, []mqtt.SubAckCode{mqtt.SubAckGrantedQoS2}, codes)
+	assert.Equal(t, []mqtt.Topic{
+		{Name: "foo/bar", QoS: mqtt.QoS2},
+	}, (<-subs).Topics)
+	assert.Equal(t, []mqtt.Topic{
+		{Name: "foo/bar", QoS: mqtt.QoS2},
+	}, client.Subscriptions())
+
+	// The filter is validated without sending a request.
+	_, err = client.Resubscribe("foo/#/bar", mqtt.QoS1)
+	assert.True(t, errors.Is(err, mqtt.ErrInvalidTopicFilter))
+	client.session.WildcardSubAvailable = false
+	_, err = client.Resubscribe("foo/+", mqtt.QoS1)
+	assert.Equal(t, ErrWildcardSubUnavailable, err)
+	assert.Len(t, subs, 0)
+}
+
+func TestRequest(t *testing.T) {
+	var subscribed, unsubscribed bool
+	broker, conn := NewPipeBroker(mqtt.MQTTv5, func(
+		b *PipeBroker, p packets.Packet,
+	) {
+		switch p := p.(type) {
+		case *packets.Subscribe:
+			subscribed = true
+			codes := make([]uint8, len(p.Topics))
+			b.Send(&packets.SubAck{
+				Version:          mqtt.MQTTv5,
+				PacketIdentifier: p.PacketIdentifier,
+				ReturnCodes:      codes,
+			})
+		case *packets.Publish:
+			// Uncorrelated response, should be ignored
+			b.Send(&packets.Publish{
+				Version:         mqtt.MQTTv5,
+				Topic:           mqtt.Topic{Name: p.ResponseTopic},
+				CorrelationData: []byte("bogus"),
+				Payload:         []byte("wrong"),
+			})
+			// Echo request on the response topic
+			b.Send(&packets.Publish{
+				Version:         mqtt.MQTTv5,
+				Topic:           mqtt.Topic{Name: p.ResponseTopic},
+				CorrelationData: p.CorrelationData,
+				Payload:         append([]byte("re: "), p.Payload...),
+			})
+		case *packets.Unsubscribe:
+			unsubscribed = true
+			b.Send(&packets.UnsubAck{
+				Version:          mqtt.MQTTv5,
+				PacketIdentifier: p.PacketIdentifier,
+				ReasonCodes: []uint8{
+					packets.UnsubAckSuccess,
+				},
+			})
+		case *packets.PingReq:
+			b.Send(&packets.PingResp{Version: mqtt.MQTTv5})
+		}
+	})
+	defer broker.Close()
+
+	clientOpts := NewClientOptions()
+	clientOpts.SetVersion(mqtt.MQTTv5)
+	client := NewClient(conn, clientOpts)
+	rsp, err := client.Request(
+		mqtt.Topic{Name: "service/echo"}, []byte("ping"), time.Second,
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("re: ping"), rsp)
+	assert.True(t, subscribed)
+	assert.True(t, unsubscribed)
+	// The UNSUBACK is decoded without breaking the connection.
+	assert.NoError(t, client.Ping())
+
+	// Requests require MQTTv5
+	client = NewClient(NewFakeConn(1))
+	_, err = client.Request(
+		mqtt.Topic{Name: "service/echo"}, []byte("ping"), time.Second,
+	)
+	assert.EqualError(t, err, ErrRequiresMQTTv5.Error())
+}
+
+func TestRequestResponseInfo(t *testing.T) {
+	connects := make(chan *packets.Connect, 1)
+	responseTopics := make(chan string, 1)
+	broker, conn := NewPipeBroker(mqtt.MQTTv5, func(
+		b *PipeBroker, p packets.Packet,
+	) {
+		switch p := p.(type) {
+		case *packets.Connect:
+			connects <- p
+			b.Send(&packets.ConnAck{
+				Version:      mqtt.MQTTv5,
+				ResponseInfo: "rsp/abc",
+			})
+		case *packets.Subscribe:
+			b.Send(&packets.SubAck{
+				Version:          mqtt.MQTTv5,
+				PacketIdentifier: p.PacketIdentifier,
+				ReturnCodes:      []uint8{0},
+			})
+		case *packets.Publish:
+			responseTopics <- p.ResponseTopic
+			b.Send(&packets.Publish{
+				Version:         mqtt.MQTTv5,
+				Topic:           mqtt.Topic{Name: p.ResponseTopic},
+				CorrelationData: p.CorrelationData,
+				Payload:         []byte("pong"),
+			})
+		case *packets.Unsubscribe:
+			b.Send(&packets.UnsubAck{
+				Version:          mqtt.MQTTv5,
+				PacketIdentifier: p.PacketIdentifier,
+				ReasonCodes: []uint8{
+					packets.UnsubAckSuccess,
+				},
+			})
+		}
+	})
+	defer broker.Close()
+
+	clientOpts := NewClientOptions()
+	clientOpts.SetVersion(mqtt.MQTTv5)
+	client := NewClient(conn, clientOpts)
+	connOpts := NewConnectOptions()
+	connOpts.SetRequestResponseInfo(true)
+	err := client.Connect(connOpts)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.True(t, (<-connects).RequestResponseInfo)
+	assert.Equal(t, "rsp/abc", client.SessionInfo().ResponseInfo)
+
+	rsp, err := client.Request(
+		mqtt.Topic{Name: "service/echo"}, []byte("ping"), time.Second,
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("pong"), rsp)
+	assert.True(t, strings.HasPrefix(<-responseTopics, "rsp/abc/"))
+}
+
+func TestClientContext(t *testing.T) {
+	broker, conn := NewPipeBroker(mqtt.MQTTv311, func(
+		b *PipeBroker, p packets.Packet,
+	) {
+		if _, ok := p.(*packets.PingReq); ok {
+			b.Send(&packets.PingResp{Version: mqtt.MQTTv311})
+		}
+	})
+	defer broker.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	client := NewClientContext(ctx, conn)
+	assert.NoError(t, client.Ping())
+
+	cancel()
+	select {
+	case <-client.Done():
+	case <-time.After(time.Second):
+		t.Fatal("receive routine not stopped")
+	}
+	assert.Equal(t, context.Canceled, client.Err())
+	// The transport is closed.
+	select {
+	case <-broker.Done:
+	case <-time.After(time.Second):
+		t.Fatal("connection not closed")
+	}
+}
+
+func TestServerDisconnect(t *testing.T) {
+	broker, conn := NewPipeBroker(mqtt.MQTTv5, func(
+		b *PipeBroker, p packets.Packet,
+	) {
+	})
+	defer broker.Close()
+	clientOpts := NewClientOptions()
+	clientOpts.SetVersion(mqtt.MQTTv5)
+	client := NewClient(conn, clientOpts)
+	assert.NoError(t, client.Err())
+
+	err := broker.Send(&packets.Disconnect{
+		Version:    mqtt.MQTTv5,
+		ReasonCode: packets.DisconnectSessionTakenOver,
+	})
+	assert.NoError(t, err)
+	select {
+	case <-client.Done():
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for client to terminate")
+	}
+	if assert.IsType(t, &DisconnectError{}, client.Err()) {
+		err := client.Err().(*DisconnectError)
+		assert.Equal(t, packets.DisconnectSessionTakenOver,
+			err.ReasonCode)
+	}
+	// The error is also passed to blocking calls
+	err = client.Ping()
+	assert.Error(t, err)
+}
+
+func TestTopicAlias(t *testing.T) {
+	broker, conn := NewPipeBroker(mqtt.MQTTv5, func(
+		b *PipeBroker, p packets.Packet,
+	) {
+		if sub, ok := p.(*packets.Subscribe); ok {
+			b.Send(&packets.SubAck{
+				Version:          mqtt.MQTTv5,
+				PacketIdentifier: sub.PacketIdentifier,
+				ReturnCodes:      []uint8{0},
+			})
+		}
+	})
+	defer broker.Close()
+	clientOpts := NewClientOptions()
+	clientOpts.SetVersion(mqtt.MQTTv5)
+	client := NewClient(conn, clientOpts)
+
+	msgs := make(chan []byte, 2)
+	_, err := client.Subscribe(mqtt.Subscription{
+		Topic:    mqtt.Topic{Name: "foo/bar"},
+		Messages: msgs,
+	})
+	assert.NoError(t, err)
+
+	// Establish alias
+	err = broker.Send(&packets.Publish{
+		Version:    mqtt.MQTTv5,
+		Topic:      mqtt.Topic{Name: "foo/bar"},
+		TopicAlias: 3,
+		Payload:    []byte("first"),
+	})
+	assert.NoError(t, err)
+	// Publish using alias only
+	err = broker.Send(&packets.Publish{
+		Version:    mqtt.MQTTv5,
+		TopicAlias: 3,
+		Payload:    []byte("second"),
+	})
+	assert.NoError(t, err)
+	for _, expected := range []string{"first", "second"} {
+		select {
+		case msg := <-msgs:
+			assert.Equal(t, expected, string(msg))
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for message")
+		}
+	}
+}
+
+func TestOrderedDelivery(t *testing.T) {
+	broker, conn := NewPipeBroker(mqtt.MQTTv311, func(
+		b *PipeBroker, p packets.Packet,
+	) {
+		if sub, ok := p.(*packets.Subscribe); ok {
+			b.Send(&packets.SubAck{
+				Version:          mqtt.MQTTv311,
+				PacketIdentifier: sub.PacketIdentifier,
+				ReturnCodes:      []uint8{1},
+			})
+		}
+	})
+	defer broker.Close()
+	clientOpts := NewClientOptions()
+	clientOpts.SetOrderedDelivery(true)
+	client := NewClient(conn, clientOpts)
+
+	// Unbuffered channel; all messages must be queued by the worker.
+	msgs := make(chan []byte)
+	_, err := client.Subscribe(mqtt.Subscription{
+		Topic:    mqtt.Topic{Name: "foo/bar", QoS: mqtt.QoS1},
+		Messages: msgs,
+	})
+	assert.NoError(t, err)
+
+	const numMsgs = 20
+	for i := 0; i < numMsgs; i++ {
+		pub := &packets.Publish{
+			Version: mqtt.MQTTv311,
+			Topic:   mqtt.Topic{Name: "foo/bar"},
+			Payload: []byte{byte(i)},
+		}
+		if i%2 == 1 {
+			pub.Topic.QoS = mqtt.QoS1
+			pub.PacketIdentifier = uint16(i)
+		}
+		err = broker.Send(pub)
+		assert.NoError(t, err)
+	}
+	for i := 0; i < numMsgs; i++ {
+		select {
+		case msg := <-msgs:
+			assert.Equal(t, []byte{byte(i)}, msg)
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for message")
+		}
+	}
+}
+
+func TestOrderedDeliveryWorkers(t *testing.T) {
+	broker, conn := NewPipeBroker(mqtt.MQTTv311, func(
+		b *PipeBroker, p packets.Packet,
+	) {
+		switch p := p.(type) {
+		case *packets.Subscribe:
+			b.Send(&packets.SubAck{
+				Version:          mqtt.MQTTv311,
+				PacketIdentifier: p.PacketIdentifier,
+				ReturnCodes:      []uint8{0},
+			})
+		case *packets.Unsubscribe:
+			b.Send(&packets.UnsubAck{
+				Version:          mqtt.MQTTv311,
+				PacketIdentifier: p.PacketIdentifier,
+			})
+		case *packets.PingReq:
+			b.Send(&packets.PingResp{Version: mqtt.MQTTv311})
+		}
+	})
+	defer broker.Close()
+	clientOpts := NewClientOptions()
+	clientOpts.SetOrderedDelivery(true)
+	client := NewClient(conn, clientOpts)
+
+	msgs := make(chan []byte, 100)
+	_, err := client.Subscribe(mqtt.Subscription{
+		Topic:    mqtt.Topic{Name: "sensors/#"},
+		Messages: msgs,
+	})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	for i := 0; i < 100; i++ {
+		assert.NoError(t, broker.Send(&packets.Publish{
+			Version: mqtt.MQTTv311,
+			Topic:   mqtt.Topic{Name: fmt.Sprintf("sensors/%d", i)},
+			Payload: []byte{byte(i)},
+		}))
+	}
+	assert.NoError(t, client.Ping())
+	// A single worker delivers the messages on all topics in order.
+	assert.Len(t, client.workers, 1)
+	for i := 0; i < 100; i++ {
+		assert.Equal(t, []byte{byte(i)}, <-msgs)
+	}
+
+	// The worker of a removed subscription is reaped.
+	assert.NoError(t, client.Unsubscribe("sensors/#"))
+	_, err = client.Subscribe(mqtt.Subscription{
+		Topic:    mqtt.Topic{Name: "sensors/+"},
+		Messages: msgs,
+	})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.NoError(t, broker.Send(&packets.Publish{
+		Version: mqtt.MQTTv311,
+		Topic:   mqtt.Topic{Name: "sensors/1"},
+		Payload: []byte("new"),
+	}))
+	assert.Equal(t, []byte("new"), <-msgs)
+	assert.Len(t, client.workers, 1)
+}
+
+func TestDeliveryWorkerQueueBound(t *testing.T) {
+	done := make(chan struct{})
+	defer close(done)
+	// Nobody receives; the worker blocks on the first message.
+	sub := newSubscription(mqtt.QoS0, make(chan []byte))
+	w := newDeliveryWorker(sub, done, func(mqtt.Message) {})
+	var pushed int
+	for w.Push(mqtt.Message{Topic: "foo"}) {
+		pushed++
+		if pushed > 2*workerQueueSize {
+			t.Fatal("queue not bounded")
+		}
+	}
+	assert.True(t, pushed >= workerQueueSize)
+
+	// Closing the subscription stops the worker.
+	assert.False(t, w.Stopped())
+	sub.Close(false)
+	assert.True(t, w.Stopped())
+}
+
+func TestSubscriptions(t *testing.T) {
+	broker, conn := NewPipeBroker(mqtt.MQTTv311, func(
+		b *PipeBroker, p packets.Packet,
+	) {
+		switch p := p.(type) {
+		case *packets.Subscribe:
+			// Grant at most QoS1
+			codes := make([]uint8, len(p.Topics))
+			for i, topic := range p.Topics {
+				codes[i] = uint8(topic.QoS)
+				if codes[i] > 1 {
+					codes[i] = 1
+				}
+			}
+			b.Send(&packets.SubAck{
+				Version:          mqtt.MQTTv311,
+				PacketIdentifier: p.PacketIdentifier,
+				ReturnCodes:      codes,
+			})
+		case *packets.Unsubscribe:
+			b.Send(&packets.UnsubAck{
+				Version:          mqtt.MQTTv311,
+				PacketIdentifier: p.PacketIdentifier,
+			})
+		}
+	})
+	defer broker.Close()
+	client := NewClient(conn)
+	assert.Empty(t, client.Subscriptions())
+
+	msgs := make(chan []byte, 1)
+	_, err := client.Subscribe(
+		mqtt.Subscription{
+			Topic:    mqtt.Topic{Name: "foo/bar", QoS: mqtt.QoS0},
+			Messages: msgs,
+		},
+		mqtt.Subscription{
+			Topic:    mqtt.Topic{Name: "foo/+/baz", QoS: mqtt.QoS1},
+			Messages: msgs,
+		},
+		mqtt.Subscription{
+			Topic:    mqtt.Topic{Name: "bar/#", QoS: mqtt.QoS2},
+			Messages: msgs,
+		},
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, []mqtt.Topic{
+		{Name: "bar/#", QoS: mqtt.QoS1},
+		{Name: "foo/+/baz", QoS: mqtt.QoS1},
+		{Name: "foo/bar", QoS: mqtt.QoS0},
+	}, client.Subscriptions())
+
+	err = client.Unsubscribe("foo/bar")
+	assert.NoError(t, err)
+	assert.Equal(t, []mqtt.Topic{
+		{Name: "bar/#", QoS: mqtt.QoS1},
+		{Name: "foo/+/baz", QoS: mqtt.QoS1},
+	}, client.Subscriptions())
+}
+
+func TestAquirePacketIDSkipsZero(t *testing.T) {
+	conn := NewFakeConn(1)
+	conn.On("Close").Return(nil)
+	client := NewClient(conn)
+	defer client.io.Close()
+
+	client.packetIDCounter = uint32(^uint16(0)) - 1
+	id, err := client.aquirePacketID()
+	assert.NoError(t, err)
+	assert.Equal(t, ^uint16(0), id)
+	id, err = client.aquirePacketID()
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(1), id)
+}
+
+func TestPacketIDAllocator(t *testing.T) {
+	pubIDs := make(chan uint16, 3)
+	broker, conn := NewPipeBroker(mqtt.MQTTv311, func(
+		b *PipeBroker, p packets.Packet,
+	) {
+		if pub, ok := p.(*packets.Publish); ok {
+			pubIDs <- pub.PacketIdentifier
+		}
+	})
+	defer broker.Close()
+	ids := []uint16{42, 7, 7}
+	clientOpts := NewClientOptions()
+	clientOpts.SetPacketIDAllocator(func() (uint16, error) {
+		if len(ids) == 0 {
+			return 0, ErrNoPacketIDs
+		}
+		id := ids[0]
+		ids = ids[1:]
+		return id, nil
+	})
+	client := NewClient(conn, clientOpts)
+
+	topic := mqtt.Topic{Name: "foo", QoS: mqtt.QoS1}
+	for _, expected := range []uint16{42, 7} {
+		err := client.Publish(topic, []byte("bar"))
+		assert.NoError(t, err)
+		select {
+		case id := <-pubIDs:
+			assert.Equal(t, expected, id)
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for publish")
+		}
+	}
+	// 7 is still awaiting acknowledgement.
+	err := client.Publish(topic, []byte("bar"))
+	assert.EqualError(t, err, ErrPacketIDInUse.Error())
+	err = client.Publish(topic, []byte("bar"))
+	assert.EqualError(t, err, ErrNoPacketIDs.Error())
+}
+
+func TestPacketIDsExhausted(t *testing.T) {
+	conn := NewFakeConn(1)
+	conn.On("Close").Return(nil)
+	client := NewClient(conn)
+	defer client.io.Close()
+
+	for id := 1; id <= int(^uint16(0)); id++ {
+		client.pendingPackets.Add(uint16(id), &packets.PubAck{})
+	}
+	_, err := client.Subscribe(mqtt.Subscription{
+		Topic:    mqtt.Topic{Name: "foo/bar"},
+		Messages: make(chan []byte),
+	})
+	assert.EqualError(t, err, ErrNoPacketIDs.Error())
+	err = client.Unsubscribe("foo/bar")
+	assert.EqualError(t, err, ErrNoPacketIDs.Error())
+	err = client.Publish(mqtt.Topic{Name: "foo/bar", QoS: mqtt.QoS1}, nil)
+	assert.EqualError(t, err, ErrNoPacketIDs.Error())
+}
+
+func TestMaxInflightControl(t *testing.T) {
+	subs := make(chan *packets.Subscribe, 2)
+	broker, conn := NewPipeBroker(mqtt.MQTTv311, func(
+		b *PipeBroker, p packets.Packet,
+	) {
+		if sub, ok := p.(*packets.Subscribe); ok {
+			subs <- sub
+		}
+	})
+	defer broker.Close()
+	clientOpts := NewClientOptions()
+	clientOpts.SetMaxInflightControl(1)
+	client := NewClient(conn, clientOpts)
+
+	errs := make(chan error, 2)
+	for _, topic := range []string{"foo", "bar"} {
+		go func(topic string) {
+			_, err := client.Subscribe(mqtt.Subscription{
+				Topic:    mqtt.Topic{Name: topic},
+				Messages: make(chan []byte),
+			})
+			errs <- err
+		}(topic)
+	}
+	for i := 0; i < 2; i++ {
+		var sub *packets.Subscribe
+		select {
+		case sub = <-subs:
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for subscribe")
+		}
+		// The second request must wait for the first to complete.
+		select {
+		case <-subs:
+			t.Fatal("too many in-flight subscribe requests")
+		case <-time.After(50 * time.Millisecond):
+		}
+		err := broker.Send(&packets.SubAck{
+			Version:          mqtt.MQTTv311,
+			PacketIdentifier: sub.PacketIdentifier,
+			ReturnCodes:      []uint8{0},
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, <-errs)
+	}
+}
+
+func TestCopyPayloads(t *testing.T) {
+	conn := NewFakeConn(1)
+	conn.On("Close").Return(nil)
+	clientOpts := NewClientOptions()
+	clientOpts.SetCopyPayloads(true)
+	client := NewClient(conn, clientOpts)
+	defer client.io.Close()
+
+	msgs := make(chan []byte, 1)
+	client.subs.Add("foo/bar", newSubscription(mqtt.QoS0, msgs))
+	pub := &packets.Publish{
+		Version: mqtt.MQTTv311,
+		Topic:   mqtt.Topic{Name: "foo/bar"},
+		Payload: []byte("baz"),
+	}
+	client.deliver(pub)
+	// Reusing the packet buffer must not corrupt the delivered message.
+	copy(pub.Payload, "xxx")
+	assert.Equal(t, []byte("baz"), <-msgs)
+}
+
+func TestUnsubscribeTimeout(t *testing.T) {
+	broker, conn := NewPipeBroker(mqtt.MQTTv311, func(
+		b *PipeBroker, p packets.Packet,
+	) {
+		// Never acknowledge
+	})
+	defer broker.Close()
+	clientOpts := NewClientOptions()
+	clientOpts.SetAckTimeout(50 * time.Millisecond)
+	client := NewClient(conn, clientOpts)
+
+	err := client.Unsubscribe("foo/bar")
+	assert.EqualError(t, err, mqtt.ErrUnsubscribeTimeout.Error())
+	// Ack channel and packet id are released
+	client.ackChan.mutex <- struct{}{}
+	assert.Empty(t, client.ackChan.chans)
+	<-client.ackChan.mutex
+	// The client is still functional
+	select {
+	case <-client.Done():
+		t.Error("client unexpectedly terminated")
+	default:
+	}
+}
+
+func TestAssignedClientID(t *testing.T) {
+	broker, conn := NewPipeBroker(mqtt.MQTTv5, func(
+		b *PipeBroker, p packets.Packet,
+	) {
+		if connect, ok := p.(*packets.Connect); ok {
+			assert.Empty(t, connect.ClientID)
+			b.Send(&packets.ConnAck{
+				Version:          mqtt.MQTTv5,
+				AssignedClientID: "server-assigned",
+			})
+		}
+	})
+	defer broker.Close()
+	clientOpts := NewClientOptions()
+	clientOpts.SetVersion(mqtt.MQTTv5)
+	clientOpts.SetClientID("")
+	client := NewClient(conn, clientOpts)
+	err := client.Connect()
+	assert.NoError(t, err)
+	assert.Equal(t, "server-assigned", client.ClientID)
+}
+
+func TestUnsubscribeFlush(t *testing.T) {
+	for _, closeChan := range []bool{false, true} {
+		broker, conn := NewPipeBroker(mqtt.MQTTv311, func(
+			b *PipeBroker, p packets.Packet,
+		) {
+			switch p := p.(type) {
+			case *packets.Subscribe:
+				codes := make([]uint8, len(p.Topics))
+				b.Send(&packets.SubAck{
+					Version:          mqtt.MQTTv311,
+					PacketIdentifier: p.PacketIdentifier,
+					ReturnCodes:      codes,
+				})
+			case *packets.Unsubscribe:
+				b.Send(&packets.UnsubAck{
+					Version:          mqtt.MQTTv311,
+					PacketIdentifier: p.PacketIdentifier,
+				})
+			case *packets.PingReq:
+				b.Send(&packets.PingResp{Version: mqtt.MQTTv311})
+			}
+		})
+		clientOpts := NewClientOptions()
+		clientOpts.SetCloseOnUnsubscribe(closeChan)
+		client := NewClient(conn, clientOpts)
+
+		msgs := make(chan []byte, 10)
+		_, err := client.Subscribe(mqtt.Subscription{
+			Topic:    mqtt.Topic{Name: "foo/bar"},
+			Messages: msgs,
+		})
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		pub := &packets.Publish{
+			Version: mqtt.MQTTv311,
+			Topic:   mqtt.Topic{Name: "foo/bar"},
+		}
+		for i := 0; i < 3; i++ {
+			pub.Payload = []byte(fmt.Sprintf("before %d", i))
+			assert.NoError(t, broker.Send(pub))
+		}
+		// Receiving the PINGRESP ensures the publishes are processed.
+		assert.NoError(t, client.Ping())
+
+		assert.NoError(t, client.Unsubscribe("foo/bar"))
+		for i := 0; i < 3; i++ {
+			pub.Payload = []byte(fmt.Sprintf("after %d", i))
+			assert.NoError(t, broker.Send(pub))
+		}
+		assert.NoError(t, client.Ping())
+
+		// Only the buffered messages from before the UNSUBACK remain.
+		for i := 0; i < 3; i++ {
+			assert.Equal(t,
+				[]byte(fmt.Sprintf("before %d", i)), <-msgs)
+		}
+		select {
+		case msg, ok := <-msgs:
+			if closeChan {
+				assert.False(t, ok, "channel not closed")
+			} else {
+				t.Errorf("unexpected message after unsubscribe: %s",
+					msg)
+			}
+		default:
+			assert.False(t, closeChan, "channel not closed")
+		}
+		broker.Close()
+	}
+}
+
+func TestCloseOnUnsubscribeSharedChannel(t *testing.T) {
+	broker, conn := NewPipeBroker(mqtt.MQTTv311, func(
+		b *PipeBroker, p packets.Packet,
+	) {
+		switch p := p.(type) {
+		case *packets.Subscribe:
+			b.Send(&packets.SubAck{
+				Version:          mqtt.MQTTv311,
+				PacketIdentifier: p.PacketIdentifier,
+				ReturnCodes:      make([]uint8, len(p.Topics)),
+			})
+		case *packets.Unsubscribe:
+			b.Send(&packets.UnsubAck{
+				Version:          mqtt.MQTTv311,
+				PacketIdentifier: p.PacketIdentifier,
+			})
+		case *packets.PingReq:
+			b.Send(&packets.PingResp{Version: mqtt.MQTTv311})
+		}
+	})
+	defer broker.Close()
+	clientOpts := NewClientOptions()
+	clientOpts.SetCloseOnUnsubscribe(true)
+	client := NewClient(conn, clientOpts)
+
+	msgs := make(chan []byte, 10)
+	_, err := client.Subscribe(mqtt.Subscription{
+		Topic:    mqtt.Topic{Name: "foo"},
+		Messages: msgs,
+	}, mqtt.Subscription{
+		Topic:    mqtt.Topic{Name: "bar"},
+		Messages: msgs,
+	})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	// The channel stays open while "bar" delivers to it.
+	assert.NoError(t, client.Unsubscribe("foo"))
+	assert.NoError(t, broker.Send(&packets.Publish{
+		Version: mqtt.MQTTv311,
+		Topic:   mqtt.Topic{Name: "bar"},
+		Payload: []byte("baz"),
+	}))
+	assert.NoError(t, client.Ping())
+	assert.Equal(t, []byte("baz"), <-msgs)
+
+	assert.NoError(t, client.Unsubscribe("bar"))
+	select {
+	case _, ok := <-msgs:
+		assert.False(t, ok, "unexpected message")
+	default:
+		t.Error("channel not closed")
+	}
+}
+
+func TestUnsubscribeInflightPublish(t *testing.T) {
+	pubAcks := make(chan *packets.PubAck, 1)
+	broker, conn := NewPipeBroker(mqtt.MQTTv311, func(
+		b *PipeBroker, p packets.Packet,
+	) {
+		switch p := p.(type) {
+		case *packets.Subscribe:
+			b.Send(&packets.SubAck{
+				Version:          mqtt.MQTTv311,
+				PacketIdentifier: p.PacketIdentifier,
+				ReturnCodes:      []uint8{1},
+			})
+		case *packets.Unsubscribe:
+			// The server publishes a message on the topic before
+			// processing the unsubscribe request. The pipe is
+			// synchronous; send without blocking the receipt of
+			// the PUBACK.
+			go func(packetID uint16) {
+				b.Send(&packets.Publish{
+					Version: mqtt.MQTTv311,
+					Topic: mqtt.Topic{
+						Name: "foo/bar", QoS: mqtt.QoS1,
+					},
+					PacketIdentifier: 1,
+					Payload:          []byte("late"),
+				})
+				b.Send(&packets.UnsubAck{
+					Version:          mqtt.MQTTv311,
+					PacketIdentifier: packetID,
+				})
+			}(p.PacketIdentifier)
+		case *packets.PubAck:
+			pubAcks <- p
+		}
+	})
+	defer broker.Close()
+	client := NewClient(conn)
+	msgs := make(chan []byte, 1)
+	_, err := client.Subscribe(mqtt.Subscription{
+		Topic:    mqtt.Topic{Name: "foo/bar", QoS: mqtt.QoS1},
+		Messages: msgs,
+	})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.NoError(t, client.Unsubscribe("foo/bar"))
+	select {
+	case msg := <-msgs:
+		assert.Equal(t, []byte("late"), msg)
+	default:
+		t.Error("message received before UNSUBACK dropped")
+	}
+	select {
+	case pubAck := <-pubAcks:
+		assert.Equal(t, uint16(1), pubAck.PacketIdentifier)
+	case <-time.After(time.Second):
+		t.Error("message not acknowledged")
+	}
+	assert.Empty(t, client.Subscriptions())
+}
+
+func TestDeadLetterChannel(t *testing.T) {
+	broker, conn := NewPipeBroker(mqtt.MQTTv311, func(
+		b *PipeBroker, p packets.Packet,
+	) {
+		switch p := p.(type) {
+		case *packets.Subscribe:
+			b.Send(&packets.SubAck{
+				Version:          mqtt.MQTTv311,
+				PacketIdentifier: p.PacketIdentifier,
+				ReturnCodes:      []uint8{0},
+			})
+		case *packets.PingReq:
+			b.Send(&packets.PingResp{Version: mqtt.MQTTv311})
+		}
+	})
+	defer broker.Close()
+	deadLetters := make(chan mqtt.Message, 2)
+	clientOpts := NewClientOptions()
+	clientOpts.SetDeadLetterChannel(deadLetters)
+	client := NewClient(conn, clientOpts)
+
+	msgs := make(chan []byte, 1)
+	_, err := client.Subscribe(mqtt.Subscription{
+		Topic:    mqtt.Topic{Name: "foo"},
+		Messages: msgs,
+	})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	for _, pub := range []*packets.Publish{{
+		Version: mqtt.MQTTv311,
+		Topic:   mqtt.Topic{Name: "foo"},
+		Payload: []byte("first"),
+	}, {
+		Version: mqtt.MQTTv311,
+		Topic:   mqtt.Topic{Name: "foo"},
+		Payload: []byte("overflow"),
+	}, {
+		Version: mqtt.MQTTv311,
+		Topic:   mqtt.Topic{Name: "bar"},
+		Retain:  true,
+		Payload: []byte("unsubscribed"),
+	}} {
+		assert.NoError(t, broker.Send(pub))
+	}
+	// Receiving the PINGRESP ensures the publishes are processed.
+	assert.NoError(t, client.Ping())
+
+	assert.Equal(t, []byte("first"), <-msgs)
+	assert.Len(t, deadLetters, 2)
+	assert.Equal(t, mqtt.Message{
+		Topic:   "foo",
+		Payload: []byte("overflow"),
+	}, <-deadLetters)
+	assert.Equal(t, mqtt.Message{
+		Topic:   "bar",
+		Retain:  true,
+		Payload: []byte("unsubscribed"),
+	}, <-deadLetters)
+}
+
+func TestIncomingQoS2Validator(t *testing.T) {
+	pubRecs := make(chan *packets.PubRec, 1)
+	pubComps := make(chan *packets.PubComp, 1)
+	broker, conn := NewPipeBroker(mqtt.MQTTv5, func(
+		b *PipeBroker, p packets.Packet,
+	) {
+		switch p := p.(type) {
+		case *packets.Subscribe:
+			b.Send(&packets.SubAck{
+				Version:          mqtt.MQTTv5,
+				PacketIdentifier: p.PacketIdentifier,
+				ReturnCodes:      []uint8{2},
+			})
+		case *packets.PubRec:
+			pubRecs <- p
+		case *packets.PubComp:
+			pubComps <- p
+		case *packets.PingReq:
+			b.Send(&packets.PingResp{Version: mqtt.MQTTv5})
+		}
+	})
+	defer broker.Close()
+	clientOpts := NewClientOptions()
+	clientOpts.SetVersion(mqtt.MQTTv5)
+	clientOpts.SetIncomingQoS2Validator(func(msg mqtt.Message) uint8 {
+		if string(msg.Payload) == "reject" {
+			return packets.PubRecQuotaExceeded
+		}
+		return packets.PubRecSuccess
+	})
+	client := NewClient(conn, clientOpts)
+
+	msgs := make(chan []byte, 1)
+	_, err := client.Subscribe(mqtt.Subscription{
+		Topic:    mqtt.Topic{Name: "foo", QoS: mqtt.QoS2},
+		Messages: msgs,
+	})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	// The client writes the PUBREC while the broker is sending.
+	go broker.Send(&packets.Publish{
+		Version:          mqtt.MQTTv5,
+		Topic:            mqtt.Topic{Name: "foo", QoS: mqtt.QoS2},
+		PacketIdentifier: 1,
+		Payload:          []byte("reject"),
+	})
+	select {
+	case pubRec := <-pubRecs:
+		assert.Equal(t, uint16(1), pubRec.PacketIdentifier)
+		assert.Equal(t, packets.PubRecQuotaExceeded, pubRec.ReasonCode)
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for PUBREC")
+	}
+	assert.NoError(t, client.Ping())
+	assert.Empty(t, msgs)
+	assert.Empty(t, pubComps)
+	assert.Zero(t, client.pendingPackets.Len())
+
+	// Accepted messages complete the exactly-once flow.
+	go broker.Send(&packets.Publish{
+		Version:          mqtt.MQTTv5,
+		Topic:            mqtt.Topic{Name: "foo", QoS: mqtt.QoS2},
+		PacketIdentifier: 2,
+		Payload:          []byte("accept"),
+	})
+	select {
+	case pubRec := <-pubRecs:
+		assert.Equal(t, uint16(2), pubRec.PacketIdentifier)
+		assert.Equal(t, packets.PubRecSuccess, pubRec.ReasonCode)
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for PUBREC")
+	}
+	go broker.Send(&packets.PubRel{
+		Version:          mqtt.MQTTv5,
+		PacketIdentifier: 2,
+	})
+	select {
+	case pubComp := <-pubComps:
+		assert.Equal(t, uint16(2), pubComp.PacketIdentifier)
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for PUBCOMP")
+	}
+	assert.Equal(t, []byte("accept"), <-msgs)
+}
+
+func TestLastRetained(t *testing.T) {
+	broker, conn := NewPipeBroker(mqtt.MQTTv311, func(
+		b *PipeBroker, p packets.Packet,
+	) {
+		if _, ok := p.(*packets.PingReq); ok {
+			b.Send(&packets.PingResp{Version: mqtt.MQTTv311})
+		}
+	})
+	defer broker.Close()
+	clientOpts := NewClientOptions()
+	clientOpts.SetRetainedCache(true)
+	client := NewClient(conn, clientOpts)
+
+	for _, pub := range []*packets.Publish{{
+		Version: mqtt.MQTTv311,
+		Topic:   mqtt.Topic{Name: "foo"},
+		Retain:  true,
+		Payload: []byte("first"),
+	}, {
+		Version: mqtt.MQTTv311,
+		Topic:   mqtt.Topic{Name: "foo"},
+		Retain:  true,
+		Payload: []byte("last"),
+	}, {
+		Version: mqtt.MQTTv311,
+		Topic:   mqtt.Topic{Name: "foo"},
+		Payload: []byte("not retained"),
+	}, {
+		Version: mqtt.MQTTv311,
+		Topic:   mqtt.Topic{Name: "bar"},
+		Retain:  true,
+		Payload: []byte("cleared"),
+	}, {
+		Version: mqtt.MQTTv311,
+		Topic:   mqtt.Topic{Name: "bar"},
+		Retain:  true,
+	}} {
+		assert.NoError(t, broker.Send(pub))
+	}
+	assert.NoError(t, client.Ping())
+
+	msg, ok := client.LastRetained("foo")
+	assert.True(t, ok)
+	assert.Equal(t, mqtt.Message{
+		Topic:   "foo",
+		Retain:  true,
+		Payload: []byte("last"),
+	}, msg)
+	_, ok = client.LastRetained("bar")
+	assert.False(t, ok)
+	_, ok = client.LastRetained("baz")
+	assert.False(t, ok)
+}
+
+func TestReconnect(t *testing.T) {
+	broker, conn := NewPipeBroker(mqtt.MQTTv311, func(
+		b *PipeBroker, p packets.Packet,
+	) {
+		if sub, ok := p.(*packets.Subscribe); ok {
+			b.Send(&packets.SubAck{
+				Version:          mqtt.MQTTv311,
+				PacketIdentifier: sub.PacketIdentifier,
+				ReturnCodes:      []uint8{1, 1},
+			})
+		}
+	})
+	client := NewClient(conn)
+	persistent := make(chan []byte, 1)
+	transient := make(chan []byte, 1)
+	_, err := client.Subscribe(mqtt.Subscription{
+		Topic:    mqtt.Topic{Name: "foo/bar", QoS: mqtt.QoS1},
+		Messages: persistent,
+	}, mqtt.Subscription{
+		Topic:     mqtt.Topic{Name: "rsp/+", QoS: mqtt.QoS1},
+		Messages:  transient,
+		Transient: true,
+	})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	// Connection lost
+	broker.Close()
+	<-client.Done()
+
+	subs := make(chan *packets.Subscribe, 1)
+	broker, conn = NewPipeBroker(mqtt.MQTTv311, func(
+		b *PipeBroker, p packets.Packet,
+	) {
+		switch p := p.(type) {
+		case *packets.Connect:
+			b.Send(&packets.ConnAck{Version: mqtt.MQTTv311})
+		case *packets.Subscribe:
+			subs <- p
+			b.Send(&packets.SubAck{
+				Version:          mqtt.MQTTv311,
+				PacketIdentifier: p.PacketIdentifier,
+				ReturnCodes:      []uint8{1},
+			})
+		}
+	})
+	defer broker.Close()
+	err = client.Reconnect(conn)
+	assert.NoError(t, err)
+	select {
+	case sub := <-subs:
+		assert.Equal(t, []mqtt.Topic{
+			{Name: "foo/bar", QoS: mqtt.QoS1},
+		}, sub.Topics)
+	default:
+		t.Error("subscriptions not restored")
+	}
+	assert.Equal(t, []mqtt.Topic{
+		{Name: "foo/bar", QoS: mqtt.QoS1},
+	}, client.Subscriptions())
+	select {
+	case <-client.Done():
+		t.Error("client unexpectedly terminated")
+	default:
+	}
+}
+
+func TestRegister(t *testing.T) {
+	newBroker := func(
+		subs chan<- *packets.Subscribe,
+	) (*PipeBroker, net.Conn) {
+		return NewPipeBroker(mqtt.MQTTv311, func(
+			b *PipeBroker, p packets.Packet,
+		) {
+			switch p := p.(type) {
+			case *packets.Connect:
+				b.Send(&packets.ConnAck{Version: mqtt.MQTTv311})
+			case *packets.Subscribe:
+				subs <- p
+				codes := make([]uint8, len(p.Topics))
+				for i, topic := range p.Topics {
+					codes[i] = uint8(topic.QoS)
+				}
+				b.Send(&packets.SubAck{
+					Version:          mqtt.MQTTv311,
+					PacketIdentifier: p.PacketIdentifier,
+					ReturnCodes:      codes,
+				})
+			}
+		})
+	}
+	subs := make(chan *packets.Subscribe, 2)
+	broker, conn := newBroker(subs)
+	client := NewClient(conn)
+	msgs := make(chan []byte, 1)
+	client.Register(mqtt.Subscription{
+		Topic:    mqtt.Topic{Name: "foo/+", QoS: mqtt.QoS1},
+		Messages: msgs,
+	})
+	err := client.Connect()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	select {
+	case sub := <-subs:
+		assert.Equal(t, []mqtt.Topic{
+			{Name: "foo/+", QoS: mqtt.QoS1},
+		}, sub.Topics)
+	default:
+		t.Fatal("registered subscription not subscribed")
+	}
+
+	// Connection lost; the subscription is restored once.
+	broker.Close()
+	<-client.Done()
+	broker, conn = newBroker(subs)
+	defer broker.Close()
+	err = client.Reconnect(conn)
+	assert.NoError(t, err)
+	assert.Len(t, subs, 1)
+	sub := <-subs
+	assert.Equal(t, []mqtt.Topic{
+		{Name: "foo/+", QoS: mqtt.QoS1},
+	}, sub.Topics)
+	assert.Equal(t, []mqtt.Topic{
+		{Name: "foo/+", QoS: mqtt.QoS1},
+	}, client.Subscriptions())
+}
+
+func TestSubscribeMap(t *testing.T) {
+	subs := make(chan *packets.Subscribe, 1)
+	broker, conn := NewPipeBroker(mqtt.MQTTv311, func(
+		b *PipeBroker, p packets.Packet,
+	) {
+		switch p := p.(type) {
+		case *packets.Subscribe:
+			subs <- p
+			codes := make([]uint8, len(p.Topics))
+			for i, topic := range p.Topics {
+				codes[i] = uint8(topic.QoS)
+			}
+			// The server refuses "foo/bar".
+			codes[2] = packets.SubAckFailure
+			b.Send(&packets.SubAck{
+				Version:          mqtt.MQTTv311,
+				PacketIdentifier: p.PacketIdentifier,
+				ReturnCodes:      codes,
+			})
+		}
+	})
+	defer broker.Close()
+	client := NewClient(conn)
+
+	msgs := make(chan mqtt.Message, 3)
+	codes, err := client.SubscribeMap(map[string]mqtt.QoS{
+		"foo/bar":   mqtt.QoS0,
+		"foo/+/baz": mqtt.QoS1,
+		"bar/#":     mqtt.QoS2,
+	}, func(msg mqtt.Message) {
+		msgs <- msg
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]mqtt.SubAckCode{
+		"bar/#":     mqtt.SubAckGrantedQoS2,
+		"foo/+/baz": mqtt.SubAckGrantedQoS1,
+		"foo/bar":   mqtt.SubAckFailure,
+	}, codes)
+	assert.False(t, codes["foo/bar"].Granted())
+	assert.Equal(t, mqtt.QoS2, codes["bar/#"].QoS())
+	// All filters are sent in a single request.
+	sub := <-subs
+	assert.Equal(t, []mqtt.Topic{
+		{Name: "bar/#", QoS: mqtt.QoS2},
+		{Name: "foo/+/baz", QoS: mqtt.QoS1},
+		{Name: "foo/bar", QoS: mqtt.QoS0},
+	}, sub.Topics)
+
+	// Messages on all filters are passed to the shared handler.
+	for _, topic := range []string{"bar/baz", "foo/x/baz"} {
+		assert.NoError(t, broker.Send(&packets.Publish{
+			Version: mqtt.MQTTv311,
+			Topic:   mqtt.Topic{Name: topic},
+			Payload: []byte(topic),
+		}))
+		msg := <-msgs
+		assert.Equal(t, topic, msg.Topic)
+		assert.Equal(t, []byte(topic), msg.Payload)
+	}
+
+	_, err = client.SubscribeMap(map[string]mqtt.QoS{"foo": 0}, nil)
+	assert.Equal(t, ErrNilHandler, err)
+}
+
+func TestReconnectRetransmit(t *testing.T) {
+	broker, conn := NewPipeBroker(mqtt.MQTTv311, func(
+		b *PipeBroker, p packets.Packet,
+	) {
+		// Never acknowledge
+	})
+	client := NewClient(conn)
+	pubOpts := NewPublishOptions()
+	pubOpts.SetRetain(true)
+	err := client.Publish(
+		mqtt.Topic{Name: "foo/bar", QoS: mqtt.QoS1},
+		[]byte("baz"), pubOpts,
+	)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	// Connection lost before the PUBACK
+	broker.Close()
+	<-client.Done()
+
+	pubs := make(chan *packets.Publish, 1)
+	broker, conn = NewPipeBroker(mqtt.MQTTv311, func(
+		b *PipeBroker, p packets.Packet,
+	) {
+		switch p := p.(type) {
+		case *packets.Connect:
+			b.Send(&packets.ConnAck{
+				Version:        mqtt.MQTTv311,
+				SessionPresent: true,
+			})
+		case *packets.Publish:
+			pubs <- p
+		}
+	})
+	defer broker.Close()
+	err = client.Reconnect(conn)
+	assert.NoError(t, err)
+	select {
+	case pub := <-pubs:
+		assert.True(t, pub.Retain)
+		assert.True(t, pub.Duplicate)
+		assert.Equal(t, mqtt.QoS1, pub.QoS)
+		assert.Equal(t, []byte("baz"), pub.Payload)
+	case <-time.After(time.Second):
+		t.Error("publish not retransmitted")
+	}
+}
+
+func TestReconnectSessionLost(t *testing.T) {
+	broker, conn := NewPipeBroker(mqtt.MQTTv311, func(
+		b *PipeBroker, p packets.Packet,
+	) {
+		if _, ok := p.(*packets.Connect); ok {
+			b.Send(&packets.ConnAck{Version: mqtt.MQTTv311})
+		}
+	})
+	defer broker.Close()
+	client := NewClient(conn)
+	// A QoS1 publish awaiting its acknowledgement when the connection is
+	// replaced; the connection error was consumed by another caller.
+	client.pendingPackets.Add(1, &packets.Publish{
+		Version:          mqtt.MQTTv311,
+		Topic:            mqtt.Topic{Name: "foo/bar", QoS: mqtt.QoS1},
+		PacketIdentifier: 1,
+		Payload:          []byte("baz"),
+	})
+	client.ackChan.New(1)
+	ackChan, _ := client.ackChan.Get(1)
+
+	broker2, conn := NewPipeBroker(mqtt.MQTTv311, func(
+		b *PipeBroker, p packets.Packet,
+	) {
+		if _, ok := p.(*packets.Connect); ok {
+			b.Send(&packets.ConnAck{Version: mqtt.MQTTv311})
+		}
+	})
+	defer broker2.Close()
+	err := client.Reconnect(conn)
+	assert.NoError(t, err)
+	// The server discarded the session; the publish is never acknowledged.
+	select {
+	case ack := <-ackChan:
+		assert.EqualError(t, publishAckError(ack), ErrSessionLost.Error())
+	default:
+		t.Fatal("publisher not woken after the session was lost")
+	}
+	assert.Equal(t, 0, client.pendingPackets.Len())
+}
+
+func TestSessionPresent(t *testing.T) {
+	testCases := []struct {
+		Name           string
+		SessionPresent bool
+	}{{
+		Name:           "resume",
+		SessionPresent: true,
+	}, {
+		Name:           "discard",
+		SessionPresent: false,
+	}}
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			pubs := make(chan *packets.Publish, 1)
+			broker, conn := NewPipeBroker(mqtt.MQTTv311, func(
+				b *PipeBroker, p packets.Packet,
+			) {
+				switch p := p.(type) {
+				case *packets.Connect:
+					b.Send(&packets.ConnAck{
+						Version:        mqtt.MQTTv311,
+						SessionPresent: tc.SessionPresent,
+					})
+				case *packets.Publish:
+					pubs <- p
+				}
+			})
+			defer broker.Close()
+			client := NewClient(conn)
+			client.LoadPendingPackets(map[uint16]packets.Packet{
+				5: &packets.Publish{
+					Version:          mqtt.MQTTv311,
+					Topic:            mqtt.Topic{Name: "foo", QoS: mqtt.QoS1},
+					PacketIdentifier: 5,
+					Payload:          []byte("bar"),
+				},
+			})
+			opts := NewConnectOptions()
+			opts.SetCleanSession(false)
+			err := client.Connect(opts)
+			if !assert.NoError(t, err) {
+				t.FailNow()
+			}
+			if tc.SessionPresent {
+				select {
+				case pub := <-pubs:
+					assert.True(t, pub.Duplicate)
+					assert.Equal(t, uint16(5), pub.PacketIdentifier)
+					assert.Equal(t, []byte("bar"), pub.Payload)
+				case <-time.After(time.Second):
+					t.Fatal("pending publish not retransmitted")
+				}
+				assert.Len(t, client.PendingPackets(), 1)
+			} else {
+				select {
+				case <-pubs:
+					t.Error("discarded publish was retransmitted")
+				case <-time.After(100 * time.Millisecond):
+				}
+				assert.Empty(t, client.PendingPackets())
+			}
+		})
+	}
+}
+
+func TestConsecutiveErrors(t *testing.T) {
+	conn := NewFakeConn(2)
+	pub := &packets.Publish{
+		Version:          mqtt.MQTTv311,
+		Topic:            mqtt.Topic{Name: "foo/bar", QoS: mqtt.QoS1},
+		PacketIdentifier: 1,
+	}
+	b, err := pub.MarshalBinary()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	// The PUBACK fails to send and the next packet is malformed.
+	conn.ReadChan <- b
+	conn.ReadChan <- []byte{0xF0, 0}
+	conn.On("Write", mock.Anything).Return(0, io.ErrClosedPipe)
+	conn.On("Read", mock.Anything).Return(nil, nil)
+	conn.On("Close").Return(nil)
+	client := NewClient(conn)
+	defer conn.Close()
+
+	select {
+	case <-client.Done():
+	case <-time.After(time.Second):
+		t.Fatal("receive routine deadlocked on error channel")
+	}
+	assert.Error(t, client.Err())
+	// The first error is kept for the caller.
+	assert.EqualError(t, <-client.errChan, io.ErrClosedPipe.Error())
+}
+
+func TestSetKeepAliveStrict(t *testing.T) {
+	opts := NewConnectOptions()
+	err := opts.SetKeepAliveStrict(24 * time.Hour)
+	assert.EqualError(t, err, ErrKeepAliveRange.Error())
+	assert.Nil(t, opts.KeepAlive)
+	err = opts.SetKeepAliveStrict(-time.Second)
+	assert.EqualError(t, err, ErrKeepAliveRange.Error())
+	assert.Nil(t, opts.KeepAlive)
+
+	err = opts.SetKeepAliveStrict(18*time.Hour + 12*time.Minute + 15*time.Second)
+	if assert.NoError(t, err) {
+		assert.Equal(t, uint16(0xFFFF), *opts.KeepAlive)
+	}
+	err = opts.SetKeepAliveStrict(90 * time.Second)
+	if assert.NoError(t, err) {
+		assert.Equal(t, uint16(90), *opts.KeepAlive)
+	}
+
+	// The lenient setter clamps to the maximum.
+	opts.SetKeepAlive(24 * time.Hour)
+	assert.Equal(t, uint16(0xFFFF), *opts.KeepAlive)
+}
+
+func TestKeepAlive(t *testing.T) {
+	pings := make(chan *packets.PingReq, 2)
+	broker, conn := NewPipeBroker(mqtt.MQTTv311, func(
+		b *PipeBroker, p packets.Packet,
+	) {
+		switch p := p.(type) {
+		case *packets.Connect:
+			b.Send(&packets.ConnAck{Version: mqtt.MQTTv311})
+		case *packets.PingReq:
+			pings <- p
+			b.Send(&packets.PingResp{Version: mqtt.MQTTv311})
+		}
+	})
+	defer broker.Close()
+	clock := NewFakeClock()
+	clientOpts := NewClientOptions()
+	clientOpts.SetClock(clock)
+	client := NewClient(conn, clientOpts)
+	connectOpts := NewConnectOptions()
+	connectOpts.SetKeepAlive(10 * time.Second)
+	err := client.Connect(connectOpts)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	for i := 0; i < 2; i++ {
+		<-clock.Waiting
+		// Nothing happens before half the keep-alive interval.
+		clock.Advance(4 * time.Second)
+		assert.Equal(t, 1, clock.Pending())
+		clock.Advance(time.Second)
+		ping := <-pings
+		assert.Equal(t, mqtt.MQTTv311, ping.Version)
+		// Response timeout
+		<-clock.Waiting
+	}
+	assert.Empty(t, pings)
+}
+
+func TestKeepAliveTimeout(t *testing.T) {
+	pings := make(chan *packets.PingReq, 1)
+	broker, conn := NewPipeBroker(mqtt.MQTTv311, func(
+		b *PipeBroker, p packets.Packet,
+	) {
+		switch p := p.(type) {
+		case *packets.Connect:
+			b.Send(&packets.ConnAck{Version: mqtt.MQTTv311})
+		case *packets.PingReq:
+			// Half-open: the ping is never answered.
+			pings <- p
+		}
+	})
+	defer broker.Close()
+	clock := NewFakeClock()
+	clientOpts := NewClientOptions()
+	clientOpts.SetClock(clock)
+	client := NewClient(conn, clientOpts)
+	connectOpts := NewConnectOptions()
+	connectOpts.SetKeepAlive(10 * time.Second)
+	err := client.Connect(connectOpts)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	<-clock.Waiting
+	clock.Advance(5 * time.Second)
+	<-pings
+	<-clock.Waiting
+	clock.Advance(4 * time.Second)
+	select {
+	case <-client.Done():
+		t.Fatal("connection closed before the timeout")
+	default:
+	}
+	clock.Advance(time.Second)
+	select {
+	case <-client.Done():
+	case <-time.After(time.Second):
+		t.Fatal("dead connection not detected")
+	}
+	assert.Equal(t, ErrPingTimeout, client.Err())
+}
+
+func TestKeepAliveTimeoutAfterReconnect(t *testing.T) {
+	broker, conn := NewPipeBroker(mqtt.MQTTv311, func(
+		b *PipeBroker, p packets.Packet,
+	) {
+		if _, ok := p.(*packets.Connect); ok {
+			b.Send(&packets.ConnAck{Version: mqtt.MQTTv311})
+		}
+	})
+	clock := NewFakeClock()
+	clientOpts := NewClientOptions()
+	clientOpts.SetClock(clock)
+	client := NewClient(conn, clientOpts)
+	connectOpts := NewConnectOptions()
+	connectOpts.SetKeepAlive(10 * time.Second)
+	err := client.Connect(connectOpts)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	<-clock.Waiting
+	broker.Close()
+	<-client.Done()
+	// A ping response left over from the previous connection.
+	client.pingResp <- &packets.PingResp{Version: mqtt.MQTTv311}
+
+	pings := make(chan *packets.PingReq, 2)
+	broker, conn = NewPipeBroker(mqtt.MQTTv311, func(
+		b *PipeBroker, p packets.Packet,
+	) {
+		switch p := p.(type) {
+		case *packets.Connect:
+			b.Send(&packets.ConnAck{Version: mqtt.MQTTv311})
+		case *packets.PingReq:
+			// Half-open: the ping is never answered.
+			pings <- p
+		}
+	})
+	defer broker.Close()
+	err = client.Reconnect(conn, connectOpts)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	<-clock.Waiting
+	clock.Advance(5 * time.Second)
+	<-pings
+	<-clock.Waiting
+	clock.Advance(5 * time.Second)
+	select {
+	case <-client.Done():
+	case <-time.After(time.Second):
+		t.Fatal("dead connection not detected")
+	}
+	assert.Equal(t, ErrPingTimeout, client.Err())
+}
+
+func TestServerMaxPacketSize(t *testing.T) {
+	pubs := make(chan *packets.Publish, 2)
+	broker, conn := NewPipeBroker(mqtt.MQTTv5, func(
+		b *PipeBroker, p packets.Packet,
+	) {
+		switch p := p.(type) {
+		case *packets.Connect:
+			b.Send(&packets.ConnAck{
+				Version:       mqtt.MQTTv5,
+				MaxPacketSize: 64,
+			})
+		case *packets.Publish:
+			pubs <- p
+		}
+	})
+	defer broker.Close()
+	clientOpts := NewClientOptions()
+	clientOpts.SetVersion(mqtt.MQTTv5)
+	client := NewClient(conn, clientOpts)
+	err := client.Connect()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	topic := mqtt.Topic{Name: "foo/bar"}
+	err = client.Publish(topic, make([]byte, 64))
+	assert.EqualError(t, err, mqtt.ErrPacketTooLarge.Error())
+	err = client.Publish(topic, []byte("baz"))
+	assert.NoError(t, err)
+	// Only the small publish reaches the server.
+	pub := <-pubs
+	assert.Equal(t, []byte("baz"), pub.Payload)
+	assert.Empty(t, pubs)
+}
+
+func TestCancelSubscribe(t *testing.T) {
+	subs := make(chan *packets.Subscribe, 1)
+	broker, conn := NewPipeBroker(mqtt.MQTTv311, func(
+		b *PipeBroker, p packets.Packet,
+	) {
+		if sub, ok := p.(*packets.Subscribe); ok {
+			// Never acknowledge
+			subs <- sub
+		}
+	})
+	defer broker.Close()
+	client := NewClient(conn)
+
+	packetID, result, err := client.SubscribeAsync(mqtt.Subscription{
+		Topic:    mqtt.Topic{Name: "foo/bar", QoS: mqtt.QoS1},
+		Messages: make(chan []byte, 1),
+	})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	sub := <-subs
+	assert.Equal(t, sub.PacketIdentifier, packetID)
+	assert.Len(t, client.Subscriptions(), 1)
+
+	assert.True(t, client.CancelSubscribe(packetID))
+	assert.Empty(t, client.Subscriptions())
+	res := <-result
+	assert.EqualError(t, res.Err, ErrSubscribeCancelled.Error())
+	assert.Nil(t, res.ReturnCodes)
+	// The packet identifier is released.
+	client.ackChan.mutex <- struct{}{}
+	assert.Empty(t, client.ackChan.chans)
+	<-client.ackChan.mutex
+	assert.False(t, client.CancelSubscribe(packetID))
+
+	// A late acknowledgement is discarded.
+	assert.NoError(t, broker.Send(&packets.SubAck{
+		Version:          mqtt.MQTTv311,
+		PacketIdentifier: packetID,
+		ReturnCodes:      []uint8{1},
+	}))
+	assert.Empty(t, client.Subscriptions())
+}
+
+func TestPublishQoS2Completion(t *testing.T) {
+	pubRels := make(chan *packets.PubRel, 1)
+	complete := make(chan struct{})
+	broker, conn := NewPipeBroker(mqtt.MQTTv311, func(
+		b *PipeBroker, p packets.Packet,
+	) {
+		switch p := p.(type) {
+		case *packets.Publish:
+			b.Send(&packets.PubRec{
+				Version:          mqtt.MQTTv311,
+				PacketIdentifier: p.PacketIdentifier,
+			})
+		case *packets.PubRel:
+			pubRels <- p
+			<-complete
+			b.Send(&packets.PubComp{
+				Version:          mqtt.MQTTv311,
+				PacketIdentifier: p.PacketIdentifier,
+			})
+		}
+	})
+	defer broker.Close()
+	client := NewClient(conn)
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- client.Publish(
+			mqtt.Topic{Name: "foo/bar", QoS: mqtt.QoS2},
+			[]byte("baz"),
+		)
+	}()
+	pubRel := <-pubRels
+	select {
+	case <-errs:
+		t.Fatal("Publish returned before PUBCOMP")
+	default:
+	}
+	close(complete)
+	assert.NoError(t, <-errs)
+	_, pending := client.pendingPackets.Get(pubRel.PacketIdentifier)
+	assert.False(t, pending)
+}
+
+func TestPublishRejected(t *testing.T) {
+	broker, conn := NewPipeBroker(mqtt.MQTTv5, func(
+		b *PipeBroker, p packets.Packet,
+	) {
+		pub, ok := p.(*packets.Publish)
+		if !ok {
+			return
+		}
+		switch pub.QoS {
+		case mqtt.QoS1:
+			b.Send(&packets.PubAck{
+				Version:          mqtt.MQTTv5,
+				PacketIdentifier: pub.PacketIdentifier,
+				ReasonCode:       packets.PubAckNotAuthorized,
+				ReasonString:     "not authorized",
+			})
+		case mqtt.QoS2:
+			b.Send(&packets.PubRec{
+				Version:          mqtt.MQTTv5,
+				PacketIdentifier: pub.PacketIdentifier,
+				ReasonCode:       packets.PubRecQuotaExceeded,
+			})
+		}
+	})
+	defer broker.Close()
+	clientOpts := NewClientOptions()
+	clientOpts.SetVersion(mqtt.MQTTv5)
+	client := NewClient(conn, clientOpts)
+
+	err := client.PublishAndWait(
+		mqtt.Topic{Name: "foo", QoS: mqtt.QoS1}, []byte("bar"),
+	)
+	assert.True(t, errors.Is(err, mqtt.ErrPublishRejected))
+	if assert.IsType(t, &PublishError{}, err) {
+		pubErr := err.(*PublishError)
+		assert.Equal(t, packets.PubAckNotAuthorized, pubErr.ReasonCode)
+		assert.Equal(t, "not authorized", pubErr.ReasonString)
+	}
+
+	// The exactly-once flow ends with the rejecting PUBREC.
+	err = client.Publish(
+		mqtt.Topic{Name: "foo", QoS: mqtt.QoS2}, []byte("bar"),
+	)
+	assert.True(t, errors.Is(err, mqtt.ErrPublishRejected))
+	assert.Equal(t, &PublishError{
+		ReasonCode: packets.PubRecQuotaExceeded,
+	}, err)
+	assert.Zero(t, client.pendingPackets.Len())
+}
+
+func TestPubCompReasonCode(t *testing.T) {
+	broker, conn := NewPipeBroker(mqtt.MQTTv5, func(
+		b *PipeBroker, p packets.Packet,
+	) {
+		switch p := p.(type) {
+		case *packets.Publish:
+			b.Send(&packets.PubRec{
+				Version:          mqtt.MQTTv5,
+				PacketIdentifier: p.PacketIdentifier,
+			})
+		case *packets.PubRel:
+			b.Send(&packets.PubComp{
+				Version:          mqtt.MQTTv5,
+				PacketIdentifier: p.PacketIdentifier,
+				ReasonCode: packets.
+					PubCompPacketIdentifierNotFound,
+			})
+		case *packets.PingReq:
+			b.Send(&packets.PingResp{Version: mqtt.MQTTv5})
+		}
+	})
+	defer broker.Close()
+	clientOpts := NewClientOptions()
+	clientOpts.SetVersion(mqtt.MQTTv5)
+	client := NewClient(conn, clientOpts)
+
+	err := client.Publish(
+		mqtt.Topic{Name: "foo", QoS: mqtt.QoS2}, []byte("bar"),
+	)
+	assert.Equal(t, &PublishError{
+		ReasonCode: packets.PubCompPacketIdentifierNotFound,
+	}, err)
+	assert.Zero(t, client.pendingPackets.Len())
+	// The connection survives the flow.
+	assert.NoError(t, client.Ping())
+}
+
+func TestTryPublish(t *testing.T) {
+	// Nothing reads from the peer end of the pipe: writes stall.
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	client := NewClient(conn)
+	defer conn.Close()
+
+	start := time.Now()
+	sent, err := client.TryPublish(mqtt.Topic{Name: "foo"}, []byte("bar"))
+	assert.NoError(t, err)
+	assert.False(t, sent)
+	assert.True(t, time.Since(start) < 500*time.Millisecond,
+		"TryPublish blocked on a stalled connection")
+
+	_, err = client.TryPublish(
+		mqtt.Topic{Name: "foo", QoS: mqtt.QoS1}, []byte("bar"),
+	)
+	assert.EqualError(t, err, mqtt.ErrIllegalQoS.Error())
+
+	// Once the peer reads again, the message is sent.
+	received := make(chan []byte, 1)
+	go func() {
+		b, err := packets.ReadRawPacket(peer)
+		if err == nil {
+			received <- b
+		}
+	}()
+	for i := 0; i < 100 && !sent; i++ {
+		sent, err = client.TryPublish(
+			mqtt.Topic{Name: "foo"}, []byte("bar"),
+		)
+		assert.NoError(t, err)
+	}
+	assert.True(t, sent)
+	select {
+	case b := <-received:
+		pub := &packets.Publish{
+			Version: mqtt.MQTTv311,
+			Topic:   mqtt.Topic{Name: "foo"},
+			Payload: []byte("bar"),
+		}
+		expected, _ := pub.MarshalBinary()
+		assert.Equal(t, expected, b)
+	case <-time.After(time.Second):
+		t.Error("message not received")
+	}
+}
+
+func TestPublishQoSOverride(t *testing.T) {
+	pubs := make(chan *packets.Publish, 1)
+	acked := make(chan struct{})
+	broker, conn := NewPipeBroker(mqtt.MQTTv311, func(
+		b *PipeBroker, p packets.Packet,
+	) {
+		if p, ok := p.(*packets.Publish); ok {
+			pubs <- p
+			b.Send(&packets.PubAck{
+				Version:          mqtt.MQTTv311,
+				PacketIdentifier: p.PacketIdentifier,
+			})
+			close(acked)
+		}
+	})
+	defer broker.Close()
+	client := NewClient(conn)
+
+	opts := NewPublishOptions()
+	opts.SetQoS(mqtt.QoS1)
+	err := client.Publish(
+		mqtt.Topic{Name: "foo/bar", QoS: mqtt.QoS0}, []byte("baz"), opts,
+	)
+	assert.NoError(t, err)
+	pub := <-pubs
+	assert.Equal(t, mqtt.QoS1, pub.QoS)
+	assert.NotZero(t, pub.PacketIdentifier)
+	<-acked
+	// The PUBACK completes the publish.
+	for i := 0; i < 100 && client.pendingPackets.Len() > 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Zero(t, client.pendingPackets.Len())
+}
+
+func TestFlowControlBlocked(t *testing.T) {
+	pubs := make(chan *packets.Publish, 2)
+	broker, conn := NewPipeBroker(mqtt.MQTTv5, func(
+		b *PipeBroker, p packets.Packet,
+	) {
+		switch p := p.(type) {
+		case *packets.Connect:
+			b.Send(&packets.ConnAck{
+				Version:    mqtt.MQTTv5,
+				ReceiveMax: 1,
+			})
+		case *packets.Publish:
+			pubs <- p
+		}
+	})
+	defer broker.Close()
+	blocked := make(chan struct{}, 2)
+	clientOpts := NewClientOptions()
+	clientOpts.SetVersion(mqtt.MQTTv5)
+	clientOpts.SetFlowControlBlockedHandler(func() {
+		blocked <- struct{}{}
+	})
+	client := NewClient(conn, clientOpts)
+	err := client.Connect()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	topic := mqtt.Topic{Name: "foo/bar", QoS: mqtt.QoS1}
+	err = client.Publish(topic, []byte("first"))
+	assert.NoError(t, err)
+	first := <-pubs
+	assert.Empty(t, blocked)
+
+	published := make(chan error)
+	go func() {
+		published <- client.Publish(topic, []byte("second"))
+	}()
+	select {
+	case <-blocked:
+	case <-time.After(time.Second):
+		t.Fatal("flow control handler not called")
+	}
+	assert.Equal(t, int64(1), client.Stats().PublishesBlocked)
+	assert.Empty(t, pubs)
+
+	// Acknowledging the first publish admits the second.
+	assert.NoError(t, broker.Send(&packets.PubAck{
+		Version:          mqtt.MQTTv5,
+		PacketIdentifier: first.PacketIdentifier,
+	}))
+	assert.NoError(t, <-published)
+	second := <-pubs
+	assert.Equal(t, []byte("second"), second.Payload)
+	assert.Zero(t, client.Stats().PublishesBlocked)
+	assert.Empty(t, blocked)
+}
+
+func TestInboundPacketIDCollision(t *testing.T) {
+	pubs := make(chan *packets.Publish, 2)
+	acks := make(chan packets.Packet, 2)
+	broker, conn := NewPipeBroker(mqtt.MQTTv5, func(
+		b *PipeBroker, p packets.Packet,
+	) {
+		switch p := p.(type) {
+		case *packets.Connect:
+			b.Send(&packets.ConnAck{
+				Version:    mqtt.MQTTv5,
+				ReceiveMax: 1,
+			})
+		case *packets.Publish:
+			pubs <- p
+		case *packets.PubAck, *packets.PubRec:
+			acks <- p
+		case *packets.PingReq:
+			b.Send(&packets.PingResp{Version: mqtt.MQTTv5})
+		}
+	})
+	defer broker.Close()
+	clientOpts := NewClientOptions()
+	clientOpts.SetVersion(mqtt.MQTTv5)
+	client := NewClient(conn, clientOpts)
+	err := client.Connect()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	topic := mqtt.Topic{Name: "foo/bar", QoS: mqtt.QoS1}
+	err = client.Publish(topic, []byte("first"))
+	assert.NoError(t, err)
+	first := <-pubs
+
+	// The server allocates the same identifier for its publishes.
+	for _, qos := range []mqtt.QoS{mqtt.QoS1, mqtt.QoS2} {
+		broker.Send(&packets.Publish{
+			Version:          mqtt.MQTTv5,
+			Topic:            mqtt.Topic{Name: "baz", QoS: qos},
+			PacketIdentifier: first.PacketIdentifier,
+			Payload:          []byte("inbound"),
+		})
+	}
+	assert.IsType(t, &packets.PubAck{}, <-acks)
+	assert.IsType(t, &packets.PubRec{}, <-acks)
+	assert.NoError(t, client.Ping())
+	pending, ok := client.pendingPackets.Get(first.PacketIdentifier)
+	if assert.True(t, ok) {
+		assert.IsType(t, &packets.Publish{}, pending)
+	}
+
+	// The acknowledgement releases the quota.
+	broker.Send(&packets.PubAck{
+		Version:          mqtt.MQTTv5,
+		PacketIdentifier: first.PacketIdentifier,
+	})
+	published := make(chan error, 1)
+	go func() {
+		published <- client.Publish(topic, []byte("second"))
+	}()
+	select {
+	case err := <-published:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("publish blocked on leaked quota")
+	}
+}
+
+func TestStats(t *testing.T) {
+	broker, conn := NewPipeBroker(mqtt.MQTTv311, func(
+		b *PipeBroker, p packets.Packet,
+	) {
+		switch p := p.(type) {
+		case *packets.Subscribe:
+			b.Send(&packets.SubAck{
+				Version:          mqtt.MQTTv311,
+				PacketIdentifier: p.PacketIdentifier,
+				ReturnCodes:      []uint8{0},
+			})
+		case *packets.PingReq:
+			b.Send(&packets.PingResp{Version: mqtt.MQTTv311})
+		}
+	})
+	defer broker.Close()
+	client := NewClient(conn)
+	msgs := make(chan []byte, 1)
+	_, err := client.Subscribe(mqtt.Subscription{
+		Topic:    mqtt.Topic{Name: "foo/bar"},
+		Messages: msgs,
+	})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	pub := &packets.Publish{
+		Version: mqtt.MQTTv311,
+		Topic:   mqtt.Topic{Name: "foo/bar"},
+		Payload: []byte("baz"),
+	}
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, broker.Send(pub))
+	}
+	// Receiving the PINGRESP ensures the publishes are processed.
+	assert.NoError(t, client.Ping())
+
+	stats := client.Stats()
+	assert.Equal(t, uint64(3), stats.MessagesReceived)
+	assert.Equal(t, uint64(2), stats.MessagesDropped)
+	assert.Equal(t, 0, stats.PendingPackets)
+	assert.Equal(t, map[string]int{"foo/bar": 1}, stats.Backlog)
+	// SUBSCRIBE and PINGREQ sent; SUBACK, three PUBLISH and PINGRESP
+	// received.
+	assert.Equal(t, uint64(2), stats.PacketsSent)
+	assert.Equal(t, uint64(14+2), stats.BytesSent)
+	assert.Equal(t, uint64(5), stats.PacketsReceived)
+	assert.Equal(t, uint64(5+3*14+2), stats.BytesReceived)
+}
+
+func TestPayloadCodec(t *testing.T) {
+	isGzip := func(props []mqtt.UserProperty) bool {
+		for _, prop := range props {
+			if prop.Key == "content-encoding" && prop.Value == "gzip" {
+				return true
+			}
+		}
+		return false
+	}
+	encoder := func(
+		props []mqtt.UserProperty, payload []byte,
+	) ([]byte, error) {
+		if !isGzip(props) {
+			return payload, nil
+		}
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(payload); err != nil {
+			return nil, err
+		} else if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	decoder := func(
+		props []mqtt.UserProperty, payload []byte,
+	) ([]byte, error) {
+		if !isGzip(props) {
+			return payload, nil
+		}
+		r, err := gzip.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.ReadAll(r)
+	}
+
+	sent := make(chan []byte, 1)
+	broker, conn := NewPipeBroker(mqtt.MQTTv5, func(
+		b *PipeBroker, p packets.Packet,
+	) {
+		switch p := p.(type) {
+		case *packets.Subscribe:
+			b.Send(&packets.SubAck{
+				Version:          mqtt.MQTTv5,
+				PacketIdentifier: p.PacketIdentifier,
+				ReturnCodes:      []uint8{0},
+			})
+		case *packets.Publish:
+			sent <- p.Payload
+			// Loop back the message.
+			b.Send(&packets.Publish{
+				Version:        mqtt.MQTTv5,
+				Topic:          mqtt.Topic{Name: p.Topic.Name},
+				UserProperties: p.UserProperties,
+				Payload:        p.Payload,
+			})
+		}
+	})
+	defer broker.Close()
+	opts := NewClientOptions()
+	opts.SetVersion(mqtt.MQTTv5)
+	opts.SetPayloadEncoder(encoder)
+	opts.SetPayloadDecoder(decoder)
+	client := NewClient(conn, opts)
+	sub, err := client.Open("foo/bar", mqtt.QoS0)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	payload := bytes.Repeat([]byte("compress me "), 100)
+	pubOpts := NewPublishOptions()
+	pubOpts.AddUserProperty("content-encoding", "gzip")
+	err = client.Publish(mqtt.Topic{Name: "foo/bar"}, payload, pubOpts)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	// The payload is compressed on the wire.
+	wire := <-sent
+	assert.Equal(t, []byte{0x1F, 0x8B}, wire[:2])
+	assert.True(t, len(wire) < len(payload))
+	select {
+	case msg := <-sub.Messages():
+		assert.Equal(t, payload, msg.Payload)
+	case <-time.After(time.Second):
+		t.Fatal("message not delivered")
+	}
+}
+
+func TestInboundTopicLimits(t *testing.T) {
+	broker, conn := NewPipeBroker(mqtt.MQTTv311, func(
+		b *PipeBroker, p packets.Packet,
+	) {
+	})
+	defer broker.Close()
+	opts := NewClientOptions()
+	opts.SetMaxInboundTopicLevels(16)
+	client := NewClient(conn, opts)
+	go broker.Send(&packets.Publish{
+		Version: mqtt.MQTTv311,
+		Topic:   mqtt.Topic{Name: strings.Repeat("a/", 1000)},
+		Payload: []byte("baz"),
+	})
+	select {
+	case <-client.Done():
+	case <-time.After(time.Second):
+		t.Fatal("topic limit not enforced")
+	}
+	assert.True(t, errors.Is(client.Err(), mqtt.ErrTopicLimitExceeded),
+		client.Err())
+}
+
+func TestUnsolicitedPingResp(t *testing.T) {
+	broker, conn := NewPipeBroker(mqtt.MQTTv311, func(
+		b *PipeBroker, p packets.Packet,
+	) {
+	})
+	defer broker.Close()
+	deadLetters := make(chan mqtt.Message, 1)
+	opts := NewClientOptions()
+	opts.SetDeadLetterChannel(deadLetters)
+	client := NewClient(conn, opts)
+	go func() {
+		for i := 0; i < 2; i++ {
+			broker.Send(&packets.PingResp{Version: mqtt.MQTTv311})
+		}
+		// The receive routine keeps processing packets.
+		broker.Send(&packets.Publish{
+			Version: mqtt.MQTTv311,
+			Topic:   mqtt.Topic{Name: "foo/bar"},
+			Payload: []byte("baz"),
+		})
+	}()
+	select {
+	case msg := <-deadLetters:
+		assert.Equal(t, "foo/bar", msg.Topic)
+	case <-time.After(time.Second):
+		t.Fatal("receive routine stalled")
+	}
+	assert.NoError(t, client.Err())
+}
+
+func TestPauseResume(t *testing.T) {
+	pubAcks := make(chan *packets.PubAck, 1)
+	broker, conn := NewPipeBroker(mqtt.MQTTv311, func(
+		b *PipeBroker, p packets.Packet,
+	) {
+		switch p := p.(type) {
+		case *packets.Subscribe:
+			b.Send(&packets.SubAck{
+				Version:          mqtt.MQTTv311,
+				PacketIdentifier: p.PacketIdentifier,
+				ReturnCodes:      []uint8{1},
+			})
+		case *packets.PubAck:
+			pubAcks <- p
+		case *packets.PingReq:
+			b.Send(&packets.PingResp{Version: mqtt.MQTTv311})
+		}
+	})
+	defer broker.Close()
+	client := NewClient(conn)
+	client.paused = newPauseGate(3)
+	// The channel holds fewer messages than held while paused.
+	msgs := make(chan []byte, 1)
+	_, err := client.Subscribe(mqtt.Subscription{
+		Topic:    mqtt.Topic{Name: "foo/+", QoS: mqtt.QoS1},
+		Messages: msgs,
+	})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	client.Pause()
+	names := []string{"foo/a", "foo/b", "foo/c", "foo/d"}
+	go func() {
+		for i, name := range names {
+			broker.Send(&packets.Publish{
+				Version:          mqtt.MQTTv311,
+				Topic:            mqtt.Topic{Name: name, QoS: mqtt.QoS1},
+				PacketIdentifier: uint16(i + 1),
+				Payload:          []byte(name),
+			})
+		}
+	}()
+	// The messages are acknowledged while paused.
+	for i := 1; i <= len(names); i++ {
+		select {
+		case pubAck := <-pubAcks:
+			assert.Equal(t, uint16(i), pubAck.PacketIdentifier)
+		case <-time.After(time.Second):
+			t.Fatal("publish not acknowledged")
+		}
+	}
+	assert.NoError(t, client.Ping())
+	assert.Len(t, msgs, 0)
+	// The message exceeding the pause queue is dropped.
+	assert.Equal(t, uint64(1), client.Stats().MessagesDropped)
+
+	resumed := make(chan struct{})
+	go func() {
+		client.Resume()
+		close(resumed)
+	}()
+	// Resume blocks on the full subscriber channel without stalling the
+	// receive routine: publishes are acknowledged and pings answered.
+	for len(msgs) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	go broker.Send(&packets.Publish{
+		Version:          mqtt.MQTTv311,
+		Topic:            mqtt.Topic{Name: "foo/e", QoS: mqtt.QoS1},
+		PacketIdentifier: 5,
+		Payload:          []byte("foo/e"),
+	})
+	select {
+	case pubAck := <-pubAcks:
+		assert.Equal(t, uint16(5), pubAck.PacketIdentifier)
+	case <-time.After(time.Second):
+		t.Fatal("publish not acknowledged while resuming")
+	}
+	pinged := make(chan error, 1)
+	go func() { pinged <- client.Ping() }()
+	select {
+	case err := <-pinged:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("ping not answered while resuming")
+	}
+	// Resume waits for the subscriber instead of dropping the messages;
+	// the message received while resuming is delivered last.
+	for _, name := range append(names[:3], "foo/e") {
+		select {
+		case msg := <-msgs:
+			assert.Equal(t, name, string(msg))
+		case <-time.After(time.Second):
+			t.Fatal("message not delivered after resume")
+		}
+	}
+	select {
+	case <-resumed:
+	case <-time.After(time.Second):
+		t.Fatal("resume did not return")
+	}
+	assert.Equal(t, uint64(1), client.Stats().MessagesDropped)
+}
+
+func TestServerClosed(t *testing.T) {
+	// The server closes the connection.
+	conn := NewFakeConn(1)
+	close(conn.ReadChan)
+	conn.On("Write", mock.Anything).Return(0, nil)
+	client := NewClient(conn)
+	select {
+	case <-client.Done():
+	case <-time.After(time.Second):
+		t.Fatal("client did not detect connection close")
+	}
+	assert.EqualError(t, client.Err(), ErrServerClosed.Error())
+	err := client.Ping()
+	assert.EqualError(t, err, ErrServerClosed.Error())
+
+	// The connection fails.
+	conn = NewFakeConn(1)
+	conn.ReadChan <- []byte{0xD0}
+	conn.On("Read", mock.Anything).Return(0, io.ErrClosedPipe)
+	conn.On("Write", mock.Anything).Return(0, nil)
+	client = NewClient(conn)
+	select {
+	case <-client.Done():
+	case <-time.After(time.Second):
+		t.Fatal("client did not detect connection failure")
+	}
+	assert.EqualError(t, client.Err(), io.ErrClosedPipe.Error())
+}
@@ -0,0 +1,110 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// lookupSRV resolves SRV records; replaceable for testing.
+var lookupSRV = net.LookupSRV
+
+// setKeepAlive enables TCP keep-alive on the connection; replaceable for
+// testing.
+var setKeepAlive = func(conn *net.TCPConn, period time.Duration) error {
+	if err := conn.SetKeepAlive(true); err != nil {
+		return err
+	}
+	return conn.SetKeepAlivePeriod(period)
+}
+
+// dial connects to the TCP address applying the dial related client options.
+func dial(address string, options []*ClientOptions) (net.Conn, error) {
+	var timeout, keepAlive time.Duration
+	for _, opt := range options {
+		if opt == nil {
+			continue
+		}
+		if opt.Timeout != nil {
+			timeout = *opt.Timeout
+		}
+		if opt.TCPKeepAlive != nil {
+			keepAlive = *opt.TCPKeepAlive
+		}
+	}
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok && keepAlive > 0 {
+		if err := setKeepAlive(tcpConn, keepAlive); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// Dial connects to the broker at the TCP address (host:port) and returns a
+// client using the connection. The client Timeout option, if set, applies to
+// the dial, and the TCPKeepAlive option enables TCP keep-alive on the
+// connection. The returned client still requires a call to Connect.
+func Dial(address string, options ...*ClientOptions) (*Client, error) {
+	conn, err := dial(address, options)
+	if err != nil {
+		return nil, err
+	}
+	return newDialedClient(conn, address, options), nil
+}
+
+// newDialedClient initializes the client for a connection established by
+// Dial or DialSRV to address, enabling the connection buffers and redialing
+// the address for version fallbacks unless overridden by the options.
+func newDialedClient(
+	conn net.Conn,
+	address string,
+	options []*ClientOptions,
+) *Client {
+	defaults := NewClientOptions()
+	defaults.VersionFallbackDial = func() (net.Conn, error) {
+		return dial(address, options)
+	}
+	defaults.SetReadBufferSize(DefaultBufferSize)
+	defaults.SetWriteBufferSize(DefaultBufferSize)
+	return NewClient(conn, append([]*ClientOptions{defaults}, options...)...)
+}
+
+// DialSRV discovers the broker by looking up the DNS SRV records for
+// _service._tcp.domain and dials the targets in the order returned by
+// net.LookupSRV, i.e. by priority and randomized by weight (RFC 2782), until
+// a connection is established. The client Timeout option, if set,
+// applies to each dial attempt, and the TCPKeepAlive option enables TCP
+// keep-alive on the connection. The returned client still requires a call to
+// Connect.
+func DialSRV(
+	service, domain string,
+	options ...*ClientOptions,
+) (*Client, error) {
+	_, addrs, err := lookupSRV(service, "tcp", domain)
+	if err != nil {
+		return nil, err
+	} else if len(addrs) == 0 {
+		return nil, fmt.Errorf(
+			"no SRV records found for _%s._tcp.%s", service, domain,
+		)
+	}
+	for _, addr := range addrs {
+		host := strings.TrimSuffix(addr.Target, ".")
+		hostPort := net.JoinHostPort(
+			host, strconv.Itoa(int(addr.Port)),
+		)
+		var conn net.Conn
+		conn, err = dial(hostPort, options)
+		if err == nil {
+			return newDialedClient(conn, hostPort, options), nil
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,102 @@
+package client
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDialSRV(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	goodPort, _ := strconv.Atoi(port)
+
+	// Reserve a port that refuses connections.
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	_, port, _ = net.SplitHostPort(closed.Addr().String())
+	badPort, _ := strconv.Atoi(port)
+	closed.Close()
+
+	defer func(orig func(string, string, string) (
+		string, []*net.SRV, error,
+	)) {
+		lookupSRV = orig
+	}(lookupSRV)
+	lookupSRV = func(service, proto, name string) (
+		string, []*net.SRV, error,
+	) {
+		assert.Equal(t, "mqtt", service)
+		assert.Equal(t, "tcp", proto)
+		assert.Equal(t, "example.com", name)
+		return "", []*net.SRV{
+			{Target: "127.0.0.1.", Port: uint16(badPort), Priority: 10},
+			{Target: "127.0.0.1.", Port: uint16(goodPort), Priority: 20},
+		}, nil
+	}
+
+	opts := NewClientOptions()
+	opts.SetTimeout(time.Second)
+	client, err := DialSRV("mqtt", "example.com", opts)
+	if assert.NoError(t, err) {
+		defer client.io.Close()
+	}
+	select {
+	case conn := <-accepted:
+		conn.Close()
+	case <-time.After(time.Second):
+		t.Error("broker did not receive a connection")
+	}
+
+	lookupSRV = func(string, string, string) (string, []*net.SRV, error) {
+		return "", nil, nil
+	}
+	_, err = DialSRV("mqtt", "example.com")
+	assert.Error(t, err)
+}
+
+func TestDialTCPKeepAlive(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			conn.Close()
+		}
+	}()
+
+	var applied time.Duration
+	orig := setKeepAlive
+	defer func() { setKeepAlive = orig }()
+	setKeepAlive = func(conn *net.TCPConn, period time.Duration) error {
+		applied = period
+		return orig(conn, period)
+	}
+
+	opts := NewClientOptions()
+	opts.SetTCPKeepAlive(30 * time.Second)
+	client, err := Dial(ln.Addr().String(), opts)
+	if assert.NoError(t, err) {
+		client.io.Close()
+	}
+	assert.Equal(t, 30*time.Second, applied)
+}
@@ -0,0 +1,44 @@
+package client_test
+
+import (
+	"fmt"
+
+	"github.com/alfrunes/mqttie/client"
+	"github.com/alfrunes/mqttie/mqtt"
+)
+
+func ExampleNewTestBroker() {
+	broker, address := client.NewTestBroker()
+	defer broker.Close()
+
+	c, err := client.Dial(address)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if err := c.Connect(); err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer c.Disconnect()
+
+	messages := make(chan []byte, 1)
+	_, err = c.Subscribe(mqtt.Subscription{
+		Topic:    mqtt.Topic{Name: "greetings/+", QoS: mqtt.QoS1},
+		Messages: messages,
+	})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	err = c.Publish(
+		mqtt.Topic{Name: "greetings/world", QoS: mqtt.QoS1},
+		[]byte("hello"),
+	)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Println(string(<-messages))
+	// Output: hello
+}
@@ -0,0 +1,72 @@
+package client
+
+import (
+	"io/ioutil"
+	"net/http"
+
+	"github.com/alfrunes/mqttie/mqtt"
+)
+
+// HTTPMaxBodySize limits the request bodies read by HTTPPublishHandler if the
+// server has not announced a maximum packet size.
+var HTTPMaxBodySize int64 = 1 << 20
+
+// HTTPPublishHandler returns an http.Handler publishing the body of POST and
+// PUT requests on the topic returned by topicFromRequest. The topic's QoS
+// selects the delivery guarantee; the handler responds once the publish has
+// completed at that QoS. Requests for which topicFromRequest fails are
+// rejected with 400 Bad Request, bodies and publishes exceeding the server's
+// maximum packet size (or HTTPMaxBodySize) with 413 Request Entity Too Large
+// and other publish errors with 502 Bad Gateway.
+func HTTPPublishHandler(
+	c *Client,
+	topicFromRequest func(*http.Request) (mqtt.Topic, error),
+) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost, http.MethodPut:
+		default:
+			w.Header().Set("Allow", "POST, PUT")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed),
+				http.StatusMethodNotAllowed)
+			return
+		}
+		topic, err := topicFromRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// The payload cannot exceed the packet size.
+		limit := int64(c.SessionInfo().MaxPacketSize)
+		if limit == 0 {
+			limit = HTTPMaxBodySize
+		}
+		if r.ContentLength > limit {
+			http.Error(w, mqtt.ErrPacketTooLarge.Error(),
+				http.StatusRequestEntityTooLarge)
+			return
+		}
+		payload, err := ioutil.ReadAll(
+			http.MaxBytesReader(w, r.Body, limit),
+		)
+		if err != nil && int64(len(payload)) == limit {
+			// MaxBytesReader fails after reading limit bytes.
+			http.Error(w, mqtt.ErrPacketTooLarge.Error(),
+				http.StatusRequestEntityTooLarge)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = c.Publish(topic, payload)
+		switch err {
+		case nil:
+			w.WriteHeader(http.StatusNoContent)
+		case mqtt.ErrPacketTooLarge:
+			http.Error(w, err.Error(),
+				http.StatusRequestEntityTooLarge)
+		default:
+			http.Error(w, err.Error(), http.StatusBadGateway)
+		}
+	})
+}
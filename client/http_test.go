@@ -0,0 +1,88 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/alfrunes/mqttie/mqtt"
+	"github.com/alfrunes/mqttie/packets"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTPPublishHandler(t *testing.T) {
+	pubs := make(chan *packets.Publish, 1)
+	broker, conn := NewPipeBroker(mqtt.MQTTv311, func(
+		b *PipeBroker, p packets.Packet,
+	) {
+		if p, ok := p.(*packets.Publish); ok {
+			pubs <- p
+			b.Send(&packets.PubAck{
+				Version:          mqtt.MQTTv311,
+				PacketIdentifier: p.PacketIdentifier,
+			})
+		}
+	})
+	defer broker.Close()
+	client := NewClient(conn)
+
+	handler := HTTPPublishHandler(client, func(
+		r *http.Request,
+	) (mqtt.Topic, error) {
+		name := strings.TrimPrefix(r.URL.Path, "/hooks/")
+		if name == "" {
+			return mqtt.Topic{}, fmt.Errorf("missing topic")
+		}
+		return mqtt.Topic{Name: "hooks/" + name, QoS: mqtt.QoS1}, nil
+	})
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	rsp, err := http.Post(
+		srv.URL+"/hooks/deploy", "text/plain", strings.NewReader("done"),
+	)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	rsp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, rsp.StatusCode)
+	pub := <-pubs
+	assert.Equal(t, "hooks/deploy", pub.Topic.Name)
+	assert.Equal(t, mqtt.QoS1, pub.QoS)
+	assert.Equal(t, []byte("done"), pub.Payload)
+
+	rsp, err = http.Post(srv.URL+"/hooks/", "text/plain", nil)
+	if assert.NoError(t, err) {
+		rsp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, rsp.StatusCode)
+	}
+	rsp, err = http.Get(srv.URL + "/hooks/deploy")
+	if assert.NoError(t, err) {
+		rsp.Body.Close()
+		assert.Equal(t, http.StatusMethodNotAllowed, rsp.StatusCode)
+	}
+
+	// Bodies exceeding the limit are rejected without publishing, both
+	// with and without a content length.
+	defer func(size int64) { HTTPMaxBodySize = size }(HTTPMaxBodySize)
+	HTTPMaxBodySize = 4
+	rsp, err = http.Post(
+		srv.URL+"/hooks/deploy", "text/plain", strings.NewReader("failed"),
+	)
+	if assert.NoError(t, err) {
+		rsp.Body.Close()
+		assert.Equal(t, http.StatusRequestEntityTooLarge, rsp.StatusCode)
+	}
+	rsp, err = http.Post(
+		srv.URL+"/hooks/deploy", "text/plain",
+		struct{ io.Reader }{strings.NewReader("failed")},
+	)
+	if assert.NoError(t, err) {
+		rsp.Body.Close()
+		assert.Equal(t, http.StatusRequestEntityTooLarge, rsp.StatusCode)
+	}
+	assert.Empty(t, pubs)
+}
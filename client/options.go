@@ -1,6 +1,7 @@
 package client
 
 import (
+	"net"
 	"time"
 
 	"github.com/alfrunes/mqttie/mqtt"
@@ -10,11 +11,138 @@ import (
 type ClientOptions struct {
 	// Version signifies the protocol version to be used. Defaults to 3.1.1
 	Version *mqtt.Version
+	// VersionFallback lists the protocol versions, in order, that Connect
+	// retries the handshake with if the server refuses the protocol
+	// version. Defaults to none.
+	VersionFallback []mqtt.Version
+	// VersionFallbackDial opens the connection for each fallback
+	// handshake, since servers close the connection after refusing the
+	// version. Clients created by Dial or DialSRV redial the server by
+	// default. The fallback requires a dial function: without one,
+	// Connect returns ErrNoFallbackDial when the version is refused.
+	VersionFallbackDial func() (net.Conn, error)
 	// The client identity communicated with the server. Defaults to random
 	// UUID (version 4).
 	ClientID *string
 	// Timeout sets the duration for how long the client blocks on requests.
 	Timeout *time.Duration
+	// OrderedDelivery makes the client deliver messages to subscribers
+	// from a per-subscription worker queueing up to 1024 messages
+	// instead of discarding messages when the subscriber channel is full.
+	// Messages on the same subscription are delivered strictly in the
+	// order they are received. Defaults to false.
+	OrderedDelivery *bool
+	// CopyPayloads makes the client copy the payload of received messages
+	// before passing them to subscribers, guaranteeing that the delivered
+	// buffer is never shared with the decoded packet. Without this option
+	// the subscriber receives the payload buffer of the packet, which is
+	// allocated per packet and owned by the subscriber once delivered.
+	// Defaults to false.
+	CopyPayloads *bool
+	// RetainedCache makes the client remember the last retained message
+	// received per topic, available from Client.LastRetained. Defaults to
+	// false.
+	RetainedCache *bool
+	// DeadLetterChannel receives the messages the client received but
+	// could not deliver, because no subscription matches the topic or
+	// the subscriber channel is full or closed. Messages are passed
+	// without blocking and discarded if the channel is full. Defaults to
+	// none.
+	DeadLetterChannel chan<- mqtt.Message
+	// IncomingQoS2Validator is called with each incoming QoS2 message
+	// before it is delivered and returns the PUBREC reason code. A reason
+	// code of 0x80 or greater (e.g. packets.PubRecQuotaExceeded) rejects
+	// the message: it is not delivered and the flow ends with the PUBREC.
+	// The validator is called from the receive routine and applies to
+	// MQTTv5 only. Defaults to none (all messages accepted).
+	IncomingQoS2Validator func(mqtt.Message) uint8
+	// MaxInflightControl bounds the number of concurrent in-flight
+	// subscribe and unsubscribe requests; further requests block until
+	// an acknowledgement is received. Defaults to 0 (unbounded).
+	MaxInflightControl *int
+	// MaxTopicsPerSubscribe bounds the number of topic filters sent in a
+	// single subscribe packet; Subscribe splits larger requests into
+	// multiple packets and aggregates the return codes. Defaults to 0
+	// (unlimited).
+	MaxTopicsPerSubscribe *int
+	// SkipInvalidFilters makes Subscribe skip invalid topic filters,
+	// reporting the failure return code (0x80) for them, instead of
+	// failing the request with a *TopicFilterError. Defaults to false.
+	SkipInvalidFilters *bool
+	// AckTimeout sets the duration the client waits for the server to
+	// acknowledge an unsubscribe request. Defaults to 0 (no timeout).
+	AckTimeout *time.Duration
+	// MaxInboundPacketSize is the maximum size of packets the client
+	// accepts from the server. Larger packets are rejected before the
+	// packet body is read, and the limit is advertised to MQTTv5 servers.
+	// Defaults to 0 (unlimited).
+	MaxInboundPacketSize *uint32
+	// MaxInboundTopicLength and MaxInboundTopicLevels limit the length
+	// in bytes and the number of levels of the topics received from the
+	// server, guarding against pathological topics from a misbehaving
+	// server. A packet exceeding the limits is a protocol error
+	// (mqtt.ErrTopicLimitExceeded) terminating the connection. Defaults
+	// to 0 (unlimited).
+	MaxInboundTopicLength *int
+	MaxInboundTopicLevels *int
+	// CloseOnUnsubscribe makes the client close the subscriber channel
+	// when the subscription is removed by Unsubscribe, such that readers
+	// can detect completion. A channel shared between subscriptions is
+	// closed once the last of them is removed. Defaults to false.
+	CloseOnUnsubscribe *bool
+	// Clock is the time source used for keep-alive and timeouts.
+	// Defaults to the system clock.
+	Clock Clock
+	// ReadBufferSize is the size of the buffer for reads from the
+	// connection, such that bursts of packets are decoded with few reads
+	// on the connection. A size of 0 disables buffering. Defaults to
+	// DefaultBufferSize for connections established by Dial and DialSRV,
+	// otherwise 0 (unbuffered).
+	ReadBufferSize *int
+	// WriteBufferSize is the size of the buffer for writes to the
+	// connection, such that packets sent concurrently (e.g. from several
+	// publishing goroutines) are written with few writes on the
+	// connection. A size of 0 disables buffering. Defaults as
+	// ReadBufferSize.
+	WriteBufferSize *int
+	// TCPKeepAlive enables TCP keep-alive with the given period on
+	// connections established by Dial and DialSRV, detecting dead peers
+	// independent of the MQTT keep-alive. Defaults to 0 (system default).
+	TCPKeepAlive *time.Duration
+	// FlowControlBlockedHandler is called when a QoS1 or QoS2 publish
+	// blocks because the number of unacknowledged publishes has reached
+	// the server's Receive Maximum (MQTTv5). The handler is called from
+	// the publishing goroutine. Defaults to none.
+	FlowControlBlockedHandler func()
+	// PacketIDAllocator returns the packet identifiers of outbound
+	// requests instead of the client's built-in counter, e.g. to
+	// coordinate identifiers externally. The allocator may be called
+	// concurrently; an identifier that is zero or in use by an in-flight
+	// packet fails the request with ErrPacketIDInUse. Defaults to none
+	// (built-in counter).
+	PacketIDAllocator func() (uint16, error)
+	// Store holds the outbound packets awaiting acknowledgement. A
+	// persistent store (e.g. FileStore) allows resuming the in-flight
+	// QoS1 and QoS2 flows after a restart when connecting with
+	// CleanSession=false. Defaults to a MemoryStore.
+	Store Store
+	// PayloadEncoder transforms the payload of published messages before
+	// they are sent, e.g. to compress or encrypt them, given the user
+	// properties of the message (MQTTv5). An error fails the publish.
+	// Defaults to none.
+	PayloadEncoder func(
+		props []mqtt.UserProperty, payload []byte,
+	) ([]byte, error)
+	// PayloadDecoder transforms the payload of received messages before
+	// they are delivered, reversing PayloadEncoder. Messages failing to
+	// decode are logged and discarded. The decoder is called from the
+	// receive routine. Defaults to none.
+	PayloadDecoder func(
+		props []mqtt.UserProperty, payload []byte,
+	) ([]byte, error)
+	// ReconnectBackoff computes the delays between the attempts of
+	// Client.ReconnectWithBackoff. Defaults to DefaultReconnectBackoff.
+	ReconnectBackoff Backoff
 }
 
 // NewClientOptions initializes a new empty client options struct.
@@ -27,6 +155,19 @@ func (opts *ClientOptions) SetVersion(version mqtt.Version) {
 	opts.Version = &version
 }
 
+// SetVersionFallback sets the protocol versions to retry connecting with.
+func (opts *ClientOptions) SetVersionFallback(versions []mqtt.Version) {
+	opts.VersionFallback = versions
+}
+
+// SetVersionFallbackDial sets the function dialing a new connection for
+// each version fallback.
+func (opts *ClientOptions) SetVersionFallbackDial(
+	dial func() (net.Conn, error),
+) {
+	opts.VersionFallbackDial = dial
+}
+
 // SetClientID sets the client id communicated with the server.
 func (opts *ClientOptions) SetClientID(id string) {
 	opts.ClientID = &id
@@ -38,6 +179,147 @@ func (opts *ClientOptions) SetTimeout(timeout time.Duration) {
 	opts.Timeout = &timeout
 }
 
+// SetOrderedDelivery enables or disables ordered per-subscription delivery
+// of messages to subscribers.
+func (opts *ClientOptions) SetOrderedDelivery(ordered bool) {
+	opts.OrderedDelivery = &ordered
+}
+
+// SetCopyPayloads sets whether the client delivers copies of the received
+// payloads to subscribers.
+func (opts *ClientOptions) SetCopyPayloads(copyPayloads bool) {
+	opts.CopyPayloads = &copyPayloads
+}
+
+// SetRetainedCache sets whether the client remembers the last retained
+// message per topic.
+func (opts *ClientOptions) SetRetainedCache(enable bool) {
+	opts.RetainedCache = &enable
+}
+
+// SetDeadLetterChannel sets the channel receiving undeliverable messages.
+func (opts *ClientOptions) SetDeadLetterChannel(c chan<- mqtt.Message) {
+	opts.DeadLetterChannel = c
+}
+
+// SetIncomingQoS2Validator sets the function accepting or rejecting incoming
+// QoS2 messages.
+func (opts *ClientOptions) SetIncomingQoS2Validator(
+	validator func(mqtt.Message) uint8,
+) {
+	opts.IncomingQoS2Validator = validator
+}
+
+// SetMaxInflightControl sets the maximum number of concurrent in-flight
+// subscribe and unsubscribe requests.
+func (opts *ClientOptions) SetMaxInflightControl(max int) {
+	opts.MaxInflightControl = &max
+}
+
+// SetSkipInvalidFilters sets whether Subscribe skips invalid topic filters
+// instead of failing the request.
+func (opts *ClientOptions) SetSkipInvalidFilters(skip bool) {
+	opts.SkipInvalidFilters = &skip
+}
+
+// SetMaxTopicsPerSubscribe sets the maximum number of topic filters per
+// subscribe packet.
+func (opts *ClientOptions) SetMaxTopicsPerSubscribe(n int) {
+	opts.MaxTopicsPerSubscribe = &n
+}
+
+// SetReadBufferSize sets the size of the buffer for reads from the
+// connection.
+func (opts *ClientOptions) SetReadBufferSize(size int) {
+	opts.ReadBufferSize = &size
+}
+
+// SetWriteBufferSize sets the size of the buffer for writes to the
+// connection.
+func (opts *ClientOptions) SetWriteBufferSize(size int) {
+	opts.WriteBufferSize = &size
+}
+
+// SetTCPKeepAlive sets the TCP keep-alive period of connections dialed by the
+// client.
+func (opts *ClientOptions) SetTCPKeepAlive(period time.Duration) {
+	opts.TCPKeepAlive = &period
+}
+
+// SetPacketIDAllocator sets the function allocating packet identifiers.
+func (opts *ClientOptions) SetPacketIDAllocator(
+	allocator func() (uint16, error),
+) {
+	opts.PacketIDAllocator = allocator
+}
+
+// SetFlowControlBlockedHandler sets the handler called when a publish blocks
+// on the server's Receive Maximum.
+func (opts *ClientOptions) SetFlowControlBlockedHandler(handler func()) {
+	opts.FlowControlBlockedHandler = handler
+}
+
+// SetClock sets the time source used by the client.
+func (opts *ClientOptions) SetClock(clock Clock) {
+	opts.Clock = clock
+}
+
+// SetStore sets the store holding the packets awaiting acknowledgement.
+func (opts *ClientOptions) SetStore(store Store) {
+	opts.Store = store
+}
+
+// SetCloseOnUnsubscribe sets whether the client closes subscriber channels
+// on unsubscribe.
+func (opts *ClientOptions) SetCloseOnUnsubscribe(closeChan bool) {
+	opts.CloseOnUnsubscribe = &closeChan
+}
+
+// SetAckTimeout sets the duration to wait for the server to acknowledge
+// unsubscribe requests.
+func (opts *ClientOptions) SetAckTimeout(timeout time.Duration) {
+	opts.AckTimeout = &timeout
+}
+
+// SetPayloadEncoder sets the transformation applied to the payload of
+// published messages.
+func (opts *ClientOptions) SetPayloadEncoder(
+	encoder func(props []mqtt.UserProperty, payload []byte) ([]byte, error),
+) {
+	opts.PayloadEncoder = encoder
+}
+
+// SetPayloadDecoder sets the transformation applied to the payload of
+// received messages.
+func (opts *ClientOptions) SetPayloadDecoder(
+	decoder func(props []mqtt.UserProperty, payload []byte) ([]byte, error),
+) {
+	opts.PayloadDecoder = decoder
+}
+
+// SetReconnectBackoff sets the backoff between reconnect attempts.
+func (opts *ClientOptions) SetReconnectBackoff(backoff Backoff) {
+	opts.ReconnectBackoff = backoff
+}
+
+// SetMaxInboundPacketSize sets the maximum size of packets accepted from the
+// server.
+func (opts *ClientOptions) SetMaxInboundPacketSize(size uint32) {
+	opts.MaxInboundPacketSize = &size
+}
+
+// SetMaxInboundTopicLength sets the maximum length of topics accepted from
+// the server.
+func (opts *ClientOptions) SetMaxInboundTopicLength(length int) {
+	opts.MaxInboundTopicLength = &length
+}
+
+// SetMaxInboundTopicLevels sets the maximum number of levels of topics
+// accepted from the server.
+func (opts *ClientOptions) SetMaxInboundTopicLevels(levels int) {
+	opts.MaxInboundTopicLevels = &levels
+}
+
 // ConnectOptions holds configuration options for making a connect request.
 type ConnectOptions struct {
 	// CleanSession indicates whether the server should discard any
@@ -64,6 +346,21 @@ type ConnectOptions struct {
 	// NOTE: if the WillTopic QoS is QoS0 the server may discard the packet
 	//       at any time.
 	WillRetain *bool
+
+	// The following options applies only to MQTTv5
+
+	// TopicAliasMax is the highest topic alias the server may use when
+	// publishing to the client. Defaults to 0 (topic aliases disabled).
+	TopicAliasMax *uint16
+	// SessionExpiryInterval is the number of seconds the server keeps
+	// the session after the connection is closed, such that the session
+	// survives reconnects. Defaults to 0 (the session ends with the
+	// connection).
+	SessionExpiryInterval *uint32
+	// RequestResponseInfo requests the server to return the basis for
+	// response topics, used by Client.Request (see
+	// mqtt.SessionInfo.ResponseInfo). Defaults to false.
+	RequestResponseInfo *bool
 }
 
 // NewConnectOptions initializes a new connect options struct.
@@ -88,6 +385,18 @@ func (opts *ConnectOptions) SetKeepAlive(duration time.Duration) {
 	opts.KeepAlive = &secsUint16
 }
 
+// SetKeepAliveStrict sets the keep alive to the given duration like
+// SetKeepAlive, but returns ErrKeepAliveRange, leaving the options unchanged,
+// instead of truncating a duration longer than the maximum 18:12:15
+// (hr:min:sec). Durations are rounded down to whole seconds.
+func (opts *ConnectOptions) SetKeepAliveStrict(duration time.Duration) error {
+	if duration < 0 || duration >= (1<<16)*time.Second {
+		return ErrKeepAliveRange
+	}
+	opts.SetKeepAlive(duration)
+	return nil
+}
+
 // SetUsername sets the username credential.
 func (opts *ConnectOptions) SetUsername(username string) {
 	opts.Username = &username
@@ -109,11 +418,83 @@ func (opts *ConnectOptions) SetWillMessage(message []byte) {
 	opts.WillMessage = message
 }
 
+// SetTopicAliasMax sets the maximum topic alias accepted from the server
+// (MQTTv5).
+func (opts *ConnectOptions) SetTopicAliasMax(max uint16) {
+	opts.TopicAliasMax = &max
+}
+
+// SetSessionExpiryInterval sets the duration the server keeps the session
+// after the connection is closed (MQTTv5).
+// NOTE: If the duration exceeds the maximum of 0xFFFFFFFF seconds, the value
+// is truncated to this maximum, which means the session does not expire.
+func (opts *ConnectOptions) SetSessionExpiryInterval(interval time.Duration) {
+	opts.SessionExpiryInterval = sessionExpirySeconds(interval)
+}
+
+// SetRequestResponseInfo sets whether to request response information from
+// the server (MQTTv5).
+func (opts *ConnectOptions) SetRequestResponseInfo(request bool) {
+	opts.RequestResponseInfo = &request
+}
+
+// sessionExpirySeconds converts interval to a session expiry interval in
+// whole seconds.
+func sessionExpirySeconds(interval time.Duration) *uint32 {
+	secs := int64(interval.Seconds())
+	if secs > int64(^uint32(0)) {
+		secs = int64(^uint32(0))
+	} else if secs < 0 {
+		secs = 0
+	}
+	secsUint32 := uint32(secs)
+	return &secsUint32
+}
+
+// DisconnectOptions contains configuration options for disconnecting.
+type DisconnectOptions struct {
+	// The following options applies only to MQTTv5
+
+	// SessionExpiryInterval updates the session expiry interval set on
+	// connect; 0 ends the session when the connection closes. Defaults
+	// to the interval set on connect.
+	SessionExpiryInterval *uint32
+}
+
+// NewDisconnectOptions initializes a new blank disconnect options struct.
+func NewDisconnectOptions() *DisconnectOptions {
+	return &DisconnectOptions{}
+}
+
+// SetSessionExpiryInterval sets the session expiry interval sent with the
+// disconnect (MQTTv5), e.g. 0 to discard the session of a client that is
+// going away. See ConnectOptions.SetSessionExpiryInterval.
+func (opts *DisconnectOptions) SetSessionExpiryInterval(
+	interval time.Duration,
+) {
+	opts.SessionExpiryInterval = sessionExpirySeconds(interval)
+}
+
 // PublishOptions contains configuration options for making a publish request.
 type PublishOptions struct {
 	// Retain determines whether the server should retain the application
 	// message and it's QoS to be delivered to future subscribers.
 	Retain *bool
+	// QoS overrides the QoS of the topic passed to Publish.
+	QoS *mqtt.QoS
+
+	// The following options applies only to MQTTv5
+
+	// ResponseTopic is the topic the receivers should publish responses
+	// to. Defaults to none.
+	ResponseTopic *string
+	// CorrelationData is passed along with the response and used by the
+	// requester to identify which request the response is for.
+	// Defaults to none.
+	CorrelationData []byte
+	// UserProperties are the user properties of the published message,
+	// e.g. describing the payload encoding. Defaults to none.
+	UserProperties []mqtt.UserProperty
 }
 
 // NewPublishOptions initializes a new blank publish options struct.
@@ -121,7 +502,34 @@ func NewPublishOptions() *PublishOptions {
 	return &PublishOptions{}
 }
 
-// SetRetain sets the retain flag to the given value.
+// SetRetain sets the retain flag to the given value. Publishing an empty
+// payload with the retain flag set clears the retained message on the topic.
 func (opts *PublishOptions) SetRetain(retain bool) {
 	opts.Retain = &retain
 }
+
+// SetQoS sets the QoS of the published message, overriding the QoS of the
+// topic.
+func (opts *PublishOptions) SetQoS(qos mqtt.QoS) {
+	opts.QoS = &qos
+}
+
+// SetResponseTopic sets the response topic of the published message (MQTTv5).
+func (opts *PublishOptions) SetResponseTopic(topic string) {
+	opts.ResponseTopic = &topic
+}
+
+// SetCorrelationData sets the correlation data of the published message
+// (MQTTv5).
+func (opts *PublishOptions) SetCorrelationData(data []byte) {
+	opts.CorrelationData = data
+}
+
+// AddUserProperty appends a user property to the published message
+// (MQTTv5).
+func (opts *PublishOptions) AddUserProperty(key, value string) {
+	opts.UserProperties = append(opts.UserProperties, mqtt.UserProperty{
+		Key:   key,
+		Value: value,
+	})
+}
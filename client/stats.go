@@ -0,0 +1,68 @@
+package client
+
+import (
+	"sync/atomic"
+
+	"github.com/alfrunes/mqttie/packets"
+)
+
+// Stats is a snapshot of the client's message statistics.
+type Stats struct {
+	// MessagesReceived is the number of publish messages received from
+	// the server.
+	MessagesReceived uint64
+	// MessagesDropped is the number of received messages discarded
+	// because the subscriber channel was full or the payload failed to
+	// decode.
+	MessagesDropped uint64
+	// PendingPackets is the number of QoS1 and QoS2 packets awaiting
+	// acknowledgement.
+	PendingPackets int
+	// PublishesBlocked is the number of publishes waiting for the
+	// server's Receive Maximum to admit them (MQTTv5).
+	PublishesBlocked int64
+	// Backlog maps topic filters to the number of messages buffered in
+	// the subscriber channel.
+	Backlog map[string]int
+	// BytesSent and BytesReceived are the number of bytes written to and
+	// read from the connections of the client, including the previous
+	// connections replaced by Reconnect.
+	BytesSent     uint64
+	BytesReceived uint64
+	// PacketsSent and PacketsReceived are the number of packets sent and
+	// received, counted like the bytes.
+	PacketsSent     uint64
+	PacketsReceived uint64
+}
+
+// clientStats holds the counters updated by the receive routine. The
+// counters are accessed atomically.
+type clientStats struct {
+	received uint64
+	dropped  uint64
+	blocked  int64
+	// previous holds the traffic of the connections replaced by
+	// Reconnect.
+	previous packets.IOStats
+}
+
+// Stats returns a snapshot of the client's message statistics.
+func (c *Client) Stats() Stats {
+	subs := c.subs.All()
+	backlog := make(map[string]int, len(subs))
+	for name, sub := range subs {
+		backlog[name] = len(sub.c)
+	}
+	traffic := c.stats.previous.Add(c.io.Stats())
+	return Stats{
+		MessagesReceived: atomic.LoadUint64(&c.stats.received),
+		MessagesDropped:  atomic.LoadUint64(&c.stats.dropped),
+		PendingPackets:   c.pendingPackets.Len(),
+		PublishesBlocked: atomic.LoadInt64(&c.stats.blocked),
+		Backlog:          backlog,
+		BytesSent:        traffic.BytesSent,
+		BytesReceived:    traffic.BytesReceived,
+		PacketsSent:      traffic.PacketsSent,
+		PacketsReceived:  traffic.PacketsReceived,
+	}
+}
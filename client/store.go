@@ -0,0 +1,176 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/alfrunes/mqttie/mqtt"
+	"github.com/alfrunes/mqttie/packets"
+)
+
+// ErrNotStored is returned by Store.Get if no packet is stored under the
+// packet identifier.
+var ErrNotStored = fmt.Errorf("packet not found in store")
+
+// Store holds the outbound packets awaiting acknowledgement (the client's
+// in-flight QoS1 and QoS2 state) indexed by packet identifier. The default
+// store keeps the packets in memory; a persistent store, injected using
+// ClientOptions.SetStore, allows a client using CleanSession=false to resume
+// the in-flight flows after a restart. The client serializes calls to the
+// store.
+type Store interface {
+	// Put stores the packet, replacing any packet with the same
+	// identifier.
+	Put(packetID uint16, packet packets.Packet) error
+	// Get returns the packet stored under the identifier or
+	// ErrNotStored.
+	Get(packetID uint16) (packets.Packet, error)
+	// Del removes the packet; removing a packet that is not stored is
+	// not an error.
+	Del(packetID uint16) error
+	// List returns all stored packets indexed by packet identifier. The
+	// returned map is owned by the caller.
+	List() (map[uint16]packets.Packet, error)
+}
+
+// MemoryStore is a Store keeping the packets in memory.
+type MemoryStore struct {
+	packets map[uint16]packets.Packet
+}
+
+// NewMemoryStore initializes an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{packets: make(map[uint16]packets.Packet)}
+}
+
+// Put implements Store.
+func (s *MemoryStore) Put(packetID uint16, packet packets.Packet) error {
+	s.packets[packetID] = packet
+	return nil
+}
+
+// Get implements Store.
+func (s *MemoryStore) Get(packetID uint16) (packets.Packet, error) {
+	packet, ok := s.packets[packetID]
+	if !ok {
+		return nil, ErrNotStored
+	}
+	return packet, nil
+}
+
+// Del implements Store.
+func (s *MemoryStore) Del(packetID uint16) error {
+	delete(s.packets, packetID)
+	return nil
+}
+
+// List implements Store.
+func (s *MemoryStore) List() (map[uint16]packets.Packet, error) {
+	ret := make(map[uint16]packets.Packet, len(s.packets))
+	for id, packet := range s.packets {
+		ret[id] = packet
+	}
+	return ret, nil
+}
+
+// FileStore is a Store persisting each packet in its binary encoding to a
+// file in a directory, named by the packet identifier. The packets are
+// also kept in memory, such that Get and List never touch the disk; an error
+// from Put or Del means that the change is not persisted.
+type FileStore struct {
+	dir     string
+	version mqtt.Version
+	mem     *MemoryStore
+}
+
+// NewFileStore opens the store in the directory dir, creating the directory
+// if it does not exist, and loads the packets persisted by a previous
+// process. The version must match the protocol version of the client.
+func NewFileStore(dir string, version mqtt.Version) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	s := &FileStore{
+		dir:     dir,
+		version: version,
+		mem:     NewMemoryStore(),
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		id, err := strconv.ParseUint(file.Name(), 10, 16)
+		if err != nil || !file.Mode().IsRegular() {
+			// Not a packet (e.g. an interrupted write).
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		packet, err := packets.ReadPacket(bytes.NewReader(b), version)
+		if err != nil {
+			return nil, fmt.Errorf(
+				"failed to decode stored packet %d: %s", id, err,
+			)
+		}
+		s.mem.Put(uint16(id), packet)
+	}
+	return s, nil
+}
+
+func (s *FileStore) path(packetID uint16) string {
+	return filepath.Join(s.dir, strconv.FormatUint(uint64(packetID), 10))
+}
+
+// Put implements Store. The file is replaced atomically.
+func (s *FileStore) Put(packetID uint16, packet packets.Packet) error {
+	s.mem.Put(packetID, packet)
+	b, err := packet.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(s.dir, ".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if errClose := f.Close(); err == nil {
+		err = errClose
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), s.path(packetID))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// Get implements Store.
+func (s *FileStore) Get(packetID uint16) (packets.Packet, error) {
+	return s.mem.Get(packetID)
+}
+
+// Del implements Store.
+func (s *FileStore) Del(packetID uint16) error {
+	s.mem.Del(packetID)
+	err := os.Remove(s.path(packetID))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// List implements Store.
+func (s *FileStore) List() (map[uint16]packets.Packet, error) {
+	return s.mem.List()
+}
@@ -0,0 +1,115 @@
+package client
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/alfrunes/mqttie/mqtt"
+	"github.com/alfrunes/mqttie/packets"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileStoreResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mqttie-store")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := NewFileStore(dir, mqtt.MQTTv311)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	// The server receives the publish, but the connection is lost before
+	// the exactly-once flow completes.
+	pubRels := make(chan *packets.PubRel, 1)
+	broker, conn := NewPipeBroker(mqtt.MQTTv311, func(
+		b *PipeBroker, p packets.Packet,
+	) {
+		switch p := p.(type) {
+		case *packets.Publish:
+			b.Send(&packets.PubRec{
+				Version:          mqtt.MQTTv311,
+				PacketIdentifier: p.PacketIdentifier,
+			})
+		case *packets.PubRel:
+			pubRels <- p
+		}
+	})
+	opts := NewClientOptions()
+	opts.SetStore(store)
+	client := NewClient(conn, opts)
+	published := make(chan error, 1)
+	go func() {
+		published <- client.Publish(
+			mqtt.Topic{Name: "foo", QoS: mqtt.QoS2}, []byte("bar"),
+		)
+	}()
+	var packetID uint16
+	select {
+	case pubRel := <-pubRels:
+		packetID = pubRel.PacketIdentifier
+	case <-time.After(time.Second):
+		t.Fatal("publish not released")
+	}
+	broker.Close()
+	select {
+	case err := <-published:
+		assert.Error(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("publish not aborted")
+	}
+	<-client.Done()
+
+	// Restart the client with the persisted session.
+	store, err = NewFileStore(dir, mqtt.MQTTv311)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	pending, _ := store.List()
+	if assert.Len(t, pending, 1) {
+		assert.IsType(t, &packets.PubRel{}, pending[packetID])
+	}
+	broker, conn = NewPipeBroker(mqtt.MQTTv311, func(
+		b *PipeBroker, p packets.Packet,
+	) {
+		switch p := p.(type) {
+		case *packets.Connect:
+			b.Send(&packets.ConnAck{
+				Version:        mqtt.MQTTv311,
+				SessionPresent: true,
+			})
+		case *packets.PubRel:
+			pubRels <- p
+			b.Send(&packets.PubComp{
+				Version:          mqtt.MQTTv311,
+				PacketIdentifier: p.PacketIdentifier,
+			})
+		}
+	})
+	defer broker.Close()
+	opts.SetStore(store)
+	client = NewClient(conn, opts)
+	connOpts := NewConnectOptions()
+	connOpts.SetCleanSession(false)
+	err = client.Connect(connOpts)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	select {
+	case pubRel := <-pubRels:
+		assert.Equal(t, packetID, pubRel.PacketIdentifier)
+	case <-time.After(time.Second):
+		t.Fatal("release not retransmitted")
+	}
+	for i := 0; i < 100 && client.pendingPackets.Len() > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Zero(t, client.pendingPackets.Len())
+	files, err := ioutil.ReadDir(dir)
+	if assert.NoError(t, err) {
+		assert.Empty(t, files)
+	}
+}
@@ -0,0 +1,132 @@
+package client
+
+import (
+	"time"
+
+	"github.com/alfrunes/mqttie/mqtt"
+)
+
+// subscriptionBufferSize is the capacity of the message channel of
+// subscriptions opened with Client.Open.
+const subscriptionBufferSize = 64
+
+// Subscription is a subscription to a single topic filter opened by
+// Client.Open. Unlike subscriptions created by Subscribe, the message channel
+// is owned by the subscription and closed when the subscription ends.
+type Subscription struct {
+	client   *Client
+	filter   string
+	sub      *subscription
+	messages <-chan mqtt.Message
+}
+
+// Open subscribes to the topic filter with the requested QoS and blocks until
+// the server acknowledges the subscription. If the server refuses the
+// subscription, ErrSubscriptionRefused is returned.
+func (c *Client) Open(filter string, qos mqtt.QoS) (*Subscription, error) {
+	return c.open(filter, qos, subscriptionBufferSize)
+}
+
+// SubscribeBuffered subscribes to the topic filter like Open with a message
+// channel of capacity bufSize (0 or less: unbuffered), and returns the
+// channel. Messages are discarded if the channel is full. The channel is
+// closed when the filter is unsubscribed using Unsubscribe.
+func (c *Client) SubscribeBuffered(
+	filter string, qos mqtt.QoS, bufSize int,
+) (<-chan mqtt.Message, error) {
+	if bufSize < 0 {
+		bufSize = 0
+	}
+	s, err := c.open(filter, qos, bufSize)
+	if err != nil {
+		return nil, err
+	}
+	return s.messages, nil
+}
+
+// SubscribeRetained subscribes to the topic filter like Open and collects
+// the messages received within timeout, i.e. the retained messages the server
+// sends on subscribing, before unsubscribing. The messages are returned in
+// the order received. If unsubscribing fails, the collected messages are
+// returned along with the error.
+func (c *Client) SubscribeRetained(
+	filter string, qos mqtt.QoS, timeout time.Duration,
+) ([]mqtt.Message, error) {
+	s, err := c.open(filter, qos, subscriptionBufferSize)
+	if err != nil {
+		return nil, err
+	}
+	var msgs []mqtt.Message
+	timer := c.clock.NewTimer(timeout)
+	defer timer.Stop()
+	for collecting := true; collecting; {
+		select {
+		case msg := <-s.messages:
+			msgs = append(msgs, msg)
+		case <-timer.C():
+			// Include the messages already received.
+			for len(s.messages) > 0 {
+				msgs = append(msgs, <-s.messages)
+			}
+			collecting = false
+		}
+	}
+	return msgs, s.Close()
+}
+
+// open subscribes to the topic filter with a message channel of the given
+// capacity (see Open).
+func (c *Client) open(
+	filter string, qos mqtt.QoS, bufSize int,
+) (*Subscription, error) {
+	messages := make(chan mqtt.Message, bufSize)
+	sub := newSubscription(qos, nil)
+	sub.msgs = messages
+	_, result, err := c.subscribeAsync(
+		[]mqtt.Topic{{Name: filter, QoS: qos}},
+		[]*subscription{sub},
+	)
+	if err != nil {
+		return nil, err
+	}
+	res := <-result
+	if res.Err == nil &&
+		(len(res.ReturnCodes) == 0 || res.ReturnCodes[0] > 2) {
+		res.Err = ErrSubscriptionRefused
+	}
+	if res.Err != nil {
+		// The failed subscription is already removed.
+		sub.Close(true)
+		return nil, res.Err
+	}
+	return &Subscription{
+		client:   c,
+		filter:   filter,
+		sub:      sub,
+		messages: messages,
+	}, nil
+}
+
+// Filter returns the topic filter of the subscription.
+func (s *Subscription) Filter() string {
+	return s.filter
+}
+
+// Messages returns the channel receiving the messages published on topics
+// matching the filter. The channel is closed when the subscription is
+// closed. Messages are discarded if the channel is full.
+func (s *Subscription) Messages() <-chan mqtt.Message {
+	return s.messages
+}
+
+// Close unsubscribes from the topic filter and closes the message channel.
+// If the server does not acknowledge the request, the error is returned, but
+// no further messages are delivered on the subscription.
+func (s *Subscription) Close() error {
+	err := s.client.Unsubscribe(s.filter)
+	if err != nil {
+		s.client.subs.Del(s.filter)
+		s.sub.Close(true)
+	}
+	return err
+}
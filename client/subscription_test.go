@@ -0,0 +1,203 @@
+package client
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alfrunes/mqttie/mqtt"
+	"github.com/alfrunes/mqttie/packets"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpen(t *testing.T) {
+	unsubscribed := make(chan *packets.Unsubscribe, 1)
+	broker, conn := NewPipeBroker(mqtt.MQTTv311, func(
+		b *PipeBroker, p packets.Packet,
+	) {
+		switch p := p.(type) {
+		case *packets.Subscribe:
+			code := uint8(p.Topics[0].QoS)
+			if p.Topics[0].Name == "forbidden" {
+				code = 0x80
+			}
+			b.Send(&packets.SubAck{
+				Version:          mqtt.MQTTv311,
+				PacketIdentifier: p.PacketIdentifier,
+				ReturnCodes:      []uint8{code},
+			})
+		case *packets.Unsubscribe:
+			unsubscribed <- p
+			b.Send(&packets.UnsubAck{
+				Version:          mqtt.MQTTv311,
+				PacketIdentifier: p.PacketIdentifier,
+			})
+		}
+	})
+	defer broker.Close()
+	client := NewClient(conn)
+
+	sub, err := client.Open("foo/+", mqtt.QoS1)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, "foo/+", sub.Filter())
+	assert.NoError(t, broker.Send(&packets.Publish{
+		Version: mqtt.MQTTv311,
+		Topic:   mqtt.Topic{Name: "foo/bar"},
+		Retain:  true,
+		Payload: []byte("baz"),
+	}))
+	select {
+	case msg := <-sub.Messages():
+		assert.Equal(t, mqtt.Message{
+			Topic:   "foo/bar",
+			Retain:  true,
+			Payload: []byte("baz"),
+		}, msg)
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for message")
+	}
+
+	assert.NoError(t, sub.Close())
+	unsub := <-unsubscribed
+	assert.Equal(t, []string{"foo/+"}, unsub.Topics)
+	_, open := <-sub.Messages()
+	assert.False(t, open)
+	assert.Empty(t, client.Subscriptions())
+
+	_, err = client.Open("forbidden", mqtt.QoS0)
+	assert.EqualError(t, err, ErrSubscriptionRefused.Error())
+	assert.Empty(t, client.Subscriptions())
+
+	// Invalid filters are refused without subscribing.
+	_, err = client.Open("foo/#/bar", mqtt.QoS0)
+	assert.True(t, errors.Is(err, mqtt.ErrInvalidTopicFilter))
+	_, _, err = client.SubscribeAsync(mqtt.Subscription{
+		Topic:    mqtt.Topic{Name: "foo/#/bar"},
+		Messages: make(chan []byte, 1),
+	})
+	assert.True(t, errors.Is(err, mqtt.ErrInvalidTopicFilter))
+	assert.Empty(t, client.Subscriptions())
+}
+
+func TestSubscribeBuffered(t *testing.T) {
+	broker, conn := NewPipeBroker(mqtt.MQTTv311, func(
+		b *PipeBroker, p packets.Packet,
+	) {
+		switch p := p.(type) {
+		case *packets.Subscribe:
+			b.Send(&packets.SubAck{
+				Version:          mqtt.MQTTv311,
+				PacketIdentifier: p.PacketIdentifier,
+				ReturnCodes:      []uint8{0},
+			})
+			b.Send(&packets.Publish{
+				Version: mqtt.MQTTv311,
+				Topic:   mqtt.Topic{Name: "foo/bar"},
+				Payload: []byte("baz"),
+			})
+		case *packets.Unsubscribe:
+			b.Send(&packets.UnsubAck{
+				Version:          mqtt.MQTTv311,
+				PacketIdentifier: p.PacketIdentifier,
+			})
+		}
+	})
+	defer broker.Close()
+	client := NewClient(conn)
+
+	messages, err := client.SubscribeBuffered("foo/+", mqtt.QoS0, 16)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, 16, cap(messages))
+	select {
+	case msg := <-messages:
+		assert.Equal(t, mqtt.Message{
+			Topic:   "foo/bar",
+			Payload: []byte("baz"),
+		}, msg)
+	case <-time.After(time.Second):
+		t.Fatal("message not received")
+	}
+
+	assert.NoError(t, client.Unsubscribe("foo/+"))
+	_, ok := <-messages
+	assert.False(t, ok, "channel not closed on unsubscribe")
+}
+
+func TestSubscribeRetained(t *testing.T) {
+	unsubscribed := make(chan *packets.Unsubscribe, 1)
+	broker, conn := NewPipeBroker(mqtt.MQTTv311, func(
+		b *PipeBroker, p packets.Packet,
+	) {
+		switch p := p.(type) {
+		case *packets.Subscribe:
+			b.Send(&packets.SubAck{
+				Version:          mqtt.MQTTv311,
+				PacketIdentifier: p.PacketIdentifier,
+				ReturnCodes:      []uint8{1},
+			})
+			for _, name := range []string{"foo/bar", "foo/baz"} {
+				b.Send(&packets.Publish{
+					Version: mqtt.MQTTv311,
+					Topic:   mqtt.Topic{Name: name},
+					Retain:  true,
+					Payload: []byte(name),
+				})
+			}
+		case *packets.PingReq:
+			b.Send(&packets.PingResp{Version: mqtt.MQTTv311})
+		case *packets.Unsubscribe:
+			unsubscribed <- p
+			b.Send(&packets.UnsubAck{
+				Version:          mqtt.MQTTv311,
+				PacketIdentifier: p.PacketIdentifier,
+			})
+		}
+	})
+	defer broker.Close()
+	clock := NewFakeClock()
+	opts := NewClientOptions()
+	opts.SetClock(clock)
+	client := NewClient(conn, opts)
+
+	type result struct {
+		msgs []mqtt.Message
+		err  error
+	}
+	results := make(chan result, 1)
+	go func() {
+		msgs, err := client.SubscribeRetained(
+			"foo/+", mqtt.QoS1, time.Second,
+		)
+		results <- result{msgs, err}
+	}()
+	<-clock.Waiting
+	// The retained messages are received before the PINGRESP.
+	assert.NoError(t, client.Ping())
+	clock.Advance(time.Second)
+
+	select {
+	case res := <-results:
+		assert.NoError(t, res.err)
+		assert.Equal(t, []mqtt.Message{{
+			Topic:   "foo/bar",
+			Retain:  true,
+			Payload: []byte("foo/bar"),
+		}, {
+			Topic:   "foo/baz",
+			Retain:  true,
+			Payload: []byte("foo/baz"),
+		}}, res.msgs)
+	case <-time.After(time.Second):
+		t.Fatal("retained messages not returned")
+	}
+	select {
+	case unsub := <-unsubscribed:
+		assert.Equal(t, []string{"foo/+"}, unsub.Topics)
+	default:
+		t.Error("filter not unsubscribed")
+	}
+}
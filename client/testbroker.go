@@ -0,0 +1,243 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/alfrunes/mqttie/mqtt"
+	"github.com/alfrunes/mqttie/packets"
+)
+
+// TestBroker is a minimal in-process broker for examples and experiments. It
+// accepts all connections, grants the subscriptions at the requested QoS and
+// forwards publishes to the connections subscribed to a matching filter. It
+// keeps no session state, does not retain messages and does not retransmit;
+// it is a fixture, not a production broker.
+type TestBroker struct {
+	listener net.Listener
+
+	mutex sync.Mutex
+	conns map[*testBrokerConn]struct{}
+	wg    sync.WaitGroup
+}
+
+// testBrokerConn is the broker side of a client connection.
+type testBrokerConn struct {
+	*packets.PacketIO
+
+	// subs holds the subscriptions of the connection (guarded by the
+	// broker mutex).
+	subs map[string]testBrokerSub
+	// packetID is the last packet identifier used for forwarding (guarded
+	// by the broker mutex).
+	packetID uint16
+}
+
+type testBrokerSub struct {
+	matcher *mqtt.Matcher
+	qos     mqtt.QoS
+}
+
+// NewTestBroker starts a TestBroker listening on a local port and returns the
+// broker along with its TCP address (see Dial). NewTestBroker panics if it
+// fails to listen. The broker must be closed using TestBroker.Close.
+func NewTestBroker() (broker *TestBroker, address string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("client: test broker failed to listen: %s", err))
+	}
+	broker = &TestBroker{
+		listener: listener,
+		conns:    make(map[*testBrokerConn]struct{}),
+	}
+	broker.wg.Add(1)
+	go broker.serve()
+	return broker, listener.Addr().String()
+}
+
+// Close stops the broker, closing all connections, and waits for the
+// connection routines to return.
+func (b *TestBroker) Close() error {
+	err := b.listener.Close()
+	b.mutex.Lock()
+	for conn := range b.conns {
+		conn.Close()
+	}
+	b.mutex.Unlock()
+	b.wg.Wait()
+	return err
+}
+
+func (b *TestBroker) serve() {
+	defer b.wg.Done()
+	for {
+		netConn, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+		conn := &testBrokerConn{
+			PacketIO: packets.NewPacketIO(netConn, mqtt.MQTTv311, 0),
+			subs:     make(map[string]testBrokerSub),
+		}
+		b.mutex.Lock()
+		b.conns[conn] = struct{}{}
+		b.mutex.Unlock()
+		b.wg.Add(1)
+		go b.handleConn(conn)
+	}
+}
+
+func (b *TestBroker) handleConn(conn *testBrokerConn) {
+	defer b.wg.Done()
+	defer func() {
+		b.mutex.Lock()
+		delete(b.conns, conn)
+		b.mutex.Unlock()
+		conn.Close()
+	}()
+	for {
+		p, err := conn.Recv()
+		if err != nil {
+			return
+		}
+		if err := b.handlePacket(conn, p); err != nil {
+			return
+		}
+	}
+}
+
+func (b *TestBroker) handlePacket(
+	conn *testBrokerConn,
+	p packets.Packet,
+) error {
+	version := conn.Version()
+	switch p := p.(type) {
+	case *packets.Connect:
+		conn.SetVersion(p.Version)
+		return conn.Send(&packets.ConnAck{Version: p.Version})
+
+	case *packets.Subscribe:
+		returnCodes := make([]uint8, len(p.Topics))
+		b.mutex.Lock()
+		for i, topic := range p.Topics {
+			matcher, err := mqtt.CompileFilter(topic.Name)
+			if err != nil || topic.QoS > mqtt.QoS2 {
+				returnCodes[i] = packets.SubAckFailure
+				continue
+			}
+			conn.subs[topic.Name] = testBrokerSub{
+				matcher: matcher,
+				qos:     topic.QoS,
+			}
+			returnCodes[i] = uint8(topic.QoS)
+		}
+		b.mutex.Unlock()
+		return conn.Send(&packets.SubAck{
+			Version:          version,
+			PacketIdentifier: p.PacketIdentifier,
+			ReturnCodes:      returnCodes,
+		})
+
+	case *packets.Unsubscribe:
+		b.mutex.Lock()
+		for _, filter := range p.Topics {
+			delete(conn.subs, filter)
+		}
+		b.mutex.Unlock()
+		unsubAck := &packets.UnsubAck{
+			Version:          version,
+			PacketIdentifier: p.PacketIdentifier,
+		}
+		if version >= mqtt.MQTTv5 {
+			unsubAck.ReasonCodes = make([]uint8, len(p.Topics))
+		}
+		return conn.Send(unsubAck)
+
+	case *packets.Publish:
+		switch p.QoS {
+		case mqtt.QoS1:
+			err := conn.Send(&packets.PubAck{
+				Version:          version,
+				PacketIdentifier: p.PacketIdentifier,
+			})
+			if err != nil {
+				return err
+			}
+		case mqtt.QoS2:
+			err := conn.Send(&packets.PubRec{
+				Version:          version,
+				PacketIdentifier: p.PacketIdentifier,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		b.forward(p)
+
+	case *packets.PubRec:
+		return conn.Send(&packets.PubRel{
+			Version:          version,
+			PacketIdentifier: p.PacketIdentifier,
+		})
+
+	case *packets.PubRel:
+		return conn.Send(&packets.PubComp{
+			Version:          version,
+			PacketIdentifier: p.PacketIdentifier,
+		})
+
+	case *packets.PingReq:
+		return conn.Send(&packets.PingResp{Version: version})
+
+	case *packets.Disconnect:
+		return mqtt.ErrConnectionClosed
+	}
+	return nil
+}
+
+// forward sends the publish to every connection with a matching subscription
+// at the lower of the publish and the subscription QoS.
+func (b *TestBroker) forward(pub *packets.Publish) {
+	type delivery struct {
+		conn *testBrokerConn
+		pub  *packets.Publish
+	}
+	var deliveries []delivery
+	b.mutex.Lock()
+	for conn := range b.conns {
+		qos, matched := mqtt.QoS0, false
+		for _, sub := range conn.subs {
+			if sub.matcher.Match(pub.Name) {
+				if !matched || sub.qos > qos {
+					qos = sub.qos
+				}
+				matched = true
+			}
+		}
+		if !matched {
+			continue
+		}
+		if pub.QoS < qos {
+			qos = pub.QoS
+		}
+		out := &packets.Publish{
+			Topic:   mqtt.Topic{Name: pub.Name, QoS: qos},
+			Version: conn.Version(),
+			Payload: pub.Payload,
+		}
+		if qos > mqtt.QoS0 {
+			conn.packetID++
+			if conn.packetID == 0 {
+				conn.packetID++
+			}
+			out.PacketIdentifier = conn.packetID
+		}
+		deliveries = append(deliveries, delivery{conn: conn, pub: out})
+	}
+	b.mutex.Unlock()
+	// Send outside the lock: a slow subscriber only stalls the publisher.
+	for _, d := range deliveries {
+		d.conn.Send(d.pub)
+	}
+}
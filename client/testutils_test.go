@@ -3,11 +3,48 @@ package client
 import (
 	"io"
 	"net"
+	"sync"
 	"time"
 
+	"github.com/alfrunes/mqttie/mqtt"
+	"github.com/alfrunes/mqttie/packets"
 	"github.com/stretchr/testify/mock"
 )
 
+// PipeBroker is a minimal broker-side endpoint communicating with the client
+// over a synchronous in-memory connection (net.Pipe). Every packet received
+// from the client is passed to the handler.
+type PipeBroker struct {
+	*packets.PacketIO
+	Conn net.Conn
+	Done chan struct{}
+}
+
+// NewPipeBroker starts a broker-side receive loop passing all incoming
+// packets to handle and returns the client end of the connection.
+func NewPipeBroker(
+	version mqtt.Version,
+	handle func(b *PipeBroker, p packets.Packet),
+) (*PipeBroker, net.Conn) {
+	brokerConn, clientConn := net.Pipe()
+	broker := &PipeBroker{
+		PacketIO: packets.NewPacketIO(brokerConn, version, 0),
+		Conn:     brokerConn,
+		Done:     make(chan struct{}),
+	}
+	go func() {
+		defer close(broker.Done)
+		for {
+			p, err := broker.Recv()
+			if err != nil {
+				return
+			}
+			handle(broker, p)
+		}
+	}()
+	return broker, clientConn
+}
+
 type FakeConn struct {
 	mock.Mock
 
@@ -145,3 +182,89 @@ func (f *FakeConn) SetWriteDeadline(t time.Time) error {
 	}
 	return r0
 }
+
+// FakeClock is a Clock that only advances when calling Advance.
+type FakeClock struct {
+	mutex   sync.Mutex
+	now     time.Time
+	waiters []*fakeTimer
+	// Waiting receives a notification every time a timer is created.
+	Waiting chan struct{}
+}
+
+func NewFakeClock() *FakeClock {
+	return &FakeClock{
+		now:     time.Unix(0, 0),
+		Waiting: make(chan struct{}, 100),
+	}
+}
+
+func (f *FakeClock) Now() time.Time {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.now
+}
+
+func (f *FakeClock) After(d time.Duration) <-chan time.Time {
+	return f.NewTimer(d).C()
+}
+
+func (f *FakeClock) NewTimer(d time.Duration) Timer {
+	f.mutex.Lock()
+	t := &fakeTimer{
+		clock:    f,
+		deadline: f.now.Add(d),
+		c:        make(chan time.Time, 1),
+	}
+	f.waiters = append(f.waiters, t)
+	f.mutex.Unlock()
+	f.Waiting <- struct{}{}
+	return t
+}
+
+// Pending returns the number of timers that have not yet fired.
+func (f *FakeClock) Pending() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return len(f.waiters)
+}
+
+// Advance moves the clock forward firing all expired timers.
+func (f *FakeClock) Advance(d time.Duration) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.now = f.now.Add(d)
+	waiters := f.waiters[:0]
+	for _, t := range f.waiters {
+		if t.deadline.After(f.now) {
+			waiters = append(waiters, t)
+		} else {
+			t.c <- f.now
+		}
+	}
+	f.waiters = waiters
+}
+
+type fakeTimer struct {
+	clock    *FakeClock
+	deadline time.Time
+	c        chan time.Time
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+	for i, waiter := range t.clock.waiters {
+		if waiter == t {
+			t.clock.waiters = append(
+				t.clock.waiters[:i], t.clock.waiters[i+1:]...,
+			)
+			return true
+		}
+	}
+	return false
+}
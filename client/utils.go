@@ -1,46 +1,155 @@
 package client
 
 import (
+	"bytes"
+	log "github.com/sirupsen/logrus"
+	"sort"
 	"strings"
 
+	"github.com/alfrunes/mqttie/mqtt"
 	"github.com/alfrunes/mqttie/packets"
 )
 
+// subscription is the value stored at the leaves of a subMap.
+type subscription struct {
+	// qos is the QoS granted by the server.
+	qos mqtt.QoS
+	c   chan<- []byte
+	// msgs, if set, receives the messages instead of c. The channel is
+	// owned by the client and closed with the subscription.
+	msgs chan<- mqtt.Message
+	// handler, if set, is called with the messages instead of sending
+	// them on a channel.
+	handler func(mqtt.Message)
+	// transient subscriptions are not restored on reconnect.
+	transient bool
+
+	// done is closed when the subscription is removed, aborting any
+	// blocking send in progress.
+	done chan struct{}
+	// mutex serializes sends with closing the subscription.
+	mutex  chan struct{}
+	closed bool
+	// lastRef is set by subscriptionMap.Del if no other subscription in
+	// the map delivers to c.
+	lastRef bool
+}
+
+func newSubscription(qos mqtt.QoS, c chan<- []byte) *subscription {
+	return &subscription{
+		qos:   qos,
+		c:     c,
+		done:  make(chan struct{}),
+		mutex: make(chan struct{}, 1),
+	}
+}
+
+// TrySend passes the message to the subscriber without blocking. The return
+// value is false if the channel is full or the subscription is closed.
+func (s *subscription) TrySend(msg mqtt.Message) bool {
+	s.mutex <- struct{}{}
+	defer func() { <-s.mutex }()
+	if s.closed {
+		return false
+	} else if s.handler != nil {
+		s.handler(msg)
+		return true
+	}
+	// Only one of the channels is set; sends on a nil channel never
+	// proceed.
+	select {
+	case s.c <- msg.Payload:
+		return true
+	case s.msgs <- msg:
+		return true
+	default:
+		return false
+	}
+}
+
+// Send blocks until the message is passed to the subscriber, the
+// subscription is closed or cancel is closed.
+func (s *subscription) Send(msg mqtt.Message, cancel <-chan struct{}) bool {
+	s.mutex <- struct{}{}
+	defer func() { <-s.mutex }()
+	if s.closed {
+		return false
+	} else if s.handler != nil {
+		s.handler(msg)
+		return true
+	}
+	select {
+	case s.c <- msg.Payload:
+		return true
+	case s.msgs <- msg:
+		return true
+	case <-s.done:
+	case <-cancel:
+	}
+	return false
+}
+
+// Close stops all further sends on the subscription; once Close returns no
+// more messages are passed to the subscriber channel. If closeChan is set,
+// the subscriber channel is closed as well unless other subscriptions still
+// deliver to it; a channel owned by the client is always closed.
+func (s *subscription) Close(closeChan bool) {
+	select {
+	case <-s.done:
+		return
+	default:
+		close(s.done)
+	}
+	s.mutex <- struct{}{}
+	s.closed = true
+	if s.msgs != nil {
+		close(s.msgs)
+	} else if closeChan && s.lastRef {
+		close(s.c)
+	}
+	<-s.mutex
+}
+
 type subMap map[string]interface{}
 
-func (s subMap) Add(topic string, c chan<- []byte) bool {
+func (s subMap) Add(topic string, sub *subscription) bool {
 	i := strings.Index(topic, "+")
 	if i < 0 {
-		s[topic] = c
+		s[topic] = sub
 		return true
 	}
 	if m, ok := s[topic[:i+1]].(subMap); ok {
-		return m.Add(topic[i+1:], c)
+		return m.Add(topic[i+1:], sub)
 	}
 	m := make(subMap)
-	if m.Add(topic[i+1:], c) {
+	if m.Add(topic[i+1:], sub) {
 		s[topic[:i+1]] = m
 		return true
 	}
 	return false
 }
 
-func (s subMap) Get(topic string) chan<- []byte {
-	if c, ok := s[topic].(chan<- []byte); ok {
-		return c
+func (s subMap) Get(topic string) *subscription {
+	if sub, ok := s[topic].(*subscription); ok {
+		return sub
 	}
 	var i, j int
 	for {
 		// Check multi-level wildcard (highest precedence)
-		if c, ok := s[topic[:i]+"#"].(chan<- []byte); ok {
-			return c
+		if sub, ok := s[topic[:i]+"#"].(*subscription); ok {
+			return sub
 		}
 		if tmp, ok := s[topic[:i]+"+"].(subMap); ok {
 			// Carve out and replace scope with wildcard
 			// and recurse onward.
-			j = strings.Index(topic[i:], "/")
-			if c := tmp.Get(topic[i+j:]); c != nil {
-				return c
+			// If the wildcard matches the last level, the
+			// remaining topic is empty.
+			var rest string
+			if j = strings.Index(topic[i:], "/"); j >= 0 {
+				rest = topic[i+j:]
+			}
+			if sub := tmp.Get(rest); sub != nil {
+				return sub
 			}
 		}
 		// Advance index
@@ -53,59 +162,371 @@ func (s subMap) Get(topic string) chan<- []byte {
 	return nil
 }
 
-func (s subMap) Del(topic string) {
+// Topics returns all topic filters in the map along with the granted QoS.
+func (s subMap) Topics() []mqtt.Topic {
+	return s.topics("", nil)
+}
+
+func (s subMap) topics(prefix string, topics []mqtt.Topic) []mqtt.Topic {
+	for key, val := range s {
+		switch val := val.(type) {
+		case subMap:
+			topics = val.topics(prefix+key, topics)
+		case *subscription:
+			topics = append(topics, mqtt.Topic{
+				Name: prefix + key,
+				QoS:  val.qos,
+			})
+		}
+	}
+	return topics
+}
+
+func (s subMap) all(prefix string, subs map[string]*subscription) {
+	for key, val := range s {
+		switch val := val.(type) {
+		case subMap:
+			val.all(prefix+key, subs)
+		case *subscription:
+			subs[prefix+key] = val
+		}
+	}
+}
+
+// Del removes the topic filter from the map, returning the removed
+// subscription (if any).
+func (s subMap) Del(topic string) *subscription {
 	i := strings.Index(topic, "+")
 	if i == -1 {
+		sub, _ := s[topic].(*subscription)
 		delete(s, topic)
-		return
+		return sub
 	}
 	if m, ok := s[topic[:i+1]].(subMap); ok {
-		if len(m) <= 1 {
+		sub := m.Del(topic[i+1:])
+		if len(m) == 0 {
 			delete(s, topic[:i+1])
-		} else {
-			m.Del(topic[i+1:])
+		}
+		return sub
+	}
+	return nil
+}
+
+// subscriptionMap provides mutual exclusive access to a subMap.
+type subscriptionMap struct {
+	subs subMap
+	// refs counts the subscriptions delivering to each subscriber
+	// channel, since a channel may be shared between topic filters.
+	refs  map[chan<- []byte]int
+	mutex chan struct{}
+}
+
+func newSubscriptionMap() *subscriptionMap {
+	return &subscriptionMap{
+		subs:  make(subMap),
+		refs:  make(map[chan<- []byte]int),
+		mutex: make(chan struct{}, 1),
+	}
+}
+
+func (s *subscriptionMap) Add(topic string, sub *subscription) {
+	s.mutex <- struct{}{}
+	defer func() { <-s.mutex }()
+	if old := s.subs.Del(topic); old != nil {
+		// The subscription is replaced.
+		s.release(old)
+	}
+	s.subs.Add(topic, sub)
+	if sub.c != nil {
+		s.refs[sub.c]++
+	}
+}
+
+// release drops the reference of the removed subscription to its channel.
+func (s *subscriptionMap) release(sub *subscription) {
+	if sub.c == nil {
+		return
+	}
+	s.refs[sub.c]--
+	if s.refs[sub.c] <= 0 {
+		delete(s.refs, sub.c)
+		sub.lastRef = true
+	}
+}
+
+func (s *subscriptionMap) SetQoS(sub *subscription, qos mqtt.QoS) {
+	s.mutex <- struct{}{}
+	sub.qos = qos
+	<-s.mutex
+}
+
+func (s *subscriptionMap) Get(topic string) *subscription {
+	s.mutex <- struct{}{}
+	defer func() { <-s.mutex }()
+	return s.subs.Get(topic)
+}
+
+func (s *subscriptionMap) Topics() []mqtt.Topic {
+	s.mutex <- struct{}{}
+	defer func() { <-s.mutex }()
+	return s.subs.Topics()
+}
+
+// All returns all subscriptions in the map indexed by topic filter.
+func (s *subscriptionMap) All() map[string]*subscription {
+	s.mutex <- struct{}{}
+	defer func() { <-s.mutex }()
+	subs := make(map[string]*subscription)
+	s.subs.all("", subs)
+	return subs
+}
+
+// Del removes the topic filter, returning the removed subscription (if any).
+func (s *subscriptionMap) Del(topic string) *subscription {
+	s.mutex <- struct{}{}
+	defer func() { <-s.mutex }()
+	sub := s.subs.Del(topic)
+	if sub != nil {
+		s.release(sub)
+	}
+	return sub
+}
+
+// subscribeRequest holds the state of an in-flight subscribe request.
+type subscribeRequest struct {
+	// names and subs are the topic filters and reserved subscriptions.
+	names []string
+	subs  []*subscription
+	// cancel is closed if the request is cancelled.
+	cancel chan struct{}
+}
+
+type subscribeRequestMap struct {
+	requests map[uint16]*subscribeRequest
+	mutex    chan struct{}
+}
+
+func newSubscribeRequestMap() *subscribeRequestMap {
+	return &subscribeRequestMap{
+		requests: make(map[uint16]*subscribeRequest),
+		mutex:    make(chan struct{}, 1),
+	}
+}
+
+func (s *subscribeRequestMap) Add(packetID uint16, req *subscribeRequest) {
+	s.mutex <- struct{}{}
+	s.requests[packetID] = req
+	<-s.mutex
+}
+
+// Pop removes and returns the request with the given packet identifier.
+func (s *subscribeRequestMap) Pop(packetID uint16) (*subscribeRequest, bool) {
+	s.mutex <- struct{}{}
+	defer func() { <-s.mutex }()
+	req, ok := s.requests[packetID]
+	delete(s.requests, packetID)
+	return req, ok
+}
+
+// registrationMap holds the subscriptions registered with Client.Register
+// indexed by topic filter.
+type registrationMap struct {
+	subs  map[string]mqtt.Subscription
+	mutex chan struct{}
+}
+
+func newRegistrationMap() *registrationMap {
+	return &registrationMap{
+		subs:  make(map[string]mqtt.Subscription),
+		mutex: make(chan struct{}, 1),
+	}
+}
+
+func (r *registrationMap) Add(sub mqtt.Subscription) {
+	r.mutex <- struct{}{}
+	r.subs[sub.Name] = sub
+	<-r.mutex
+}
+
+func (r *registrationMap) Del(topic string) {
+	r.mutex <- struct{}{}
+	delete(r.subs, topic)
+	<-r.mutex
+}
+
+// All returns the registered subscriptions sorted by topic filter.
+func (r *registrationMap) All() []mqtt.Subscription {
+	r.mutex <- struct{}{}
+	subs := make([]mqtt.Subscription, 0, len(r.subs))
+	for _, sub := range r.subs {
+		subs = append(subs, sub)
+	}
+	<-r.mutex
+	sort.Slice(subs, func(i, j int) bool {
+		return subs[i].Name < subs[j].Name
+	})
+	return subs
+}
+
+// sendQuota bounds the number of unacknowledged QoS1 and QoS2 publishes to
+// the Receive Maximum of the server (MQTTv5).
+type sendQuota struct {
+	// slots holds a token per in-flight publish (nil: unlimited).
+	slots chan struct{}
+	mutex chan struct{}
+}
+
+func newSendQuota() *sendQuota {
+	return &sendQuota{
+		mutex: make(chan struct{}, 1),
+	}
+}
+
+// Reset sets the quota to max in-flight publishes, of which inflight are
+// already in use. A max of 0 removes the limit.
+func (q *sendQuota) Reset(max, inflight int) {
+	var slots chan struct{}
+	if max > 0 {
+		slots = make(chan struct{}, max)
+		for i := 0; i < inflight && i < max; i++ {
+			slots <- struct{}{}
 		}
 	}
+	q.mutex <- struct{}{}
+	q.slots = slots
+	<-q.mutex
 }
 
+// Acquire reserves a slot for a publish, blocking until a slot is released
+// or done is closed. If the quota is exhausted, blocked is called before
+// blocking. The return value is false if done is closed.
+func (q *sendQuota) Acquire(done <-chan struct{}, blocked func()) bool {
+	q.mutex <- struct{}{}
+	slots := q.slots
+	<-q.mutex
+	if slots == nil {
+		return true
+	}
+	select {
+	case slots <- struct{}{}:
+		return true
+	default:
+	}
+	blocked()
+	select {
+	case slots <- struct{}{}:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+// Release frees the slot of a completed publish.
+func (q *sendQuota) Release() {
+	q.mutex <- struct{}{}
+	slots := q.slots
+	<-q.mutex
+	select {
+	case <-slots:
+	default:
+	}
+}
+
+// packetMap holds the packets awaiting acknowledgement in a Store.
 type packetMap struct {
-	packets map[uint16]packets.Packet
-	mutex   chan struct{}
+	store Store
+	mutex chan struct{}
 }
 
-func newPacketMap() *packetMap {
+func newPacketMap(store Store) *packetMap {
 	return &packetMap{
-		packets: make(map[uint16]packets.Packet),
-		mutex:   make(chan struct{}, 1),
+		store: store,
+		mutex: make(chan struct{}, 1),
+	}
+}
+
+// The following methods log store errors instead of returning them; the
+// session state is kept by the store regardless of whether it is persisted
+// (see FileStore).
+
+func (p *packetMap) put(packetID uint16, packet packets.Packet) {
+	if err := p.store.Put(packetID, packet); err != nil {
+		log.Errorf("Failed to store packet %d: %s", packetID, err)
+	}
+}
+
+func (p *packetMap) get(packetID uint16) (packets.Packet, bool) {
+	packet, err := p.store.Get(packetID)
+	if err != nil {
+		if err != ErrNotStored {
+			log.Errorf("Failed to load packet %d: %s", packetID, err)
+		}
+		return nil, false
+	}
+	return packet, true
+}
+
+func (p *packetMap) del(packetID uint16) {
+	if err := p.store.Del(packetID); err != nil {
+		log.Errorf("Failed to delete stored packet %d: %s",
+			packetID, err)
+	}
+}
+
+func (p *packetMap) all() map[uint16]packets.Packet {
+	ret, err := p.store.List()
+	if err != nil {
+		log.Errorf("Failed to list stored packets: %s", err)
 	}
+	return ret
 }
 
 func (p *packetMap) Add(packetID uint16, packet packets.Packet) bool {
 	p.mutex <- struct{}{}
 	defer func() { <-p.mutex }()
-	if _, ok := p.packets[packetID]; ok {
+	if _, ok := p.get(packetID); ok {
 		return false
 	}
-	p.packets[packetID] = packet
+	p.put(packetID, packet)
 	return true
 }
 
 func (p *packetMap) Set(packetID uint16, packet packets.Packet) {
 	p.mutex <- struct{}{}
-	p.packets[packetID] = packet
+	p.put(packetID, packet)
 	<-p.mutex
 }
 
 func (p *packetMap) Get(packetID uint16) (packets.Packet, bool) {
 	p.mutex <- struct{}{}
 	defer func() { <-p.mutex }()
-	packet, ok := p.packets[packetID]
-	return packet, ok
+	return p.get(packetID)
+}
+
+func (p *packetMap) Len() int {
+	p.mutex <- struct{}{}
+	defer func() { <-p.mutex }()
+	return len(p.all())
+}
+
+// All returns a copy of the map of packets indexed by packet identifier.
+func (p *packetMap) All() map[uint16]packets.Packet {
+	p.mutex <- struct{}{}
+	defer func() { <-p.mutex }()
+	return p.all()
 }
 
 func (p *packetMap) Del(packetID uint16) {
 	p.mutex <- struct{}{}
-	delete(p.packets, packetID)
+	p.del(packetID)
+	<-p.mutex
+}
+
+func (p *packetMap) Clear() {
+	p.mutex <- struct{}{}
+	for id := range p.all() {
+		p.del(id)
+	}
 	<-p.mutex
 }
 
@@ -143,3 +564,293 @@ func (p *packetChanMap) Del(packetID uint16) {
 	delete(p.chans, packetID)
 	<-p.mutex
 }
+
+// retainedMap holds the last retained message per topic name.
+type retainedMap struct {
+	msgs  map[string]mqtt.Message
+	mutex chan struct{}
+}
+
+func newRetainedMap() *retainedMap {
+	return &retainedMap{
+		msgs:  make(map[string]mqtt.Message),
+		mutex: make(chan struct{}, 1),
+	}
+}
+
+// Set stores a copy of the retained message, replacing the previous message
+// on the topic. A message with an empty payload clears the topic.
+func (r *retainedMap) Set(msg mqtt.Message) {
+	r.mutex <- struct{}{}
+	defer func() { <-r.mutex }()
+	if len(msg.Payload) == 0 {
+		delete(r.msgs, msg.Topic)
+		return
+	}
+	payload := make([]byte, len(msg.Payload))
+	copy(payload, msg.Payload)
+	msg.Payload = payload
+	r.msgs[msg.Topic] = msg
+}
+
+func (r *retainedMap) Get(topic string) (mqtt.Message, bool) {
+	r.mutex <- struct{}{}
+	defer func() { <-r.mutex }()
+	msg, ok := r.msgs[topic]
+	return msg, ok
+}
+
+type response struct {
+	correlationData []byte
+	c               chan *packets.Publish
+}
+
+type responseMap struct {
+	responses map[string]response
+	mutex     chan struct{}
+}
+
+func newResponseMap() *responseMap {
+	return &responseMap{
+		responses: make(map[string]response),
+		mutex:     make(chan struct{}, 1),
+	}
+}
+
+func (r *responseMap) New(
+	topic string, correlationData []byte,
+) chan *packets.Publish {
+	r.mutex <- struct{}{}
+	defer func() { <-r.mutex }()
+	c := make(chan *packets.Publish, 1)
+	r.responses[topic] = response{
+		correlationData: correlationData,
+		c:               c,
+	}
+	return c
+}
+
+// Deliver passes the publish packet to the request awaiting a response on the
+// packet's topic. The return value is false if the topic is not a response
+// topic of any outstanding request; uncorrelated responses are discarded.
+func (r *responseMap) Deliver(pub *packets.Publish) bool {
+	r.mutex <- struct{}{}
+	defer func() { <-r.mutex }()
+	rsp, ok := r.responses[pub.Topic.Name]
+	if !ok {
+		return false
+	}
+	if bytes.Equal(rsp.correlationData, pub.CorrelationData) {
+		select {
+		case rsp.c <- pub:
+		default:
+		}
+	}
+	return true
+}
+
+func (r *responseMap) Del(topic string) {
+	r.mutex <- struct{}{}
+	delete(r.responses, topic)
+	<-r.mutex
+}
+
+// workerQueueSize bounds the messages queued on a delivery worker.
+const workerQueueSize = 1024
+
+// deliveryWorker delivers the messages of a subscription to the subscriber
+// in the order they are pushed, such that the receive routine never blocks
+// on a slow subscriber. The worker stops when the subscription is closed.
+type deliveryWorker struct {
+	sub   *subscription
+	queue []mqtt.Message
+	// signal notifies the worker routine that the queue is non-empty.
+	signal chan struct{}
+	// space notifies PushWait that a message was taken off the queue.
+	space chan struct{}
+	mutex chan struct{}
+	done  <-chan struct{}
+	// dropped is called with messages that could not be delivered.
+	dropped func(mqtt.Message)
+}
+
+func newDeliveryWorker(
+	sub *subscription,
+	done <-chan struct{},
+	dropped func(mqtt.Message),
+) *deliveryWorker {
+	w := &deliveryWorker{
+		sub:     sub,
+		signal:  make(chan struct{}, 1),
+		space:   make(chan struct{}, 1),
+		mutex:   make(chan struct{}, 1),
+		done:    done,
+		dropped: dropped,
+	}
+	go w.run()
+	return w
+}
+
+// Push queues the message for delivery. The return value is false if the
+// queue is full.
+func (w *deliveryWorker) Push(msg mqtt.Message) bool {
+	w.mutex <- struct{}{}
+	if len(w.queue) >= workerQueueSize {
+		<-w.mutex
+		return false
+	}
+	w.queue = append(w.queue, msg)
+	<-w.mutex
+	select {
+	case w.signal <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// PushWait queues the message for delivery, waiting for room in the queue.
+// The return value is false if the worker stops or cancel is closed first.
+func (w *deliveryWorker) PushWait(
+	msg mqtt.Message, cancel <-chan struct{},
+) bool {
+	for !w.Push(msg) {
+		select {
+		case <-w.space:
+		case <-w.sub.done:
+			return false
+		case <-w.done:
+			return false
+		case <-cancel:
+			return false
+		}
+	}
+	return true
+}
+
+func (w *deliveryWorker) pop() (mqtt.Message, bool) {
+	w.mutex <- struct{}{}
+	defer func() { <-w.mutex }()
+	if len(w.queue) == 0 {
+		return mqtt.Message{}, false
+	}
+	msg := w.queue[0]
+	w.queue[0] = mqtt.Message{}
+	w.queue = w.queue[1:]
+	select {
+	case w.space <- struct{}{}:
+	default:
+	}
+	return msg, true
+}
+
+// Stopped returns whether the worker routine has stopped or is stopping.
+func (w *deliveryWorker) Stopped() bool {
+	select {
+	case <-w.sub.done:
+		return true
+	case <-w.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (w *deliveryWorker) run() {
+	for {
+		select {
+		case <-w.signal:
+		case <-w.sub.done:
+			// The queued messages can no longer be delivered.
+			for msg, ok := w.pop(); ok; msg, ok = w.pop() {
+				w.dropped(msg)
+			}
+			return
+		case <-w.done:
+			return
+		}
+		for msg, ok := w.pop(); ok; msg, ok = w.pop() {
+			if !w.sub.Send(msg, w.done) {
+				w.dropped(msg)
+			}
+			select {
+			case <-w.done:
+				return
+			default:
+			}
+		}
+	}
+}
+
+// pauseQueueSize bounds the messages held while the client is paused.
+const pauseQueueSize = 1024
+
+// pauseGate withholds the messages from the subscribers while the client is
+// paused (see Client.Pause).
+type pauseGate struct {
+	paused bool
+	// resuming is set while Resume drains the queue.
+	resuming bool
+	queue    []mqtt.Message
+	size     int
+	mutex    chan struct{}
+}
+
+func newPauseGate(size int) *pauseGate {
+	return &pauseGate{size: size, mutex: make(chan struct{}, 1)}
+}
+
+// Deliver passes the message to dispatch unless the gate is paused, in which
+// case the message is queued. The return value is false if the gate is
+// paused and the queue is full.
+func (g *pauseGate) Deliver(
+	msg mqtt.Message, dispatch func(mqtt.Message),
+) bool {
+	g.mutex <- struct{}{}
+	defer func() { <-g.mutex }()
+	if g.paused {
+		if len(g.queue) >= g.size {
+			return false
+		}
+		g.queue = append(g.queue, msg)
+		return true
+	}
+	dispatch(msg)
+	return true
+}
+
+func (g *pauseGate) Pause() {
+	g.mutex <- struct{}{}
+	g.paused = true
+	g.resuming = false
+	<-g.mutex
+}
+
+// Resume passes the queued messages to drain in the order received. drain
+// is called without holding the gate, such that Deliver does not block
+// while the subscribers catch up; the gate stays paused until the queue is
+// empty so the messages arriving meanwhile are queued behind the others.
+// Resume returns early if Pause is called meanwhile, or if another Resume
+// is already draining the queue.
+func (g *pauseGate) Resume(drain func(mqtt.Message)) {
+	g.mutex <- struct{}{}
+	if g.resuming {
+		<-g.mutex
+		return
+	}
+	g.resuming = true
+	for g.resuming {
+		queue := g.queue
+		if len(queue) == 0 {
+			g.paused = false
+			g.resuming = false
+			break
+		}
+		g.queue = nil
+		<-g.mutex
+		for _, msg := range queue {
+			drain(msg)
+		}
+		g.mutex <- struct{}{}
+	}
+	<-g.mutex
+}
@@ -0,0 +1,112 @@
+package mqtt
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// ErrInvalidTopicFilter is returned by CompileFilter and ValidateTopicFilter
+// if the filter is not a valid topic filter.
+var ErrInvalidTopicFilter = fmt.Errorf("invalid topic filter")
+
+// Matcher is a compiled topic filter for matching topic names. The level
+// structure of the filter is computed once, making repeated matching cheap.
+type Matcher struct {
+	filter string
+	// levels holds the filter levels excluding a trailing multi-level
+	// wildcard.
+	levels []string
+	// multiLevel is set if the filter ends with the multi-level
+	// wildcard ('#').
+	multiLevel bool
+}
+
+// CompileFilter validates and compiles the topic filter.
+func CompileFilter(filter string) (*Matcher, error) {
+	if filter == "" {
+		return nil, ErrInvalidTopicFilter
+	}
+	levels := strings.Split(filter, "/")
+	m := &Matcher{filter: filter}
+	for i, level := range levels {
+		switch {
+		case level == "#":
+			if i != len(levels)-1 {
+				return nil, ErrInvalidTopicFilter
+			}
+			m.multiLevel = true
+			levels = levels[:i]
+		case level == "+":
+		case strings.ContainsAny(level, "+#"):
+			// Wildcards must occupy an entire level.
+			return nil, ErrInvalidTopicFilter
+		}
+	}
+	m.levels = levels
+	return m, nil
+}
+
+// sharePrefix is the prefix of shared subscription filters (MQTTv5).
+const sharePrefix = "$share/"
+
+// ValidateTopicFilter returns ErrInvalidTopicFilter if the filter is not a
+// valid topic filter: the filter must be a non-empty UTF-8 string of at most
+// 65535 bytes without null characters, and the wildcards ('+' and '#') must
+// occupy an entire level, with '#' only as the last level. A shared
+// subscription filter ($share/{ShareName}/{filter}) must have a share name
+// without wildcards followed by a valid filter.
+func ValidateTopicFilter(filter string) error {
+	if filter == "" || len(filter) > 0xFFFF ||
+		!utf8.ValidString(filter) || strings.ContainsRune(filter, 0) {
+		return ErrInvalidTopicFilter
+	}
+	if strings.HasPrefix(filter, sharePrefix) {
+		rest := filter[len(sharePrefix):]
+		i := strings.IndexByte(rest, '/')
+		if i <= 0 || strings.ContainsAny(rest[:i], "+#") {
+			return ErrInvalidTopicFilter
+		}
+		filter = rest[i+1:]
+		if filter == "" {
+			return ErrInvalidTopicFilter
+		}
+	}
+	_, err := CompileFilter(filter)
+	return err
+}
+
+// String returns the topic filter.
+func (m *Matcher) String() string {
+	return m.filter
+}
+
+// Match reports whether the topic name matches the filter.
+func (m *Matcher) Match(topic string) bool {
+	if topic == "" {
+		return false
+	} else if topic[0] == '$' &&
+		(len(m.levels) == 0 || m.levels[0] == "+") {
+		// Wildcards at the first level must not match topics beginning
+		// with '$' [MQTT-4.7.2-1].
+		return false
+	}
+	var name string
+	var last bool
+	for _, level := range m.levels {
+		if last {
+			// Topic has fewer levels than the filter.
+			return false
+		}
+		if i := strings.IndexByte(topic, '/'); i >= 0 {
+			name, topic = topic[:i], topic[i+1:]
+		} else {
+			name, last = topic, true
+		}
+		if level != "+" && level != name {
+			return false
+		}
+	}
+	// '#' also matches the parent level [MQTT-4.7.1-2].
+	return last || m.multiLevel
+}
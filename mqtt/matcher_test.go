@@ -0,0 +1,140 @@
+package mqtt
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompileFilter(t *testing.T) {
+	for _, filter := range []string{
+		"", "sport/#/score", "sport+", "sport/+score", "sport/ten#",
+	} {
+		_, err := CompileFilter(filter)
+		assert.EqualError(t, err, ErrInvalidTopicFilter.Error(), filter)
+	}
+}
+
+func TestValidateTopicFilter(t *testing.T) {
+	for _, filter := range []string{
+		"sport/tennis/player1", "sport/#", "#", "+", "+/tennis/#",
+		"sport//score", "/", "$SYS/#", "$share/group/sport/+",
+	} {
+		assert.NoError(t, ValidateTopicFilter(filter), filter)
+	}
+	for _, filter := range []string{
+		"", "sport/#/score", "sport+", "sport/ten#", "foo\x00bar",
+		"\xff", strings.Repeat("a", 0x10000), "$share/group",
+		"$share/group/", "$share//sport", "$share/gr+oup/sport",
+		"$share/group/sport#",
+	} {
+		assert.EqualError(t, ValidateTopicFilter(filter),
+			ErrInvalidTopicFilter.Error(), filter)
+	}
+}
+
+func TestMatcher(t *testing.T) {
+	testCases := []struct {
+		filter  string
+		match   []string
+		noMatch []string
+	}{{
+		filter:  "sport/tennis/player1",
+		match:   []string{"sport/tennis/player1"},
+		noMatch: []string{"sport/tennis", "sport/tennis/player1/x"},
+	}, {
+		filter: "sport/+/score",
+		match:  []string{"sport/tennis/score", "sport//score"},
+		noMatch: []string{
+			"sport/score", "sport/tennis/score/x", "sport/tennis",
+		},
+	}, {
+		filter: "sport/#",
+		match: []string{
+			"sport", "sport/tennis", "sport/tennis/player1",
+		},
+		noMatch: []string{"sports", "other/sport"},
+	}, {
+		filter:  "+",
+		match:   []string{"sport", "x"},
+		noMatch: []string{"sport/tennis", "$SYS"},
+	}, {
+		filter:  "+/+",
+		match:   []string{"/finance", "sport/"},
+		noMatch: []string{"finance", "$SYS/monitor"},
+	}, {
+		filter:  "#",
+		match:   []string{"sport", "sport/tennis", "/"},
+		noMatch: []string{"$SYS/monitor"},
+	}, {
+		filter: "$SYS/#",
+		match:  []string{"$SYS/monitor/clients"},
+	}}
+	for _, testCase := range testCases {
+		m, err := CompileFilter(testCase.filter)
+		if !assert.NoError(t, err) {
+			continue
+		}
+		assert.Equal(t, testCase.filter, m.String())
+		for _, topic := range testCase.match {
+			assert.True(t, m.Match(topic),
+				"%s should match %s", testCase.filter, topic)
+		}
+		for _, topic := range testCase.noMatch {
+			assert.False(t, m.Match(topic),
+				"%s should not match %s", testCase.filter, topic)
+		}
+	}
+}
+
+var benchTopics = func() []string {
+	topics := make([]string, 10000)
+	sports := []string{"tennis", "football", "chess", "golf"}
+	for i := range topics {
+		switch i % 3 {
+		case 0:
+			topics[i] = fmt.Sprintf("sport/%s%d/score", sports[i%4], i)
+		case 1:
+			topics[i] = fmt.Sprintf("sport/%s/player%d", sports[i%4], i)
+		default:
+			topics[i] = fmt.Sprintf("news/%d/score", i)
+		}
+	}
+	return topics
+}()
+
+// naiveMatch splits both filter and topic on every call.
+func naiveMatch(filter, topic string) bool {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		} else if i >= len(topicLevels) {
+			return false
+		} else if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
+
+func BenchmarkMatcher(b *testing.B) {
+	m, _ := CompileFilter("sport/+/score")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, topic := range benchTopics {
+			m.Match(topic)
+		}
+	}
+}
+
+func BenchmarkNaiveMatch(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		for _, topic := range benchTopics {
+			naiveMatch("sport/+/score", topic)
+		}
+	}
+}
@@ -28,6 +28,8 @@ const (
 type Version uint8
 
 const (
+	// MQTTv31 defines the legacy MQTT protocol version 3.1
+	MQTTv31 Version = 0x03
 	// MQTTv311 defines the MQTT protocol version 3.1.1
 	MQTTv311 Version = 0x04
 	// MQTTv5 defines the MQTT protocol version 5.0
@@ -59,10 +61,38 @@ var (
 	// ErrPacketLong is returned if a received packet is longer than
 	// given in the header.
 	ErrPacketLong = fmt.Errorf("malformed packet: length too long")
+	// ErrMalformedUTF8 is returned if a received string is truncated or
+	// not valid UTF-8.
+	ErrMalformedUTF8 = fmt.Errorf("malformed packet: invalid UTF-8 string")
+
+	// ErrProtocolViolation is returned if a received packet violates the
+	// protocol specification, e.g. a zero packet identifier.
+	ErrProtocolViolation = fmt.Errorf("protocol violation")
 
 	// ErrIllegalQoS is returned if an invalid QoS value is passed to a
 	// publish/subscribe request.
 	ErrIllegalQoS = fmt.Errorf("invalid QoS value")
+
+	// ErrRequestTimeout is returned by client.Request if no response is
+	// received within the given timeout.
+	ErrRequestTimeout = fmt.Errorf("timeout waiting for response")
+
+	// ErrConnectionClosed is returned when sending or receiving packets
+	// on a connection that is closed.
+	ErrConnectionClosed = fmt.Errorf("connection closed")
+
+	// ErrUnsubscribeTimeout is returned by client.Unsubscribe if the
+	// server does not acknowledge the request in time.
+	ErrUnsubscribeTimeout = fmt.Errorf("timeout waiting for unsubscribe ack")
+
+	// ErrPublishRejected is returned by client.PublishAndWait if the
+	// server acknowledges a publish with an error reason code (MQTTv5).
+	ErrPublishRejected = fmt.Errorf("publish rejected by server")
+	// ErrTopicLimitExceeded is returned if a received topic exceeds the
+	// configured length or number of levels.
+	ErrTopicLimitExceeded = fmt.Errorf(
+		"protocol violation: topic exceeds limits",
+	)
 )
 
 // Topic describes a topic name along with it's QoS value.
@@ -73,6 +103,24 @@ type Topic struct {
 	QoS QoS
 }
 
+// Message is an application message received on a subscription.
+type Message struct {
+	// Topic is the topic name the message was published on.
+	Topic string
+	// Retain is set if the message was retained by the server.
+	Retain bool
+	// Payload is the application message.
+	Payload []byte
+}
+
+// UserProperty is a user defined key/value pair attached to a packet
+// (MQTTv5). The protocol allows the same key to appear more than once, and
+// the order of the properties is preserved.
+type UserProperty struct {
+	Key   string
+	Value string
+}
+
 // Subscription defines a topic with a channel to pass incoming messages for
 // the topic.
 type Subscription struct {
@@ -80,4 +128,44 @@ type Subscription struct {
 	Topic
 	// Messages will receive incoming publish messages on the topic.
 	Messages chan<- []byte
+	// Transient subscriptions are not restored when the client
+	// reconnects, e.g. temporary subscriptions for request/response.
+	// By default, subscriptions are persistent.
+	Transient bool
+}
+
+// SessionInfo holds the session parameters in effect after connecting: the
+// parameters requested by the client as overridden by the server, and the
+// capabilities advertised by the server (MQTTv5). For earlier protocol
+// versions the server capabilities are the protocol defaults.
+type SessionInfo struct {
+	// SessionPresent is set if the server resumed an existing session.
+	SessionPresent bool
+	// KeepAlive is the keep alive in seconds (0: disabled).
+	KeepAlive uint16
+	// ReceiveMax is the number of QoS1 and QoS2 publications the server
+	// is willing to process concurrently.
+	ReceiveMax uint16
+	// MaxPacketSize is the maximum packet size accepted by the server
+	// (0: unlimited).
+	MaxPacketSize uint32
+	// TopicAliasMax is the highest topic alias accepted by the server
+	// (0: topic aliases not accepted).
+	TopicAliasMax uint16
+	// MaxQoS is the maximum QoS supported by the server.
+	MaxQoS QoS
+	// RetainAvailable is set if the server supports retained messages.
+	RetainAvailable bool
+	// WildcardSubAvailable is set if the server supports wildcard
+	// subscriptions.
+	WildcardSubAvailable bool
+	// SubIDAvailable is set if the server supports subscription
+	// identifiers.
+	SubIDAvailable bool
+	// SharedSubAvailable is set if the server supports shared
+	// subscriptions.
+	SharedSubAvailable bool
+	// ResponseInfo is the basis for response topics returned by the
+	// server if requested on connect (empty otherwise).
+	ResponseInfo string
 }
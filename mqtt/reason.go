@@ -0,0 +1,148 @@
+package mqtt
+
+import (
+	"fmt"
+)
+
+// ConnAckReason is the reason code of a ConnAck packet (MQTTv5).
+type ConnAckReason uint8
+
+// ConnAck reason codes (MQTTv5)
+const (
+	ConnAckSuccess                ConnAckReason = 0x00
+	ConnAckUnspecified            ConnAckReason = 0x80
+	ConnAckMalformedPacket        ConnAckReason = 0x81
+	ConnAckProtocolError          ConnAckReason = 0x82
+	ConnAckImplementationError    ConnAckReason = 0x83
+	ConnAckUnsupportedVersion     ConnAckReason = 0x84
+	ConnAckClientIDInvalid        ConnAckReason = 0x85
+	ConnAckBadCredentials         ConnAckReason = 0x86
+	ConnAckNotAuthorized          ConnAckReason = 0x87
+	ConnAckServerUnavailable      ConnAckReason = 0x88
+	ConnAckServerBusy             ConnAckReason = 0x89
+	ConnAckBanned                 ConnAckReason = 0x8A
+	ConnAckBadAuthMethod          ConnAckReason = 0x8C
+	ConnAckTopicNameInvalid       ConnAckReason = 0x90
+	ConnAckPacketTooLarge         ConnAckReason = 0x95
+	ConnAckQuotaExceeded          ConnAckReason = 0x97
+	ConnAckPayloadFormatInvalid   ConnAckReason = 0x99
+	ConnAckRetainNotSupported     ConnAckReason = 0x9A
+	ConnAckQoSNotSupported        ConnAckReason = 0x9B
+	ConnAckUseAnotherServer       ConnAckReason = 0x9C
+	ConnAckServerMoved            ConnAckReason = 0x9D
+	ConnAckConnectionRateExceeded ConnAckReason = 0x9F
+)
+
+var (
+	// ErrConnectUnspecified is returned by client.Connect if the server
+	// refused the connection without specifying a reason.
+	ErrConnectUnspecified = fmt.Errorf("connection refused by server")
+	// ErrMalformedPacket is returned if the server reports a malformed
+	// packet.
+	ErrMalformedPacket = fmt.Errorf("malformed packet")
+	// ErrImplementation is returned if the server reports an
+	// implementation specific error.
+	ErrImplementation = fmt.Errorf("implementation specific error")
+	// ErrServerBusy is returned if the server is busy.
+	ErrServerBusy = fmt.Errorf("server busy")
+	// ErrConnectBanned is returned by client.Connect if the client is
+	// banned by the server.
+	ErrConnectBanned = fmt.Errorf("client banned by server")
+	// ErrConnectBadAuthMethod is returned by client.Connect if the
+	// authentication method is not supported by the server.
+	ErrConnectBadAuthMethod = fmt.Errorf("bad authentication method")
+	// ErrTopicNameInvalid is returned if the server does not accept the
+	// topic name.
+	ErrTopicNameInvalid = fmt.Errorf("topic name invalid")
+	// ErrPacketTooLarge is returned if a packet exceeds the maximum
+	// packet size.
+	ErrPacketTooLarge = fmt.Errorf("packet too large")
+	// ErrQuotaExceeded is returned if an implementation or
+	// administratively imposed limit is exceeded.
+	ErrQuotaExceeded = fmt.Errorf("quota exceeded")
+	// ErrPayloadFormatInvalid is returned if the server does not accept
+	// the payload format.
+	ErrPayloadFormatInvalid = fmt.Errorf("payload format invalid")
+	// ErrRetainNotSupported is returned if the server does not support
+	// retained messages.
+	ErrRetainNotSupported = fmt.Errorf("retain not supported")
+	// ErrQoSNotSupported is returned if the server does not support the
+	// requested QoS.
+	ErrQoSNotSupported = fmt.Errorf("QoS not supported")
+	// ErrUseAnotherServer is returned if the client should temporarily
+	// use another server.
+	ErrUseAnotherServer = fmt.Errorf("use another server")
+	// ErrServerMoved is returned if the client should permanently use
+	// another server.
+	ErrServerMoved = fmt.Errorf("server moved")
+	// ErrConnectionRateExceeded is returned by client.Connect if the
+	// client is connecting too frequently.
+	ErrConnectionRateExceeded = fmt.Errorf("connection rate exceeded")
+)
+
+var connAckReasonErrors = map[ConnAckReason]error{
+	ConnAckUnspecified:            ErrConnectUnspecified,
+	ConnAckMalformedPacket:        ErrMalformedPacket,
+	ConnAckProtocolError:          ErrProtocolViolation,
+	ConnAckImplementationError:    ErrImplementation,
+	ConnAckUnsupportedVersion:     ErrConnectBadVersion,
+	ConnAckClientIDInvalid:        ErrConnectIDNotAllowed,
+	ConnAckBadCredentials:         ErrConnectCredentials,
+	ConnAckNotAuthorized:          ErrConnectUnauthorized,
+	ConnAckServerUnavailable:      ErrConnectUnavailable,
+	ConnAckServerBusy:             ErrServerBusy,
+	ConnAckBanned:                 ErrConnectBanned,
+	ConnAckBadAuthMethod:          ErrConnectBadAuthMethod,
+	ConnAckTopicNameInvalid:       ErrTopicNameInvalid,
+	ConnAckPacketTooLarge:         ErrPacketTooLarge,
+	ConnAckQuotaExceeded:          ErrQuotaExceeded,
+	ConnAckPayloadFormatInvalid:   ErrPayloadFormatInvalid,
+	ConnAckRetainNotSupported:     ErrRetainNotSupported,
+	ConnAckQoSNotSupported:        ErrQoSNotSupported,
+	ConnAckUseAnotherServer:       ErrUseAnotherServer,
+	ConnAckServerMoved:            ErrServerMoved,
+	ConnAckConnectionRateExceeded: ErrConnectionRateExceeded,
+}
+
+// Err returns the error corresponding to the reason code, or nil if the
+// connection was accepted.
+func (r ConnAckReason) Err() error {
+	if r == ConnAckSuccess {
+		return nil
+	} else if err, ok := connAckReasonErrors[r]; ok {
+		return err
+	}
+	return fmt.Errorf("connection refused: reason code 0x%02X", uint8(r))
+}
+
+// SubAckCode is the status code of a topic filter in a SubAck packet: the
+// granted QoS if the subscription is accepted, otherwise a failure code.
+// MQTT 3.1.1 servers only use SubAckFailure to refuse a subscription.
+type SubAckCode uint8
+
+// SubAck status codes
+const (
+	SubAckGrantedQoS0             SubAckCode = 0x00
+	SubAckGrantedQoS1             SubAckCode = 0x01
+	SubAckGrantedQoS2             SubAckCode = 0x02
+	SubAckFailure                 SubAckCode = 0x80
+	SubAckImplementationError     SubAckCode = 0x83
+	SubAckNotAuthorized           SubAckCode = 0x87
+	SubAckTopicFilterInvalid      SubAckCode = 0x8F
+	SubAckPacketIDInUse           SubAckCode = 0x91
+	SubAckQuotaExceeded           SubAckCode = 0x97
+	SubAckSharedSubsUnsupported   SubAckCode = 0x9E
+	SubAckSubIDsUnsupported       SubAckCode = 0xA1
+	SubAckWildcardSubsUnsupported SubAckCode = 0xA2
+)
+
+// Granted returns whether the server accepted the subscription.
+func (c SubAckCode) Granted() bool {
+	return c <= SubAckGrantedQoS2
+}
+
+// QoS returns the QoS granted by the server; the result is only meaningful
+// if the subscription is granted.
+func (c SubAckCode) QoS() QoS {
+	return QoS(c)
+}
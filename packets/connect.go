@@ -1,10 +1,11 @@
 package packets
 
 import (
-	"bytes"
 	"encoding/binary"
 	"fmt"
 	"io"
+	"strings"
+	"unicode/utf8"
 
 	"github.com/alfrunes/mqttie/mqtt"
 	"github.com/alfrunes/mqttie/x/util"
@@ -42,6 +43,29 @@ const (
 	connPropWillCorrelationData uint8 = 0x09
 	connPropWillUserProps       uint8 = 0x26
 
+	connAckPropSessionExpire      uint8 = 0x11
+	connAckPropReceiveMax         uint8 = 0x21
+	connAckPropMaxQoS             uint8 = 0x24
+	connAckPropRetainAvailable    uint8 = 0x25
+	connAckPropMaxPacketSize      uint8 = 0x27
+	connAckPropAssignedClientID   uint8 = 0x12
+	connAckPropTopicAliasMax      uint8 = 0x22
+	connAckPropReasonString       uint8 = 0x1F
+	connAckPropUserProperty       uint8 = 0x26
+	connAckPropWildcardAvailable  uint8 = 0x28
+	connAckPropSubIDAvailable     uint8 = 0x29
+	connAckPropSharedSubAvailable uint8 = 0x2A
+	connAckPropServerKeepAlive    uint8 = 0x13
+	connAckPropResponseInfo       uint8 = 0x1A
+	connAckPropServerReference    uint8 = 0x1C
+	connAckPropAuthMethod         uint8 = 0x15
+	connAckPropAuthData           uint8 = 0x16
+
+	disconnPropSessionExpire   uint8 = 0x11
+	disconnPropReasonString    uint8 = 0x1F
+	disconnPropUserProperty    uint8 = 0x26
+	disconnPropServerReference uint8 = 0x1C
+
 	// ConnAck status codes
 	ConnAckAccepted       uint8 = 0x00
 	ConnAckBadVersion     uint8 = 0x01
@@ -51,6 +75,39 @@ const (
 	ConnAckUnauthorized   uint8 = 0x05
 )
 
+// Disconnect reason codes (MQTTv5)
+const (
+	DisconnectNormal                  uint8 = 0x00
+	DisconnectWithWill                uint8 = 0x04
+	DisconnectUnspecified             uint8 = 0x80
+	DisconnectMalformedPacket         uint8 = 0x81
+	DisconnectProtocolError           uint8 = 0x82
+	DisconnectImplementationError     uint8 = 0x83
+	DisconnectNotAuthorized           uint8 = 0x87
+	DisconnectServerBusy              uint8 = 0x89
+	DisconnectServerShuttingDown      uint8 = 0x8B
+	DisconnectKeepAliveTimeout        uint8 = 0x8D
+	DisconnectSessionTakenOver        uint8 = 0x8E
+	DisconnectTopicFilterInvalid      uint8 = 0x8F
+	DisconnectTopicNameInvalid        uint8 = 0x90
+	DisconnectReceiveMaxExceeded      uint8 = 0x93
+	DisconnectTopicAliasInvalid       uint8 = 0x94
+	DisconnectPacketTooLarge          uint8 = 0x95
+	DisconnectMessageRateTooHigh      uint8 = 0x96
+	DisconnectQuotaExceeded           uint8 = 0x97
+	DisconnectAdministrativeAction    uint8 = 0x98
+	DisconnectPayloadFormatInvalid    uint8 = 0x99
+	DisconnectRetainNotSupported      uint8 = 0x9A
+	DisconnectQoSNotSupported         uint8 = 0x9B
+	DisconnectUseAnotherServer        uint8 = 0x9C
+	DisconnectServerMoved             uint8 = 0x9D
+	DisconnectSharedSubsNotSupported  uint8 = 0x9E
+	DisconnectConnectionRateExceeded  uint8 = 0x9F
+	DisconnectMaxConnectTime          uint8 = 0xA0
+	DisconnectSubIDsNotSupported      uint8 = 0xA1
+	DisconnectWildcardSubsUnsupported uint8 = 0xA2
+)
+
 // Connect contains a structural representation of a connect packet. Some of
 // the parameters are dependent, for instance: Password requires Username to
 // be set. Other parameters are version dependent, these are highlighted in
@@ -58,6 +115,12 @@ const (
 type Connect struct {
 	// Version holds the protocol version of this packet (see mqtt package).
 	Version mqtt.Version
+	// ProtocolName overrides the protocol name encoded in the variable
+	// header, e.g. for testing servers or talking to non-standard
+	// gateways (defaults to "MQTT", or "MQIsdp" for MQTT 3.1). Decoded
+	// packets only hold the name if it is not the standard name of the
+	// protocol version.
+	ProtocolName string
 	// CleanSession stores the clean session flag (MQTT 3.1.1) or clean
 	// start flag (MQTT 5.0).
 	//
@@ -85,7 +148,8 @@ type Connect struct {
 	WillRetain bool
 
 	// ClientID stores the client identifier presented to the server. If
-	// left empty a random UUID (v4) is automatically generated.
+	// left empty a random UUID (v4) is automatically generated, unless
+	// Version == MQTTv5 in which case the server assigns an identifier.
 	ClientID string
 	// Username holds the Username credential if the server has access
 	// control enabled (cannot be an empty string).
@@ -124,7 +188,7 @@ type Connect struct {
 	// key-value pairs. The meaning of these properties is not defined by
 	// the MQTT 5.0 specification
 	// (ref. https://docs.oasis-open.org/mqtt/mqtt/v5.0/mqtt-v5.0.pdf :871).
-	ConnUserProperties map[string]string
+	ConnUserProperties []mqtt.UserProperty
 	// AuthMethod specifies (and enables) the name of the authentication
 	// method used for extensive authentication. If specified, the client
 	// must not follow up with any other packets than Auth or Disconnect
@@ -156,24 +220,89 @@ type Connect struct {
 	// to none).
 	WillResponseTopic string
 	// WillCorrelationData is used by the sender of the request message to
-	// identify which request the response message is for. The value is
-	// ignored if WillResponseTopic is not set (defaults to unset).
+	// identify which request the response message is for (defaults to
+	// unset).
 	WillCorrelationData []byte
 	// WillUserProperties provides user-specified key:value pairs of data
 	// to the WillMessage. The interpretation of these parameters are
 	// completely up to the user's application (think of it as custom HTTP
 	// headers).
-	WillUserProperties map[string]string
+	WillUserProperties []mqtt.UserProperty
 }
 
 type ConnAck struct {
 	SessionPresent bool
 	ReturnCode     uint8
 	Version        mqtt.Version
+
+	// The following parameters applies only to Version == MQTTv5
+
+	// SessionExpiryInterval overrides the session expiry interval
+	// requested by the client (seconds).
+	SessionExpiryInterval uint32
+	// ReceiveMax is the number of QoS1 and QoS2 publications the server
+	// is willing to process concurrently (defaults to 0: 65535).
+	ReceiveMax uint16
+	// MaxQoS is the maximum QoS supported by the server (defaults to
+	// nil: QoS2).
+	MaxQoS *mqtt.QoS
+	// RetainUnavailable is set if the server does not support retained
+	// messages.
+	RetainUnavailable bool
+	// MaxPacketSize is the maximum packet size the server is willing to
+	// accept (defaults to 0: unlimited).
+	MaxPacketSize uint32
+	// AssignedClientID is the client identifier assigned by the server
+	// when the client connected with an empty identifier.
+	AssignedClientID string
+	// TopicAliasMax is the highest topic alias the server accepts from
+	// the client (defaults to 0: topic aliases not accepted).
+	TopicAliasMax uint16
+	// ReasonString is a human readable string describing the reason code.
+	ReasonString string
+	// UserProperties are user defined key/value pairs.
+	UserProperties []mqtt.UserProperty
+	// WildcardSubUnavailable is set if the server does not support
+	// wildcard subscriptions.
+	WildcardSubUnavailable bool
+	// SubIDUnavailable is set if the server does not support subscription
+	// identifiers.
+	SubIDUnavailable bool
+	// SharedSubUnavailable is set if the server does not support shared
+	// subscriptions.
+	SharedSubUnavailable bool
+	// ServerKeepAlive overrides the keep alive requested by the client
+	// (defaults to nil: the requested keep alive applies).
+	ServerKeepAlive *uint16
+	// ResponseInfo is used as the basis for creating response topics.
+	ResponseInfo string
+	// ServerReference points the client to another server to use.
+	ServerReference string
+	// AuthMethod is the name of the authentication method.
+	AuthMethod string
+	// AuthData contains the authentication data.
+	AuthData []byte
 }
 
 type Disconnect struct {
 	Version mqtt.Version
+
+	// The following parameters applies only to Version == MQTTv5
+
+	// ReasonCode holds the reason for disconnecting (defaults to 0:
+	// normal disconnection).
+	ReasonCode uint8
+	// ReasonString is a human readable string describing the reason for
+	// disconnecting.
+	ReasonString string
+	// SessionExpiryInterval, if set, updates the session expiry interval
+	// (in seconds) requested on connect. Only sent by the client.
+	SessionExpiryInterval *uint32
+	// ServerReference may be sent by the server to point the client to
+	// another server to use.
+	ServerReference string
+	// UserProperties are user defined key/value pairs.
+	UserProperties []mqtt.UserProperty
 }
 
 // the following private functions compute the length of the respective packet
@@ -182,94 +311,89 @@ type Disconnect struct {
 // the message is truncated to the overflown value, making it up to the user
 // to keep the lengths within the boundaries.
 
-func (c *Connect) computeConnectPropLen() uint64 {
-	var length uint64
+// connProperties returns the properties of the variable header.
+func (c *Connect) connProperties() Properties {
+	var props Properties
 	if c.SessionExpiryInterval > 0 {
-		// uint32
-		length += 5
+		props.AddUint32(connPropSessionExpire, c.SessionExpiryInterval)
 	}
 	if c.ReceiveMax > 0 {
-		// uint16
-		length += 3
+		props.AddUint16(connPropReceiveMax, c.ReceiveMax)
 	}
 	if c.MaxPacketSize > 0 {
-		// uint32
-		length += 5
+		props.AddUint32(connPropMaxPacketSize, c.MaxPacketSize)
 	}
 	if c.TopicAliasMax > 0 {
-		// uint16
-		length += 3
+		props.AddUint16(connPropTopicAliasMax, c.TopicAliasMax)
 	}
 	if c.RequestResponseInfo {
-		// byte
-		length += 2
+		props.AddByte(connPropRequestResponseInfo, 0x01)
 	}
 	if c.DisableProblemInfo {
-		// byte
-		length += 2
-	}
-	if len(c.ConnUserProperties) > 0 {
-		for key, value := range c.ConnUserProperties {
-			// UTF8-encoded key/value (+ property byte)
-			length += uint64(uint16(len(key)) + 5)
-			length += uint64(uint16(len(value)))
-		}
+		props.AddByte(connPropDisableProblemInfo, 0x00)
+	}
+	for _, prop := range c.ConnUserProperties {
+		props.AddUserProperty(prop.Key, prop.Value)
 	}
 	if c.AuthMethod != "" {
-		// UTF-8 string
-		length += uint64(uint16(len(c.AuthMethod)) + 3)
+		props.AddString(connPropAuthMethod, c.AuthMethod)
 	}
 	if c.AuthData != nil {
-		// Binary data
-		length += uint64(uint16(len(c.AuthData)) + 3)
+		props.AddBinary(connPropAuthData, c.AuthData)
 	}
-	return length
+	return props
 }
 
-func (c *Connect) computeWillPropLen() uint64 {
-	var length uint64
-	if c.WillTopic.Name == "" {
-		return length
-	}
+// willProperties returns the will properties of the payload.
+func (c *Connect) willProperties() Properties {
+	var props Properties
 	if c.WillDelayInterval > 0 {
-		// uint32
-		length += 5
+		props.AddUint32(connPropWillDelay, c.WillDelayInterval)
 	}
 	if c.WillFormatUTF8 {
-		// byte
-		length += 2
+		props.AddByte(connPropWillUTF8, 0x01)
 	}
 	if c.WillMessageExpiry > 0 {
-		// uint32
-		length += 5
+		props.AddUint32(connPropWillExpire, c.WillMessageExpiry)
 	}
 	if c.WillContentType != "" {
-		// UTF-8 string
-		length += uint64(uint16(len(c.WillContentType)) + 3)
+		props.AddString(connPropWillContentType, c.WillContentType)
 	}
 	if c.WillResponseTopic != "" {
-		// UTF-8 string
-		length += uint64(uint16(len(c.WillResponseTopic)) + 3)
+		props.AddString(connPropWillResponseTopic, c.WillResponseTopic)
+	}
+	if c.WillCorrelationData != nil {
+		props.AddBinary(
+			connPropWillCorrelationData, c.WillCorrelationData,
+		)
+	}
+	for _, prop := range c.WillUserProperties {
+		props.AddUserProperty(prop.Key, prop.Value)
+	}
+	return props
+}
 
-		if c.WillCorrelationData != nil {
-			// Binary data
-			length += uint64(uint16(len(c.WillCorrelationData)) + 3)
-		}
+// protocolName returns the protocol name of the protocol version: "MQIsdp"
+// for MQTT 3.1 and "MQTT" for later versions.
+func protocolName(version mqtt.Version) string {
+	if version == mqtt.MQTTv31 {
+		return "MQIsdp"
 	}
-	if len(c.WillUserProperties) > 0 {
-		// UTF-8 key/value pairs
-		for key, value := range c.WillUserProperties {
-			length += uint64(uint16(len(key)) + 5)
-			length += uint64(uint16(len(value)))
-		}
+	return "MQTT"
+}
+
+// protocolName returns the protocol name to encode.
+func (c *Connect) protocolName() string {
+	if c.ProtocolName != "" {
+		return c.ProtocolName
 	}
-	return length
+	return protocolName(c.Version)
 }
 
 func (c *Connect) computeFlagsAndLen() (uint8, uint64) {
 	// Initialize length to fixed variable header length:
-	//     "MQTT" + version + Flags + KeepAlive
-	var length uint64 = 10
+	//     protocol name + version + Flags + KeepAlive
+	var length = uint64(len(c.protocolName())) + 6
 	var flags uint8
 	if c.CleanSession {
 		flags |= connectFlagCleanSession
@@ -297,7 +421,7 @@ func (c *Connect) computeFlagsAndLen() (uint8, uint64) {
 		}
 	}
 
-	if len(c.ClientID) == 0 {
+	if len(c.ClientID) == 0 && c.Version < mqtt.MQTTv5 {
 		id := uuid.NewV4()
 		c.ClientID = id.String()
 	}
@@ -305,123 +429,25 @@ func (c *Connect) computeFlagsAndLen() (uint8, uint64) {
 	return flags, length
 }
 
-func (c *Connect) marshalConnProperties(b []byte) int {
-	var i int
-	if c.SessionExpiryInterval > 0 {
-		b[i] = connPropSessionExpire
-		i++
-		i += util.EncodeValue(b[i:], c.SessionExpiryInterval)
-	}
-	if c.ReceiveMax > 0 {
-		b[i] = connPropReceiveMax
-		i++
-		i += util.EncodeValue(b[i:], c.ReceiveMax)
-	}
-	if c.MaxPacketSize > 0 {
-		b[i] = connPropMaxPacketSize
-		i++
-		i += util.EncodeValue(b[i:], c.MaxPacketSize)
-	}
-	if c.TopicAliasMax > 0 {
-		b[i] = connPropTopicAliasMax
-		i++
-		i += util.EncodeValue(b[i:], c.TopicAliasMax)
-	}
-	if c.RequestResponseInfo {
-		i += copy(b[i:], []byte{
-			connPropRequestResponseInfo, 0x01,
-		})
-	}
-	if c.DisableProblemInfo {
-		i += copy(b[i:], []byte{
-			connPropDisableProblemInfo, 0x00,
-		})
-	}
-	if len(c.ConnUserProperties) > 0 {
-		for key, value := range c.ConnUserProperties {
-			// UTF8-encoded key/value (+ property byte)
-			b[i] = connPropUserProperty
-			i++
-			i += util.EncodeValue(b[i:], key)
-			i += util.EncodeValue(b[i:], value)
-		}
-	}
-	if c.AuthMethod != "" {
-		// UTF-8 string
-		b[i] = connPropAuthMethod
-		i++
-		i += util.EncodeValue(b[i:], c.AuthMethod)
-	}
-	if c.AuthData != nil {
-		// Binary data
-		b[i] = connPropAuthData
-		i++
-		i += util.EncodeValue(b[i:], c.AuthData)
-	}
-	return i
-}
-
-func (c *Connect) marshalWillProperties(b []byte) int {
-	var i int
-	if c.WillDelayInterval > 0 {
-		b[i] = connPropWillDelay
-		i++
-		i += util.EncodeValue(b[i:], c.WillDelayInterval)
-	}
-	if c.WillFormatUTF8 {
-		i += copy(b[i:], []byte{connPropWillUTF8, 0x01})
-	}
-	if c.WillMessageExpiry > 0 {
-		b[i] = connPropWillExpire
-		i++
-		i += util.EncodeValue(b[i:], c.WillMessageExpiry)
-	}
-	if c.WillContentType != "" {
-		b[i] = connPropWillContentType
-		i++
-		i += util.EncodeValue(b[i:], c.WillContentType)
-	}
-	if c.WillResponseTopic != "" {
-		b[i] = connPropWillResponseTopic
-		i++
-		i += util.EncodeValue(b[i:], c.WillResponseTopic)
-		if c.WillCorrelationData != nil {
-			b[i] = connPropWillCorrelationData
-			i++
-			i += util.EncodeValue(
-				b[i:], c.WillCorrelationData,
-			)
-		}
-	}
-	if len(c.WillUserProperties) > 0 {
-		for key, value := range c.WillUserProperties {
-			b[i] = connPropWillUserProps
-			i++
-			i += util.EncodeValue(b[i:], key)
-			i += util.EncodeValue(b[i:], value)
-		}
-	}
-	return i
-}
-
 func (c *Connect) MarshalBinary() (b []byte, err error) {
 	var i int
 	var flags uint8
 	var remLen uint64
-	var connPropLen uint64
-	var willPropLen uint64
+	var connProps, willProps Properties
 	if c.WillTopic.QoS > 2 {
 		return nil, fmt.Errorf("illegal QoS value (highest: 2)")
+	} else if len(c.ProtocolName) > 0xFFFF {
+		// Exceeds the maximum length of an UTF-8 string.
+		return nil, mqtt.ErrPacketTooLarge
 	}
 	// Compute packet length.
 	flags, remLen = c.computeFlagsAndLen()
 	if c.Version >= mqtt.MQTTv5 {
-		connPropLen = c.computeConnectPropLen()
-		remLen += connPropLen + uint64(util.GetUvarintLen(connPropLen))
+		connProps = c.connProperties()
+		remLen += uint64(connProps.Size())
 		if c.WillTopic.Name != "" {
-			willPropLen = c.computeWillPropLen()
-			remLen += willPropLen +
-				uint64(util.GetUvarintLen(willPropLen))
+			willProps = c.willProperties()
+			remLen += uint64(willProps.Size())
 		}
 	}
 	remLenSize := util.GetUvarintLen(remLen)
@@ -436,13 +462,12 @@ func (c *Connect) MarshalBinary() (b []byte, err error) {
 	i += binary.PutUvarint(b[i:], remLen)
 
 	// Variable header
-	i += copy(b[i:], []byte{0, 4, 'M', 'Q', 'T', 'T',
-		uint8(c.Version), flags})
+	i += util.EncodeValue(b[i:], c.protocolName())
+	i += copy(b[i:], []byte{uint8(c.Version), flags})
 	binary.BigEndian.PutUint16(b[i:], c.KeepAlive)
 	i += 2
 	if c.Version >= mqtt.MQTTv5 {
-		i += binary.PutUvarint(b[i:], connPropLen)
-		i += c.marshalConnProperties(b[i:])
+		i += connProps.MarshalTo(b[i:])
 	}
 
 	// Payload
@@ -450,8 +475,7 @@ func (c *Connect) MarshalBinary() (b []byte, err error) {
 	if c.WillTopic.Name != "" {
 		if c.Version >= mqtt.MQTTv5 {
 			// Will properties
-			i += binary.PutUvarint(b[i:], willPropLen)
-			i += c.marshalWillProperties(b[i:])
+			i += willProps.MarshalTo(b[i:])
 		}
 		i += util.EncodeValue(b[i:], c.WillTopic.Name)
 		i += util.EncodeValue(b[i:], c.WillMessage)
@@ -481,126 +505,96 @@ func (c *Connect) WriteTo(w io.Writer) (n int64, err error) {
 	return n, err
 }
 
-func (c *Connect) readConnProperty(
-	r io.Reader, propID uint8, propLen int,
-) (n int, err error) {
-	var N int
-	switch propID {
-	case connPropSessionExpire:
-		N, err = util.ReadValue(
-			r, &c.SessionExpiryInterval, propLen-n,
-		)
-		n += N
-
-	case connPropReceiveMax:
-		N, err = util.ReadValue(r, &c.ReceiveMax, propLen-n)
-		n += N
-
-	case connPropMaxPacketSize:
-		N, err = util.ReadValue(r, &c.MaxPacketSize, propLen-n)
-		n += N
-
-	case connPropTopicAliasMax:
-		N, err = util.ReadValue(r, &c.TopicAliasMax, propLen-n)
-		n += N
-
-	case connPropRequestResponseInfo:
-		var requestResponseInfo uint8
-		N, err = util.ReadValue(
-			r, &requestResponseInfo, propLen-n,
-		)
-		n += N
-		if requestResponseInfo == 1 {
-			c.RequestResponseInfo = true
-		}
-
-	case connPropDisableProblemInfo:
-		var requestProblemInfo uint8
-		N, err = util.ReadValue(
-			r, &requestProblemInfo, propLen-n,
-		)
-		n += N
-		if requestProblemInfo == 0 {
-			c.DisableProblemInfo = true
-		}
-
-	case connPropUserProperty:
-		var key, value string
-		N, err = util.ReadValue(r, &key, propLen-n)
-		n += N
-		if err != nil {
-			return n, err
-		}
-		N, err = util.ReadValue(r, &value, propLen-n)
-		n += N
-		if c.ConnUserProperties == nil {
-			c.ConnUserProperties = make(map[string]string)
+// setConnProperties assigns the properties of the variable header.
+func (c *Connect) setConnProperties(props Properties) error {
+	for _, prop := range props {
+		switch prop.ID {
+		case connPropSessionExpire:
+			c.SessionExpiryInterval = prop.Value.(uint32)
+		case connPropReceiveMax:
+			c.ReceiveMax = prop.Value.(uint16)
+		case connPropMaxPacketSize:
+			c.MaxPacketSize = prop.Value.(uint32)
+		case connPropTopicAliasMax:
+			c.TopicAliasMax = prop.Value.(uint16)
+		case connPropRequestResponseInfo:
+			c.RequestResponseInfo = prop.Value.(uint8) == 1
+		case connPropDisableProblemInfo:
+			c.DisableProblemInfo = prop.Value.(uint8) == 0
+		case connPropUserProperty:
+			c.ConnUserProperties = append(
+				c.ConnUserProperties,
+				prop.Value.(mqtt.UserProperty),
+			)
+		case connPropAuthMethod:
+			c.AuthMethod = prop.Value.(string)
+		case connPropAuthData:
+			c.AuthData = prop.Value.([]byte)
+		default:
+			return fmt.Errorf(
+				"protocol error: illegal property ID: %02X",
+				prop.ID,
+			)
 		}
-		c.ConnUserProperties[key] = value
-
-	case connPropAuthMethod:
-		N, err = util.ReadValue(r, &c.AuthMethod, propLen-n)
-		n += N
-
-	case connPropAuthData:
-		N, err = util.ReadValue(r, &c.AuthData, propLen-n)
-		n += N
-
-	default:
-		err = fmt.Errorf(
-			"protocol error: illegal property ID: %02X",
-			propID,
-		)
 	}
-	return n, err
+	return nil
 }
 
-func (c *Connect) readConnProperties(
-	r io.Reader, propLen int,
-) (n int, err error) {
-	var N int
-	var propID uint8
-	for n < propLen {
-		N, err = util.ReadValue(r, &propID, propLen-n)
-		n += N
-		if err != nil {
-			break
-		}
-
-		N, err = c.readConnProperty(r, propID, propLen-n)
-		n += N
-		if err != nil {
-			break
-		}
-	}
-	return n, err
-}
+// connectMinHeaderLen is the minimum length of a connect packet following
+// the protocol name: protocol level, flags, keep alive and the length of the
+// client identifier.
+const connectMinHeaderLen = 6
 
 func (c *Connect) parseVarHeader(
 	r io.Reader, remLen int,
 ) (flags uint8, n int, err error) {
-	var buf []byte
+	var nameLen uint16
 	var b uint8
-	n, err = util.ReadValue(r, &buf, remLen)
+	n, err = util.ReadValue(r, &nameLen, remLen)
 	if err != nil {
 		return flags, n, err
-	} else if !bytes.Equal(buf, []byte{'M', 'Q', 'T', 'T'}) {
-		return flags, n, fmt.Errorf(
-			"connect: unknown protocol: %s", string(buf))
 	}
-	N, err := util.ReadValue(r, &b, remLen-n)
+	if nameLen == 0 {
+		return flags, n, mqtt.ErrProtocolViolation
+	} else if remLen-n < int(nameLen)+connectMinHeaderLen {
+		// The name is followed by at least the protocol level, the
+		// flags, the keep alive and the client identifier length.
+		return flags, n, mqtt.ErrPacketShort
+	}
+	buf := make([]byte, nameLen)
+	N, err := io.ReadFull(r, buf)
+	n += N
+	if err != nil {
+		return flags, n, err
+	}
+	name := string(buf)
+	if !utf8.ValidString(name) || strings.ContainsRune(name, 0) {
+		return flags, n, mqtt.ErrProtocolViolation
+	}
+	N, err = util.ReadValue(r, &b, remLen-n)
 	n += N
 	if err != nil {
 		return flags, n, err
 	}
 
 	switch mqtt.Version(b) {
-	case mqtt.MQTTv311, mqtt.MQTTv5:
+	case mqtt.MQTTv31, mqtt.MQTTv311, mqtt.MQTTv5:
 		c.Version = mqtt.Version(b)
 	default:
 		return flags, n, fmt.Errorf(
 			"connect: unknown protocol version: 0x%02X", b)
 	}
+	switch name {
+	case protocolName(c.Version):
+	case protocolName(mqtt.MQTTv31), protocolName(mqtt.MQTTv311):
+		// A standard name must match the protocol level.
+		return flags, n, fmt.Errorf(
+			"connect: protocol %s does not match version 0x%02X",
+			name, b)
+	default:
+		// Custom protocol name (see ProtocolName).
+		c.ProtocolName = name
+	}
 
 	N, err = util.ReadValue(r, &b, remLen-n)
 	n += N
@@ -626,86 +620,46 @@ func (c *Connect) parseVarHeader(
 		return flags, n, err
 	}
 	if c.Version >= mqtt.MQTTv5 {
-		var v int
-		v, N, err = util.ReadVarint(r)
-		n += N
+		var props Properties
+		N, err := props.ReadFrom(r)
+		n += int(N)
 		if err != nil {
 			return flags, n, err
-		} else if remLen < N {
-			return flags, n, mqtt.ErrPacketShort
 		}
-		N, err = c.readConnProperties(r, v)
-		n += N
+		err = c.setConnProperties(props)
 	}
 	return flags, n, err
 }
 
-func (c *Connect) readWillProperties(r io.Reader, propLen int) (n int, err error) {
-	for n < propLen {
-		var propID uint8
-		N, err := util.ReadValue(r, &propID, propLen-n)
-		n += N
-		if err != nil {
-			return n, err
-		}
-		switch propID {
+// setWillProperties assigns the will properties of the payload.
+func (c *Connect) setWillProperties(props Properties) error {
+	for _, prop := range props {
+		switch prop.ID {
 		case connPropWillContentType:
-			N, err = util.ReadValue(
-				r, &c.WillContentType, propLen-n,
-			)
-
+			c.WillContentType = prop.Value.(string)
 		case connPropWillCorrelationData:
-			N, err = util.ReadValue(
-				r, &c.WillCorrelationData, propLen,
-			)
-
+			c.WillCorrelationData = prop.Value.([]byte)
 		case connPropWillDelay:
-			N, err = util.ReadValue(
-				r, &c.WillDelayInterval, propLen-n,
-			)
-
+			c.WillDelayInterval = prop.Value.(uint32)
 		case connPropWillExpire:
-			N, err = util.ReadValue(
-				r, &c.WillMessageExpiry, propLen-n,
-			)
-
+			c.WillMessageExpiry = prop.Value.(uint32)
 		case connPropWillResponseTopic:
-			N, err = util.ReadValue(
-				r, &c.WillResponseTopic, propLen-n,
-			)
-
+			c.WillResponseTopic = prop.Value.(string)
 		case connPropWillUTF8:
-			var format uint8
-			N, err = util.ReadValue(r, &format, propLen-n)
-			if format == 1 {
-				c.WillFormatUTF8 = true
-			}
-
+			c.WillFormatUTF8 = prop.Value.(uint8) == 1
 		case connPropWillUserProps:
-			var key, value string
-			N, err = util.ReadValue(r, &key, propLen-n)
-			n += N
-			if err != nil {
-				return n, err
-			}
-			N, err = util.ReadValue(r, &value, propLen-n)
-			if c.WillUserProperties == nil {
-				c.WillUserProperties = make(map[string]string)
-			}
-			c.WillUserProperties[key] = value
-
+			c.WillUserProperties = append(
+				c.WillUserProperties,
+				prop.Value.(mqtt.UserProperty),
+			)
 		default:
-			err = fmt.Errorf(
+			return fmt.Errorf(
 				"protocol error: illegal property ID: %02X",
-				propID,
+				prop.ID,
 			)
 		}
-		n += N
-		if err != nil {
-			break
-		}
 	}
-	return n, err
+	return nil
 }
 
 func (c *Connect) readPayload(
@@ -718,15 +672,13 @@ func (c *Connect) readPayload(
 	}
 	if flags&connectFlagWill > 0 {
 		if c.Version >= mqtt.MQTTv5 {
-			var propLen int
-			propLen, N, err = util.ReadVarint(r)
-			n += N
+			var props Properties
+			N, err := props.ReadFrom(r)
+			n += int(N)
 			if err != nil {
 				return n, err
 			}
-			N, err = c.readWillProperties(r, propLen)
-			n += N
-			if err != nil {
+			if err = c.setWillProperties(props); err != nil {
 				return n, err
 			}
 		}
@@ -778,7 +730,8 @@ func (c *Connect) ReadFrom(r io.Reader) (n int64, err error) {
 	}
 	length := int64(remLength + N)
 	n = int64(N)
-	if length <= 12 {
+	if remLength < 2 {
+		// No room for the protocol name length.
 		return n, mqtt.ErrPacketShort
 	}
 	defer func() {
@@ -812,7 +765,82 @@ func (c *Connect) ReadFrom(r io.Reader) (n int64, err error) {
 	return n, err
 }
 
+// properties returns the properties of the variable header.
+func (c *ConnAck) properties() Properties {
+	var props Properties
+	if c.SessionExpiryInterval > 0 {
+		props.AddUint32(
+			connAckPropSessionExpire, c.SessionExpiryInterval,
+		)
+	}
+	if c.ReceiveMax > 0 {
+		props.AddUint16(connAckPropReceiveMax, c.ReceiveMax)
+	}
+	if c.MaxQoS != nil {
+		props.AddByte(connAckPropMaxQoS, uint8(*c.MaxQoS))
+	}
+	if c.RetainUnavailable {
+		props.AddByte(connAckPropRetainAvailable, 0)
+	}
+	if c.MaxPacketSize > 0 {
+		props.AddUint32(connAckPropMaxPacketSize, c.MaxPacketSize)
+	}
+	if c.AssignedClientID != "" {
+		props.AddString(connAckPropAssignedClientID, c.AssignedClientID)
+	}
+	if c.TopicAliasMax > 0 {
+		props.AddUint16(connAckPropTopicAliasMax, c.TopicAliasMax)
+	}
+	if c.ReasonString != "" {
+		props.AddString(connAckPropReasonString, c.ReasonString)
+	}
+	for _, prop := range c.UserProperties {
+		props.AddUserProperty(prop.Key, prop.Value)
+	}
+	if c.WildcardSubUnavailable {
+		props.AddByte(connAckPropWildcardAvailable, 0)
+	}
+	if c.SubIDUnavailable {
+		props.AddByte(connAckPropSubIDAvailable, 0)
+	}
+	if c.SharedSubUnavailable {
+		props.AddByte(connAckPropSharedSubAvailable, 0)
+	}
+	if c.ServerKeepAlive != nil {
+		props.AddUint16(connAckPropServerKeepAlive, *c.ServerKeepAlive)
+	}
+	if c.ResponseInfo != "" {
+		props.AddString(connAckPropResponseInfo, c.ResponseInfo)
+	}
+	if c.ServerReference != "" {
+		props.AddString(connAckPropServerReference, c.ServerReference)
+	}
+	if c.AuthMethod != "" {
+		props.AddString(connAckPropAuthMethod, c.AuthMethod)
+	}
+	if c.AuthData != nil {
+		props.AddBinary(connAckPropAuthData, c.AuthData)
+	}
+	return props
+}
+
 func (c *ConnAck) MarshalBinary() (b []byte, err error) {
+	if c.Version >= mqtt.MQTTv5 {
+		props := c.properties()
+		// Remaining length = flags + return code + len(properties)
+		remLen := 2 + uint64(props.Size())
+		b = make([]byte, 1+util.GetUvarintLen(remLen)+int(remLen))
+		b[0] = cmdConnAck
+		i := 1
+		i += binary.PutUvarint(b[i:], remLen)
+		if c.SessionPresent {
+			b[i] = connAckFlagSessionPresent
+		}
+		b[i+1] = c.ReturnCode
+		i += 2
+		props.MarshalTo(b[i:])
+		return b, nil
+	}
 	b = []byte{cmdConnAck, 2, 0, c.ReturnCode}
 	if c.SessionPresent {
 		b[2] |= connAckFlagSessionPresent
@@ -831,28 +859,147 @@ func (c *ConnAck) WriteTo(w io.Writer) (n int64, err error) {
 // ReadFrom reads and unmarshals the ConnAck request from stream.
 // NOTE: it is assumed that the command byte is already consumed from the reader.
 func (c *ConnAck) ReadFrom(r io.Reader) (n int64, err error) {
-	var raw [3]byte
-	N, err := r.Read(raw[:])
+	var raw [2]byte
+	length, N, err := util.ReadVarint(r)
 	n = int64(N)
 	if err != nil {
 		return n, err
-	} else if raw[0] > byte(2) {
-		return n, mqtt.ErrPacketLong
-	} else if raw[0] < byte(2) {
+	} else if length < 2 {
 		return n, mqtt.ErrPacketShort
+	} else if length > 2 && c.Version < mqtt.MQTTv5 {
+		return n, mqtt.ErrPacketLong
+	}
+	N, err = io.ReadFull(r, raw[:])
+	n += int64(N)
+	if err != nil {
+		return n, err
 	}
-	flags := raw[1]
+	flags := raw[0]
 	if flags > connAckFlagSessionPresent {
 		return n, fmt.Errorf("connack: illegal flags: %02X", flags)
 	} else if flags&connAckFlagSessionPresent > 0 {
 		c.SessionPresent = true
 	}
-	c.ReturnCode = raw[2]
-	return n, nil
+	c.ReturnCode = raw[1]
+	if c.Version < mqtt.MQTTv5 || length == 2 {
+		return n, nil
+	}
+	length -= 2
+	propLen, N, err := util.ReadVarint(r)
+	n += int64(N)
+	length -= N
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return n, err
+	} else if propLen > length {
+		return n, mqtt.ErrPacketShort
+	}
+	var props Properties
+	N, err = props.read(r, propLen)
+	n += int64(N)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return n, err
+	}
+	return n, c.setProperties(props)
+}
+
+// setProperties assigns the properties of the variable header.
+func (c *ConnAck) setProperties(props Properties) error {
+	for _, prop := range props {
+		switch prop.ID {
+		case connAckPropSessionExpire:
+			c.SessionExpiryInterval = prop.Value.(uint32)
+		case connAckPropReceiveMax:
+			c.ReceiveMax = prop.Value.(uint16)
+		case connAckPropMaxQoS:
+			qos := mqtt.QoS(prop.Value.(uint8))
+			c.MaxQoS = &qos
+		case connAckPropRetainAvailable:
+			c.RetainUnavailable = prop.Value.(uint8) == 0
+		case connAckPropMaxPacketSize:
+			c.MaxPacketSize = prop.Value.(uint32)
+		case connAckPropAssignedClientID:
+			c.AssignedClientID = prop.Value.(string)
+		case connAckPropTopicAliasMax:
+			c.TopicAliasMax = prop.Value.(uint16)
+		case connAckPropReasonString:
+			c.ReasonString = prop.Value.(string)
+		case connAckPropUserProperty:
+			c.UserProperties = append(
+				c.UserProperties,
+				prop.Value.(mqtt.UserProperty),
+			)
+		case connAckPropWildcardAvailable:
+			c.WildcardSubUnavailable = prop.Value.(uint8) == 0
+		case connAckPropSubIDAvailable:
+			c.SubIDUnavailable = prop.Value.(uint8) == 0
+		case connAckPropSharedSubAvailable:
+			c.SharedSubUnavailable = prop.Value.(uint8) == 0
+		case connAckPropServerKeepAlive:
+			keepAlive := prop.Value.(uint16)
+			c.ServerKeepAlive = &keepAlive
+		case connAckPropResponseInfo:
+			c.ResponseInfo = prop.Value.(string)
+		case connAckPropServerReference:
+			c.ServerReference = prop.Value.(string)
+		case connAckPropAuthMethod:
+			c.AuthMethod = prop.Value.(string)
+		case connAckPropAuthData:
+			c.AuthData = prop.Value.([]byte)
+		default:
+			return fmt.Errorf(
+				"protocol error: illegal property ID: %02X",
+				prop.ID,
+			)
+		}
+	}
+	return nil
+}
+
+// properties returns the properties of the variable header.
+func (d *Disconnect) properties() Properties {
+	var props Properties
+	if d.SessionExpiryInterval != nil {
+		props.AddUint32(
+			disconnPropSessionExpire, *d.SessionExpiryInterval,
+		)
+	}
+	if d.ReasonString != "" {
+		props.AddString(disconnPropReasonString, d.ReasonString)
+	}
+	if d.ServerReference != "" {
+		props.AddString(disconnPropServerReference, d.ServerReference)
+	}
+	for _, prop := range d.UserProperties {
+		props.AddUserProperty(prop.Key, prop.Value)
+	}
+	return props
 }
 
 func (d *Disconnect) MarshalBinary() (b []byte, err error) {
-	return []byte{cmdDisconnect, 0}, nil
+	if d.Version < mqtt.MQTTv5 {
+		return []byte{cmdDisconnect, 0}, nil
+	}
+	props := d.properties()
+	if len(props) == 0 && d.ReasonCode == DisconnectNormal {
+		// Reason code and properties may be omitted.
+		return []byte{cmdDisconnect, 0}, nil
+	}
+	// Remaining length = reason code + len(properties)
+	remLen := 1 + uint64(props.Size())
+	b = make([]byte, 1+util.GetUvarintLen(remLen)+int(remLen))
+	b[0] = cmdDisconnect
+	i := 1
+	i += binary.PutUvarint(b[i:], remLen)
+	b[i] = d.ReasonCode
+	i++
+	props.MarshalTo(b[i:])
+	return b, nil
 }
 
 // WriteTo writes the marshaled Disconnect request to stream.
@@ -863,14 +1010,61 @@ func (d *Disconnect) WriteTo(w io.Writer) (n int64, err error) {
 	return n, err
 }
 
-// ReadFrom reads the final length byte from stream, verifying that the packet
-// is indeed a disconnect request.
+// setProperties assigns the properties of the variable header.
+func (d *Disconnect) setProperties(props Properties) error {
+	for _, prop := range props {
+		switch prop.ID {
+		case disconnPropSessionExpire:
+			expiry := prop.Value.(uint32)
+			d.SessionExpiryInterval = &expiry
+		case disconnPropReasonString:
+			d.ReasonString = prop.Value.(string)
+		case disconnPropServerReference:
+			d.ServerReference = prop.Value.(string)
+		case disconnPropUserProperty:
+			d.UserProperties = append(
+				d.UserProperties,
+				prop.Value.(mqtt.UserProperty),
+			)
+		default:
+			return fmt.Errorf(
+				"protocol error: illegal property ID: %02X",
+				prop.ID,
+			)
+		}
+	}
+	return nil
+}
+
+// ReadFrom reads the remainder of the disconnect request from stream. For
+// MQTTv3.1.1 the packet is verified to not carry any payload.
 func (d *Disconnect) ReadFrom(r io.Reader) (n int64, err error) {
-	var b [1]byte
-	N, err := r.Read(b[:])
+	remLength, N, err := util.ReadVarint(r)
 	n = int64(N)
-	if b[0] != byte(0) {
+	if err != nil {
+		return n, err
+	} else if remLength == 0 {
+		return n, nil
+	} else if d.Version < mqtt.MQTTv5 {
 		return n, fmt.Errorf("disconnect: unexpected payload")
 	}
-	return n, err
+	N, err = util.ReadValue(r, &d.ReasonCode, remLength)
+	n += int64(N)
+	if err != nil || remLength < 2 {
+		return n, err
+	}
+	propLen, N, err := util.ReadVarint(r)
+	n += int64(N)
+	if err != nil {
+		return n, err
+	} else if propLen > remLength-1-N {
+		return n, mqtt.ErrPacketShort
+	}
+	var props Properties
+	N, err = props.read(r, propLen)
+	n += int64(N)
+	if err != nil {
+		return n, err
+	}
+	return n, d.setProperties(props)
 }
@@ -2,6 +2,7 @@ package packets
 
 import (
 	"bytes"
+	"encoding/binary"
 	"testing"
 	"time"
 
@@ -16,6 +17,12 @@ func TestConnectSendRecv(t *testing.T) {
 	}
 	testCases := []testCase{
 		{
+			Name: "Simple v3.1",
+			Connect: &Connect{
+				Version:  mqtt.MQTTv31,
+				ClientID: "legacy",
+			},
+		}, {
 			Name: "Simple v3.1.1",
 			Connect: &Connect{
 				Version: mqtt.MQTTv311,
@@ -67,14 +74,27 @@ func TestConnectSendRecv(t *testing.T) {
 				WillDelayInterval:     1234567,
 				WillFormatUTF8:        true,
 				WillMessageExpiry:     0xFFFFFFFF,
-				WillUserProperties: map[string]string{
-					"key": "value",
+				WillUserProperties: []mqtt.UserProperty{
+					{Key: "key", Value: "value"},
 				},
 				WillResponseTopic: "rsp/here/pls",
-				ConnUserProperties: map[string]string{
-					"this":   "is",
-					"mostly": "useless",
+				ConnUserProperties: []mqtt.UserProperty{
+					{Key: "this", Value: "is"},
+					{Key: "mostly", Value: "useless"},
+					{Key: "this", Value: "is duplicate"},
+				},
+			},
+		}, {
+			Name: "Will correlation data without response topic",
+			Connect: &Connect{
+				Version:     mqtt.MQTTv5,
+				ClientID:    "correlated",
+				WillMessage: []byte("bye"),
+				WillTopic: mqtt.Topic{
+					Name: "foo/will",
+					QoS:  mqtt.QoS1,
 				},
+				WillCorrelationData: []byte{0x00, 0x01, 0x02},
 			},
 		},
 	}
@@ -96,5 +116,199 @@ func TestConnectSendRecv(t *testing.T) {
 			}
 		})
 	}
+}
+
+func TestConnectV31ProtocolName(t *testing.T) {
+	connect := &Connect{
+		Version:   mqtt.MQTTv31,
+		ClientID:  "legacy",
+		KeepAlive: 60,
+	}
+	b, err := connect.MarshalBinary()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, []byte{
+		0, 6, 'M', 'Q', 'I', 's', 'd', 'p', byte(mqtt.MQTTv31),
+	}, b[2:11])
+
+	decoded := new(Connect)
+	_, err = decoded.ReadFrom(bytes.NewReader(b[1:]))
+	assert.NoError(t, err)
+	assert.Equal(t, connect, decoded)
+
+	// The protocol name must match the protocol level.
+	b[10] = byte(mqtt.MQTTv311)
+	_, err = new(Connect).ReadFrom(bytes.NewReader(b[1:]))
+	assert.Error(t, err)
+}
+
+func TestConnectProtocolNameLength(t *testing.T) {
+	connect := &Connect{
+		Version:  mqtt.MQTTv311,
+		ClientID: "foobar",
+	}
+	b, err := connect.MarshalBinary()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	// Declare an 8 byte protocol name.
+	binary.BigEndian.PutUint16(b[2:4], 8)
+	_, err = new(Connect).ReadFrom(bytes.NewReader(b[1:]))
+	assert.EqualError(t, err, mqtt.ErrProtocolViolation.Error())
+
+	// Declare a length exceeding the packet.
+	binary.BigEndian.PutUint16(b[2:4], 0xFFFF)
+	_, err = new(Connect).ReadFrom(bytes.NewReader(b[1:]))
+	assert.EqualError(t, err, mqtt.ErrPacketShort.Error())
+}
+
+func TestConnectCustomProtocolName(t *testing.T) {
+	connect := &Connect{
+		Version:      mqtt.MQTTv311,
+		ProtocolName: "MQTT-GW",
+		ClientID:     "foobar",
+	}
+	b, err := connect.MarshalBinary()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, []byte{
+		0, 7, 'M', 'Q', 'T', 'T', '-', 'G', 'W', byte(mqtt.MQTTv311),
+	}, b[2:12])
 
+	decoded := new(Connect)
+	_, err = decoded.ReadFrom(bytes.NewReader(b[1:]))
+	assert.NoError(t, err)
+	assert.Equal(t, connect, decoded)
+
+	// MQTT 3.1 using the standard name of later versions.
+	connect = &Connect{
+		Version:      mqtt.MQTTv31,
+		ProtocolName: "MQTT",
+		ClientID:     "foobar",
+	}
+	b, err = connect.MarshalBinary()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, []byte{0, 4, 'M', 'Q', 'T', 'T'}, b[2:8])
+	_, err = new(Connect).ReadFrom(bytes.NewReader(b[1:]))
+	assert.Error(t, err)
+	// A name shorter than the standard names.
+	connect = &Connect{
+		Version:      mqtt.MQTTv311,
+		ProtocolName: "MQ",
+		ClientID:     "a",
+	}
+	b, err = connect.MarshalBinary()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, []byte{cmdConnect, 11, 0, 2, 'M', 'Q'}, b[:6])
+	decoded = new(Connect)
+	_, err = decoded.ReadFrom(bytes.NewReader(b[1:]))
+	assert.NoError(t, err)
+	assert.Equal(t, connect, decoded)
+
+	// The packet ends right after the name.
+	_, err = new(Connect).ReadFrom(bytes.NewReader(
+		[]byte{9, 0, 2, 'M', 'Q', 4, 0, 0, 0, 0},
+	))
+	assert.EqualError(t, err, mqtt.ErrPacketShort.Error())
+}
+
+func TestConnectWillCorrelationDataLength(t *testing.T) {
+	connect := &Connect{
+		Version:     mqtt.MQTTv5,
+		ClientID:    "foobar",
+		WillMessage: []byte("bye"),
+		WillTopic: mqtt.Topic{
+			Name: "foo/will",
+			QoS:  mqtt.QoS1,
+		},
+		WillContentType:     "ct",
+		WillCorrelationData: []byte{1, 2, 3},
+	}
+	b, err := connect.MarshalBinary()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	decoded := new(Connect)
+	_, err = decoded.ReadFrom(bytes.NewReader(b[1:]))
+	assert.NoError(t, err)
+	assert.Equal(t, connect, decoded)
+
+	// The correlation data claims more bytes than remain in the will
+	// properties, but less than the full property length.
+	i := bytes.Index(b, []byte{connPropWillCorrelationData, 0, 3, 1, 2, 3})
+	if !assert.True(t, i > 0) {
+		t.FailNow()
+	}
+	b[i+2] = 7
+	decoded = new(Connect)
+	_, err = decoded.ReadFrom(bytes.NewReader(b[1:]))
+	assert.EqualError(t, err, mqtt.ErrPacketShort.Error())
+	// The field is not read past the will properties.
+	assert.Empty(t, decoded.WillCorrelationData)
+}
+
+func TestConnectWillPropertiesOrder(t *testing.T) {
+	connect := &Connect{
+		Version:     mqtt.MQTTv5,
+		ClientID:    "foobar",
+		WillMessage: []byte("bye"),
+		WillTopic: mqtt.Topic{
+			Name: "foo/will",
+			QoS:  mqtt.QoS1,
+		},
+		WillDelayInterval:   30,
+		WillFormatUTF8:      true,
+		WillMessageExpiry:   60,
+		WillContentType:     "text/plain",
+		WillResponseTopic:   "foo/rsp",
+		WillCorrelationData: []byte{1, 2, 3},
+		WillUserProperties: []mqtt.UserProperty{
+			{Key: "a", Value: "1"},
+			{Key: "b", Value: "2"},
+		},
+	}
+	b, err := connect.MarshalBinary()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	// Fixed header, protocol name, version, flags, keep alive, empty
+	// connect properties and the client ID precede the will properties.
+	start := 2 + 6 + 1 + 1 + 2 + 1 + 2 + len(connect.ClientID)
+	var props Properties
+	N, err := props.ReadFrom(bytes.NewReader(b[start:]))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	// The will topic follows the will properties.
+	assert.Equal(t,
+		[]byte{0, 8, 'f', 'o', 'o', '/', 'w', 'i', 'l', 'l'},
+		b[start+int(N):start+int(N)+10],
+	)
+
+	// Reverse the properties; the order among the user properties is
+	// significant and must be preserved.
+	shuffled := Properties{props[len(props)-2], props[len(props)-1]}
+	for i := len(props) - 3; i >= 0; i-- {
+		shuffled = append(shuffled, props[i])
+	}
+	reordered := make([]byte, len(b))
+	copy(reordered, b)
+	assert.Equal(t, int(N), shuffled.MarshalTo(reordered[start:]))
+	assert.NotEqual(t, b, reordered)
+
+	decoded := new(Connect)
+	_, err = decoded.ReadFrom(bytes.NewReader(reordered[1:]))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, connect, decoded)
+	reencoded, err := decoded.MarshalBinary()
+	assert.NoError(t, err)
+	assert.Equal(t, b, reencoded)
 }
@@ -1,12 +1,20 @@
 package packets
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/alfrunes/mqttie/mqtt"
+	"github.com/alfrunes/mqttie/x/util"
 )
 
 // Packet contains a generic packet interface conforming with the standard
@@ -20,16 +28,221 @@ type Packet interface {
 	ReadFrom(r io.Reader) (n int64, err error)
 	// MarshalBinary serializes the packet to a binary buffer.
 	MarshalBinary() (b []byte, err error)
+	// Type returns the control packet type.
+	Type() PacketType
+}
+
+// ReadRawPacket reads the next complete packet from the stream r without
+// decoding it. The returned buffer contains the fixed header (command byte and
+// remaining length) followed by the remaining packet body, which makes it
+// suitable for proxies and loggers forwarding packets verbatim.
+func ReadRawPacket(r io.Reader) ([]byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:1]); err != nil {
+		return nil, err
+	}
+	// Read the remaining length (variable byte integer, max 4 bytes)
+	i := 1
+	for {
+		if i > 4 {
+			return nil, util.ErrVarintTooLong
+		}
+		_, err := io.ReadFull(r, header[i:i+1])
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		} else if err != nil {
+			return nil, err
+		}
+		i++
+		if header[i-1]&0x80 == 0 {
+			break
+		}
+	}
+	remLength, _ := binary.Uvarint(header[1:i])
+
+	// The remaining length is untrusted: the buffer grows with the bytes
+	// actually read rather than being allocated up front.
+	var buf bytes.Buffer
+	if remLength < bytes.MinRead {
+		buf.Grow(i + int(remLength))
+	}
+	buf.Write(header[:i])
+	n, err := io.CopyN(&buf, r, int64(remLength))
+	if err == io.EOF && n < int64(remLength) {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// ReadPacket reads and decodes the next packet from the stream r, such as a
+// packet serialized with MarshalBinary and persisted for later use. The
+// packet is decoded using the given protocol version.
+func ReadPacket(r io.Reader, version mqtt.Version) (Packet, error) {
+	p := &PacketIO{reader: r, version: uint32(version)}
+	return p.recv()
+}
+
+// DecodeAll decodes a stream of concatenated packets, such as the bytes
+// captured from a connection, using the given protocol version. The packets
+// decoded before an error are returned along with the error; a truncated
+// last packet results in io.ErrUnexpectedEOF.
+func DecodeAll(data []byte, version mqtt.Version) ([]Packet, error) {
+	r := bytes.NewReader(data)
+	p := &PacketIO{reader: r, version: uint32(version)}
+	var pkgs []Packet
+	for r.Len() > 0 {
+		// Check the remaining length against the data left before
+		// decoding: the decoders report a truncated body as whatever
+		// field they failed to read.
+		rem := data[len(data)-r.Len()+1:]
+		remLength, n := binary.Uvarint(rem)
+		if (n == 0 && len(rem) < 4) ||
+			(n > 0 && n <= 4 && remLength > uint64(len(rem)-n)) {
+			return pkgs, io.ErrUnexpectedEOF
+		}
+		pkg, err := p.recv()
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return pkgs, err
+		}
+		pkgs = append(pkgs, pkg)
+	}
+	return pkgs, nil
+}
+
+// PeekType returns the MQTT control packet type (1: CONNECT through 15: AUTH)
+// of the next packet in r without consuming any input. Together with
+// ReadRawPacket this allows proxies to decide whether to decode a packet or
+// forward it verbatim.
+func PeekType(r *bufio.Reader) (uint8, error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0] >> 4, nil
+}
+
+// Fixed header flags required by the specification for packets with
+// reserved flag bits set.
+const (
+	flagsPubRel      uint8 = 0x02
+	flagsSubscribe   uint8 = 0x02
+	flagsUnsubscribe uint8 = 0x02
+)
+
+// reservedFlags returns the fixed header flags required for the packet type.
+// The flags of publish packets are not reserved; the return value is false.
+func reservedFlags(cmd uint8) (uint8, bool) {
+	switch cmd {
+	case cmdPublish:
+		return 0, false
+	case cmdPubRel:
+		return flagsPubRel, true
+	case cmdSubscribe:
+		return flagsSubscribe, true
+	case cmdUnsubscribe:
+		return flagsUnsubscribe, true
+	default:
+		return 0, true
+	}
+}
+
+// maxRetainedRaw bounds the buffer retained for recording the raw bytes of
+// received packets; buffers grown beyond it by large packets are released.
+const maxRetainedRaw = 64 * 1024
+
+// DecodeError is returned by Recv if a received packet cannot be decoded. It
+// carries the raw bytes of the packet consumed by the decoder (the fixed
+// header followed by the body up to the point of failure), which helps
+// diagnosing interoperability issues.
+type DecodeError struct {
+	// Err is the cause of the failure.
+	Err error
+	raw []byte
+}
+
+func (e *DecodeError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the cause of the failure.
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// RawBytes returns the bytes consumed before the failure.
+func (e *DecodeError) RawBytes() []byte {
+	return e.raw
 }
 
 // PacketIO provides an interface for communicating packets between client and
 // server.
 type PacketIO struct {
+	// stats holds the traffic counters (accessed atomically); kept first
+	// for 64-bit alignment.
+	stats     IOStats
 	timeout   time.Duration
 	conn      net.Conn
-	version   mqtt.Version
+	version   uint32 // accessed atomically, see SetVersion
 	sendMutex chan struct{}
 	recvMutex chan struct{}
+
+	// reader is the source of received packets; either conn or a
+	// buffered reader on top of conn.
+	reader io.Reader
+	// buffered is set if reads are buffered (see SetReadBufferSize).
+	buffered *bufio.Reader
+	// writer is set if writes are buffered (see SetWriteBufferSize).
+	writer *bufio.Writer
+	// sending counts the Send calls holding or waiting for sendMutex
+	// (accessed atomically); the last one flushes the write buffer.
+	sending int32
+
+	// maxPacketSize is the maximum size of received packets
+	// (0: unlimited).
+	maxPacketSize uint32
+	// maxSendPacketSize is the maximum size of sent packets
+	// (0: unlimited).
+	maxSendPacketSize uint32
+	// maxTopicLength and maxTopicLevels limit the topics of received
+	// packets (0: unlimited).
+	maxTopicLength int
+	maxTopicLevels int
+	// strict enables strict decoding of received packets.
+	strict bool
+	// raw records the bytes of the packet being decoded for DecodeError.
+	raw bytes.Buffer
+	// closed is set (atomically) when Close is called.
+	closed uint32
+}
+
+// IOStats holds the traffic counters of a PacketIO.
+type IOStats struct {
+	// BytesSent is the number of bytes written, including those of
+	// packets only partially written.
+	BytesSent uint64
+	// BytesReceived is the number of bytes read, including those of
+	// packets that failed to decode.
+	BytesReceived uint64
+	// PacketsSent is the number of packets written successfully.
+	PacketsSent uint64
+	// PacketsReceived is the number of packets decoded successfully.
+	PacketsReceived uint64
+}
+
+// Add returns the sum of the counters of s and o.
+func (s IOStats) Add(o IOStats) IOStats {
+	return IOStats{
+		BytesSent:       s.BytesSent + o.BytesSent,
+		BytesReceived:   s.BytesReceived + o.BytesReceived,
+		PacketsSent:     s.PacketsSent + o.PacketsSent,
+		PacketsReceived: s.PacketsReceived + o.PacketsReceived,
+	}
 }
 
 // NewPacketIO initializes a new PacketIO struct.
@@ -41,16 +254,167 @@ func NewPacketIO(
 	return &PacketIO{
 		timeout:   timeout,
 		conn:      conn,
-		version:   version,
+		reader:    conn,
+		version:   uint32(version),
 		sendMutex: make(chan struct{}, 1),
 		recvMutex: make(chan struct{}, 1),
 	}
 }
 
+// Version returns the protocol version used for decoding received packets.
+func (p *PacketIO) Version() mqtt.Version {
+	return mqtt.Version(atomic.LoadUint32(&p.version))
+}
+
+// SetVersion changes the protocol version used for decoding received
+// packets, e.g. when falling back to an earlier version during the connect
+// handshake. Unlike the other setters it does not wait for a blocking Recv;
+// the version applies to the packets arriving after the call.
+func (p *PacketIO) SetVersion(version mqtt.Version) {
+	atomic.StoreUint32(&p.version, uint32(version))
+}
+
+// SetMaxPacketSize sets the maximum size of received packets including the
+// fixed header. Recv returns mqtt.ErrPacketTooLarge, without reading the
+// packet body, if a packet exceeds the limit. A size of 0 disables the limit.
+func (p *PacketIO) SetMaxPacketSize(size uint32) {
+	p.recvMutex <- struct{}{}
+	p.maxPacketSize = size
+	<-p.recvMutex
+}
+
+// SetMaxTopicLength sets the maximum length in bytes of the topic names and
+// filters of received Publish, Subscribe and Unsubscribe packets. Recv
+// returns mqtt.ErrTopicLimitExceeded for packets with longer topics. A length
+// of 0 disables the limit.
+func (p *PacketIO) SetMaxTopicLength(length int) {
+	p.recvMutex <- struct{}{}
+	p.maxTopicLength = length
+	<-p.recvMutex
+}
+
+// SetMaxTopicLevels sets the maximum number of levels of the topic names and
+// filters of received packets like SetMaxTopicLength, guarding against
+// pathologically deep topics. A limit of 0 disables the limit.
+func (p *PacketIO) SetMaxTopicLevels(levels int) {
+	p.recvMutex <- struct{}{}
+	p.maxTopicLevels = levels
+	<-p.recvMutex
+}
+
+// checkTopic returns mqtt.ErrTopicLimitExceeded if the topic exceeds the
+// topic limits.
+func (p *PacketIO) checkTopic(topic string) error {
+	if p.maxTopicLength > 0 && len(topic) > p.maxTopicLength {
+		return mqtt.ErrTopicLimitExceeded
+	} else if p.maxTopicLevels > 0 &&
+		strings.Count(topic, "/") >= p.maxTopicLevels {
+		return mqtt.ErrTopicLimitExceeded
+	}
+	return nil
+}
+
+// checkTopics applies the topic limits to the topics of the packet.
+func (p *PacketIO) checkTopics(pkg Packet) error {
+	if p.maxTopicLength <= 0 && p.maxTopicLevels <= 0 {
+		return nil
+	}
+	switch pkg := pkg.(type) {
+	case *Publish:
+		return p.checkTopic(pkg.Topic.Name)
+	case *Subscribe:
+		for _, topic := range pkg.Topics {
+			if err := p.checkTopic(topic.Name); err != nil {
+				return err
+			}
+		}
+	case *Unsubscribe:
+		for _, topic := range pkg.Topics {
+			if err := p.checkTopic(topic); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// SetStrict enables or disables strict decoding of received packets. In
+// strict mode, Recv rejects packets violating the specification that are
+// otherwise accepted for interoperability: a remaining length not encoded
+// using the minimal number of bytes is rejected with
+// util.ErrVarintNotMinimal, and packets with fixed header flags differing
+// from the reserved values are rejected with mqtt.ErrProtocolViolation.
+// Strict mode is disabled by default.
+func (p *PacketIO) SetStrict(strict bool) {
+	p.recvMutex <- struct{}{}
+	p.strict = strict
+	<-p.recvMutex
+}
+
+// SetReadBufferSize enables buffered reads with a buffer of the given size,
+// such that bursts of small packets are received with few reads on the
+// connection. A size of 0 disables buffering. The buffer size must only be
+// changed before receiving the first packet.
+func (p *PacketIO) SetReadBufferSize(size int) {
+	p.recvMutex <- struct{}{}
+	if size > 0 {
+		p.buffered = bufio.NewReaderSize(p.conn, size)
+		p.reader = p.buffered
+	} else {
+		p.buffered = nil
+		p.reader = p.conn
+	}
+	<-p.recvMutex
+}
+
+// SetWriteBufferSize enables buffered writes with a buffer of the given size,
+// such that packets sent concurrently are written to the connection with few
+// writes (see Send). A size of 0 disables buffering.
+func (p *PacketIO) SetWriteBufferSize(size int) {
+	p.sendMutex <- struct{}{}
+	if p.writer != nil {
+		p.writer.Flush()
+	}
+	if size > 0 {
+		p.writer = bufio.NewWriterSize(fullWriter{p.conn}, size)
+	} else {
+		p.writer = nil
+	}
+	<-p.sendMutex
+}
+
+// SetMaxSendPacketSize sets the maximum size of sent packets including the
+// fixed header, e.g. the maximum packet size accepted by the server. Send
+// returns mqtt.ErrPacketTooLarge, without writing, if a packet exceeds the
+// limit. A size of 0 disables the limit.
+func (p *PacketIO) SetMaxSendPacketSize(size uint32) {
+	p.sendMutex <- struct{}{}
+	p.maxSendPacketSize = size
+	<-p.sendMutex
+}
+
 // Send writes the packet p to stream w, ensuring mutual exclusive access.
+// Packets are written in the order Send acquires the stream, hence
+// consecutive calls from the same goroutine are written in call order.
+// Unbuffered, the packet is written when Send returns. If writes are
+// buffered (see SetWriteBufferSize) and other Send calls are waiting, the
+// packet is left in the buffer for the last of them to flush.
 func (p *PacketIO) Send(pkt Packet) (err error) {
+	atomic.AddInt32(&p.sending, 1)
 	p.sendMutex <- struct{}{}
-	defer func() { <-p.sendMutex }()
+	defer func() {
+		if atomic.AddInt32(&p.sending, -1) == 0 &&
+			p.writer != nil && p.writer.Buffered() > 0 {
+			// No packet is queued behind this one.
+			if errFlush := p.writer.Flush(); err == nil {
+				err = errFlush
+			}
+		}
+		<-p.sendMutex
+	}()
+	if p.isClosed() {
+		return mqtt.ErrConnectionClosed
+	}
 	if p.timeout > time.Duration(0) {
 		if err := p.conn.SetWriteDeadline(
 			time.Now().Add(p.timeout),
@@ -58,16 +422,147 @@ func (p *PacketIO) Send(pkt Packet) (err error) {
 			return err
 		}
 	}
-	_, err = pkt.WriteTo(p.conn)
+	var b []byte
+	if p.maxSendPacketSize > 0 {
+		b, err = pkt.MarshalBinary()
+		if err != nil {
+			return err
+		} else if uint64(len(b)) > uint64(p.maxSendPacketSize) {
+			return mqtt.ErrPacketTooLarge
+		}
+	}
+	var w io.Writer = fullWriter{p.conn}
+	if p.writer != nil {
+		w = p.writer
+	}
+	var n int64
+	if b != nil {
+		var N int
+		N, err = w.Write(b)
+		n = int64(N)
+	} else {
+		n, err = pkt.WriteTo(w)
+	}
+	p.countSent(n, err)
 	return err
 }
 
-// Recv reads and encodes a packet from stream. The Recv operation is protected
-// by a mutex, but should only be handled by a single goroutine.
+// countSent updates the send counters with a packet of which n bytes were
+// written.
+func (p *PacketIO) countSent(n int64, err error) {
+	if n > 0 {
+		atomic.AddUint64(&p.stats.BytesSent, uint64(n))
+	}
+	if err == nil {
+		atomic.AddUint64(&p.stats.PacketsSent, 1)
+	}
+}
+
+// Stats returns a snapshot of the traffic counters.
+func (p *PacketIO) Stats() IOStats {
+	return IOStats{
+		BytesSent:       atomic.LoadUint64(&p.stats.BytesSent),
+		BytesReceived:   atomic.LoadUint64(&p.stats.BytesReceived),
+		PacketsSent:     atomic.LoadUint64(&p.stats.PacketsSent),
+		PacketsReceived: atomic.LoadUint64(&p.stats.PacketsReceived),
+	}
+}
+
+// TrySend writes the packet like Send without blocking on a busy or stalled
+// connection: if another packet is being sent, or the connection does not
+// accept the packet within wait, the packet is dropped and sent is false.
+// If writes are buffered, the packet is flushed along with the buffer before
+// TrySend returns. If the connection accepts only part of the packet the
+// stream is corrupted; the PacketIO is closed and the write error returned.
+func (p *PacketIO) TrySend(pkt Packet, wait time.Duration) (sent bool, err error) {
+	select {
+	case p.sendMutex <- struct{}{}:
+		defer func() { <-p.sendMutex }()
+	default:
+		return false, nil
+	}
+	if atomic.LoadInt32(&p.sending) > 0 ||
+		(p.writer != nil && p.writer.Buffered() > 0) {
+		// A Send is waiting to write or flush the buffer; writing
+		// ahead of it would reorder the stream.
+		return false, nil
+	}
+	if p.isClosed() {
+		return false, mqtt.ErrConnectionClosed
+	}
+	b, err := pkt.MarshalBinary()
+	if err != nil {
+		return false, err
+	} else if p.maxSendPacketSize > 0 &&
+		uint64(len(b)) > uint64(p.maxSendPacketSize) {
+		return false, mqtt.ErrPacketTooLarge
+	}
+	if err := p.conn.SetWriteDeadline(time.Now().Add(wait)); err != nil {
+		return false, err
+	}
+	// Send sets the deadline only if a timeout is configured.
+	defer p.conn.SetWriteDeadline(time.Time{})
+	var n int
+	if p.writer != nil {
+		n, err = p.writer.Write(b)
+		if err == nil {
+			err = p.writer.Flush()
+			n -= p.writer.Buffered()
+		}
+		if err != nil && n == 0 {
+			// Nothing reached the connection; discard the packet
+			// and clear the writer error.
+			p.writer.Reset(fullWriter{p.conn})
+		}
+	} else {
+		n, err = fullWriter{p.conn}.Write(b)
+	}
+	p.countSent(int64(n), err)
+	if err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() && n == 0 {
+			return false, nil
+		} else if n > 0 {
+			p.Close()
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// fullWriter wraps a writer, retrying short writes until the entire buffer
+// is written. If the underlying writer makes no progress, io.ErrShortWrite is
+// returned.
+type fullWriter struct {
+	w io.Writer
+}
+
+func (f fullWriter) Write(b []byte) (n int, err error) {
+	for n < len(b) {
+		N, err := f.w.Write(b[n:])
+		if N > 0 {
+			n += N
+		}
+		if err != nil {
+			return n, err
+		} else if N <= 0 {
+			return n, io.ErrShortWrite
+		}
+	}
+	return n, nil
+}
+
+// Recv reads and encodes a packet from stream. The packet is decoded from a
+// reader limited to the remaining length, so no field can read past the
+// packet boundary, and unread bytes are discarded; a malformed packet does
+// not corrupt the following packets. Errors decoding the packet are returned
+// as a *DecodeError carrying the bytes consumed. The Recv operation is
+// protected by a mutex, but should only be handled by a single goroutine.
 func (p *PacketIO) Recv() (pkg Packet, err error) {
-	var buf [1]byte
 	p.recvMutex <- struct{}{}
 	defer func() { <-p.recvMutex }()
+	if p.isClosed() {
+		return nil, mqtt.ErrConnectionClosed
+	}
 	if p.timeout > time.Duration(0) {
 		if err := p.conn.SetReadDeadline(
 			time.Now().Add(p.timeout),
@@ -75,20 +570,142 @@ func (p *PacketIO) Recv() (pkg Packet, err error) {
 			return nil, err
 		}
 	}
-	_, err = p.conn.Read(buf[:])
+	pkg, err = p.recv()
+	if err != nil && p.isClosed() {
+		// Interrupted by Close
+		return nil, mqtt.ErrConnectionClosed
+	}
+	return pkg, err
+}
+
+// RecvBatch receives the next packet like Recv, followed by all complete
+// packets already in the read buffer (see SetReadBufferSize); the packets
+// are appended to pkgs. Packets decoded before an error are returned along
+// with the error.
+func (p *PacketIO) RecvBatch(pkgs []Packet) ([]Packet, error) {
+	pkg, err := p.Recv()
+	if err != nil {
+		return pkgs, err
+	}
+	pkgs = append(pkgs, pkg)
+	p.recvMutex <- struct{}{}
+	defer func() { <-p.recvMutex }()
+	for p.packetBuffered() {
+		pkg, err = p.recv()
+		if err != nil {
+			return pkgs, err
+		}
+		pkgs = append(pkgs, pkg)
+	}
+	return pkgs, nil
+}
+
+// packetBuffered returns true if a complete packet is available in the read
+// buffer.
+func (p *PacketIO) packetBuffered() bool {
+	if p.buffered == nil {
+		return false
+	}
+	n := p.buffered.Buffered()
+	if n < 2 {
+		return false
+	} else if n > 5 {
+		n = 5
+	}
+	header, _ := p.buffered.Peek(n)
+	remLength, N := binary.Uvarint(header[1:])
+	if N <= 0 {
+		// Incomplete remaining length; or malformed which is
+		// reported by recv.
+		return N < 0
+	}
+	return uint64(1+N)+remLength <= uint64(p.buffered.Buffered())
+}
+
+func (p *PacketIO) recv() (pkg Packet, err error) {
+	var buf [1]byte
+	n, err := p.reader.Read(buf[:])
+	atomic.AddUint64(&p.stats.BytesReceived, uint64(n))
 	if err != nil {
 		return nil, err
 	}
+	defer func() {
+		if err == nil {
+			atomic.AddUint64(&p.stats.PacketsReceived, 1)
+		}
+	}()
 	cmdByte := buf[0]
 	cmd := uint8(buf[0] & 0xF0)
 
+	// Validate the remaining length before decoding the packet.
+	readVarint := util.ReadVarint
+	if p.strict {
+		readVarint = util.ReadVarintStrict
+	}
+	remLength, N, err := readVarint(p.reader)
+	atomic.AddUint64(&p.stats.BytesReceived, uint64(N))
+	if err != nil {
+		return nil, err
+	} else if p.maxPacketSize > 0 &&
+		uint64(1+N+remLength) > uint64(p.maxPacketSize) {
+		return nil, mqtt.ErrPacketTooLarge
+	}
+	var lenBuf [4]byte
+	N, _ = util.EncodeUvarint(lenBuf[:], uint32(remLength))
+	// Record the bytes consumed by the decoder, such that decode errors
+	// carry the offending bytes.
+	if p.raw.Cap() > maxRetainedRaw {
+		p.raw = bytes.Buffer{}
+	}
+	p.raw.Reset()
+	p.raw.WriteByte(cmdByte)
+	p.raw.Write(lenBuf[:N])
+	defer func() {
+		if err != nil {
+			err = &DecodeError{
+				Err: err,
+				raw: append([]byte(nil), p.raw.Bytes()...),
+			}
+		}
+	}()
+	// Bound the body by the remaining length and drain whatever the
+	// decoder leaves unread, such that the stream stays aligned with the
+	// packet boundaries even if the packet is malformed.
+	limited := &io.LimitedReader{
+		R: io.TeeReader(p.reader, &p.raw),
+		N: int64(remLength),
+	}
+	defer func() {
+		// Runs after the drain below.
+		atomic.AddUint64(
+			&p.stats.BytesReceived, uint64(int64(remLength)-limited.N),
+		)
+	}()
+	defer func() {
+		if limited.N > 0 {
+			// The unread bytes are not part of the raw bytes.
+			limited.R = p.reader
+			_, _ = io.Copy(ioutil.Discard, limited)
+		} else if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// The fields claim more bytes than the packet holds.
+			err = mqtt.ErrPacketShort
+		}
+	}()
+	body := io.MultiReader(bytes.NewReader(lenBuf[:N]), limited)
+	if flags, ok := reservedFlags(cmd); ok && p.strict &&
+		cmdByte&0x0F != flags {
+		return nil, mqtt.ErrProtocolViolation
+	}
+
+	// The version is loaded once the packet arrives, such that a version
+	// change (see SetVersion) applies to the next packet received.
+	version := p.Version()
 	switch cmd {
-	// TODO: Support for different MQTT versions
 	case cmdConnect:
 		connect := &Connect{
-			Version: p.version,
+			Version: version,
 		}
-		_, err := connect.ReadFrom(p.conn)
+		_, err := connect.ReadFrom(body)
 		if err != nil {
 			return nil, err
 		}
@@ -96,9 +713,9 @@ func (p *PacketIO) Recv() (pkg Packet, err error) {
 
 	case cmdConnAck:
 		connAck := &ConnAck{
-			Version: p.version,
+			Version: version,
 		}
-		_, err := connAck.ReadFrom(p.conn)
+		_, err := connAck.ReadFrom(body)
 		if err != nil {
 			return nil, err
 		}
@@ -106,7 +723,7 @@ func (p *PacketIO) Recv() (pkg Packet, err error) {
 
 	case cmdPublish:
 		pub := &Publish{
-			Version: p.version,
+			Version: version,
 		}
 		if cmdByte&PublishFlagDuplicate > 0 {
 			pub.Duplicate = true
@@ -115,8 +732,12 @@ func (p *PacketIO) Recv() (pkg Packet, err error) {
 			pub.Retain = true
 		}
 		pub.Topic.QoS = mqtt.QoS((cmdByte & 0x06) >> 1)
+		if pub.Topic.QoS > mqtt.QoS2 {
+			// Both QoS bits set is a malformed packet [MQTT-3.3.1-4]
+			return nil, mqtt.ErrIllegalQoS
+		}
 
-		_, err = pub.ReadFrom(p.conn)
+		_, err = pub.ReadFrom(body)
 		if err != nil {
 			return nil, err
 		}
@@ -124,9 +745,9 @@ func (p *PacketIO) Recv() (pkg Packet, err error) {
 
 	case cmdPubAck:
 		pubAck := &PubAck{
-			Version: p.version,
+			Version: version,
 		}
-		_, err := pubAck.ReadFrom(p.conn)
+		_, err := pubAck.ReadFrom(body)
 		if err != nil {
 			return nil, err
 		}
@@ -134,9 +755,9 @@ func (p *PacketIO) Recv() (pkg Packet, err error) {
 
 	case cmdPubRec:
 		pubRec := &PubRec{
-			Version: p.version,
+			Version: version,
 		}
-		_, err := pubRec.ReadFrom(p.conn)
+		_, err := pubRec.ReadFrom(body)
 		if err != nil {
 			return nil, err
 		}
@@ -144,9 +765,9 @@ func (p *PacketIO) Recv() (pkg Packet, err error) {
 
 	case cmdPubRel:
 		pubRel := &PubRel{
-			Version: p.version,
+			Version: version,
 		}
-		_, err := pubRel.ReadFrom(p.conn)
+		_, err := pubRel.ReadFrom(body)
 		if err != nil {
 			return nil, err
 		}
@@ -154,9 +775,9 @@ func (p *PacketIO) Recv() (pkg Packet, err error) {
 
 	case cmdPubComp:
 		pubComp := &PubComp{
-			Version: p.version,
+			Version: version,
 		}
-		_, err := pubComp.ReadFrom(p.conn)
+		_, err := pubComp.ReadFrom(body)
 		if err != nil {
 			return nil, err
 		}
@@ -164,9 +785,9 @@ func (p *PacketIO) Recv() (pkg Packet, err error) {
 
 	case cmdSubscribe:
 		sub := &Subscribe{
-			Version: p.version,
+			Version: version,
 		}
-		_, err := sub.ReadFrom(p.conn)
+		_, err := sub.ReadFrom(body)
 		if err != nil {
 			return nil, err
 		}
@@ -174,9 +795,9 @@ func (p *PacketIO) Recv() (pkg Packet, err error) {
 
 	case cmdSubAck:
 		subAck := &SubAck{
-			Version: p.version,
+			Version: version,
 		}
-		_, err := subAck.ReadFrom(p.conn)
+		_, err := subAck.ReadFrom(body)
 		if err != nil {
 			return nil, err
 		}
@@ -184,9 +805,9 @@ func (p *PacketIO) Recv() (pkg Packet, err error) {
 
 	case cmdUnsubscribe:
 		unSub := &Unsubscribe{
-			Version: p.version,
+			Version: version,
 		}
-		_, err := unSub.ReadFrom(p.conn)
+		_, err := unSub.ReadFrom(body)
 		if err != nil {
 			return nil, err
 		}
@@ -194,9 +815,9 @@ func (p *PacketIO) Recv() (pkg Packet, err error) {
 
 	case cmdUnsubAck:
 		unsubAck := &UnsubAck{
-			Version: p.version,
+			Version: version,
 		}
-		_, err := unsubAck.ReadFrom(p.conn)
+		_, err := unsubAck.ReadFrom(body)
 		if err != nil {
 			return nil, err
 		}
@@ -204,9 +825,9 @@ func (p *PacketIO) Recv() (pkg Packet, err error) {
 
 	case cmdPingReq:
 		ping := &PingReq{
-			Version: p.version,
+			Version: version,
 		}
-		_, err := ping.ReadFrom(p.conn)
+		_, err := ping.ReadFrom(body)
 		if err != nil {
 			return nil, err
 		}
@@ -214,9 +835,9 @@ func (p *PacketIO) Recv() (pkg Packet, err error) {
 
 	case cmdPingResp:
 		pingRsp := &PingResp{
-			Version: p.version,
+			Version: version,
 		}
-		_, err := pingRsp.ReadFrom(p.conn)
+		_, err := pingRsp.ReadFrom(body)
 		if err != nil {
 			return nil, err
 		}
@@ -224,9 +845,9 @@ func (p *PacketIO) Recv() (pkg Packet, err error) {
 
 	case cmdDisconnect:
 		disconnect := &Disconnect{
-			Version: p.version,
+			Version: version,
 		}
-		_, err := disconnect.ReadFrom(p.conn)
+		_, err := disconnect.ReadFrom(body)
 		if err != nil {
 			return nil, err
 		}
@@ -235,11 +856,22 @@ func (p *PacketIO) Recv() (pkg Packet, err error) {
 	default:
 		return nil, fmt.Errorf("invalid command byte: 0x%02X", cmd)
 	}
+	if err := p.checkTopics(pkg); err != nil {
+		return nil, err
+	}
 
 	return pkg, err
 }
 
-// Close closes the underlying connection.
+// Close closes the underlying connection. After Close, Send and Recv return
+// mqtt.ErrConnectionClosed, as do subsequent calls to Close.
 func (p *PacketIO) Close() error {
+	if !atomic.CompareAndSwapUint32(&p.closed, 0, 1) {
+		return mqtt.ErrConnectionClosed
+	}
 	return p.conn.Close()
 }
+
+func (p *PacketIO) isClosed() bool {
+	return atomic.LoadUint32(&p.closed) != 0
+}
@@ -0,0 +1,724 @@
+package packets
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alfrunes/mqttie/mqtt"
+	"github.com/alfrunes/mqttie/x/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadRawPacket(t *testing.T) {
+	largePayload := make([]byte, 20000)
+	for i := range largePayload {
+		largePayload[i] = byte(i)
+	}
+	testPackets := []Packet{
+		&PingReq{Version: mqtt.MQTTv311},
+		&Publish{
+			Version: mqtt.MQTTv311,
+			Topic: mqtt.Topic{
+				Name: "foo/bar",
+				QoS:  mqtt.QoS1,
+			},
+			PacketIdentifier: 1,
+			Payload:          []byte("baz"),
+		},
+		// Two byte remaining length
+		&Publish{
+			Version: mqtt.MQTTv311,
+			Topic: mqtt.Topic{
+				Name: "foo",
+			},
+			Payload: largePayload[:200],
+		},
+		&PubAck{Version: mqtt.MQTTv311, PacketIdentifier: 2},
+		// Three byte remaining length
+		&Publish{
+			Version: mqtt.MQTTv311,
+			Topic: mqtt.Topic{
+				Name: "foo/bar/baz",
+			},
+			Payload: largePayload,
+		},
+		&Disconnect{Version: mqtt.MQTTv311},
+	}
+	var stream bytes.Buffer
+	var expected [][]byte
+	for _, p := range testPackets {
+		b, err := p.MarshalBinary()
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		expected = append(expected, b)
+		stream.Write(b)
+	}
+
+	for _, b := range expected {
+		raw, err := ReadRawPacket(&stream)
+		assert.NoError(t, err)
+		assert.Equal(t, b, raw)
+	}
+	_, err := ReadRawPacket(&stream)
+	assert.EqualError(t, err, io.EOF.Error())
+
+	// Truncated remaining length
+	_, err = ReadRawPacket(bytes.NewReader([]byte{cmdPublish, 0x80}))
+	assert.EqualError(t, err, io.ErrUnexpectedEOF.Error())
+
+	// Truncated body
+	_, err = ReadRawPacket(bytes.NewReader([]byte{cmdPubAck, 2, 0}))
+	assert.EqualError(t, err, io.ErrUnexpectedEOF.Error())
+
+	// Remaining length too long
+	_, err = ReadRawPacket(bytes.NewReader(
+		[]byte{cmdPublish, 0xFF, 0xFF, 0xFF, 0xFF, 0x01},
+	))
+	assert.EqualError(t, err, util.ErrVarintTooLong.Error())
+
+	// A truncated body does not allocate the declared remaining length:
+	// the buffers passed to Read stay small.
+	r := &readSizeRecorder{Reader: bytes.NewReader(
+		[]byte{cmdPublish, 0xFF, 0xFF, 0xFF, 0x7F, 0, 3, 'f', 'o', 'o'},
+	)}
+	_, err = ReadRawPacket(r)
+	assert.EqualError(t, err, io.ErrUnexpectedEOF.Error())
+	assert.Less(t, r.maxRead, 1<<20)
+}
+
+// readSizeRecorder records the largest buffer passed to Read.
+type readSizeRecorder struct {
+	io.Reader
+	maxRead int
+}
+
+func (r *readSizeRecorder) Read(b []byte) (int, error) {
+	if len(b) > r.maxRead {
+		r.maxRead = len(b)
+	}
+	return r.Reader.Read(b)
+}
+
+func TestPeekType(t *testing.T) {
+	connect := &Connect{
+		Version:  mqtt.MQTTv311,
+		ClientID: "foo",
+	}
+	b, err := connect.MarshalBinary()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	r := bufio.NewReader(bytes.NewReader(b))
+	typ, err := PeekType(r)
+	assert.NoError(t, err)
+	assert.Equal(t, cmdConnect>>4, typ)
+
+	// The packet is not consumed by peeking.
+	cmd, err := r.ReadByte()
+	assert.NoError(t, err)
+	assert.Equal(t, cmdConnect, cmd)
+	decoded := new(Connect)
+	_, err = decoded.ReadFrom(r)
+	assert.NoError(t, err)
+	assert.Equal(t, connect.ClientID, decoded.ClientID)
+	assert.Equal(t, connect.Version, decoded.Version)
+
+	_, err = PeekType(r)
+	assert.EqualError(t, err, io.EOF.Error())
+}
+
+func TestRecvIllegalQoS(t *testing.T) {
+	buf := bytes.NewBuffer([]byte{
+		0x36, 0x09, 0x00, 0x03, 'f', 'o', 'o', 0x00, 0x01, 'b', 'a',
+	})
+	conn := NewBufferConn(buf)
+	bufIO := NewPacketIO(conn, mqtt.MQTTv311, time.Duration(0))
+	_, err := bufIO.Recv()
+	assert.EqualError(t, err, mqtt.ErrIllegalQoS.Error())
+}
+
+func TestRecvStrictVarint(t *testing.T) {
+	buf := &bytes.Buffer{}
+	conn := NewBufferConn(buf)
+	bufIO := NewPacketIO(conn, mqtt.MQTTv311, time.Duration(0))
+
+	// Non-minimal remaining length is accepted by default.
+	buf.Write([]byte{cmdPingReq, 0x80, 0x00})
+	p, err := bufIO.Recv()
+	assert.NoError(t, err)
+	assert.Equal(t, &PingReq{Version: mqtt.MQTTv311}, p)
+
+	bufIO.SetStrict(true)
+	buf.Write([]byte{cmdPingReq, 0x80, 0x00})
+	_, err = bufIO.Recv()
+	assert.EqualError(t, err, util.ErrVarintNotMinimal.Error())
+
+	buf.Reset()
+	buf.Write([]byte{cmdPingReq, 0x00})
+	_, err = bufIO.Recv()
+	assert.NoError(t, err)
+}
+
+func TestRecvStrictFlags(t *testing.T) {
+	buf := &bytes.Buffer{}
+	conn := NewBufferConn(buf)
+	bufIO := NewPacketIO(conn, mqtt.MQTTv311, time.Duration(0))
+	pubAck := []byte{0x4F, 2, 0, 1}
+
+	// Reserved flags are ignored by default.
+	buf.Write(pubAck)
+	p, err := bufIO.Recv()
+	assert.NoError(t, err)
+	assert.Equal(t, &PubAck{
+		Version:          mqtt.MQTTv311,
+		PacketIdentifier: 1,
+	}, p)
+
+	bufIO.SetStrict(true)
+	buf.Write(pubAck)
+	buf.Write([]byte{cmdPubAck, 2, 0, 2})
+	_, err = bufIO.Recv()
+	assert.EqualError(t, err, mqtt.ErrProtocolViolation.Error())
+	// The stream remains aligned.
+	p, err = bufIO.Recv()
+	assert.NoError(t, err)
+	assert.Equal(t, &PubAck{
+		Version:          mqtt.MQTTv311,
+		PacketIdentifier: 2,
+	}, p)
+
+	// PUBREL, SUBSCRIBE and UNSUBSCRIBE require the flags 0b0010.
+	buf.Write([]byte{cmdPubRel, 2, 0, 1})
+	_, err = bufIO.Recv()
+	assert.EqualError(t, err, mqtt.ErrProtocolViolation.Error())
+	for _, v := range []mqtt.Version{mqtt.MQTTv311, mqtt.MQTTv5} {
+		err = bufIO.Send(&PubRel{Version: v, PacketIdentifier: 1})
+		assert.NoError(t, err)
+		_, err = bufIO.Recv()
+		assert.NoError(t, err)
+	}
+}
+
+func TestSendRecvAfterClose(t *testing.T) {
+	buf := &bytes.Buffer{}
+	conn := NewBufferConn(buf)
+	bufIO := NewPacketIO(conn, mqtt.MQTTv311, time.Duration(0))
+	assert.NoError(t, bufIO.Close())
+
+	err := bufIO.Send(&PingReq{Version: mqtt.MQTTv311})
+	assert.EqualError(t, err, mqtt.ErrConnectionClosed.Error())
+	assert.Zero(t, buf.Len())
+	_, err = bufIO.Recv()
+	assert.EqualError(t, err, mqtt.ErrConnectionClosed.Error())
+	err = bufIO.Close()
+	assert.EqualError(t, err, mqtt.ErrConnectionClosed.Error())
+}
+
+func TestRecvMalformedAlignment(t *testing.T) {
+	buf := &bytes.Buffer{}
+	conn := NewBufferConn(buf)
+	bufIO := NewPacketIO(conn, mqtt.MQTTv311, time.Duration(0))
+
+	// Topic name claiming more bytes than the packet contains
+	buf.Write([]byte{cmdPublish, 4, 0, 10, 'a', 'b'})
+	buf.Write([]byte{cmdPingResp, 0})
+	_, err := bufIO.Recv()
+	assert.EqualError(t, err, mqtt.ErrMalformedUTF8.Error())
+	p, err := bufIO.Recv()
+	assert.NoError(t, err)
+	assert.Equal(t, &PingResp{Version: mqtt.MQTTv311}, p)
+
+	// Packet rejected before reading the body
+	buf.Write([]byte{cmdConnAck, 3, 0, 0, 0})
+	buf.Write([]byte{cmdPubAck, 2, 0, 1})
+	_, err = bufIO.Recv()
+	assert.EqualError(t, err, mqtt.ErrPacketLong.Error())
+	p, err = bufIO.Recv()
+	assert.NoError(t, err)
+	assert.Equal(t, &PubAck{
+		Version:          mqtt.MQTTv311,
+		PacketIdentifier: 1,
+	}, p)
+}
+
+func TestRecvFieldOverclaim(t *testing.T) {
+	// truncate drops the last n bytes of the packet such that the last
+	// field claims more bytes than the packet contains.
+	truncate := func(p Packet, n int) []byte {
+		b, err := p.MarshalBinary()
+		if !assert.NoError(t, err) || !assert.True(t, b[1] < 0x80) {
+			t.FailNow()
+		}
+		b[1] -= byte(n)
+		return b[:len(b)-n]
+	}
+	testCases := map[string][]byte{
+		"Connect password": truncate(&Connect{
+			Version:  mqtt.MQTTv5,
+			ClientID: "foobar",
+			Username: "user",
+			Password: "secret",
+		}, 2),
+		"Subscribe topic filter": truncate(&Subscribe{
+			Version:          mqtt.MQTTv5,
+			PacketIdentifier: 1,
+			Topics:           []mqtt.Topic{{Name: "foo/bar"}},
+		}, 2),
+		"Unsubscribe topic filter": truncate(&Unsubscribe{
+			Version:          mqtt.MQTTv5,
+			PacketIdentifier: 1,
+			Topics:           []string{"foo/bar"},
+		}, 2),
+		"Publish topic name": func() []byte {
+			b, _ := (&Publish{
+				Version: mqtt.MQTTv5,
+				Topic:   mqtt.Topic{Name: "foo/bar"},
+				Payload: []byte("payload"),
+			}).MarshalBinary()
+			// Topic length exceeding the packet
+			b[2], b[3] = 0, 0xFF
+			return b
+		}(),
+	}
+	for name, b := range testCases {
+		t.Run(name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			conn := NewBufferConn(buf)
+			bufIO := NewPacketIO(conn, mqtt.MQTTv5, time.Duration(0))
+			buf.Write(b)
+			buf.Write([]byte{cmdPubAck, 2, 0, 7})
+			_, err := bufIO.Recv()
+			assert.Error(t, err)
+			// The following packet is decoded intact.
+			p, err := bufIO.Recv()
+			assert.NoError(t, err)
+			assert.Equal(t, &PubAck{
+				Version:          mqtt.MQTTv5,
+				PacketIdentifier: 7,
+			}, p)
+		})
+	}
+}
+
+func TestSendShortWrite(t *testing.T) {
+	buf := &bytes.Buffer{}
+	conn := NewBufferConn(buf)
+	bufIO := NewPacketIO(conn, mqtt.MQTTv311, time.Duration(0))
+	pub := &Publish{
+		Version: mqtt.MQTTv311,
+		Topic:   mqtt.Topic{Name: "foo/bar"},
+		Payload: []byte("a payload spanning several writes"),
+	}
+	var writes int
+	conn.writeLimit = func(l int) int {
+		writes++
+		return (l + 1) / 2
+	}
+	err := bufIO.Send(pub)
+	assert.NoError(t, err)
+	assert.True(t, writes > 1)
+	p, err := bufIO.Recv()
+	assert.NoError(t, err)
+	assert.Equal(t, pub, p)
+
+	// Transport making no progress
+	buf.Reset()
+	conn.writeLimit = func(l int) int { return 0 }
+	err = bufIO.Send(pub)
+	assert.EqualError(t, err, io.ErrShortWrite.Error())
+}
+
+func TestSendBuffered(t *testing.T) {
+	buf := &bytes.Buffer{}
+	conn := NewBufferConn(buf)
+	bufIO := NewPacketIO(conn, mqtt.MQTTv311, time.Duration(0))
+	bufIO.SetWriteBufferSize(4096)
+	pub := &Publish{
+		Version: mqtt.MQTTv311,
+		Topic:   mqtt.Topic{Name: "foo/bar"},
+		Payload: []byte("baz"),
+	}
+	var writes int
+	conn.writeLimit = func(l int) int {
+		writes++
+		return l
+	}
+	// A lone packet is flushed before Send returns.
+	assert.NoError(t, bufIO.Send(pub))
+	assert.Equal(t, 1, writes)
+	p, err := bufIO.Recv()
+	assert.NoError(t, err)
+	assert.Equal(t, pub, p)
+
+	// Packets queued behind each other are flushed by the last sender.
+	writes = 0
+	bufIO.sendMutex <- struct{}{}
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		go func() { errs <- bufIO.Send(pub) }()
+	}
+	for atomic.LoadInt32(&bufIO.sending) < 10 {
+		time.Sleep(time.Millisecond)
+	}
+	<-bufIO.sendMutex
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, <-errs)
+	}
+	assert.Equal(t, 1, writes)
+	for i := 0; i < 10; i++ {
+		p, err := bufIO.Recv()
+		assert.NoError(t, err)
+		assert.Equal(t, pub, p)
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestTrySendBuffered(t *testing.T) {
+	buf := &bytes.Buffer{}
+	conn := NewBufferConn(buf)
+	bufIO := NewPacketIO(conn, mqtt.MQTTv311, time.Duration(0))
+	bufIO.SetWriteBufferSize(4096)
+	pub := &Publish{
+		Version: mqtt.MQTTv311,
+		Topic:   mqtt.Topic{Name: "foo/bar"},
+		Payload: []byte("baz"),
+	}
+	// The packet is flushed through the buffer.
+	sent, err := bufIO.TrySend(pub, time.Second)
+	assert.NoError(t, err)
+	assert.True(t, sent)
+	assert.Equal(t, 0, bufIO.writer.Buffered())
+	p, err := bufIO.Recv()
+	assert.NoError(t, err)
+	assert.Equal(t, pub, p)
+
+	// A packet left in the buffer for a waiting Send is not overtaken.
+	bufIO.writer.Write([]byte{0xC0, 0x00})
+	atomic.AddInt32(&bufIO.sending, 1)
+	sent, err = bufIO.TrySend(pub, time.Second)
+	assert.NoError(t, err)
+	assert.False(t, sent)
+	assert.Equal(t, 0, buf.Len())
+	atomic.AddInt32(&bufIO.sending, -1)
+	assert.NoError(t, bufIO.writer.Flush())
+	p, err = bufIO.Recv()
+	assert.NoError(t, err)
+	assert.Equal(t, &PingReq{Version: mqtt.MQTTv311}, p)
+
+	// A packet not accepted within the wait is dropped, and the writer
+	// remains usable.
+	conn.writeErr = timeoutError{}
+	sent, err = bufIO.TrySend(pub, time.Millisecond)
+	assert.NoError(t, err)
+	assert.False(t, sent)
+	conn.writeErr = nil
+	assert.NoError(t, bufIO.Send(pub))
+	p, err = bufIO.Recv()
+	assert.NoError(t, err)
+	assert.Equal(t, pub, p)
+	assert.Equal(t, 0, buf.Len())
+}
+
+func TestIOStats(t *testing.T) {
+	buf := &bytes.Buffer{}
+	conn := NewBufferConn(buf)
+	bufIO := NewPacketIO(conn, mqtt.MQTTv311, time.Duration(0))
+	pkts := []Packet{
+		&Publish{
+			Version: mqtt.MQTTv311,
+			Topic:   mqtt.Topic{Name: "foo/bar"},
+			Payload: []byte("baz"),
+		},
+		&PingReq{Version: mqtt.MQTTv311},
+		&Subscribe{
+			Version:          mqtt.MQTTv311,
+			PacketIdentifier: 1,
+			Topics:           []mqtt.Topic{{Name: "foo/#"}},
+		},
+	}
+	var size uint64
+	for _, pkt := range pkts {
+		b, _ := pkt.MarshalBinary()
+		size += uint64(len(b))
+		assert.NoError(t, bufIO.Send(pkt))
+	}
+	assert.Equal(t, IOStats{
+		BytesSent:   size,
+		PacketsSent: 3,
+	}, bufIO.Stats())
+	for range pkts {
+		_, err := bufIO.Recv()
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, IOStats{
+		BytesSent:       size,
+		BytesReceived:   size,
+		PacketsSent:     3,
+		PacketsReceived: 3,
+	}, bufIO.Stats())
+
+	// A malformed packet counts the bytes, but not the packet.
+	buf.Write([]byte{cmdPublish | 0x06, 0x03, 0x00, 0x01, 'a'})
+	_, err := bufIO.Recv()
+	assert.Error(t, err)
+	stats := bufIO.Stats()
+	assert.Equal(t, size+5, stats.BytesReceived)
+	assert.Equal(t, uint64(3), stats.PacketsReceived)
+}
+
+func TestRecvTopicLimits(t *testing.T) {
+	buf := &bytes.Buffer{}
+	conn := NewBufferConn(buf)
+	bufIO := NewPacketIO(conn, mqtt.MQTTv311, time.Duration(0))
+	bufIO.SetMaxTopicLength(64)
+	bufIO.SetMaxTopicLevels(8)
+
+	deep := strings.Repeat("a/", 999) + "a"
+	testCases := []struct {
+		Name  string
+		Pkt   Packet
+		Error error
+	}{{
+		Name: "Publish within limits",
+		Pkt: &Publish{
+			Version: mqtt.MQTTv311,
+			Topic:   mqtt.Topic{Name: "a/b/c/d/e/f/g/h"},
+			Payload: []byte{},
+		},
+	}, {
+		Name: "Publish too deep",
+		Pkt: &Publish{
+			Version: mqtt.MQTTv311,
+			Topic:   mqtt.Topic{Name: "a/b/c/d/e/f/g/h/i"},
+		},
+		Error: mqtt.ErrTopicLimitExceeded,
+	}, {
+		Name: "Publish too long",
+		Pkt: &Publish{
+			Version: mqtt.MQTTv311,
+			Topic:   mqtt.Topic{Name: strings.Repeat("a", 65)},
+		},
+		Error: mqtt.ErrTopicLimitExceeded,
+	}, {
+		Name: "Subscribe with 1000 levels",
+		Pkt: &Subscribe{
+			Version:          mqtt.MQTTv311,
+			PacketIdentifier: 1,
+			Topics:           []mqtt.Topic{{Name: "foo"}, {Name: deep}},
+		},
+		Error: mqtt.ErrTopicLimitExceeded,
+	}, {
+		Name: "Unsubscribe too deep",
+		Pkt: &Unsubscribe{
+			Version:          mqtt.MQTTv311,
+			PacketIdentifier: 1,
+			Topics:           []string{deep},
+		},
+		Error: mqtt.ErrTopicLimitExceeded,
+	}}
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			assert.NoError(t, bufIO.Send(tc.Pkt))
+			p, err := bufIO.Recv()
+			if tc.Error != nil {
+				assert.True(t, errors.Is(err, tc.Error), err)
+				assert.Nil(t, p)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tc.Pkt, p)
+			}
+		})
+	}
+	// The stream stays aligned after the rejected packets.
+	assert.Zero(t, buf.Len())
+}
+
+func TestRecvMaxPacketSize(t *testing.T) {
+	buf := &bytes.Buffer{}
+	conn := NewBufferConn(buf)
+	bufIO := NewPacketIO(conn, mqtt.MQTTv5, time.Duration(0))
+	bufIO.SetMaxPacketSize(64)
+
+	// ConnAck claiming a 100MB property block
+	buf.Write([]byte{cmdConnAck, 0x87, 0xAD, 0x4B, 0x30, 0, 0})
+	_, err := bufIO.Recv()
+	assert.EqualError(t, err, mqtt.ErrPacketTooLarge.Error())
+
+	// Property length exceeding the remaining length
+	buf.Reset()
+	buf.Write([]byte{cmdConnAck, 3, 0, 0, 0x80, 0xDA, 0xC4, 0x09})
+	_, err = bufIO.Recv()
+	assert.EqualError(t, err, mqtt.ErrPacketShort.Error())
+
+	// Packets within the limit are accepted
+	buf.Reset()
+	connAck := &ConnAck{Version: mqtt.MQTTv5, ReasonString: "hi"}
+	err = bufIO.Send(connAck)
+	assert.NoError(t, err)
+	p, err := bufIO.Recv()
+	assert.NoError(t, err)
+	assert.Equal(t, connAck, p)
+}
+
+func TestRecvBatch(t *testing.T) {
+	buf := &bytes.Buffer{}
+	conn := NewBufferConn(buf)
+	bufIO := NewPacketIO(conn, mqtt.MQTTv311, time.Duration(0))
+	bufIO.SetReadBufferSize(4096)
+	pub := &Publish{
+		Version: mqtt.MQTTv311,
+		Topic:   mqtt.Topic{Name: "foo/bar"},
+		Payload: []byte("baz"),
+	}
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, bufIO.Send(pub))
+	}
+	// Trailing incomplete packet
+	b, _ := pub.MarshalBinary()
+	buf.Write(b[:len(b)-1])
+
+	pkgs, err := bufIO.RecvBatch(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []Packet{pub, pub, pub}, pkgs)
+
+	buf.Write(b[len(b)-1:])
+	pkgs, err = bufIO.RecvBatch(pkgs[:0])
+	assert.NoError(t, err)
+	assert.Equal(t, []Packet{pub}, pkgs)
+
+	_, err = bufIO.RecvBatch(nil)
+	assert.EqualError(t, err, io.EOF.Error())
+}
+
+func benchmarkRecv(b *testing.B, bufferSize int, payload []byte) {
+	pub := &Publish{
+		Version: mqtt.MQTTv311,
+		Topic:   mqtt.Topic{Name: "foo/bar"},
+		Payload: payload,
+	}
+	p, _ := pub.MarshalBinary()
+	stream := bytes.Repeat(p, 1000)
+	buf := &bytes.Buffer{}
+	bufIO := NewPacketIO(NewBufferConn(buf), mqtt.MQTTv311, 0)
+	bufIO.SetReadBufferSize(bufferSize)
+	var pkgs []Packet
+	b.SetBytes(int64(len(stream)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		buf.Write(stream)
+		for n := 0; n < 1000; n += len(pkgs) {
+			var err error
+			pkgs, err = bufIO.RecvBatch(pkgs[:0])
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkRecv(b *testing.B) {
+	benchmarkRecv(b, 0, []byte("payload"))
+}
+
+func BenchmarkRecvBatch(b *testing.B) {
+	benchmarkRecv(b, 32*1024, []byte("payload"))
+}
+
+func BenchmarkRecvBuffer4K(b *testing.B) {
+	benchmarkRecv(b, 4*1024, make([]byte, 1024))
+}
+
+func BenchmarkRecvBuffer64K(b *testing.B) {
+	benchmarkRecv(b, 64*1024, make([]byte, 1024))
+}
+
+func TestRecvDecodeError(t *testing.T) {
+	buf := &bytes.Buffer{}
+	conn := NewBufferConn(buf)
+	bufIO := NewPacketIO(conn, mqtt.MQTTv311, time.Duration(0))
+	// The topic name claims 16 bytes but the packet ends after 3.
+	malformed := []byte{cmdPublish, 5, 0, 16, 'f', 'o', 'o'}
+	buf.Write(malformed)
+	buf.Write([]byte{cmdPingResp, 0})
+
+	_, err := bufIO.Recv()
+	if assert.Error(t, err) {
+		rawErr, ok := err.(interface{ RawBytes() []byte })
+		if assert.True(t, ok, "error does not expose the raw bytes") {
+			assert.Equal(t, malformed, rawErr.RawBytes())
+		}
+		assert.EqualError(t, err, mqtt.ErrMalformedUTF8.Error())
+	}
+	// The stream remains aligned.
+	p, err := bufIO.Recv()
+	assert.NoError(t, err)
+	assert.IsType(t, &PingResp{}, p)
+
+	// Unread bytes are drained but not reported as consumed.
+	buf.Write([]byte{cmdUnsubAck, 4, 0, 1, 0xFF, 0xFF})
+	_, err = bufIO.Recv()
+	if decodeErr, ok := err.(*DecodeError); assert.True(t, ok) {
+		assert.Equal(t,
+			[]byte{cmdUnsubAck, 4}, decodeErr.RawBytes())
+		assert.Equal(t, mqtt.ErrPacketLong, decodeErr.Unwrap())
+	}
+	assert.Zero(t, buf.Len())
+}
+
+func TestDecodeAll(t *testing.T) {
+	stream := []byte{
+		// CONNACK: session present, accepted
+		0x20, 0x02, 0x01, 0x00,
+		// PUBLISH: QoS1 "a/b" packet id 7 payload "hi"
+		0x32, 0x09, 0x00, 0x03, 'a', '/', 'b', 0x00, 0x07, 'h', 'i',
+		// PINGRESP
+		0xD0, 0x00,
+	}
+	pkgs, err := DecodeAll(stream, mqtt.MQTTv311)
+	assert.NoError(t, err)
+	assert.Equal(t, []Packet{
+		&ConnAck{Version: mqtt.MQTTv311, SessionPresent: true},
+		&Publish{
+			Version:          mqtt.MQTTv311,
+			Topic:            mqtt.Topic{Name: "a/b", QoS: mqtt.QoS1},
+			PacketIdentifier: 7,
+			Payload:          []byte("hi"),
+		},
+		&PingResp{Version: mqtt.MQTTv311},
+	}, pkgs)
+
+	// Truncated stream
+	pkgs, err = DecodeAll(stream[:len(stream)-3], mqtt.MQTTv311)
+	assert.Error(t, err)
+	assert.Len(t, pkgs, 1)
+	pkgs, err = DecodeAll(stream[:len(stream)-1], mqtt.MQTTv311)
+	assert.EqualError(t, err, io.ErrUnexpectedEOF.Error())
+	assert.Len(t, pkgs, 2)
+
+	// Truncated body: the remaining length exceeds the data left
+	pkgs, err = DecodeAll(
+		[]byte{0x20, 0x02, 0x01, 0x00, 0x30, 0x07, 0x00, 0x03, 'a'},
+		mqtt.MQTTv311,
+	)
+	assert.EqualError(t, err, io.ErrUnexpectedEOF.Error())
+	assert.Len(t, pkgs, 1)
+	// Truncated fixed header
+	pkgs, err = DecodeAll([]byte{0x20, 0x02, 0x01, 0x00, 0x30},
+		mqtt.MQTTv311)
+	assert.EqualError(t, err, io.ErrUnexpectedEOF.Error())
+	assert.Len(t, pkgs, 1)
+}
@@ -0,0 +1,110 @@
+package packets
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// JSON type names of the packets supporting JSON encoding.
+const (
+	jsonTypeConnect   = "CONNECT"
+	jsonTypePublish   = "PUBLISH"
+	jsonTypeSubscribe = "SUBSCRIBE"
+)
+
+// jsonPacket is the JSON envelope of a packet. The packet type is recorded
+// alongside the fields such that captured packets can be decoded by
+// UnmarshalJSONPacket without prior knowledge of the type. Binary fields
+// (payloads and correlation data) are base64 encoded.
+type jsonPacket struct {
+	Type   string          `json:"type"`
+	Packet json.RawMessage `json:"packet"`
+}
+
+// The following types share the fields of the packets without their
+// methods, preventing MarshalJSON and UnmarshalJSON from recursing.
+type (
+	connectJSON   Connect
+	publishJSON   Publish
+	subscribeJSON Subscribe
+)
+
+func marshalJSONPacket(typ string, packet interface{}) ([]byte, error) {
+	b, err := json.Marshal(packet)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(jsonPacket{Type: typ, Packet: b})
+}
+
+func unmarshalJSONPacket(b []byte, typ string, packet interface{}) error {
+	var envelope jsonPacket
+	if err := json.Unmarshal(b, &envelope); err != nil {
+		return err
+	} else if envelope.Type != typ {
+		return fmt.Errorf(
+			"cannot unmarshal %s packet into %s", envelope.Type, typ,
+		)
+	}
+	return json.Unmarshal(envelope.Packet, packet)
+}
+
+// MarshalJSON encodes the connect packet as JSON for logging and replay.
+// The credentials (Password and AuthData) are redacted such that they do
+// not end up in logs; a replayed connect packet has to be given the
+// credentials again before it is sent.
+func (c *Connect) MarshalJSON() ([]byte, error) {
+	redacted := *c
+	redacted.Password = ""
+	redacted.AuthData = nil
+	return marshalJSONPacket(jsonTypeConnect, (*connectJSON)(&redacted))
+}
+
+// UnmarshalJSON decodes a connect packet encoded by MarshalJSON.
+func (c *Connect) UnmarshalJSON(b []byte) error {
+	return unmarshalJSONPacket(b, jsonTypeConnect, (*connectJSON)(c))
+}
+
+// MarshalJSON encodes the publish packet as JSON for logging and replay.
+func (p *Publish) MarshalJSON() ([]byte, error) {
+	return marshalJSONPacket(jsonTypePublish, (*publishJSON)(p))
+}
+
+// UnmarshalJSON decodes a publish packet encoded by MarshalJSON.
+func (p *Publish) UnmarshalJSON(b []byte) error {
+	return unmarshalJSONPacket(b, jsonTypePublish, (*publishJSON)(p))
+}
+
+// MarshalJSON encodes the subscribe packet as JSON for logging and replay.
+func (s *Subscribe) MarshalJSON() ([]byte, error) {
+	return marshalJSONPacket(jsonTypeSubscribe, (*subscribeJSON)(s))
+}
+
+// UnmarshalJSON decodes a subscribe packet encoded by MarshalJSON.
+func (s *Subscribe) UnmarshalJSON(b []byte) error {
+	return unmarshalJSONPacket(b, jsonTypeSubscribe, (*subscribeJSON)(s))
+}
+
+// UnmarshalJSONPacket decodes a packet encoded by one of the packets'
+// MarshalJSON methods, e.g. when replaying a capture, using the recorded
+// packet type.
+func UnmarshalJSONPacket(b []byte) (Packet, error) {
+	var envelope jsonPacket
+	if err := json.Unmarshal(b, &envelope); err != nil {
+		return nil, err
+	}
+	var packet Packet
+	switch envelope.Type {
+	case jsonTypeConnect:
+		packet = &Connect{}
+	case jsonTypePublish:
+		packet = &Publish{}
+	case jsonTypeSubscribe:
+		packet = &Subscribe{}
+	default:
+		return nil, fmt.Errorf(
+			"unsupported JSON packet type %q", envelope.Type,
+		)
+	}
+	return packet, json.Unmarshal(b, packet)
+}
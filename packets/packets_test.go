@@ -3,9 +3,13 @@ package packets
 import (
 	"bytes"
 	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"strings"
 	"testing"
+	"testing/iotest"
 	"time"
 
 	"github.com/alfrunes/mqttie/mqtt"
@@ -216,6 +220,57 @@ func TestDisconnect(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestDisconnectV5(t *testing.T) {
+	buf := &bytes.Buffer{}
+	conn := NewBufferConn(buf)
+	bufIO := NewPacketIO(conn, mqtt.MQTTv5, time.Duration(0))
+	d := &Disconnect{
+		Version: mqtt.MQTTv5,
+	}
+	b, err := d.MarshalBinary()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{cmdDisconnect, 0}, b)
+
+	d.ReasonCode = DisconnectSessionTakenOver
+	d.ReasonString = "bye"
+	d.ServerReference = "other.server"
+	d.UserProperties = []mqtt.UserProperty{
+		{Key: "k", Value: "v1"},
+		{Key: "k", Value: "v2"},
+	}
+	err = bufIO.Send(d)
+	assert.NoError(t, err)
+	p, err := bufIO.Recv()
+	assert.NoError(t, err)
+	assert.Equal(t, d, p)
+
+	// Session expiry of 0 is sent explicitly
+	var expiry uint32
+	d = &Disconnect{
+		Version:               mqtt.MQTTv5,
+		SessionExpiryInterval: &expiry,
+	}
+	err = bufIO.Send(d)
+	assert.NoError(t, err)
+	p, err = bufIO.Recv()
+	assert.NoError(t, err)
+	assert.Equal(t, d, p)
+
+	// Reason code without properties
+	buf.Write([]byte{cmdDisconnect, 1, DisconnectServerBusy})
+	p, err = bufIO.Recv()
+	assert.NoError(t, err)
+	assert.Equal(t, &Disconnect{
+		Version:    mqtt.MQTTv5,
+		ReasonCode: DisconnectServerBusy,
+	}, p)
+
+	// Property length exceeding remaining length
+	buf.Write([]byte{cmdDisconnect, 2, DisconnectServerBusy, 5})
+	_, err = bufIO.Recv()
+	assert.EqualError(t, err, mqtt.ErrPacketShort.Error())
+}
+
 func TestPing(t *testing.T) {
 	buf := &bytes.Buffer{}
 	conn := NewBufferConn(buf)
@@ -316,6 +371,7 @@ func TestPublish(t *testing.T) {
 
 	pub.Duplicate = true
 	pub.Topic.QoS = mqtt.QoS2
+	pub.PacketIdentifier = 1
 	pub.Retain = true
 	err = bufIO.Send(pub)
 	assert.NoError(t, err)
@@ -356,12 +412,35 @@ func TestPublish(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestPublishEmptyRetained(t *testing.T) {
+	pub := &Publish{
+		Version: mqtt.MQTTv311,
+		Topic:   mqtt.Topic{Name: "foo"},
+		Retain:  true,
+		Payload: []byte{},
+	}
+	b, err := pub.MarshalBinary()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{cmdPublish | 0x01, 5, 0, 3, 'f', 'o', 'o'}, b)
+
+	bufIO := NewPacketIO(
+		NewBufferConn(bytes.NewBuffer(b)), mqtt.MQTTv311, time.Duration(0),
+	)
+	p, err := bufIO.Recv()
+	assert.NoError(t, err)
+	if assert.IsType(t, pub, p) {
+		assert.True(t, p.(*Publish).Retain)
+		assert.Empty(t, p.(*Publish).Payload)
+	}
+}
+
 func TestPubAck(t *testing.T) {
 	buf := &bytes.Buffer{}
 	conn := NewBufferConn(buf)
 	bufIO := NewPacketIO(conn, mqtt.MQTTv311, time.Duration(0))
 	pubAck := &PubAck{
-		Version: mqtt.MQTTv311,
+		Version:          mqtt.MQTTv311,
+		PacketIdentifier: 1,
 	}
 	err := bufIO.Send(pubAck)
 	assert.NoError(t, err)
@@ -384,12 +463,60 @@ func TestPubAck(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestPubAckV5(t *testing.T) {
+	buf := &bytes.Buffer{}
+	conn := NewBufferConn(buf)
+	bufIO := NewPacketIO(conn, mqtt.MQTTv5, time.Duration(0))
+	pubAck := &PubAck{
+		Version:          mqtt.MQTTv5,
+		PacketIdentifier: 1,
+		ReasonCode:       PubAckNotAuthorized,
+		ReasonString:     "no",
+	}
+	b, err := pubAck.MarshalBinary()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{
+		cmdPubAck, 9, 0, 1, 0x87, 5, 0x1F, 0, 2, 'n', 'o',
+	}, b)
+	err = bufIO.Send(pubAck)
+	assert.NoError(t, err)
+	p, err := bufIO.Recv()
+	assert.NoError(t, err)
+	assert.Equal(t, pubAck, p)
+
+	// Reason code without properties, followed by the short form.
+	buf.Write([]byte{
+		cmdPubAck, 3, 0, 2, 0x97,
+		cmdPubAck, 2, 0, 3,
+	})
+	p, err = bufIO.Recv()
+	assert.NoError(t, err)
+	assert.Equal(t, &PubAck{
+		Version:          mqtt.MQTTv5,
+		PacketIdentifier: 2,
+		ReasonCode:       PubAckQuotaExceeded,
+	}, p)
+	p, err = bufIO.Recv()
+	assert.NoError(t, err)
+	assert.Equal(t, &PubAck{
+		Version:          mqtt.MQTTv5,
+		PacketIdentifier: 3,
+	}, p)
+
+	// The reason is not encoded before MQTTv5.
+	pubAck.Version = mqtt.MQTTv311
+	b, err = pubAck.MarshalBinary()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{cmdPubAck, 2, 0, 1}, b)
+}
+
 func TestPubRec(t *testing.T) {
 	buf := &bytes.Buffer{}
 	conn := NewBufferConn(buf)
 	bufIO := NewPacketIO(conn, mqtt.MQTTv311, time.Duration(0))
 	pubRec := &PubRec{
-		Version: mqtt.MQTTv311,
+		Version:          mqtt.MQTTv311,
+		PacketIdentifier: 1,
 	}
 	err := bufIO.Send(pubRec)
 	assert.NoError(t, err)
@@ -417,7 +544,8 @@ func TestPubRel(t *testing.T) {
 	conn := NewBufferConn(buf)
 	bufIO := NewPacketIO(conn, mqtt.MQTTv311, time.Duration(0))
 	pubRel := &PubRel{
-		Version: mqtt.MQTTv311,
+		Version:          mqtt.MQTTv311,
+		PacketIdentifier: 1,
 	}
 	err := bufIO.Send(pubRel)
 	assert.NoError(t, err)
@@ -440,12 +568,225 @@ func TestPubRel(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestPubRelFlags(t *testing.T) {
+	for _, version := range []mqtt.Version{
+		mqtt.MQTTv31, mqtt.MQTTv311, mqtt.MQTTv5,
+	} {
+		for _, code := range []uint8{
+			PubRelSuccess, PubRelPacketIdentifierNotFound,
+		} {
+			pubRel := &PubRel{
+				Version:          version,
+				PacketIdentifier: 1,
+				ReasonCode:       code,
+			}
+			b, err := pubRel.MarshalBinary()
+			if assert.NoError(t, err) {
+				assert.Equal(t, byte(0x62), b[0],
+					"version %d, reason code %02X",
+					version, code)
+			}
+		}
+		// Strict decoding rejects other flags.
+		buf := &bytes.Buffer{}
+		bufIO := NewPacketIO(NewBufferConn(buf), version, 0)
+		bufIO.SetStrict(true)
+		buf.Write([]byte{0x60, 2, 0, 1, 0x62, 2, 0, 1})
+		_, err := bufIO.Recv()
+		assert.EqualError(t, err, mqtt.ErrProtocolViolation.Error())
+		p, err := bufIO.Recv()
+		assert.NoError(t, err)
+		assert.IsType(t, &PubRel{}, p)
+	}
+}
+
+func TestPubRelV5(t *testing.T) {
+	buf := &bytes.Buffer{}
+	conn := NewBufferConn(buf)
+	bufIO := NewPacketIO(conn, mqtt.MQTTv5, time.Duration(0))
+	pubRel := &PubRel{
+		Version:          mqtt.MQTTv5,
+		PacketIdentifier: 1,
+		ReasonCode:       PubRelPacketIdentifierNotFound,
+	}
+	b, err := pubRel.MarshalBinary()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{cmdPubRel | flagsPubRel, 3, 0, 1, 0x92}, b)
+	err = bufIO.Send(pubRel)
+	assert.NoError(t, err)
+	p, err := bufIO.Recv()
+	assert.NoError(t, err)
+	assert.Equal(t, pubRel, p)
+
+	// Reason code followed by properties (reason string)
+	buf.Write([]byte{
+		cmdPubRel, 9, 0, 2, 0x92, 5, 0x1F, 0, 2, 'n', 'o',
+		cmdPubRel, 2, 0, 3,
+	})
+	p, err = bufIO.Recv()
+	assert.NoError(t, err)
+	assert.Equal(t, &PubRel{
+		Version:          mqtt.MQTTv5,
+		PacketIdentifier: 2,
+		ReasonCode:       PubRelPacketIdentifierNotFound,
+	}, p)
+	// Short form (success)
+	p, err = bufIO.Recv()
+	assert.NoError(t, err)
+	assert.Equal(t, &PubRel{
+		Version:          mqtt.MQTTv5,
+		PacketIdentifier: 3,
+	}, p)
+}
+
+func TestPubRecV5(t *testing.T) {
+	buf := &bytes.Buffer{}
+	conn := NewBufferConn(buf)
+	bufIO := NewPacketIO(conn, mqtt.MQTTv5, time.Duration(0))
+	pubRec := &PubRec{
+		Version:          mqtt.MQTTv5,
+		PacketIdentifier: 1,
+		ReasonCode:       PubRecQuotaExceeded,
+	}
+	b, err := pubRec.MarshalBinary()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{cmdPubRec, 3, 0, 1, 0x97}, b)
+	err = bufIO.Send(pubRec)
+	assert.NoError(t, err)
+	p, err := bufIO.Recv()
+	assert.NoError(t, err)
+	assert.Equal(t, pubRec, p)
+
+	// Short form (success)
+	buf.Write([]byte{cmdPubRec, 2, 0, 2})
+	p, err = bufIO.Recv()
+	assert.NoError(t, err)
+	assert.Equal(t, &PubRec{
+		Version:          mqtt.MQTTv5,
+		PacketIdentifier: 2,
+	}, p)
+
+	// Reason string and user property are read and discarded.
+	buf.Write([]byte{
+		cmdPubRec, 16, 0, 3, 0x80,
+		12,
+		0x1F, 0, 2, 'n', 'o',
+		0x26, 0, 1, 'k', 0, 1, 'v',
+	})
+	p, err = bufIO.Recv()
+	assert.NoError(t, err)
+	assert.Equal(t, &PubRec{
+		Version:          mqtt.MQTTv5,
+		PacketIdentifier: 3,
+		ReasonCode:       PubRecUnspecifiedError,
+	}, p)
+
+	// Illegal property (payload format indicator)
+	buf.Write([]byte{cmdPubRec, 6, 0, 4, 0x80, 2, 0x01, 0})
+	_, err = bufIO.Recv()
+	assert.Error(t, err)
+}
+
+func TestAckReadOneByte(t *testing.T) {
+	testCases := []struct {
+		Name   string
+		Packet Packet
+		Empty  Packet
+	}{{
+		Name: "ConnAck",
+		Packet: &ConnAck{
+			Version:        mqtt.MQTTv311,
+			SessionPresent: true,
+			ReturnCode:     ConnAckUnauthorized,
+		},
+		Empty: &ConnAck{Version: mqtt.MQTTv311},
+	}, {
+		Name: "ConnAck v5",
+		Packet: &ConnAck{
+			Version:        mqtt.MQTTv5,
+			SessionPresent: true,
+			ReceiveMax:     10,
+			ReasonString:   "ok",
+		},
+		Empty: &ConnAck{Version: mqtt.MQTTv5},
+	}, {
+		Name: "PubAck",
+		Packet: &PubAck{
+			Version:          mqtt.MQTTv5,
+			PacketIdentifier: 0x1234,
+			ReasonCode:       PubAckNotAuthorized,
+			ReasonString:     "no",
+		},
+		Empty: &PubAck{Version: mqtt.MQTTv5},
+	}, {
+		Name: "PubRec",
+		Packet: &PubRec{
+			Version:          mqtt.MQTTv5,
+			PacketIdentifier: 0x1234,
+			ReasonCode:       PubRecQuotaExceeded,
+		},
+		Empty: &PubRec{Version: mqtt.MQTTv5},
+	}, {
+		Name: "PubRel",
+		Packet: &PubRel{
+			Version:          mqtt.MQTTv311,
+			PacketIdentifier: 0x1234,
+		},
+		Empty: &PubRel{Version: mqtt.MQTTv311},
+	}, {
+		Name: "PubComp",
+		Packet: &PubComp{
+			Version:          mqtt.MQTTv311,
+			PacketIdentifier: 0x1234,
+		},
+		Empty: &PubComp{Version: mqtt.MQTTv311},
+	}, {
+		Name: "SubAck",
+		Packet: &SubAck{
+			Version:          mqtt.MQTTv311,
+			PacketIdentifier: 0x1234,
+			ReturnCodes:      []uint8{0, 1, 2, 0x80},
+		},
+		Empty: &SubAck{Version: mqtt.MQTTv311},
+	}, {
+		Name: "UnsubAck",
+		Packet: &UnsubAck{
+			Version:          mqtt.MQTTv311,
+			PacketIdentifier: 0x1234,
+		},
+		Empty: &UnsubAck{Version: mqtt.MQTTv311},
+	}, {
+		Name: "Unsubscribe",
+		Packet: &Unsubscribe{
+			Version:          mqtt.MQTTv311,
+			PacketIdentifier: 0x1234,
+			Topics:           []string{"foo", "bar/#"},
+		},
+		Empty: &Unsubscribe{Version: mqtt.MQTTv311},
+	}}
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			b, err := tc.Packet.MarshalBinary()
+			if !assert.NoError(t, err) {
+				t.FailNow()
+			}
+			// Skip the command byte.
+			r := iotest.OneByteReader(bytes.NewReader(b[1:]))
+			n, err := tc.Empty.ReadFrom(r)
+			assert.NoError(t, err)
+			assert.Equal(t, int64(len(b)-1), n)
+			assert.Equal(t, tc.Packet, tc.Empty)
+		})
+	}
+}
+
 func TestPubComp(t *testing.T) {
 	buf := &bytes.Buffer{}
 	conn := NewBufferConn(buf)
 	bufIO := NewPacketIO(conn, mqtt.MQTTv311, time.Duration(0))
 	pubComp := &PubComp{
-		Version: mqtt.MQTTv311,
+		Version:          mqtt.MQTTv311,
+		PacketIdentifier: 1,
 	}
 	err := bufIO.Send(pubComp)
 	assert.NoError(t, err)
@@ -468,12 +809,47 @@ func TestPubComp(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestPubCompV5(t *testing.T) {
+	buf := &bytes.Buffer{}
+	bufIO := NewPacketIO(NewBufferConn(buf), mqtt.MQTTv5, 0)
+	pubComp := &PubComp{
+		Version:          mqtt.MQTTv5,
+		PacketIdentifier: 1,
+		ReasonCode:       PubCompPacketIdentifierNotFound,
+	}
+	err := bufIO.Send(pubComp)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{cmdPubComp, 3, 0, 1, 0x92}, buf.Bytes())
+	p, err := bufIO.Recv()
+	assert.NoError(t, err)
+	assert.Equal(t, pubComp, p)
+
+	// Reason code with a reason string property.
+	buf.Write([]byte{
+		cmdPubComp, 10, 0, 2, 0x92,
+		6, 0x1F, 0, 3, 'f', 'o', 'o',
+	})
+	p, err = bufIO.Recv()
+	assert.NoError(t, err)
+	assert.Equal(t, &PubComp{
+		Version:          mqtt.MQTTv5,
+		PacketIdentifier: 2,
+		ReasonCode:       PubCompPacketIdentifierNotFound,
+	}, p)
+
+	// The property length exceeds the packet.
+	buf.Write([]byte{cmdPubComp, 4, 0, 3, 0x92, 1})
+	_, err = bufIO.Recv()
+	assert.Error(t, err)
+}
+
 func TestSubscribe(t *testing.T) {
 	buf := &bytes.Buffer{}
 	conn := NewBufferConn(buf)
 	bufIO := NewPacketIO(conn, mqtt.MQTTv311, time.Duration(0))
 	sub := &Subscribe{
-		Version: mqtt.MQTTv311,
+		Version:          mqtt.MQTTv311,
+		PacketIdentifier: 1,
 		Topics: []mqtt.Topic{
 			{
 				Name: "foo",
@@ -521,7 +897,8 @@ func TestSubscribe(t *testing.T) {
 	b[1] = 5
 	buf.Write(b)
 	_, err = bufIO.Recv()
-	assert.EqualError(t, err, mqtt.ErrPacketShort.Error())
+	// The topic filter is truncated at the packet boundary.
+	assert.EqualError(t, err, mqtt.ErrMalformedUTF8.Error())
 
 	buf.Reset()
 	b, err = sub.MarshalBinary()
@@ -551,7 +928,8 @@ func TestSubAck(t *testing.T) {
 	conn := NewBufferConn(buf)
 	bufIO := NewPacketIO(conn, mqtt.MQTTv311, time.Duration(0))
 	subAck := &SubAck{
-		Version: mqtt.MQTTv311,
+		Version:          mqtt.MQTTv311,
+		PacketIdentifier: 1,
 		ReturnCodes: []uint8{
 			0,
 			1,
@@ -593,6 +971,12 @@ func TestSubAck(t *testing.T) {
 	_, err = bufIO.Recv()
 	assert.EqualError(t, err, mqtt.ErrPacketShort.Error())
 
+	// Zero packet identifier
+	buf.Reset()
+	buf.Write([]byte{cmdSubAck, 3, 0, 0, 1})
+	_, err = bufIO.Recv()
+	assert.EqualError(t, err, mqtt.ErrProtocolViolation.Error())
+
 	// Test broken writer
 	conn.writeErr = fmt.Errorf("foo")
 	err = bufIO.Send(subAck)
@@ -600,12 +984,141 @@ func TestSubAck(t *testing.T) {
 
 }
 
+func TestSubscribeV5(t *testing.T) {
+	sub := &Subscribe{
+		Version:          mqtt.MQTTv5,
+		PacketIdentifier: 1,
+		Topics:           []mqtt.Topic{{Name: "a", QoS: mqtt.QoS1}},
+	}
+	b, err := sub.MarshalBinary()
+	assert.NoError(t, err)
+	// The (empty) property block follows the packet identifier.
+	assert.Equal(t,
+		[]byte{cmdSubscribe | flagsSubscribe, 7, 0, 1, 0, 0, 1, 'a', 1},
+		b,
+	)
+
+	raw := []byte{
+		cmdSubscribe | flagsSubscribe, 16, 0, 1,
+		// Subscription identifier 5, user property k=v
+		9, 0x0B, 5, 0x26, 0, 1, 'k', 0, 1, 'v',
+		0, 1, 'a', 1,
+	}
+	p, err := ReadPacket(bytes.NewReader(raw), mqtt.MQTTv5)
+	if assert.NoError(t, err) {
+		assert.Equal(t, &Subscribe{
+			Version:          mqtt.MQTTv5,
+			PacketIdentifier: 1,
+			SubscriptionID:   5,
+			UserProperties: []mqtt.UserProperty{
+				{Key: "k", Value: "v"},
+			},
+			Topics: []mqtt.Topic{{Name: "a", QoS: mqtt.QoS1}},
+		}, p)
+	}
+	b, err = p.MarshalBinary()
+	assert.NoError(t, err)
+	assert.Equal(t, raw, b)
+
+	// The property block exceeds the packet.
+	_, err = ReadPacket(bytes.NewReader(
+		[]byte{cmdSubscribe | flagsSubscribe, 3, 0, 1, 9},
+	), mqtt.MQTTv5)
+	assert.EqualError(t, err, mqtt.ErrPacketShort.Error())
+}
+
+func TestSubAckV5(t *testing.T) {
+	p, err := ReadPacket(
+		bytes.NewReader([]byte{cmdSubAck, 4, 0, 1, 0, 1}), mqtt.MQTTv5,
+	)
+	if assert.NoError(t, err) {
+		assert.Equal(t, &SubAck{
+			Version:          mqtt.MQTTv5,
+			PacketIdentifier: 1,
+			ReturnCodes:      []uint8{1},
+		}, p)
+	}
+
+	raw := []byte{
+		cmdSubAck, 11, 0, 2,
+		// Reason string "no"
+		5, 0x1F, 0, 2, 'n', 'o',
+		0x00, 0x87, 0x02,
+	}
+	p, err = ReadPacket(bytes.NewReader(raw), mqtt.MQTTv5)
+	if assert.NoError(t, err) {
+		assert.Equal(t, &SubAck{
+			Version:          mqtt.MQTTv5,
+			PacketIdentifier: 2,
+			ReasonString:     "no",
+			ReturnCodes:      []uint8{0x00, 0x87, 0x02},
+		}, p)
+	}
+	b, err := p.MarshalBinary()
+	assert.NoError(t, err)
+	assert.Equal(t, raw, b)
+
+	// Properties without return codes.
+	_, err = ReadPacket(
+		bytes.NewReader([]byte{cmdSubAck, 3, 0, 1, 0}), mqtt.MQTTv5,
+	)
+	assert.EqualError(t, err, mqtt.ErrPacketShort.Error())
+}
+
+func TestUnsubAckV5(t *testing.T) {
+	raw := []byte{cmdUnsubAck, 5, 0, 1, 0, 0x00, 0x11}
+	p, err := ReadPacket(bytes.NewReader(raw), mqtt.MQTTv5)
+	if assert.NoError(t, err) {
+		assert.Equal(t, &UnsubAck{
+			Version:          mqtt.MQTTv5,
+			PacketIdentifier: 1,
+			ReasonCodes: []uint8{
+				UnsubAckSuccess, UnsubAckNoSubscriptionExisted,
+			},
+		}, p)
+	}
+	b, err := p.MarshalBinary()
+	assert.NoError(t, err)
+	assert.Equal(t, raw, b)
+
+	raw = []byte{
+		cmdUnsubAck, 9, 0, 2,
+		// Reason string "no"
+		5, 0x1F, 0, 2, 'n', 'o',
+		0x87,
+	}
+	p, err = ReadPacket(bytes.NewReader(raw), mqtt.MQTTv5)
+	if assert.NoError(t, err) {
+		assert.Equal(t, &UnsubAck{
+			Version:          mqtt.MQTTv5,
+			PacketIdentifier: 2,
+			ReasonString:     "no",
+			ReasonCodes:      []uint8{UnsubAckNotAuthorized},
+		}, p)
+	}
+	b, err = p.MarshalBinary()
+	assert.NoError(t, err)
+	assert.Equal(t, raw, b)
+
+	// No reason codes.
+	_, err = ReadPacket(
+		bytes.NewReader([]byte{cmdUnsubAck, 3, 0, 1, 0}), mqtt.MQTTv5,
+	)
+	assert.EqualError(t, err, mqtt.ErrPacketShort.Error())
+	// The property block exceeds the packet.
+	_, err = ReadPacket(
+		bytes.NewReader([]byte{cmdUnsubAck, 4, 0, 1, 5, 0}), mqtt.MQTTv5,
+	)
+	assert.EqualError(t, err, mqtt.ErrPacketShort.Error())
+}
+
 func TestUnsubAck(t *testing.T) {
 	buf := &bytes.Buffer{}
 	conn := NewBufferConn(buf)
 	bufIO := NewPacketIO(conn, mqtt.MQTTv311, time.Duration(0))
 	uAck := &UnsubAck{
-		Version: mqtt.MQTTv311,
+		Version:          mqtt.MQTTv311,
+		PacketIdentifier: 1,
 	}
 	err := bufIO.Send(uAck)
 	assert.NoError(t, err)
@@ -653,8 +1166,9 @@ func TestUnsubscribe(t *testing.T) {
 	conn := NewBufferConn(buf)
 	bufIO := NewPacketIO(conn, mqtt.MQTTv311, time.Duration(0))
 	sub := &Unsubscribe{
-		Version: mqtt.MQTTv311,
-		Topics:  []string{"foo", "foo/bar", "foo/bar/baz"},
+		Version:          mqtt.MQTTv311,
+		PacketIdentifier: 1,
+		Topics:           []string{"foo", "foo/bar", "foo/bar/baz"},
 	}
 
 	err := bufIO.Send(sub)
@@ -681,7 +1195,8 @@ func TestUnsubscribe(t *testing.T) {
 	b[1] = 5
 	buf.Write(b)
 	_, err = bufIO.Recv()
-	assert.EqualError(t, err, mqtt.ErrPacketShort.Error())
+	// The topic filter is truncated at the packet boundary.
+	assert.EqualError(t, err, mqtt.ErrMalformedUTF8.Error())
 
 	buf.Reset()
 	b, err = sub.MarshalBinary()
@@ -706,6 +1221,57 @@ func TestUnsubscribe(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestSubscribeTopicTooLong(t *testing.T) {
+	name := strings.Repeat("a", 70*1024)
+	sub := &Subscribe{
+		Version:          mqtt.MQTTv311,
+		PacketIdentifier: 1,
+		Topics:           []mqtt.Topic{{Name: "foo"}, {Name: name}},
+	}
+	_, err := sub.MarshalBinary()
+	assert.EqualError(t, err, mqtt.ErrPacketTooLarge.Error())
+
+	unsub := &Unsubscribe{
+		Version:          mqtt.MQTTv311,
+		PacketIdentifier: 1,
+		Topics:           []string{name},
+	}
+	_, err = unsub.MarshalBinary()
+	assert.EqualError(t, err, mqtt.ErrPacketTooLarge.Error())
+}
+
+func TestUnsubscribeV5(t *testing.T) {
+	buf := &bytes.Buffer{}
+	conn := NewBufferConn(buf)
+	bufIO := NewPacketIO(conn, mqtt.MQTTv5, time.Duration(0))
+	unsub := &Unsubscribe{
+		Version:          mqtt.MQTTv5,
+		PacketIdentifier: 1,
+		UserProperties: []mqtt.UserProperty{
+			{Key: "foo", Value: "bar"},
+		},
+		Topics: []string{"foo", "foo/bar"},
+	}
+	err := bufIO.Send(unsub)
+	assert.NoError(t, err)
+	p, err := bufIO.Recv()
+	assert.NoError(t, err)
+	assert.Equal(t, unsub, p)
+
+	// Properties without topics
+	buf.Write([]byte{cmdUnsubscribe | flagsUnsubscribe, 3, 0, 1, 0})
+	_, err = bufIO.Recv()
+	assert.EqualError(t, err, mqtt.ErrPacketShort.Error())
+
+	// Illegal property
+	buf.Write([]byte{
+		cmdUnsubscribe | flagsUnsubscribe, 10, 0, 1, 2, 0x01, 0x01,
+		0, 3, 'f', 'o', 'o',
+	})
+	_, err = bufIO.Recv()
+	assert.Error(t, err)
+}
+
 func TestIllegalCommand(t *testing.T) {
 	buf := &bytes.Buffer{}
 	conn := NewBufferConn(buf)
@@ -714,3 +1280,372 @@ func TestIllegalCommand(t *testing.T) {
 	_, err := bufIO.Recv()
 	assert.Error(t, err)
 }
+
+func TestPublishV5(t *testing.T) {
+	buf := &bytes.Buffer{}
+	conn := NewBufferConn(buf)
+	bufIO := NewPacketIO(conn, mqtt.MQTTv5, time.Duration(0))
+	pub := &Publish{
+		Version: mqtt.MQTTv5,
+		Topic: mqtt.Topic{
+			Name: "foo/bar",
+			QoS:  mqtt.QoS1,
+		},
+		PacketIdentifier: 1,
+		FormatUTF8:       true,
+		MessageExpiry:    60,
+		ContentType:      "text/plain",
+		ResponseTopic:    "foo/rsp",
+		CorrelationData:  []byte("correlate this!"),
+		TopicAlias:       7,
+		UserProperties: []mqtt.UserProperty{
+			{Key: "b", Value: "1"},
+			{Key: "a", Value: "2"},
+			{Key: "b", Value: "3"},
+		},
+		Payload: []byte("baz"),
+	}
+	err := bufIO.Send(pub)
+	assert.NoError(t, err)
+	p, err := bufIO.Recv()
+	assert.NoError(t, err)
+	assert.Equal(t, pub, p)
+
+	// Illegal property ID
+	buf.Reset()
+	buf.Write([]byte{cmdPublish, 7, 0, 1, 'f', 2, 0xFF, 0, 0})
+	_, err = bufIO.Recv()
+	assert.Error(t, err)
+
+	// Property length exceeding remaining length
+	buf.Reset()
+	buf.Write([]byte{cmdPublish, 5, 0, 1, 'f', 10, 0})
+	_, err = bufIO.Recv()
+	assert.EqualError(t, err, mqtt.ErrPacketShort.Error())
+}
+
+func TestPublishMissingPacketID(t *testing.T) {
+	// QoS1 publish with the remaining length ending after the topic,
+	// followed by a PINGREQ.
+	b := []byte{0x05, 0x00, 0x03, 'f', 'o', 'o', cmdPingReq, 0x00}
+	for _, version := range []mqtt.Version{mqtt.MQTTv311, mqtt.MQTTv5} {
+		r := bytes.NewReader(b)
+		pub := &Publish{
+			Version: version,
+			Topic:   mqtt.Topic{QoS: mqtt.QoS1},
+		}
+		_, err := pub.ReadFrom(r)
+		assert.EqualError(t, err, mqtt.ErrPacketShort.Error())
+		// The following packet is not consumed.
+		assert.Equal(t, 2, r.Len())
+	}
+
+	// One byte short of the identifier.
+	buf := &bytes.Buffer{}
+	conn := NewBufferConn(buf)
+	bufIO := NewPacketIO(conn, mqtt.MQTTv311, time.Duration(0))
+	buf.Write([]byte{
+		cmdPublish | 0x02, 0x06, 0x00, 0x03, 'f', 'o', 'o', 0x01,
+	})
+	buf.Write([]byte{cmdPingReq, 0x00})
+	_, err := bufIO.Recv()
+	assert.True(t, errors.Is(err, mqtt.ErrPacketShort), err)
+	p, err := bufIO.Recv()
+	assert.NoError(t, err)
+	assert.IsType(t, &PingReq{}, p)
+}
+
+func TestPublishEmptyTopic(t *testing.T) {
+	buf := &bytes.Buffer{}
+	conn := NewBufferConn(buf)
+	bufIO := NewPacketIO(conn, mqtt.MQTTv5, time.Duration(0))
+
+	// Empty topic with alias
+	pub := &Publish{
+		Version:    mqtt.MQTTv5,
+		TopicAlias: 1,
+		Payload:    []byte("baz"),
+	}
+	err := bufIO.Send(pub)
+	assert.NoError(t, err)
+	p, err := bufIO.Recv()
+	assert.NoError(t, err)
+	assert.Equal(t, pub, p)
+
+	// Empty topic without alias
+	pub.TopicAlias = 0
+	_, err = pub.MarshalBinary()
+	assert.EqualError(t, err, mqtt.ErrProtocolViolation.Error())
+	buf.Write([]byte{cmdPublish, 6, 0, 0, 0, 'b', 'a', 'z'})
+	_, err = bufIO.Recv()
+	assert.EqualError(t, err, mqtt.ErrProtocolViolation.Error())
+
+	// Aliases are not supported before MQTTv5
+	pub = &Publish{Version: mqtt.MQTTv311, TopicAlias: 1}
+	_, err = pub.MarshalBinary()
+	assert.EqualError(t, err, mqtt.ErrProtocolViolation.Error())
+}
+
+func TestSubscribeFragmented(t *testing.T) {
+	sub := &Subscribe{
+		Version:          mqtt.MQTTv311,
+		PacketIdentifier: 0x1234,
+	}
+	for i := 0; i < 200; i++ {
+		sub.Topics = append(sub.Topics, mqtt.Topic{
+			Name: fmt.Sprintf("foo/bar/%d", i),
+			QoS:  mqtt.QoS(i % 3),
+		})
+	}
+	b, err := sub.MarshalBinary()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	// Remaining length exceeds 127 bytes
+	assert.NotZero(t, b[1]&0x80)
+
+	r := iotest.OneByteReader(bytes.NewReader(b[1:]))
+	decoded := &Subscribe{Version: mqtt.MQTTv311}
+	n, err := decoded.ReadFrom(r)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(b)-1), n)
+	assert.Equal(t, sub, decoded)
+}
+
+func TestSubscribeNoTopics(t *testing.T) {
+	sub := &Subscribe{
+		Version:          mqtt.MQTTv311,
+		PacketIdentifier: 1,
+	}
+	_, err := sub.MarshalBinary()
+	assert.EqualError(t, err, mqtt.ErrProtocolViolation.Error())
+
+	// Packet identifier without payload
+	_, err = new(Subscribe).ReadFrom(bytes.NewReader([]byte{2, 0, 1}))
+	assert.EqualError(t, err, mqtt.ErrProtocolViolation.Error())
+}
+
+func TestConnAckLayout(t *testing.T) {
+	// MQTT 3.1.1 section 3.2: the connect acknowledge flags (bit 0:
+	// session present) precede the connect return code.
+	testCases := []struct {
+		ConnAck  ConnAck
+		Expected []byte
+	}{{
+		ConnAck: ConnAck{
+			Version:    mqtt.MQTTv311,
+			ReturnCode: ConnAckAccepted,
+		},
+		Expected: []byte{0x20, 0x02, 0x00, 0x00},
+	}, {
+		ConnAck: ConnAck{
+			Version:        mqtt.MQTTv311,
+			SessionPresent: true,
+			ReturnCode:     ConnAckAccepted,
+		},
+		Expected: []byte{0x20, 0x02, 0x01, 0x00},
+	}, {
+		ConnAck: ConnAck{
+			Version:    mqtt.MQTTv311,
+			ReturnCode: ConnAckUnauthorized,
+		},
+		Expected: []byte{0x20, 0x02, 0x00, 0x05},
+	}, {
+		ConnAck: ConnAck{
+			Version:        mqtt.MQTTv5,
+			SessionPresent: true,
+			ReturnCode:     0x87,
+		},
+		Expected: []byte{0x20, 0x03, 0x01, 0x87, 0x00},
+	}}
+	for _, tc := range testCases {
+		b, err := tc.ConnAck.MarshalBinary()
+		if !assert.NoError(t, err) {
+			continue
+		}
+		assert.Equal(t, tc.Expected, b)
+
+		buf := bytes.NewBuffer(b)
+		bufIO := NewPacketIO(
+			NewBufferConn(buf), tc.ConnAck.Version, time.Duration(0),
+		)
+		p, err := bufIO.Recv()
+		if assert.NoError(t, err) {
+			assert.Equal(t, &tc.ConnAck, p)
+		}
+	}
+}
+
+func TestConnAckV5(t *testing.T) {
+	buf := &bytes.Buffer{}
+	conn := NewBufferConn(buf)
+	bufIO := NewPacketIO(conn, mqtt.MQTTv5, time.Duration(0))
+	connAck := &ConnAck{
+		Version:        mqtt.MQTTv5,
+		SessionPresent: true,
+		ReturnCode:     uint8(mqtt.ConnAckQuotaExceeded),
+	}
+	err := bufIO.Send(connAck)
+	assert.NoError(t, err)
+	p, err := bufIO.Recv()
+	assert.NoError(t, err)
+	assert.Equal(t, connAck, p)
+
+	maxQoS := mqtt.QoS1
+	keepAlive := uint16(0)
+	connAck = &ConnAck{
+		Version:                mqtt.MQTTv5,
+		SessionExpiryInterval:  3600,
+		ReceiveMax:             10,
+		MaxQoS:                 &maxQoS,
+		RetainUnavailable:      true,
+		MaxPacketSize:          1024,
+		AssignedClientID:       "assigned",
+		TopicAliasMax:          5,
+		ReasonString:           "welcome",
+		UserProperties:         []mqtt.UserProperty{{Key: "k", Value: "v"}},
+		WildcardSubUnavailable: true,
+		SubIDUnavailable:       true,
+		SharedSubUnavailable:   true,
+		ServerKeepAlive:        &keepAlive,
+		ResponseInfo:           "rsp/",
+		ServerReference:        "other.server",
+		AuthMethod:             "SCRAM-SHA-1",
+		AuthData:               []byte("data"),
+	}
+	err = bufIO.Send(connAck)
+	assert.NoError(t, err)
+	p, err = bufIO.Recv()
+	assert.NoError(t, err)
+	assert.Equal(t, connAck, p)
+
+	buf.Write([]byte{cmdConnAck, 6, 0, 0, 3, 0x22, 0, 10})
+	p, err = bufIO.Recv()
+	assert.NoError(t, err)
+	assert.Equal(t, &ConnAck{Version: mqtt.MQTTv5, TopicAliasMax: 10}, p)
+
+	// Property length exceeding remaining length
+	buf.Reset()
+	buf.Write([]byte{cmdConnAck, 4, 0, 0, 3, 0x24})
+	_, err = bufIO.Recv()
+	assert.EqualError(t, err, mqtt.ErrPacketShort.Error())
+
+	// Truncated properties
+	buf.Reset()
+	buf.Write([]byte{cmdConnAck, 6, 0, 0, 3, 0x22})
+	_, err = bufIO.Recv()
+	assert.EqualError(t, err, io.ErrUnexpectedEOF.Error())
+}
+
+func TestPublishJSON(t *testing.T) {
+	pub := &Publish{
+		Version: mqtt.MQTTv5,
+		Topic: mqtt.Topic{
+			Name: "foo/bar",
+			QoS:  mqtt.QoS2,
+		},
+		Duplicate:        true,
+		Retain:           true,
+		PacketIdentifier: 42,
+		ContentType:      "application/octet-stream",
+		ResponseTopic:    "foo/response",
+		CorrelationData:  []byte{0xDE, 0xAD},
+		UserProperties:   []mqtt.UserProperty{{Key: "k", Value: "v"}},
+		Payload:          []byte{0x00, 0xFF, 0x80, 0x7F},
+	}
+	b, err := json.Marshal(pub)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	// Binary fields are base64 encoded.
+	assert.Contains(t, string(b), `"Payload":"AP+Afw=="`)
+	assert.Contains(t, string(b), `"type":"PUBLISH"`)
+
+	var decoded Publish
+	err = json.Unmarshal(b, &decoded)
+	assert.NoError(t, err)
+	assert.Equal(t, pub, &decoded)
+
+	packet, err := UnmarshalJSONPacket(b)
+	assert.NoError(t, err)
+	assert.Equal(t, pub, packet)
+
+	// Type mismatch
+	var sub Subscribe
+	err = json.Unmarshal(b, &sub)
+	assert.Error(t, err)
+}
+
+func TestConnectJSONRedacted(t *testing.T) {
+	connect := &Connect{
+		Version:    mqtt.MQTTv5,
+		ClientID:   "client",
+		Username:   "user",
+		Password:   "secret",
+		AuthMethod: "SCRAM-SHA-1",
+		AuthData:   []byte("token"),
+	}
+	b, err := json.Marshal(connect)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.NotContains(t, string(b), "secret")
+	assert.NotContains(t, string(b), "dG9rZW4=") // base64("token")
+	// The packet is left untouched.
+	assert.Equal(t, "secret", connect.Password)
+
+	packet, err := UnmarshalJSONPacket(b)
+	assert.NoError(t, err)
+	assert.Equal(t, &Connect{
+		Version:    mqtt.MQTTv5,
+		ClientID:   "client",
+		Username:   "user",
+		AuthMethod: "SCRAM-SHA-1",
+	}, packet)
+}
+
+func TestPacketType(t *testing.T) {
+	testCases := []struct {
+		Packet Packet
+		Type   PacketType
+		Name   string
+	}{
+		{&Connect{Version: mqtt.MQTTv311, ClientID: "foo"}, TypeConnect, "CONNECT"},
+		{&ConnAck{Version: mqtt.MQTTv311}, TypeConnAck, "CONNACK"},
+		{&Publish{
+			Version: mqtt.MQTTv311,
+			Topic:   mqtt.Topic{Name: "foo"},
+		}, TypePublish, "PUBLISH"},
+		{&PubAck{Version: mqtt.MQTTv311}, TypePubAck, "PUBACK"},
+		{&PubRec{Version: mqtt.MQTTv311}, TypePubRec, "PUBREC"},
+		{&PubRel{Version: mqtt.MQTTv311}, TypePubRel, "PUBREL"},
+		{&PubComp{Version: mqtt.MQTTv311}, TypePubComp, "PUBCOMP"},
+		{&Subscribe{
+			Version: mqtt.MQTTv311,
+			Topics:  []mqtt.Topic{{Name: "foo"}},
+		}, TypeSubscribe, "SUBSCRIBE"},
+		{&SubAck{
+			Version:     mqtt.MQTTv311,
+			ReturnCodes: []uint8{0},
+		}, TypeSubAck, "SUBACK"},
+		{&Unsubscribe{
+			Version: mqtt.MQTTv311,
+			Topics:  []string{"foo"},
+		}, TypeUnsubscribe, "UNSUBSCRIBE"},
+		{&UnsubAck{Version: mqtt.MQTTv311}, TypeUnsubAck, "UNSUBACK"},
+		{&PingReq{Version: mqtt.MQTTv311}, TypePingReq, "PINGREQ"},
+		{&PingResp{Version: mqtt.MQTTv311}, TypePingResp, "PINGRESP"},
+		{&Disconnect{Version: mqtt.MQTTv311}, TypeDisconnect, "DISCONNECT"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			assert.Equal(t, tc.Type, tc.Packet.Type())
+			assert.Equal(t, tc.Name, tc.Type.String())
+			b, err := tc.Packet.MarshalBinary()
+			if assert.NoError(t, err) {
+				assert.Equal(t, tc.Type, PacketType(b[0]&0xF0))
+			}
+		})
+	}
+	assert.Equal(t, "PacketType(0xF0)", PacketType(0xF0).String())
+}
@@ -0,0 +1,269 @@
+package packets
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/alfrunes/mqttie/mqtt"
+	"github.com/alfrunes/mqttie/x/util"
+)
+
+// propType is the data type of a property value.
+type propType uint8
+
+const (
+	propTypeByte propType = iota
+	propTypeUint16
+	propTypeUint32
+	propTypeVarint
+	propTypeString
+	propTypeBinary
+	propTypeStringPair
+)
+
+// propUserProperty is the identifier of the user property, which is common
+// to all packets carrying properties.
+const propUserProperty uint8 = 0x26
+
+// propTypes maps the MQTTv5 property identifiers to the type of the value;
+// the type of a property is the same regardless of the packet carrying it.
+var propTypes = map[uint8]propType{
+	0x01: propTypeByte,       // Payload format indicator
+	0x02: propTypeUint32,     // Message expiry interval
+	0x03: propTypeString,     // Content type
+	0x08: propTypeString,     // Response topic
+	0x09: propTypeBinary,     // Correlation data
+	0x0B: propTypeVarint,     // Subscription identifier
+	0x11: propTypeUint32,     // Session expiry interval
+	0x12: propTypeString,     // Assigned client identifier
+	0x13: propTypeUint16,     // Server keep alive
+	0x15: propTypeString,     // Authentication method
+	0x16: propTypeBinary,     // Authentication data
+	0x17: propTypeByte,       // Request problem information
+	0x18: propTypeUint32,     // Will delay interval
+	0x19: propTypeByte,       // Request response information
+	0x1A: propTypeString,     // Response information
+	0x1C: propTypeString,     // Server reference
+	0x1F: propTypeString,     // Reason string
+	0x21: propTypeUint16,     // Receive maximum
+	0x22: propTypeUint16,     // Topic alias maximum
+	0x23: propTypeUint16,     // Topic alias
+	0x24: propTypeByte,       // Maximum QoS
+	0x25: propTypeByte,       // Retain available
+	0x26: propTypeStringPair, // User property
+	0x27: propTypeUint32,     // Maximum packet size
+	0x28: propTypeByte,       // Wildcard subscription available
+	0x29: propTypeByte,       // Subscription identifier available
+	0x2A: propTypeByte,       // Shared subscription available
+}
+
+// Property is a single MQTTv5 property. The dynamic type of Value is
+// determined by the property identifier: uint8, uint16, uint32 (four byte
+// and variable byte integers), string, []byte or mqtt.UserProperty.
+type Property struct {
+	ID    uint8
+	Value interface{}
+}
+
+// Properties is an ordered MQTTv5 property block. The encoding is prefixed
+// with the property length as a variable byte integer. As for the other
+// fields, strings and binary data are truncated to 65535 bytes.
+type Properties []Property
+
+// AddByte appends a byte property.
+func (p *Properties) AddByte(id uint8, v uint8) {
+	*p = append(*p, Property{ID: id, Value: v})
+}
+
+// AddUint16 appends a two byte integer property.
+func (p *Properties) AddUint16(id uint8, v uint16) {
+	*p = append(*p, Property{ID: id, Value: v})
+}
+
+// AddUint32 appends a four byte integer property.
+func (p *Properties) AddUint32(id uint8, v uint32) {
+	*p = append(*p, Property{ID: id, Value: v})
+}
+
+// AddVarint appends a variable byte integer property (i.e. the
+// subscription identifier).
+func (p *Properties) AddVarint(id uint8, v uint32) {
+	*p = append(*p, Property{ID: id, Value: v})
+}
+
+// AddString appends a UTF-8 string property.
+func (p *Properties) AddString(id uint8, v string) {
+	*p = append(*p, Property{ID: id, Value: v})
+}
+
+// AddBinary appends a binary data property.
+func (p *Properties) AddBinary(id uint8, v []byte) {
+	*p = append(*p, Property{ID: id, Value: v})
+}
+
+// AddUserProperty appends a user property.
+func (p *Properties) AddUserProperty(key, value string) {
+	*p = append(*p, Property{
+		ID:    propUserProperty,
+		Value: mqtt.UserProperty{Key: key, Value: value},
+	})
+}
+
+// Len returns the encoded length of the properties excluding the property
+// length prefix.
+func (p Properties) Len() int {
+	var length int
+	for _, prop := range p {
+		length++
+		switch v := prop.Value.(type) {
+		case uint8:
+			length++
+		case uint16:
+			length += 2
+		case uint32:
+			if propTypes[prop.ID] == propTypeVarint {
+				length += util.GetUvarintLen(uint64(v))
+			} else {
+				length += 4
+			}
+		case string:
+			length += int(uint16(len(v))) + 2
+		case []byte:
+			length += int(uint16(len(v))) + 2
+		case mqtt.UserProperty:
+			length += int(uint16(len(v.Key))) + 2
+			length += int(uint16(len(v.Value))) + 2
+		}
+	}
+	return length
+}
+
+// Size returns the encoded length of the block including the property
+// length prefix.
+func (p Properties) Size() int {
+	length := p.Len()
+	return length + util.GetUvarintLen(uint64(length))
+}
+
+// MarshalTo encodes the property length followed by the properties to b
+// and returns the number of bytes written. b must hold at least Size bytes.
+func (p Properties) MarshalTo(b []byte) int {
+	i := binary.PutUvarint(b, uint64(p.Len()))
+	for _, prop := range p {
+		b[i] = prop.ID
+		i++
+		switch v := prop.Value.(type) {
+		case uint32:
+			if propTypes[prop.ID] == propTypeVarint {
+				i += binary.PutUvarint(b[i:], uint64(v))
+			} else {
+				i += util.EncodeValue(b[i:], v)
+			}
+		case mqtt.UserProperty:
+			i += util.EncodeValue(b[i:], v.Key)
+			i += util.EncodeValue(b[i:], v.Value)
+		default:
+			i += util.EncodeValue(b[i:], v)
+		}
+	}
+	return i
+}
+
+// ReadFrom reads the property length and the properties from r, appending
+// them to p. Unknown property identifiers are a protocol error.
+func (p *Properties) ReadFrom(r io.Reader) (n int64, err error) {
+	propLen, N, err := util.ReadVarint(r)
+	n = int64(N)
+	if err != nil {
+		return n, err
+	}
+	N, err = p.read(r, propLen)
+	n += int64(N)
+	return n, err
+}
+
+// readBlock reads the property length and the properties like ReadFrom,
+// checking that the block fits within the maxLen bytes left of the packet.
+func (p *Properties) readBlock(r io.Reader, maxLen int) (n int, err error) {
+	propLen, n, err := util.ReadVarint(r)
+	if err != nil {
+		return n, err
+	} else if propLen > maxLen-n {
+		return n, mqtt.ErrPacketShort
+	}
+	N, err := p.read(r, propLen)
+	n += N
+	return n, err
+}
+
+func (p *Properties) read(r io.Reader, propLen int) (n int, err error) {
+	var N int
+	for n < propLen {
+		var propID uint8
+		N, err = util.ReadValue(r, &propID, propLen-n)
+		n += N
+		if err != nil {
+			return n, err
+		}
+		t, ok := propTypes[propID]
+		if !ok {
+			return n, fmt.Errorf(
+				"protocol error: illegal property ID: %02X",
+				propID,
+			)
+		}
+		var value interface{}
+		switch t {
+		case propTypeByte:
+			var v uint8
+			N, err = util.ReadValue(r, &v, propLen-n)
+			value = v
+		case propTypeUint16:
+			var v uint16
+			N, err = util.ReadValue(r, &v, propLen-n)
+			value = v
+		case propTypeUint32:
+			var v uint32
+			N, err = util.ReadValue(r, &v, propLen-n)
+			value = v
+		case propTypeVarint:
+			var v int
+			v, N, err = util.ReadVarint(r)
+			if err == nil && N > propLen-n {
+				err = mqtt.ErrPacketShort
+			}
+			value = uint32(v)
+		case propTypeString:
+			var v string
+			N, err = util.ReadValue(r, &v, propLen-n)
+			value = v
+		case propTypeBinary:
+			var v []byte
+			N, err = util.ReadValue(r, &v, propLen-n)
+			value = v
+		case propTypeStringPair:
+			value, N, err = readUserProperty(r, propLen-n)
+		}
+		n += N
+		if err != nil {
+			return n, err
+		}
+		*p = append(*p, Property{ID: propID, Value: value})
+	}
+	return n, err
+}
+
+// readUserProperty reads a single user property key/value pair (minus the
+// property identifier) from r.
+func readUserProperty(
+	r io.Reader, maxLen int,
+) (prop mqtt.UserProperty, n int, err error) {
+	n, err = util.ReadValue(r, &prop.Key, maxLen)
+	if err != nil {
+		return prop, n, err
+	}
+	N, err := util.ReadValue(r, &prop.Value, maxLen-n)
+	n += N
+	return prop, n, err
+}
@@ -0,0 +1,170 @@
+package packets
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/alfrunes/mqttie/mqtt"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProperties(t *testing.T) {
+	testCases := []struct {
+		Name  string
+		Props func(p *Properties)
+		Bytes []byte
+	}{{
+		Name:  "Empty",
+		Props: func(p *Properties) {},
+		Bytes: []byte{0x00},
+	}, {
+		Name: "Byte",
+		Props: func(p *Properties) {
+			p.AddByte(0x01, 0x01)
+		},
+		Bytes: []byte{0x02, 0x01, 0x01},
+	}, {
+		Name: "Uint16",
+		Props: func(p *Properties) {
+			p.AddUint16(0x21, 0x1234)
+		},
+		Bytes: []byte{0x03, 0x21, 0x12, 0x34},
+	}, {
+		Name: "Uint32",
+		Props: func(p *Properties) {
+			p.AddUint32(0x11, 0x12345678)
+		},
+		Bytes: []byte{0x05, 0x11, 0x12, 0x34, 0x56, 0x78},
+	}, {
+		Name: "Varint",
+		Props: func(p *Properties) {
+			p.AddVarint(0x0B, 321)
+		},
+		Bytes: []byte{0x03, 0x0B, 0xC1, 0x02},
+	}, {
+		Name: "String",
+		Props: func(p *Properties) {
+			p.AddString(0x03, "text")
+		},
+		Bytes: []byte{0x07, 0x03, 0x00, 0x04, 't', 'e', 'x', 't'},
+	}, {
+		Name: "Binary",
+		Props: func(p *Properties) {
+			p.AddBinary(0x09, []byte{0xDE, 0xAD})
+		},
+		Bytes: []byte{0x05, 0x09, 0x00, 0x02, 0xDE, 0xAD},
+	}, {
+		Name: "User property",
+		Props: func(p *Properties) {
+			p.AddUserProperty("k", "v")
+		},
+		Bytes: []byte{0x07, 0x26, 0x00, 0x01, 'k', 0x00, 0x01, 'v'},
+	}, {
+		Name: "Ordered",
+		Props: func(p *Properties) {
+			p.AddUserProperty("k", "1")
+			p.AddByte(0x24, 0x01)
+			p.AddUserProperty("k", "2")
+		},
+		Bytes: []byte{
+			0x10,
+			0x26, 0x00, 0x01, 'k', 0x00, 0x01, '1',
+			0x24, 0x01,
+			0x26, 0x00, 0x01, 'k', 0x00, 0x01, '2',
+		},
+	}}
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			var props Properties
+			tc.Props(&props)
+			assert.Equal(t, len(tc.Bytes), props.Size())
+			b := make([]byte, props.Size())
+			n := props.MarshalTo(b)
+			assert.Equal(t, len(b), n)
+			assert.Equal(t, tc.Bytes, b)
+
+			var recv Properties
+			N, err := recv.ReadFrom(bytes.NewReader(tc.Bytes))
+			assert.NoError(t, err)
+			assert.Equal(t, int64(len(tc.Bytes)), N)
+			assert.Equal(t, len(props), len(recv))
+			for i := range recv {
+				assert.Equal(t, props[i], recv[i])
+			}
+		})
+	}
+}
+
+func TestPropertiesLongVarint(t *testing.T) {
+	// The property length spans two bytes.
+	var props Properties
+	props.AddBinary(0x16, make([]byte, 200))
+	b := make([]byte, props.Size())
+	props.MarshalTo(b)
+	assert.Equal(t, []byte{0xCB, 0x01, 0x16, 0x00, 0xC8}, b[:5])
+
+	var recv Properties
+	N, err := recv.ReadFrom(bytes.NewReader(b))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(b)), N)
+	assert.Equal(t, props, recv)
+}
+
+func TestPropertiesReadError(t *testing.T) {
+	testCases := []struct {
+		Name  string
+		Bytes []byte
+		Error error
+	}{{
+		Name:  "Unknown property",
+		Bytes: []byte{0x02, 0x7F, 0x00},
+	}, {
+		Name:  "Value exceeds length",
+		Bytes: []byte{0x03, 0x11, 0x00, 0x00, 0x00, 0x00},
+		Error: mqtt.ErrPacketShort,
+	}, {
+		Name:  "String exceeds length",
+		Bytes: []byte{0x04, 0x03, 0x00, 0x04, 't', 'e', 'x', 't'},
+		Error: mqtt.ErrPacketShort,
+	}, {
+		Name:  "Truncated",
+		Bytes: []byte{0x05, 0x11, 0x00},
+	}}
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			var props Properties
+			_, err := props.ReadFrom(bytes.NewReader(tc.Bytes))
+			if tc.Error != nil {
+				assert.Equal(t, tc.Error, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestPacketPropertiesIllegal(t *testing.T) {
+	// A valid property not allowed in the packet (topic alias).
+	disconnect := &Disconnect{Version: mqtt.MQTTv5}
+	_, err := disconnect.ReadFrom(
+		bytes.NewReader([]byte{0x05, 0x00, 0x03, 0x23, 0x00, 0x01}),
+	)
+	assert.Error(t, err)
+
+	connAck := &ConnAck{Version: mqtt.MQTTv5}
+	_, err = connAck.ReadFrom(
+		bytes.NewReader([]byte{0x06, 0x00, 0x00, 0x03, 0x23, 0x00, 0x01}),
+	)
+	assert.Error(t, err)
+
+	publish := &Publish{Version: mqtt.MQTTv5}
+	_, err = publish.ReadFrom(bytes.NewReader(
+		[]byte{0x08, 0x00, 0x01, 'a', 0x03, 0x13, 0x00, 0x01, 'x'},
+	))
+	assert.Error(t, err)
+	_, err = publish.ReadFrom(bytes.NewReader(
+		[]byte{0x08, 0x00, 0x01, 'a', 0x03, 0x23, 0x00, 0x01, 'x'},
+	))
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(1), publish.TopicAlias)
+}
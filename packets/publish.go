@@ -2,6 +2,7 @@ package packets
 
 import (
 	"encoding/binary"
+	"fmt"
 	"io"
 
 	"github.com/alfrunes/mqttie/mqtt"
@@ -18,6 +19,18 @@ const (
 	// Flags
 	PublishFlagDuplicate uint8 = 0x08
 	PublishFlagRetain    uint8 = 0x01
+
+	pubPropFormatUTF8      uint8 = 0x01
+	pubPropMessageExpiry   uint8 = 0x02
+	pubPropContentType     uint8 = 0x03
+	pubPropResponseTopic   uint8 = 0x08
+	pubPropCorrelationData uint8 = 0x09
+	pubPropSubscriptionID  uint8 = 0x0B
+	pubPropTopicAlias      uint8 = 0x23
+	pubPropUserProperty    uint8 = 0x26
+
+	pubAckPropReasonString uint8 = 0x1F
+	pubAckPropUserProperty uint8 = 0x26
 )
 
 type Publish struct {
@@ -31,14 +44,83 @@ type Publish struct {
 	// Variable header
 	PacketIdentifier uint16
 
+	// The following parameters applies only to Version == MQTTv5
+
+	// FormatUTF8 notifies the receiver that the payload is UTF-8 encoded
+	// character data, otherwise the payload is treated as a stream of
+	// bytes (default).
+	FormatUTF8 bool
+	// MessageExpiry is the lifetime of the message in seconds (defaults
+	// to 0: does not expire).
+	MessageExpiry uint32
+	// ContentType provides a string content-type descriptor of the
+	// payload (unset by default).
+	ContentType string
+	// ResponseTopic is the topic the receiver should publish responses
+	// to, enabling request/response interaction (defaults to none).
+	ResponseTopic string
+	// CorrelationData is used by the sender of a request message to
+	// identify which request the response message is for.
+	CorrelationData []byte
+	// TopicAlias is an integer value identifying the topic instead of
+	// the topic name. A publish carrying both a topic name and alias
+	// establishes the mapping for following publishes that only carries
+	// the alias (defaults to 0: unset).
+	TopicAlias uint16
+	// UserProperties are user defined key/value pairs attached to the
+	// message, forwarded unaltered by the server.
+	UserProperties []mqtt.UserProperty
+
 	Payload []byte
 }
 
+// PubAck reason codes (MQTTv5)
+const (
+	PubAckSuccess               uint8 = 0x00
+	PubAckNoMatchingSubscribers uint8 = 0x10
+	PubAckUnspecifiedError      uint8 = 0x80
+	PubAckImplementationError   uint8 = 0x83
+	PubAckNotAuthorized         uint8 = 0x87
+	PubAckTopicNameInvalid      uint8 = 0x90
+	PubAckPacketIdentifierInUse uint8 = 0x91
+	PubAckQuotaExceeded         uint8 = 0x97
+	PubAckPayloadFormatInvalid  uint8 = 0x99
+)
+
+// PubRec reason codes (MQTTv5)
+const (
+	PubRecSuccess               uint8 = 0x00
+	PubRecNoMatchingSubscribers uint8 = 0x10
+	PubRecUnspecifiedError      uint8 = 0x80
+	PubRecQuotaExceeded         uint8 = 0x97
+)
+
+// PubRel reason codes (MQTTv5)
+const (
+	PubRelSuccess                  uint8 = 0x00
+	PubRelPacketIdentifierNotFound uint8 = 0x92
+)
+
+// PubComp reason codes (MQTTv5)
+const (
+	PubCompSuccess                  uint8 = 0x00
+	PubCompPacketIdentifierNotFound uint8 = 0x92
+)
+
 type PubAck struct {
 	Version mqtt.Version
 
 	// Variable header
 	PacketIdentifier uint16
+
+	// The following parameters applies only to Version == MQTTv5
+
+	// ReasonCode holds the result of the publish (defaults to 0:
+	// success). A reason code of 0x80 or greater means the message was
+	// rejected.
+	ReasonCode uint8
+	// ReasonString is a human readable string describing the reason code.
+	ReasonString string
 }
 
 type PubRec struct {
@@ -46,6 +128,12 @@ type PubRec struct {
 
 	// Variable header
 	PacketIdentifier uint16
+
+	// The following parameters applies only to Version == MQTTv5
+
+	// ReasonCode holds the result of the receipt (defaults to 0:
+	// success). A reason code of 0x80 or greater aborts the flow.
+	ReasonCode uint8
 }
 
 type PubRel struct {
@@ -53,6 +141,12 @@ type PubRel struct {
 
 	// Variable header
 	PacketIdentifier uint16
+
+	// The following parameters applies only to Version == MQTTv5
+
+	// ReasonCode holds the result of the release (defaults to 0:
+	// success).
+	ReasonCode uint8
 }
 
 type PubComp struct {
@@ -60,11 +154,50 @@ type PubComp struct {
 
 	// Variable header
 	PacketIdentifier uint16
+
+	// The following parameters applies only to Version == MQTTv5
+
+	// ReasonCode holds the result of the completion (defaults to 0:
+	// success).
+	ReasonCode uint8
+}
+
+// properties returns the properties of the variable header.
+func (p *Publish) properties() Properties {
+	var props Properties
+	if p.FormatUTF8 {
+		props.AddByte(pubPropFormatUTF8, 0x01)
+	}
+	if p.MessageExpiry > 0 {
+		props.AddUint32(pubPropMessageExpiry, p.MessageExpiry)
+	}
+	if p.ContentType != "" {
+		props.AddString(pubPropContentType, p.ContentType)
+	}
+	if p.ResponseTopic != "" {
+		props.AddString(pubPropResponseTopic, p.ResponseTopic)
+	}
+	if p.CorrelationData != nil {
+		props.AddBinary(pubPropCorrelationData, p.CorrelationData)
+	}
+	if p.TopicAlias > 0 {
+		props.AddUint16(pubPropTopicAlias, p.TopicAlias)
+	}
+	for _, prop := range p.UserProperties {
+		props.AddUserProperty(prop.Key, prop.Value)
+	}
+	return props
 }
 
 func (p *Publish) MarshalBinary() (b []byte, err error) {
 	var buf [4]byte
 	var i int
+	var props Properties
+	if p.Topic.Name == "" &&
+		(p.Version < mqtt.MQTTv5 || p.TopicAlias == 0) {
+		// The topic name may only be empty if a topic alias is used.
+		return nil, mqtt.ErrProtocolViolation
+	}
 	fixedHeader := cmdPublish
 	if p.Duplicate {
 		fixedHeader |= PublishFlagDuplicate
@@ -78,10 +211,15 @@ func (p *Publish) MarshalBinary() (b []byte, err error) {
 	// Remaining length = len(utf-8(topicName))
 	//                  + len(payload)
 	//                  + (qos > 0 ) ? len(packet id) : 0
+	//                  + (v5) ? len(properties) : 0
 	remLength := uint32(len(p.Topic.Name) + 2 + len(p.Payload))
 	if p.Topic.QoS > 0 {
 		remLength += 2
 	}
+	if p.Version >= mqtt.MQTTv5 {
+		props = p.properties()
+		remLength += uint32(props.Size())
+	}
 
 	n, err := util.EncodeUvarint(buf[:], remLength)
 	if err != nil {
@@ -106,6 +244,9 @@ func (p *Publish) MarshalBinary() (b []byte, err error) {
 		binary.BigEndian.PutUint16(b[i:], p.PacketIdentifier)
 		i += 2
 	}
+	if p.Version >= mqtt.MQTTv5 {
+		i += props.MarshalTo(b[i:])
+	}
 	copy(b[i:], p.Payload)
 	return b, err
 }
@@ -136,33 +277,190 @@ func (p *Publish) ReadFrom(r io.Reader) (n int64, err error) {
 	length -= N
 	if err != nil {
 		return n, err
-	} else if length <= 0 {
+	} else if length < 0 {
+		// NOTE: payload can be zero length
 		return n, mqtt.ErrPacketShort
 	}
 	if p.QoS > 0 {
-		N, err = r.Read(buf[:])
+		if length < len(buf) {
+			// No room for the packet identifier; do not read
+			// past the packet.
+			return n, mqtt.ErrPacketShort
+		}
+		N, err = io.ReadFull(r, buf[:])
 		length -= N
 		n += int64(N)
 		if err != nil {
 			return n, err
-		} else if length < 0 {
-			// NOTE: payload can be zero length
-			return n, mqtt.ErrPacketShort
 		}
 		p.PacketIdentifier = binary.BigEndian.Uint16(buf[:])
+		if p.PacketIdentifier == 0 {
+			return n, mqtt.ErrProtocolViolation
+		}
+	}
+	if p.Version >= mqtt.MQTTv5 {
+		var propLen int
+		propLen, N, err = util.ReadVarint(r)
+		n += int64(N)
+		length -= N
+		if err != nil {
+			return n, err
+		} else if length < propLen {
+			return n, mqtt.ErrPacketShort
+		}
+		var props Properties
+		N, err = props.read(r, propLen)
+		n += int64(N)
+		length -= N
+		if err != nil {
+			return n, err
+		}
+		if err = p.setProperties(props); err != nil {
+			return n, err
+		}
 	}
+	if p.Topic.Name == "" && p.TopicAlias == 0 {
+		// The topic name may only be empty if a topic alias is used.
+		return n, mqtt.ErrProtocolViolation
+	}
+	// A zero-length payload is valid, e.g. to clear a retained message.
 	p.Payload = make([]byte, length)
-	N, err = r.Read(p.Payload)
+	N, err = io.ReadFull(r, p.Payload)
 	n += int64(N)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
 	return n, err
 }
 
+// setProperties assigns the properties of the variable header.
+func (p *Publish) setProperties(props Properties) error {
+	for _, prop := range props {
+		switch prop.ID {
+		case pubPropFormatUTF8:
+			p.FormatUTF8 = prop.Value.(uint8) == 1
+		case pubPropMessageExpiry:
+			p.MessageExpiry = prop.Value.(uint32)
+		case pubPropContentType:
+			p.ContentType = prop.Value.(string)
+		case pubPropResponseTopic:
+			p.ResponseTopic = prop.Value.(string)
+		case pubPropCorrelationData:
+			p.CorrelationData = prop.Value.([]byte)
+		case pubPropSubscriptionID:
+			// Subscription identifiers are not supported;
+			// discard the value.
+		case pubPropTopicAlias:
+			p.TopicAlias = prop.Value.(uint16)
+		case pubPropUserProperty:
+			p.UserProperties = append(
+				p.UserProperties,
+				prop.Value.(mqtt.UserProperty),
+			)
+		default:
+			return fmt.Errorf(
+				"protocol error: illegal property ID: %02X",
+				prop.ID,
+			)
+		}
+	}
+	return nil
+}
+
+// marshalAck encodes a PUBACK, PUBREC, PUBREL or PUBCOMP. The reason code
+// and the properties are omitted unless the version is MQTTv5 and the
+// reason code is not success or there are properties.
+func marshalAck(
+	cmd uint8, version mqtt.Version,
+	packetID uint16, reasonCode uint8, props Properties,
+) []byte {
+	if version < mqtt.MQTTv5 || (reasonCode == 0 && len(props) == 0) {
+		b := []byte{cmd, 2, 0, 0}
+		binary.BigEndian.PutUint16(b[2:], packetID)
+		return b
+	}
+	// Remaining length = packet id + reason code + len(properties)
+	remLen := 3
+	if len(props) > 0 {
+		remLen += props.Size()
+	}
+	b := make([]byte, 1+util.GetUvarintLen(uint64(remLen))+remLen)
+	b[0] = cmd
+	i := 1
+	i += binary.PutUvarint(b[i:], uint64(remLen))
+	binary.BigEndian.PutUint16(b[i:], packetID)
+	i += 2
+	b[i] = reasonCode
+	i++
+	if len(props) > 0 {
+		props.MarshalTo(b[i:])
+	}
+	return b
+}
+
+// readAck reads the remainder of a PUBACK, PUBREC, PUBREL or PUBCOMP: the
+// packet identifier followed, for MQTTv5, by the optional reason code and
+// properties. The properties may only be a reason string and user
+// properties.
+func readAck(r io.Reader, version mqtt.Version) (
+	packetID uint16, reasonCode uint8, props Properties,
+	n int64, err error,
+) {
+	var buf [2]byte
+	remLength, N, err := util.ReadVarint(r)
+	n = int64(N)
+	if err != nil {
+		return packetID, reasonCode, props, n, err
+	} else if remLength < 2 {
+		return packetID, reasonCode, props, n, mqtt.ErrPacketShort
+	} else if remLength > 2 && version < mqtt.MQTTv5 {
+		return packetID, reasonCode, props, n, mqtt.ErrPacketLong
+	}
+	N, err = io.ReadFull(r, buf[:])
+	n += int64(N)
+	if err != nil {
+		return packetID, reasonCode, props, n, err
+	}
+	packetID = binary.BigEndian.Uint16(buf[:])
+	if packetID == 0 {
+		err = mqtt.ErrProtocolViolation
+		return packetID, reasonCode, props, n, err
+	} else if remLength == 2 {
+		// Reason code omitted: success
+		return packetID, reasonCode, props, n, nil
+	}
+	N, err = util.ReadValue(r, &reasonCode, remLength-2)
+	n += int64(N)
+	if err != nil || remLength == 3 {
+		return packetID, reasonCode, props, n, err
+	}
+	N, err = props.readBlock(r, remLength-3)
+	n += int64(N)
+	if err != nil {
+		return packetID, reasonCode, props, n, err
+	}
+	for _, prop := range props {
+		switch prop.ID {
+		case pubAckPropReasonString, pubAckPropUserProperty:
+		default:
+			err = fmt.Errorf(
+				"protocol error: illegal property ID: %02X",
+				prop.ID,
+			)
+			return packetID, reasonCode, props, n, err
+		}
+	}
+	return packetID, reasonCode, props, n, nil
+}
+
 func (p *PubAck) MarshalBinary() (b []byte, err error) {
-	b = make([]byte, 4)
-	b[0] = cmdPubAck
-	b[1] = 2
-	binary.BigEndian.PutUint16(b[2:], p.PacketIdentifier)
-	return b, err
+	var props Properties
+	if p.ReasonString != "" {
+		props.AddString(pubAckPropReasonString, p.ReasonString)
+	}
+	return marshalAck(
+		cmdPubAck, p.Version, p.PacketIdentifier, p.ReasonCode, props,
+	), nil
 }
 
 func (p *PubAck) WriteTo(w io.Writer) (n int64, err error) {
@@ -172,32 +470,23 @@ func (p *PubAck) WriteTo(w io.Writer) (n int64, err error) {
 	return n, err
 }
 
+// ReadFrom reads the remainder of the acknowledgement from the stream. User
+// properties are discarded.
 func (p *PubAck) ReadFrom(r io.Reader) (n int64, err error) {
-	var buf [2]byte
-	N, err := r.Read(buf[:1])
-	n = int64(N)
-	if err != nil {
-		return n, err
-	} else if buf[0] < byte(2) {
-		return n, mqtt.ErrPacketShort
-	} else if buf[0] > byte(2) {
-		return n, mqtt.ErrPacketLong
-	}
-	N, err = r.Read(buf[:])
-	n += int64(N)
-	if err != nil {
-		return n, err
+	var props Properties
+	p.PacketIdentifier, p.ReasonCode, props, n, err = readAck(r, p.Version)
+	for _, prop := range props {
+		if prop.ID == pubAckPropReasonString {
+			p.ReasonString = prop.Value.(string)
+		}
 	}
-	p.PacketIdentifier = binary.BigEndian.Uint16(buf[:])
 	return n, err
 }
 
 func (p *PubRec) MarshalBinary() (b []byte, err error) {
-	b = make([]byte, 4)
-	b[0] = cmdPubRec
-	b[1] = 2
-	binary.BigEndian.PutUint16(b[2:], p.PacketIdentifier)
-	return b, err
+	return marshalAck(
+		cmdPubRec, p.Version, p.PacketIdentifier, p.ReasonCode, nil,
+	), nil
 }
 
 func (p *PubRec) WriteTo(w io.Writer) (n int64, err error) {
@@ -207,35 +496,18 @@ func (p *PubRec) WriteTo(w io.Writer) (n int64, err error) {
 	return n, err
 }
 
+// ReadFrom reads the remainder of the PUBREC from the stream. The
+// properties (reason string and user properties) are discarded.
 func (p *PubRec) ReadFrom(r io.Reader) (n int64, err error) {
-	var buf [2]byte
-	N, err := r.Read(buf[:1])
-	n = int64(N)
-	if err != nil {
-		return n, err
-	} else if buf[0] < byte(2) {
-		return n, mqtt.ErrPacketShort
-	} else if buf[0] > byte(2) {
-		return n, mqtt.ErrPacketLong
-	}
-	N, err = r.Read(buf[:])
-	n += int64(N)
-	if err != nil {
-		return n, err
-	}
-	p.PacketIdentifier = binary.BigEndian.Uint16(buf[:])
+	p.PacketIdentifier, p.ReasonCode, _, n, err = readAck(r, p.Version)
 	return n, err
 }
 
 func (p *PubRel) MarshalBinary() (b []byte, err error) {
-	b = make([]byte, 4)
-	b[0] = cmdPubRel
-	if p.Version == mqtt.MQTTv311 {
-		b[0] |= 0x02
-	}
-	b[1] = 2
-	binary.BigEndian.PutUint16(b[2:], p.PacketIdentifier)
-	return b, err
+	return marshalAck(
+		cmdPubRel|flagsPubRel, p.Version,
+		p.PacketIdentifier, p.ReasonCode, nil,
+	), nil
 }
 
 func (p *PubRel) WriteTo(w io.Writer) (n int64, err error) {
@@ -245,32 +517,17 @@ func (p *PubRel) WriteTo(w io.Writer) (n int64, err error) {
 	return n, err
 }
 
+// ReadFrom reads the remainder of the PUBREL from the stream. The
+// properties (reason string and user properties) are discarded.
 func (p *PubRel) ReadFrom(r io.Reader) (n int64, err error) {
-	var buf [2]byte
-	N, err := r.Read(buf[:1])
-	n = int64(N)
-	if err != nil {
-		return n, err
-	} else if buf[0] < byte(2) {
-		return n, mqtt.ErrPacketShort
-	} else if buf[0] > byte(2) {
-		return n, mqtt.ErrPacketLong
-	}
-	N, err = r.Read(buf[:])
-	n += int64(N)
-	if err != nil {
-		return n, err
-	}
-	p.PacketIdentifier = binary.BigEndian.Uint16(buf[:])
+	p.PacketIdentifier, p.ReasonCode, _, n, err = readAck(r, p.Version)
 	return n, err
 }
 
 func (p *PubComp) MarshalBinary() (b []byte, err error) {
-	b = make([]byte, 4)
-	b[0] = cmdPubComp
-	b[1] = 2
-	binary.BigEndian.PutUint16(b[2:], p.PacketIdentifier)
-	return b, err
+	return marshalAck(
+		cmdPubComp, p.Version, p.PacketIdentifier, p.ReasonCode, nil,
+	), nil
 }
 
 func (p *PubComp) WriteTo(w io.Writer) (n int64, err error) {
@@ -280,22 +537,9 @@ func (p *PubComp) WriteTo(w io.Writer) (n int64, err error) {
 	return n, err
 }
 
+// ReadFrom reads the remainder of the PUBCOMP from the stream. The
+// properties (reason string and user properties) are discarded.
 func (p *PubComp) ReadFrom(r io.Reader) (n int64, err error) {
-	var buf [2]byte
-	N, err := r.Read(buf[:1])
-	n = int64(N)
-	if err != nil {
-		return n, err
-	} else if buf[0] < byte(2) {
-		return n, mqtt.ErrPacketShort
-	} else if buf[0] > byte(2) {
-		return n, mqtt.ErrPacketLong
-	}
-	N, err = r.Read(buf[:])
-	n += int64(N)
-	if err != nil {
-		return n, err
-	}
-	p.PacketIdentifier = binary.BigEndian.Uint16(buf[:])
+	p.PacketIdentifier, p.ReasonCode, _, n, err = readAck(r, p.Version)
 	return n, err
 }
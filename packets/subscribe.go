@@ -2,6 +2,7 @@ package packets
 
 import (
 	"encoding/binary"
+	"fmt"
 	"io"
 
 	"github.com/alfrunes/mqttie/mqtt"
@@ -13,13 +14,33 @@ const (
 	cmdSubAck      uint8 = 0x90
 	cmdUnsubscribe uint8 = 0xA0
 	cmdUnsubAck    uint8 = 0xB0
+
+	subPropSubscriptionID  uint8 = 0x0B
+	subPropUserProperty    uint8 = 0x26
+	subAckPropReasonString uint8 = 0x1F
+	subAckPropUserProperty uint8 = 0x26
+	unsubPropUserProperty  uint8 = 0x26
+
+	unsubAckPropReasonString uint8 = 0x1F
+	unsubAckPropUserProperty uint8 = 0x26
 )
 
+// SubAckFailure is the SubAck return code of a refused subscription.
+const SubAckFailure uint8 = 0x80
+
 type Subscribe struct {
 	Version mqtt.Version
 
 	PacketIdentifier uint16
 
+	// Properties (MQTTv5)
+
+	// SubscriptionID is passed back by the server with the publishes
+	// matching the subscription (defaults to 0: unset).
+	SubscriptionID uint32
+	// UserProperties are user defined key/value pairs.
+	UserProperties []mqtt.UserProperty
+
 	// Payload
 	Topics []mqtt.Topic
 }
@@ -29,6 +50,13 @@ type SubAck struct {
 
 	PacketIdentifier uint16
 
+	// Properties (MQTTv5)
+
+	// ReasonString is the (optional) human readable reason.
+	ReasonString string
+	// UserProperties are user defined key/value pairs.
+	UserProperties []mqtt.UserProperty
+
 	ReturnCodes []uint8
 }
 
@@ -37,26 +65,66 @@ type Unsubscribe struct {
 
 	PacketIdentifier uint16
 
+	// Properties (MQTTv5)
+
+	// UserProperties are user defined key/value pairs.
+	UserProperties []mqtt.UserProperty
+
 	Topics []string
 }
 
+// UnsubAck reason codes (MQTTv5)
+const (
+	UnsubAckSuccess               uint8 = 0x00
+	UnsubAckNoSubscriptionExisted uint8 = 0x11
+	UnsubAckUnspecifiedError      uint8 = 0x80
+	UnsubAckImplementationError   uint8 = 0x83
+	UnsubAckNotAuthorized         uint8 = 0x87
+	UnsubAckTopicFilterInvalid    uint8 = 0x8F
+	UnsubAckPacketIdentifierInUse uint8 = 0x91
+)
+
 type UnsubAck struct {
 	Version mqtt.Version
 
 	PacketIdentifier uint16
+
+	// The following parameters applies only to Version == MQTTv5
+
+	// ReasonString is the (optional) human readable reason.
+	ReasonString string
+	// UserProperties are user defined key/value pairs.
+	UserProperties []mqtt.UserProperty
+	// ReasonCodes holds the result of each topic filter in the order of
+	// the Unsubscribe request.
+	ReasonCodes []uint8
 }
 
 func (s *Subscribe) MarshalBinary() (b []byte, err error) {
+	if len(s.Topics) == 0 {
+		// A subscribe packet must contain at least one topic filter.
+		return nil, mqtt.ErrProtocolViolation
+	}
 	var buf [4]byte
 	var i int
 	var payloadLength int64
 	for _, topic := range s.Topics {
+		if len(topic.Name) > 0xFFFF {
+			// Exceeds the maximum length of an UTF-8 string.
+			return nil, mqtt.ErrPacketTooLarge
+		}
 		// Add length of utf-8 encoded topics + QoS byte
 		payloadLength += int64(len(topic.Name) + 3)
 	}
 
 	// Remaining length = payloadLength + len(packetIdentifier)
+	//                  + (v5) ? len(properties) : 0
 	remainingLength := payloadLength + 2
+	var props Properties
+	if s.Version >= mqtt.MQTTv5 {
+		props = s.properties()
+		remainingLength += int64(props.Size())
+	}
 	if remainingLength > int64(^uint32(0)) {
 		// Casting to uint32 overflows
 		return nil, mqtt.ErrPacketLong
@@ -66,12 +134,14 @@ func (s *Subscribe) MarshalBinary() (b []byte, err error) {
 		return nil, err
 	}
 	b = make([]byte, int(remainingLength)+N+1)
-	// FIXME: the flag section may change across versions
-	b[0] = cmdSubscribe | 0x02
+	b[0] = cmdSubscribe | flagsSubscribe
 	i++
 	i += copy(b[i:], buf[:N])
 	binary.BigEndian.PutUint16(b[i:], s.PacketIdentifier)
 	i += 2
+	if s.Version >= mqtt.MQTTv5 {
+		i += props.MarshalTo(b[i:])
+	}
 
 	// Payload
 	for _, topic := range s.Topics {
@@ -86,6 +156,39 @@ func (s *Subscribe) MarshalBinary() (b []byte, err error) {
 	return b, nil
 }
 
+// properties returns the properties of the variable header.
+func (s *Subscribe) properties() Properties {
+	var props Properties
+	if s.SubscriptionID > 0 {
+		props.AddVarint(subPropSubscriptionID, s.SubscriptionID)
+	}
+	for _, prop := range s.UserProperties {
+		props.AddUserProperty(prop.Key, prop.Value)
+	}
+	return props
+}
+
+// setProperties assigns the properties of the variable header.
+func (s *Subscribe) setProperties(props Properties) error {
+	for _, prop := range props {
+		switch prop.ID {
+		case subPropSubscriptionID:
+			s.SubscriptionID = prop.Value.(uint32)
+		case subPropUserProperty:
+			s.UserProperties = append(
+				s.UserProperties,
+				prop.Value.(mqtt.UserProperty),
+			)
+		default:
+			return fmt.Errorf(
+				"protocol error: illegal property ID: %02X",
+				prop.ID,
+			)
+		}
+	}
+	return nil
+}
+
 func (s *Subscribe) WriteTo(w io.Writer) (n int64, err error) {
 	buf, err := s.MarshalBinary()
 	if err != nil {
@@ -105,15 +208,34 @@ func (s *Subscribe) ReadFrom(r io.Reader) (n int64, err error) {
 	}
 	length := int(remLength)
 
-	N, err = r.Read(buf[:])
+	N, err = io.ReadFull(r, buf[:])
 	n += int64(N)
 	length -= N
 	if err != nil {
 		return n, err
-	} else if length <= 0 {
+	} else if length < 0 {
 		return n, mqtt.ErrPacketShort
 	}
 	s.PacketIdentifier = binary.BigEndian.Uint16(buf[:])
+	if s.PacketIdentifier == 0 {
+		return n, mqtt.ErrProtocolViolation
+	}
+	if s.Version >= mqtt.MQTTv5 {
+		var props Properties
+		N, err = props.readBlock(r, length)
+		n += int64(N)
+		length -= N
+		if err != nil {
+			return n, err
+		}
+		if err = s.setProperties(props); err != nil {
+			return n, err
+		}
+	}
+	if length == 0 {
+		// The payload must contain at least one topic filter.
+		return n, mqtt.ErrProtocolViolation
+	}
 
 	// Payload
 	s.Topics = []mqtt.Topic{}
@@ -125,7 +247,7 @@ func (s *Subscribe) ReadFrom(r io.Reader) (n int64, err error) {
 		if err != nil {
 			return n, err
 		}
-		N, err = r.Read(buf[:1])
+		N, err = io.ReadFull(r, buf[:1])
 		n += int64(N)
 		length -= N
 		if err != nil {
@@ -142,7 +264,12 @@ func (s *Subscribe) ReadFrom(r io.Reader) (n int64, err error) {
 func (s *SubAck) MarshalBinary() (b []byte, err error) {
 	var i int
 	var buf [4]byte
+	var props Properties
 	remLength := len(s.ReturnCodes) + 2
+	if s.Version >= mqtt.MQTTv5 {
+		props = s.properties()
+		remLength += props.Size()
+	}
 	n, err := util.EncodeUvarint(buf[:], uint32(remLength))
 	if err != nil {
 		return nil, err
@@ -157,6 +284,9 @@ func (s *SubAck) MarshalBinary() (b []byte, err error) {
 	// Variable header
 	binary.BigEndian.PutUint16(b[i:], s.PacketIdentifier)
 	i += 2
+	if s.Version >= mqtt.MQTTv5 {
+		i += props.MarshalTo(b[i:])
+	}
 
 	// Payload
 	for _, code := range s.ReturnCodes {
@@ -166,6 +296,39 @@ func (s *SubAck) MarshalBinary() (b []byte, err error) {
 	return b, err
 }
 
+// properties returns the properties of the variable header.
+func (s *SubAck) properties() Properties {
+	var props Properties
+	if s.ReasonString != "" {
+		props.AddString(subAckPropReasonString, s.ReasonString)
+	}
+	for _, prop := range s.UserProperties {
+		props.AddUserProperty(prop.Key, prop.Value)
+	}
+	return props
+}
+
+// setProperties assigns the properties of the variable header.
+func (s *SubAck) setProperties(props Properties) error {
+	for _, prop := range props {
+		switch prop.ID {
+		case subAckPropReasonString:
+			s.ReasonString = prop.Value.(string)
+		case subAckPropUserProperty:
+			s.UserProperties = append(
+				s.UserProperties,
+				prop.Value.(mqtt.UserProperty),
+			)
+		default:
+			return fmt.Errorf(
+				"protocol error: illegal property ID: %02X",
+				prop.ID,
+			)
+		}
+	}
+	return nil
+}
+
 func (s *SubAck) WriteTo(w io.Writer) (n int64, err error) {
 	b, err := s.MarshalBinary()
 	if err != nil {
@@ -184,7 +347,7 @@ func (s *SubAck) ReadFrom(r io.Reader) (n int64, err error) {
 	if err != nil {
 		return n, err
 	}
-	N, err = r.Read(buf[:])
+	N, err = io.ReadFull(r, buf[:])
 	n += int64(N)
 	if err != nil {
 		return n, err
@@ -192,9 +355,25 @@ func (s *SubAck) ReadFrom(r io.Reader) (n int64, err error) {
 		return n, mqtt.ErrPacketShort
 	}
 	s.PacketIdentifier = binary.BigEndian.Uint16(buf[:])
+	if s.PacketIdentifier == 0 {
+		return n, mqtt.ErrProtocolViolation
+	}
+	if s.Version >= mqtt.MQTTv5 {
+		var props Properties
+		N, err = props.readBlock(r, length)
+		n += int64(N)
+		length -= N
+		if err != nil {
+			return n, err
+		} else if err = s.setProperties(props); err != nil {
+			return n, err
+		} else if length <= 0 {
+			return n, mqtt.ErrPacketShort
+		}
+	}
 
 	s.ReturnCodes = make([]uint8, length)
-	N, err = r.Read(s.ReturnCodes)
+	N, err = io.ReadFull(r, s.ReturnCodes)
 	n += int64(N)
 	return n, err
 }
@@ -203,7 +382,16 @@ func (u *Unsubscribe) MarshalBinary() (b []byte, err error) {
 	var i int
 	var buf [4]byte
 	var remLength int = 2
+	var props Properties
+	if u.Version >= mqtt.MQTTv5 {
+		props = u.properties()
+		remLength += props.Size()
+	}
 	for _, topic := range u.Topics {
+		if len(topic) > 0xFFFF {
+			// Exceeds the maximum length of an UTF-8 string.
+			return nil, mqtt.ErrPacketTooLarge
+		}
 		remLength += len([]byte(topic)) + 2
 	}
 	n, err := util.EncodeUvarint(buf[:], uint32(remLength))
@@ -213,16 +401,16 @@ func (u *Unsubscribe) MarshalBinary() (b []byte, err error) {
 
 	b = make([]byte, n+remLength+1)
 	// Fixed header
-	b[0] = cmdUnsubscribe
-	if u.Version == mqtt.MQTTv311 {
-		b[0] |= 0x02
-	}
+	b[0] = cmdUnsubscribe | flagsUnsubscribe
 	i++
 
 	// Variable header
 	i += copy(b[i:], buf[:n])
 	binary.BigEndian.PutUint16(b[i:], u.PacketIdentifier)
 	i += 2
+	if u.Version >= mqtt.MQTTv5 {
+		i += props.MarshalTo(b[i:])
+	}
 
 	// Payload
 	for _, topic := range u.Topics {
@@ -253,7 +441,7 @@ func (u *Unsubscribe) ReadFrom(r io.Reader) (n int64, err error) {
 		return n, err
 	}
 	length := int(remLength)
-	N, err = r.Read(buf[:])
+	N, err = io.ReadFull(r, buf[:])
 	n += int64(N)
 	length -= N
 	if err != nil {
@@ -261,6 +449,24 @@ func (u *Unsubscribe) ReadFrom(r io.Reader) (n int64, err error) {
 	} else if length <= 0 {
 		return n, mqtt.ErrPacketShort
 	}
+	u.PacketIdentifier = binary.BigEndian.Uint16(buf[:])
+	if u.PacketIdentifier == 0 {
+		return n, mqtt.ErrProtocolViolation
+	}
+	if u.Version >= mqtt.MQTTv5 {
+		var props Properties
+		N, err = props.readBlock(r, length)
+		n += int64(N)
+		length -= N
+		if err != nil {
+			return n, err
+		} else if err = u.setProperties(props); err != nil {
+			return n, err
+		} else if length <= 0 {
+			// The payload must contain at least one topic filter.
+			return n, mqtt.ErrPacketShort
+		}
+	}
 
 	u.Topics = []string{}
 	for length > 0 {
@@ -277,12 +483,91 @@ func (u *Unsubscribe) ReadFrom(r io.Reader) (n int64, err error) {
 	return n, err
 }
 
+// properties returns the properties of the variable header.
+func (u *Unsubscribe) properties() Properties {
+	var props Properties
+	for _, prop := range u.UserProperties {
+		props.AddUserProperty(prop.Key, prop.Value)
+	}
+	return props
+}
+
+// setProperties assigns the properties of the variable header.
+func (u *Unsubscribe) setProperties(props Properties) error {
+	for _, prop := range props {
+		switch prop.ID {
+		case unsubPropUserProperty:
+			u.UserProperties = append(
+				u.UserProperties,
+				prop.Value.(mqtt.UserProperty),
+			)
+		default:
+			return fmt.Errorf(
+				"protocol error: illegal property ID: %02X",
+				prop.ID,
+			)
+		}
+	}
+	return nil
+}
+
 func (u *UnsubAck) MarshalBinary() (b []byte, err error) {
-	b = []byte{cmdUnsubAck, 2, 0, 0}
-	binary.BigEndian.PutUint16(b[2:], u.PacketIdentifier)
+	if u.Version < mqtt.MQTTv5 {
+		b = []byte{cmdUnsubAck, 2, 0, 0}
+		binary.BigEndian.PutUint16(b[2:], u.PacketIdentifier)
+		return b, nil
+	}
+	var buf [4]byte
+	props := u.properties()
+	remLength := 2 + props.Size() + len(u.ReasonCodes)
+	n, err := util.EncodeUvarint(buf[:], uint32(remLength))
+	if err != nil {
+		return nil, err
+	}
+	b = make([]byte, 1+n+remLength)
+	b[0] = cmdUnsubAck
+	i := 1
+	i += copy(b[i:], buf[:n])
+	binary.BigEndian.PutUint16(b[i:], u.PacketIdentifier)
+	i += 2
+	i += props.MarshalTo(b[i:])
+	copy(b[i:], u.ReasonCodes)
 	return b, nil
 }
 
+// properties returns the properties of the variable header.
+func (u *UnsubAck) properties() Properties {
+	var props Properties
+	if u.ReasonString != "" {
+		props.AddString(unsubAckPropReasonString, u.ReasonString)
+	}
+	for _, prop := range u.UserProperties {
+		props.AddUserProperty(prop.Key, prop.Value)
+	}
+	return props
+}
+
+// setProperties assigns the properties of the variable header.
+func (u *UnsubAck) setProperties(props Properties) error {
+	for _, prop := range props {
+		switch prop.ID {
+		case unsubAckPropReasonString:
+			u.ReasonString = prop.Value.(string)
+		case unsubAckPropUserProperty:
+			u.UserProperties = append(
+				u.UserProperties,
+				prop.Value.(mqtt.UserProperty),
+			)
+		default:
+			return fmt.Errorf(
+				"protocol error: illegal property ID: %02X",
+				prop.ID,
+			)
+		}
+	}
+	return nil
+}
+
 func (u *UnsubAck) WriteTo(w io.Writer) (n int64, err error) {
 	b, _ := u.MarshalBinary()
 	N, err := w.Write(b)
@@ -290,6 +575,9 @@ func (u *UnsubAck) WriteTo(w io.Writer) (n int64, err error) {
 	return n, err
 }
 
+// ReadFrom reads the remainder of the unsubscribe acknowledgement from
+// stream. For MQTTv5 the packet carries properties and a reason code for
+// each topic filter of the request.
 func (u *UnsubAck) ReadFrom(r io.Reader) (n int64, err error) {
 	var buf [2]byte
 	remLength, N, err := util.ReadVarint(r)
@@ -298,14 +586,38 @@ func (u *UnsubAck) ReadFrom(r io.Reader) (n int64, err error) {
 		return n, err
 	} else if remLength < 2 {
 		return n, mqtt.ErrPacketShort
-	} else if remLength > 2 {
+	} else if remLength > 2 && u.Version < mqtt.MQTTv5 {
 		return n, mqtt.ErrPacketLong
 	}
-	N, err = r.Read(buf[:])
+	N, err = io.ReadFull(r, buf[:])
 	n += int64(N)
 	if err != nil {
 		return n, err
 	}
 	u.PacketIdentifier = binary.BigEndian.Uint16(buf[:])
+	if u.PacketIdentifier == 0 {
+		return n, mqtt.ErrProtocolViolation
+	} else if u.Version < mqtt.MQTTv5 {
+		return n, nil
+	}
+	length := remLength - N
+	var props Properties
+	N, err = props.readBlock(r, length)
+	n += int64(N)
+	length -= N
+	if err != nil {
+		return n, err
+	} else if err = u.setProperties(props); err != nil {
+		return n, err
+	} else if length <= 0 {
+		// At least one reason code is required.
+		return n, mqtt.ErrPacketShort
+	}
+	u.ReasonCodes = make([]uint8, length)
+	N, err = io.ReadFull(r, u.ReasonCodes)
+	n += int64(N)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
 	return n, err
 }
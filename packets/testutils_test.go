@@ -10,6 +10,9 @@ type BufferConn struct {
 	*bytes.Buffer
 	writeErr error
 	readErr  error
+	// writeLimit, if set, returns the number of bytes written by a
+	// single call to Write given the length of the buffer.
+	writeLimit func(l int) int
 }
 
 func NewBufferConn(buf *bytes.Buffer) *BufferConn {
@@ -20,6 +23,9 @@ func (f *BufferConn) Write(b []byte) (int, error) {
 	if f.writeErr != nil {
 		return 0, f.writeErr
 	}
+	if f.writeLimit != nil {
+		b = b[:f.writeLimit(len(b))]
+	}
 	return f.Buffer.Write(b)
 }
 
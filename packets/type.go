@@ -0,0 +1,65 @@
+package packets
+
+import "fmt"
+
+// PacketType is the MQTT control packet type, stored in the upper four bits
+// of the first byte of the fixed header.
+type PacketType uint8
+
+// Control packet types.
+const (
+	TypeConnect     = PacketType(cmdConnect)
+	TypeConnAck     = PacketType(cmdConnAck)
+	TypePublish     = PacketType(cmdPublish)
+	TypePubAck      = PacketType(cmdPubAck)
+	TypePubRec      = PacketType(cmdPubRec)
+	TypePubRel      = PacketType(cmdPubRel)
+	TypePubComp     = PacketType(cmdPubComp)
+	TypeSubscribe   = PacketType(cmdSubscribe)
+	TypeSubAck      = PacketType(cmdSubAck)
+	TypeUnsubscribe = PacketType(cmdUnsubscribe)
+	TypeUnsubAck    = PacketType(cmdUnsubAck)
+	TypePingReq     = PacketType(cmdPingReq)
+	TypePingResp    = PacketType(cmdPingResp)
+	TypeDisconnect  = PacketType(cmdDisconnect)
+)
+
+var packetTypeNames = map[PacketType]string{
+	TypeConnect:     "CONNECT",
+	TypeConnAck:     "CONNACK",
+	TypePublish:     "PUBLISH",
+	TypePubAck:      "PUBACK",
+	TypePubRec:      "PUBREC",
+	TypePubRel:      "PUBREL",
+	TypePubComp:     "PUBCOMP",
+	TypeSubscribe:   "SUBSCRIBE",
+	TypeSubAck:      "SUBACK",
+	TypeUnsubscribe: "UNSUBSCRIBE",
+	TypeUnsubAck:    "UNSUBACK",
+	TypePingReq:     "PINGREQ",
+	TypePingResp:    "PINGRESP",
+	TypeDisconnect:  "DISCONNECT",
+}
+
+// String returns the name of the packet type as used by the specification.
+func (t PacketType) String() string {
+	if name, ok := packetTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("PacketType(0x%02X)", uint8(t))
+}
+
+func (c *Connect) Type() PacketType     { return TypeConnect }
+func (c *ConnAck) Type() PacketType     { return TypeConnAck }
+func (p *Publish) Type() PacketType     { return TypePublish }
+func (p *PubAck) Type() PacketType      { return TypePubAck }
+func (p *PubRec) Type() PacketType      { return TypePubRec }
+func (p *PubRel) Type() PacketType      { return TypePubRel }
+func (p *PubComp) Type() PacketType     { return TypePubComp }
+func (s *Subscribe) Type() PacketType   { return TypeSubscribe }
+func (s *SubAck) Type() PacketType      { return TypeSubAck }
+func (u *Unsubscribe) Type() PacketType { return TypeUnsubscribe }
+func (u *UnsubAck) Type() PacketType    { return TypeUnsubAck }
+func (p *PingReq) Type() PacketType     { return TypePingReq }
+func (p *PingResp) Type() PacketType    { return TypePingResp }
+func (d *Disconnect) Type() PacketType  { return TypeDisconnect }
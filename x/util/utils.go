@@ -4,12 +4,14 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"unicode/utf8"
 
 	"github.com/alfrunes/mqttie/mqtt"
 )
 
 var (
-	ErrVarintTooLong = fmt.Errorf("varint too long: > 4 bytes")
+	ErrVarintTooLong    = fmt.Errorf("varint too long: > 4 bytes")
+	ErrVarintNotMinimal = fmt.Errorf("varint not minimally encoded")
 )
 
 func EncodeUvarint(b []byte, val uint32) (n int, err error) {
@@ -37,11 +39,13 @@ func GetUvarintLen(val uint64) int {
 	return length
 }
 
+// ReadVarint reads a variable byte integer of up to 4 bytes from r. For
+// interoperability, non-minimal encodings (e.g. 0x80 0x00) are accepted.
 func ReadVarint(r io.Reader) (v int, n int, err error) {
 	var b [1]byte
 	// Read up to maximum of 4 bytes
 	for i := 0; i < 28; i += 7 {
-		N, err := r.Read(b[:])
+		N, err := io.ReadFull(r, b[:])
 		n += N
 		if err != nil {
 			return v, n, err
@@ -54,6 +58,17 @@ func ReadVarint(r io.Reader) (v int, n int, err error) {
 	return 0, 4, ErrVarintTooLong
 }
 
+// ReadVarintStrict reads a variable byte integer like ReadVarint, but
+// returns ErrVarintNotMinimal if the value is not encoded using the minimal
+// number of bytes as required by the specification.
+func ReadVarintStrict(r io.Reader) (v int, n int, err error) {
+	v, n, err = ReadVarint(r)
+	if err == nil && n != GetUvarintLen(uint64(v)) {
+		return v, n, ErrVarintNotMinimal
+	}
+	return v, n, err
+}
+
 func EncodeValue(b []byte, val interface{}) int {
 	var n int
 	switch v := val.(type) {
@@ -94,7 +109,7 @@ func ReadValue(r io.Reader, valPtr interface{}, maxLen int) (n int, err error) {
 			return 0, mqtt.ErrPacketShort
 		}
 		var b [2]byte
-		n, err = r.Read(b[:])
+		n, err = io.ReadFull(r, b[:])
 		if err != nil {
 			return n, err
 		}
@@ -103,7 +118,7 @@ func ReadValue(r io.Reader, valPtr interface{}, maxLen int) (n int, err error) {
 			return n, mqtt.ErrPacketShort
 		}
 		str := make([]byte, int(strLen))
-		N, err := r.Read(str)
+		N, err := io.ReadFull(r, str)
 		n += N
 		*val = string(str)
 		return n, err
@@ -113,7 +128,7 @@ func ReadValue(r io.Reader, valPtr interface{}, maxLen int) (n int, err error) {
 			return 0, mqtt.ErrPacketShort
 		}
 		var b [2]byte
-		n, err = r.Read(b[:])
+		n, err = io.ReadFull(r, b[:])
 		if err != nil {
 			return n, err
 		}
@@ -122,7 +137,7 @@ func ReadValue(r io.Reader, valPtr interface{}, maxLen int) (n int, err error) {
 			return n, mqtt.ErrPacketShort
 		}
 		data := make([]byte, int(dataLen))
-		N, err := r.Read(data)
+		N, err := io.ReadFull(r, data)
 		n += N
 		*val = data
 		return n, err
@@ -132,7 +147,7 @@ func ReadValue(r io.Reader, valPtr interface{}, maxLen int) (n int, err error) {
 			return 0, mqtt.ErrPacketShort
 		}
 		var b [4]byte
-		n, err = r.Read(b[:])
+		n, err = io.ReadFull(r, b[:])
 		*val = binary.BigEndian.Uint32(b[:])
 		return n, err
 
@@ -141,7 +156,7 @@ func ReadValue(r io.Reader, valPtr interface{}, maxLen int) (n int, err error) {
 			return 0, mqtt.ErrPacketShort
 		}
 		var b [2]byte
-		n, err = r.Read(b[:])
+		n, err = io.ReadFull(r, b[:])
 		*val = binary.BigEndian.Uint16(b[:])
 		return n, err
 
@@ -150,7 +165,7 @@ func ReadValue(r io.Reader, valPtr interface{}, maxLen int) (n int, err error) {
 			return 0, mqtt.ErrPacketShort
 		}
 		var b [1]byte
-		n, err = r.Read(b[:])
+		n, err = io.ReadFull(r, b[:])
 		*val = b[0]
 		return n, err
 
@@ -190,23 +205,26 @@ func WriteUTF8(w io.Writer, str string) (n int, err error) {
 	return w.Write(append(buf[:], sb...))
 }
 
+// ReadUTF8 reads a length prefixed UTF-8 string from r. If the string is
+// shorter than the declared length or is not valid UTF-8,
+// mqtt.ErrMalformedUTF8 is returned.
 func ReadUTF8(r io.Reader) (str string, n int, err error) {
 	var b [2]byte
-	n, err = r.Read(b[:])
+	n, err = io.ReadFull(r, b[:])
 	if err != nil {
 		return "", n, err
-	} else if n < 2 {
-		return "", n, io.ErrUnexpectedEOF
 	}
 	l := binary.BigEndian.Uint16(b[:])
 
 	ret := make([]byte, int(l))
-	N, err := r.Read(ret)
+	N, err := io.ReadFull(r, ret)
 	n += N
-	if err != nil {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return "", n, mqtt.ErrMalformedUTF8
+	} else if err != nil {
 		return "", n, err
-	} else if n < len(ret) {
-		return "", n, io.ErrUnexpectedEOF
+	} else if !utf8.Valid(ret) {
+		return "", n, mqtt.ErrMalformedUTF8
 	}
 	return string(ret), n, nil
 }
@@ -0,0 +1,105 @@
+package util
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/alfrunes/mqttie/mqtt"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadUTF8(t *testing.T) {
+	testCases := []struct {
+		Name string
+
+		Input  []byte
+		Result string
+		N      int
+		Error  error
+	}{{
+		Name:   "ok",
+		Input:  []byte{0, 5, 'h', 0xC3, 0xA6, 'l', 'o'},
+		Result: "hælo",
+		N:      7,
+	}, {
+		Name:  "empty input",
+		Input: []byte{},
+		Error: io.EOF,
+	}, {
+		Name:  "truncated string",
+		Input: []byte{0, 5, 'f', 'o', 'o'},
+		N:     5,
+		Error: mqtt.ErrMalformedUTF8,
+	}, {
+		Name:  "invalid UTF-8",
+		Input: []byte{0, 3, 'f', 0xFF, 'o'},
+		N:     5,
+		Error: mqtt.ErrMalformedUTF8,
+	}}
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			str, n, err := ReadUTF8(bytes.NewReader(testCase.Input))
+			assert.Equal(t, testCase.N, n)
+			if testCase.Error != nil {
+				assert.EqualError(t, err, testCase.Error.Error())
+			} else if assert.NoError(t, err) {
+				assert.Equal(t, testCase.Result, str)
+			}
+		})
+	}
+}
+
+func TestReadVarint(t *testing.T) {
+	testCases := []struct {
+		Name string
+
+		Input  []byte
+		Strict bool
+		Result int
+		N      int
+		Error  error
+	}{{
+		Name:   "minimal",
+		Input:  []byte{0x80, 0x01},
+		Result: 128,
+		N:      2,
+	}, {
+		Name:   "minimal strict",
+		Input:  []byte{0x80, 0x01},
+		Strict: true,
+		Result: 128,
+		N:      2,
+	}, {
+		Name:   "non-minimal zero",
+		Input:  []byte{0x80, 0x00},
+		Result: 0,
+		N:      2,
+	}, {
+		Name:   "non-minimal zero strict",
+		Input:  []byte{0x80, 0x00},
+		Strict: true,
+		N:      2,
+		Error:  ErrVarintNotMinimal,
+	}, {
+		Name:  "too long",
+		Input: []byte{0x80, 0x80, 0x80, 0x80, 0x01},
+		N:     4,
+		Error: ErrVarintTooLong,
+	}}
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			readVarint := ReadVarint
+			if testCase.Strict {
+				readVarint = ReadVarintStrict
+			}
+			v, n, err := readVarint(bytes.NewReader(testCase.Input))
+			assert.Equal(t, testCase.N, n)
+			if testCase.Error != nil {
+				assert.EqualError(t, err, testCase.Error.Error())
+			} else if assert.NoError(t, err) {
+				assert.Equal(t, testCase.Result, v)
+			}
+		})
+	}
+}